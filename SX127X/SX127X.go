@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/Waziup/single_chan_pkt_fwd/lora"
@@ -12,11 +14,7 @@ import (
 	// "github.com/Waziup/wazigate-rpi/spi"
 
 	"periph.io/x/conn/v3/gpio"
-	"periph.io/x/conn/v3/gpio/gpioreg"
-
-	"periph.io/x/conn/v3/physic"
 	"periph.io/x/conn/v3/spi"
-	"periph.io/x/conn/v3/spi/spireg"
 )
 
 const (
@@ -43,6 +41,12 @@ const LogLevelError = 1
 type Chip struct {
 	// pinSS           gpio.Pin
 	pinRst          gpio.PinIO
+	pinDIO0         gpio.PinIn
+	pinDIO1         gpio.PinIn
+	pinRXEN         gpio.PinOut
+	pinTXEN         gpio.PinOut
+	packets         chan *lora.RxPacket
+	mu              sync.Mutex
 	dev             spi.Conn
 	version         byte
 	defaultSyncWord byte
@@ -53,6 +57,7 @@ type Chip struct {
 	mode            int
 	syncWord        byte
 	spreadingFactor uint32
+	bitrate         uint32
 	retries         int
 	maxRetries      int
 	payloadLength   byte
@@ -62,6 +67,9 @@ type Chip struct {
 	NeedPABOOST     bool
 	power           byte
 	channel         uint32
+	crc             bool
+	preambleLength  uint16
+	invertIQ        bool
 }
 
 var logLevel = []string{
@@ -88,6 +96,8 @@ func New(dev spi.Conn, pinRst gpio.PinIO) *Chip {
 		pinRst:          pinRst,
 		defaultSyncWord: PublicSyncWord,
 		spreadingFactor: 0,
+		header:          true,
+		preambleLength:  DefaultPreambleLength,
 		NeedPABOOST:     true,
 		LogLevel:        LogLevel,
 		Logger:          Logger,
@@ -120,49 +130,41 @@ func (c *Chip) writeRegister(addr byte, data byte) error {
 	return err
 }
 
-// var spiSpeed = 10000000 // 10MHz
-var spiSpeed = 1000000 // 1MHz
-
-func Discover() (*Chip, error) {
-
-	// dev, err := spi.Open("/dev/spidev0.1", spiSpeed)
-	// if err != nil {
-	// 	return nil, err
-	// }
-	// dev.SetMode(0)
-	// dev.SetBitsPerWord(8)
-	// dev.SetLSBFirst(false)
-	// dev.SetMaxSpeed(spiSpeed)
-
-	p, err := spireg.Open("/dev/spidev0.0")
-	if err != nil {
-		return nil, err
-	}
-
-	conn, err := p.Connect(physic.MegaHertz, spi.Mode0, 8)
-	if err != nil {
-		return nil, err
-	}
+// readRegisters reads n consecutive registers starting at addr in a single SPI transaction.
+// Reading REG_FIFO reads n bytes from the FIFO.
+func (c *Chip) readRegisters(addr byte, n int) ([]byte, error) {
+	in := make([]byte, n+1)
+	out := make([]byte, n+1)
+	in[0] = addr & 0x7F
+	err := c.dev.Tx(in, out)
+	c.Log(LogLevelDebug, "Reading regs %X:  %X", addr, out[1:])
+	return out[1:], err
+}
 
-	pinRST := gpioreg.ByName("GPIO17")
+// writeRegisters writes data to consecutive registers starting at addr in a single SPI transaction.
+// Writing REG_FIFO writes all data to the FIFO.
+func (c *Chip) writeRegisters(addr byte, data []byte) error {
+	in := make([]byte, len(data)+1)
+	out := make([]byte, len(data)+1)
+	in[0] = addr | 0x80
+	copy(in[1:], data)
+	err := c.dev.Tx(in, out)
+	c.Log(LogLevelDebug, "Writing regs %X:  %X", addr, data)
+	return err
+}
 
-	if err := pinRST.Out(gpio.Low); err != nil {
-		return nil, err
-	}
-	delay(100)
-	if err := pinRST.Out(gpio.High); err != nil {
-		return nil, err
-	}
-	delay(100)
+// Discover opens the SX127X on the default board (see Boards).
+func Discover() (*Chip, error) {
+	return DiscoverWith(BoardConfig{})
+}
 
-	// Reset GIOP Pin
-	// pinRst, err := gpio.Output(17)
-	// if err != nil {
-	// 	return nil, err
-	// }
+// Open creates a new SX127X instance like New, reads the chip version and
+// initializes the chip in LoRa mode.
+// The chip must have been reset before.
+func Open(dev spi.Conn, pinRst gpio.PinIO) (*Chip, error) {
 
 	// SX127X instance
-	c := New(conn, pinRST)
+	c := New(dev, pinRst)
 
 	// c.pinSS.Write(High)
 	// delay(100)
@@ -188,14 +190,12 @@ func Discover() (*Chip, error) {
 	// c.writeRegister(0x1E, 0xC4)
 	// c.writeRegister(0x26, 0x04)
 
-	c.writeRegister(REG_INVERT_IQ, 0x26)
-	c.writeRegister(REG_INVERT_IQ2, 0x1D)
 	c.RxChainCalibration()
 	c.SetMaxCurrent(0x1B)
 	c.SetLORA()
+	c.SetIQInversion(false)
 	c.SetCRC(true)
 	c.SetSyncWord(c.defaultSyncWord)
-	// c.SetIQInversion(true)
 
 	return c, nil
 }
@@ -351,6 +351,24 @@ func delay(d int) {
 	time.Sleep((time.Millisecond * time.Duration(d)))
 }
 
+// waitUntil waits until t, busy waiting for the last millisecond to be more precise.
+// It returns ErrTooLate if t has already passed and returns immediately if t is zero.
+func waitUntil(t time.Time) error {
+	if t.IsZero() {
+		return nil
+	}
+	d := time.Until(t)
+	if d < 0 {
+		return ErrTooLate
+	}
+	if d > time.Millisecond {
+		time.Sleep(d - time.Millisecond)
+	}
+	for time.Now().Before(t) {
+	}
+	return nil
+}
+
 func (c *Chip) setOCP(mA byte) error {
 
 	var ocpTrim byte = 27
@@ -422,7 +440,16 @@ func (c *Chip) RxChainCalibration() (err error) {
 	return
 }
 
+// SetFreq sets the frequency in Hz. It fails with lora.ErrFreq if the frequency is out of the range
+// of the chip: 860 to 1020 MHz for the SX1272, 137 to 1020 MHz for the SX1276.
 func (c *Chip) SetFreq(freq uint32) (err error) {
+	min := uint32(137000000)
+	if c.version == VersionSX1272 {
+		min = 860000000
+	}
+	if freq < min || freq > 1020000000 {
+		return fmt.Errorf("%w: %.2f MHz", lora.ErrFreq, float64(freq)/1e6)
+	}
 	var ch = uint32((uint64(freq) << 19) / 32000000)
 	return c.SetChannel(ch)
 }
@@ -442,15 +469,12 @@ func (c *Chip) SetChannel(ch uint32) (err error) {
 		c.writeRegister(REG_OP_MODE, FSK_STANDBY_MODE)
 	}
 
-	c.writeRegister(REG_FRF_MSB, byte((ch>>16)&0xFF))
-	c.writeRegister(REG_FRF_MID, byte((ch>>8)&0xFF))
-	c.writeRegister(REG_FRF_LSB, byte(ch&0xFF))
-
-	frf3, _ := c.readRegister(REG_FRF_MSB)
-	frf2, _ := c.readRegister(REG_FRF_MID)
-	frf1, _ := c.readRegister(REG_FRF_LSB)
+	c.writeRegisters(REG_FRF_MSB, []byte{byte(ch >> 16), byte(ch >> 8), byte(ch)})
 
-	frf := uint32(frf3)<<16 + uint32(frf2)<<8 + uint32(frf1)
+	var frf uint32
+	if v, err := c.readRegisters(REG_FRF_MSB, 3); err == nil {
+		frf = uint32(v[0])<<16 + uint32(v[1])<<8 + uint32(v[2])
+	}
 
 	if frf != ch {
 		err = fmt.Errorf("can not change channel: got %x, expected %x", frf, ch)
@@ -489,14 +513,40 @@ func (c *Chip) GetPreambleLength() (length int, err error) {
 
 	if c.mode == ModeLoRa {
 		// LORA mode
-		l0, _ := c.readRegister(REG_PREAMBLE_MSB_LORA)
-		l1, _ := c.readRegister(REG_PREAMBLE_LSB_LORA)
-		return int(l0)<<8 + int(l1), nil
+		v, err := c.readRegisters(REG_PREAMBLE_MSB_LORA, 2)
+		return int(v[0])<<8 + int(v[1]), err
 	}
 	// FSK mode
-	l0, _ := c.readRegister(REG_PREAMBLE_MSB_FSK)
-	l1, _ := c.readRegister(REG_PREAMBLE_LSB_FSK)
-	return int(l0)<<8 + int(l1), nil
+	v, err := c.readRegisters(REG_PREAMBLE_MSB_FSK, 2)
+	return int(v[0])<<8 + int(v[1]), err
+}
+
+// SetPreambleLength sets the preamble length in symbols (LoRa) or bytes (FSK).
+func (c *Chip) SetPreambleLength(length uint16) (err error) {
+
+	c.Log(LogLevelDebug, "Starting 'SetPreambleLength'.")
+
+	st0, _ := c.readRegister(REG_OP_MODE) // Save the previous status
+	reg := byte(REG_PREAMBLE_MSB_LORA)
+	if c.mode == ModeLoRa {
+		c.writeRegister(REG_OP_MODE, LORA_STANDBY_MODE)
+	} else {
+		reg = REG_PREAMBLE_MSB_FSK
+		c.writeRegister(REG_OP_MODE, FSK_STANDBY_MODE)
+	}
+
+	c.writeRegisters(reg, []byte{byte(length >> 8), byte(length)})
+
+	if l, _ := c.GetPreambleLength(); l == int(length) {
+		c.preambleLength = length
+		c.Log(LogLevelVerbose, "Preamble length %d has been successfully set.", length)
+	} else {
+		c.Log(LogLevelError, "Can not set preamble length: expected %d, got %d", length, l)
+		err = fmt.Errorf("can not set preamble length")
+	}
+
+	c.writeRegister(REG_OP_MODE, st0) // Getting back to previous status
+	return
 }
 
 func (c *Chip) SetLORA() error {
@@ -550,23 +600,30 @@ func (c *Chip) receive() (err error) {
 	// writeRegister(REG_LNA, 0x23)			// Important in reception
 	// modified by C. Pham
 	c.writeRegister(REG_LNA, LNA_MAX_GAIN)
-	c.writeRegister(REG_FIFO_ADDR_PTR, 0x00) // Setting address pointer in FIFO data buffer
-	// change RegSymbTimeoutLsb
-	// comment by C. Pham
-	// single_chan_pkt_fwd uses 00 00001000
-	// why here we have 11 11111111
-	// change RegSymbTimeoutLsb
-	// writeRegister(REG_SYMB_TIMEOUT_LSB, 0xFF)
 
-	// modified by C. Pham
-	if c.spreadingFactor == SF_10 || c.spreadingFactor == SF_11 || c.spreadingFactor == SF_12 {
-		c.writeRegister(REG_SYMB_TIMEOUT_LSB, 0x05)
-	} else {
-		c.writeRegister(REG_SYMB_TIMEOUT_LSB, 0x08)
+	if c.mode == ModeLoRa {
+		c.writeRegister(REG_FIFO_ADDR_PTR, 0x00) // Setting address pointer in FIFO data buffer
+		// change RegSymbTimeoutLsb
+		// comment by C. Pham
+		// single_chan_pkt_fwd uses 00 00001000
+		// why here we have 11 11111111
+		// change RegSymbTimeoutLsb
+		// writeRegister(REG_SYMB_TIMEOUT_LSB, 0xFF)
+
+		// modified by C. Pham
+		if c.spreadingFactor == SF_10 || c.spreadingFactor == SF_11 || c.spreadingFactor == SF_12 {
+			c.writeRegister(REG_SYMB_TIMEOUT_LSB, 0x05)
+		} else {
+			c.writeRegister(REG_SYMB_TIMEOUT_LSB, 0x08)
+		}
+		//end
+
+		c.writeRegister(REG_FIFO_RX_BYTE_ADDR, 0x00) // Setting current value of reception buffer pointer
 	}
-	//end
 
-	c.writeRegister(REG_FIFO_RX_BYTE_ADDR, 0x00) // Setting current value of reception buffer pointer
+	if err = c.setAntenna(true, false); err != nil {
+		return err
+	}
 
 	//clearFlags();						// Initializing flags
 
@@ -578,7 +635,11 @@ func (c *Chip) receive() (err error) {
 		c.Log(LogLevelDebug, "Receiving LoRa mode activated with success.")
 	} else {
 		// FSK mode
-		c.setPacketLength(c.payloadLength)
+		// with variable length packets, PayloadLength is the maximum length of received packets
+		if err = c.setPacketLength(MAX_LENGTH); err != nil {
+			return err
+		}
+		c.clearFlags()
 		c.writeRegister(REG_OP_MODE, FSK_RX_MODE) // FSK mode - Rx
 		c.Log(LogLevelDebug, "Receiving FSK mode activated with succes.")
 	}
@@ -619,8 +680,12 @@ func (c *Chip) setPacketLength(length byte) (err error) {
 	return
 }
 
+// DefaultPreambleLength is the LoRa preamble length in symbols used if none is given, as used by LoRaWAN.
+const DefaultPreambleLength = 8
+
 var ErrIncorrectCRC = fmt.Errorf("incorrect CRC")
 var ErrTimeout = fmt.Errorf("timeout")
+var ErrTooLate = lora.ErrTooLate
 
 var bandwidths = map[uint32]byte{
 	7800:   BW_7_8,
@@ -646,30 +711,51 @@ var coderates = map[string]byte{
 }
 
 func (c *Chip) Receive(cfg *lora.Config) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	bw, ok := bandwidths[cfg.LoRaBW]
-	if !ok {
-		return fmt.Errorf("unknown bandwidth: %d", cfg.LoRaBW)
-	}
-	cr, ok := coderates[cfg.LoRaCR]
-	if !ok {
-		return fmt.Errorf("unknown coderate: %s", cfg.LoRaCR)
-	}
+	if cfg.Modulation == "FSK" {
+		if err := c.configureFSK(cfg.Datarate, cfg.FreqDev, cfg.PreambleLength, true); err != nil {
+			return err
+		}
+	} else {
+		bw, ok := bandwidths[cfg.LoRaBW]
+		if !ok {
+			return fmt.Errorf("unknown bandwidth: %d", cfg.LoRaBW)
+		}
+		cr, ok := coderates[cfg.LoRaCR]
+		if !ok {
+			return fmt.Errorf("unknown coderate: %s", cfg.LoRaCR)
+		}
 
-	sf := cfg.Datarate
+		sf := cfg.Datarate
 
-	if c.codingRate != cr {
-		if err := c.SetCR(cr); err != nil {
-			return err
+		if c.mode == ModemFSK {
+			if err := c.SetLORA(); err != nil {
+				return err
+			}
 		}
-	}
-	if c.spreadingFactor != sf {
-		if err := c.SetSF(sf); err != nil {
-			return err
+		if c.codingRate != cr {
+			if err := c.SetCR(cr); err != nil {
+				return err
+			}
 		}
-	}
-	if c.bandwidth != bw {
-		if err := c.SetBW(bw); err != nil {
+		if c.spreadingFactor != sf {
+			if err := c.SetSF(sf); err != nil {
+				return err
+			}
+		}
+		if c.bandwidth != bw {
+			if err := c.SetBW(bw); err != nil {
+				return err
+			}
+		}
+
+		preamble := cfg.PreambleLength
+		if preamble == 0 {
+			preamble = DefaultPreambleLength
+		}
+		if err := c.setPacketConfig(true, sf != SF_6, preamble, false); err != nil {
 			return err
 		}
 	}
@@ -680,18 +766,18 @@ func (c *Chip) Receive(cfg *lora.Config) error {
 
 	c.SetPowerDBM(14)
 
-	// from ReceiveAll()
-	if c.mode == ModemFSK { // FSK mode
-		c.writeRegister(REG_OP_MODE, FSK_STANDBY_MODE) // Setting standby FSK mode
-		config1, _ := c.readRegister(REG_PACKET_CONFIG1)
-		config1 &= 0xf9                              // (0B11111001) clears bits 2-1 from REG_PACKET_CONFIG1
-		c.writeRegister(REG_PACKET_CONFIG1, config1) // AddressFiltering = None
+	if c.pinDIO0 != nil {
+		// DIO0 = RxDone (LoRa) or PayloadReady (FSK), DIO1 = FifoLevel (FSK)
+		c.writeRegister(REG_DIO_MAPPING1, 0x00)
 	}
 
 	return c.receive()
 }
 
 func (c *Chip) Read() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	mode, _ := c.readRegister(REG_OP_MODE)
 	if (c.mode == ModeLoRa && mode != LORA_RX_MODE) || (c.mode == ModemFSK && mode != FSK_RX_MODE) {
 		if err := c.receive(); err != nil {
@@ -703,14 +789,39 @@ func (c *Chip) Read() ([]byte, error) {
 }
 
 func (c *Chip) GetPacket() ([]*lora.RxPacket, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.getPackets(time.Now())
+}
+
+// getPackets reads the received packet (if any) and uses t as its "RX finished" timestamp.
+func (c *Chip) getPackets(t time.Time) ([]*lora.RxPacket, error) {
 	data, crc, err := c.getPacket()
 	if data == nil || err != nil {
 		return nil, err
 	}
-	rssi, _ := c.GetRSSIpacket()
-	snr, _ := c.getSNR()
+	if c.mode == ModemFSK {
+		rssi, _ := c.getRSSIFSK()
+		foff, _ := c.getFreqError()
+		pkt := &lora.RxPacket{
+			TimeFin:    t,
+			RSSI:       float32(rssi),
+			FreqOffset: foff,
+			Data:       data,
+			StatCRC:    crc,
+			Freq:       c.GetFreq(),
+			Modulation: "FSK",
+			Datarate:   c.bitrate,
+		}
+		return []*lora.RxPacket{pkt}, err
+	}
+	rssi, rssis, snr, _ := c.getPacketRSSI()
+	foff, _ := c.getFreqError()
 	pkt := &lora.RxPacket{
-		RSSI:       float32(rssi),
+		TimeFin:    t,
+		RSSI:       rssi,
+		RSSISignal: rssis,
+		FreqOffset: foff,
 		Data:       data,
 		StatCRC:    crc,
 		Freq:       c.GetFreq(),
@@ -718,11 +829,110 @@ func (c *Chip) GetPacket() ([]*lora.RxPacket, error) {
 		Datarate:   uint32(c.spreadingFactor),
 		LoRaCR:     c.codingRate + 4,
 		LoRaBW:     c.bandwidth + 1,
-		LoRaSNR:    float32(snr),
+		LoRaSNR:    snr,
 	}
 	return []*lora.RxPacket{pkt}, err
 }
 
+// SetDIO0 uses the pin that is connected to the DIO0 line of the chip to get notified
+// about received packets (RxDone) without polling.
+// The packets are delivered on the Packets channel, timestamped at the rising edge of DIO0.
+// If the pin does not support edge detection, the packets are polled every dioPollInterval.
+func (c *Chip) SetDIO0(pin gpio.PinIn) error {
+	if c.pinDIO0 != nil {
+		return fmt.Errorf("DIO0 is already set")
+	}
+	if err := pin.In(gpio.PullDown, gpio.RisingEdge); err != nil {
+		return err
+	}
+	c.pinDIO0 = pin
+	c.packets = make(chan *lora.RxPacket, 8)
+	go c.watchDIO(pin, "DIO0")
+	if c.pinDIO1 != nil {
+		go c.watchDIO(c.pinDIO1, "DIO1")
+	}
+	return nil
+}
+
+// SetDIO1 uses the pin that is connected to the DIO1 line of the chip to drain the FIFO (FifoLevel)
+// while receiving FSK packets that are longer than the FIFO.
+// The pin is only watched if DIO0 is set too, see SetDIO0.
+func (c *Chip) SetDIO1(pin gpio.PinIn) error {
+	if c.pinDIO1 != nil {
+		return fmt.Errorf("DIO1 is already set")
+	}
+	if err := pin.In(gpio.PullDown, gpio.RisingEdge); err != nil {
+		return err
+	}
+	c.pinDIO1 = pin
+	if c.pinDIO0 != nil {
+		go c.watchDIO(pin, "DIO1")
+	}
+	return nil
+}
+
+// SetAntennaSwitch sets the pins that control the RX and TX path of the antenna switch.
+// RXEN is high while receiving, TXEN is high while transmitting. Any of them can be nil.
+func (c *Chip) SetAntennaSwitch(rxen, txen gpio.PinOut) error {
+	c.pinRXEN = rxen
+	c.pinTXEN = txen
+	return c.setAntenna(false, false)
+}
+
+func (c *Chip) setAntenna(rx bool, tx bool) (err error) {
+	if c.pinRXEN != nil {
+		err = c.pinRXEN.Out(gpio.Level(rx))
+	}
+	if c.pinTXEN != nil {
+		if err2 := c.pinTXEN.Out(gpio.Level(tx)); err == nil {
+			err = err2
+		}
+	}
+	return
+}
+
+// Packets implements lora.Notifier.
+// It returns nil if no DIO0 pin has been set with SetDIO0.
+func (c *Chip) Packets() <-chan *lora.RxPacket {
+	if c.packets == nil {
+		return nil
+	}
+	return c.packets
+}
+
+// dioPollInterval is the interval that packets are polled at if a DIO pin does not support edge detection.
+var dioPollInterval = 100 * time.Millisecond
+
+// watchDIO gets the packets on the rising edges of a DIO pin and delivers them on the Packets channel.
+func (c *Chip) watchDIO(pin gpio.PinIn, name string) {
+	polling := false
+	for {
+		if pin.WaitForEdge(-1) {
+			c.Log(LogLevelDebug, "%s rising edge.", name)
+		} else {
+			// WaitForEdge fails immediately if edges can not be detected on the pin
+			if !polling {
+				c.Log(LogLevelWarning, "Can not wait for %s edges, polling every %s.", name, dioPollInterval)
+				polling = true
+			}
+			time.Sleep(dioPollInterval)
+		}
+		t := time.Now()
+
+		c.mu.Lock()
+		pkts, err := c.getPackets(t)
+		c.mu.Unlock()
+
+		if err != nil {
+			c.Log(LogLevelError, "Can not get packet: %v", err)
+			continue
+		}
+		for _, pkt := range pkts {
+			c.packets <- pkt
+		}
+	}
+}
+
 func (c *Chip) getPacket() (data []byte, crc int8, err error) {
 
 	c.Log(LogLevelDebug, "Starting 'getPacket'.")
@@ -760,59 +970,30 @@ func (c *Chip) getPacket() (data []byte, crc int8, err error) {
 		}
 		c.writeRegister(REG_OP_MODE, LORA_STANDBY_MODE) // Setting standby LoRa mode
 	} else {
-
 		// FSK mode
-		value, _ := c.readRegister(REG_IRQ_FLAGS2)
-		//while( (bitRead(value, 2) == 0) && (millis() - previous < wait) )
-		if value&Bit2 == 0 {
-			return nil, 0, nil
-		}
-
-		// packet received
-		if value&Bit1 != 0 {
-			// CRC correct
-			crc = 1
-			c.Log(LogLevelDebug, "Packet correctly received in FSK mode.")
-		} else {
-			// CRC incorrect
-			crc = -1
-			c.Log(LogLevelDebug, "Packet incorrectly received in FSK mode.")
-		}
-
-		c.writeRegister(REG_OP_MODE, FSK_STANDBY_MODE) // Setting standby FSK mode
+		return c.getPacketFSK()
 	}
 
 	// Store the packet
-	if c.mode == ModeLoRa {
-		// comment by C. Pham
-		// set the FIFO addr to 0 to read again the destination
-		c.writeRegister(REG_FIFO_ADDR_PTR, 0x00) // Setting address pointer in FIFO data buffer
-
-		// added by C. Pham
-		// packet_received.netkey[0]=readRegister(REG_FIFO);
-		// packet_received.netkey[1]=readRegister(REG_FIFO);
-
-	} else {
-		value, _ := c.readRegister(REG_PACKET_CONFIG1)
-		if value&Bit2 == 0 && value&Bit1 == 0 {
-			// Storing first byte of the received packet
-			_, _ = c.readRegister(REG_FIFO)
-		} else {
+	// comment by C. Pham
+	// set the FIFO addr to 0 to read again the destination
+	c.writeRegister(REG_FIFO_ADDR_PTR, 0x00) // Setting address pointer in FIFO data buffer
 
-			// dest = DefaultDestination
-		}
-	}
+	// added by C. Pham
+	// packet_received.netkey[0]=readRegister(REG_FIFO);
+	// packet_received.netkey[1]=readRegister(REG_FIFO);
 
 	length, _ := c.readRegister(REG_RX_NB_BYTES)
-	data = make([]byte, length)
-	for i := 0; i < int(length); i++ {
-		data[i], _ = c.readRegister(REG_FIFO) // Storing payload
+	data = []byte{}
+	if length != 0 {
+		data, err = c.readRegisters(REG_FIFO, int(length)) // Storing payload
+		if err != nil {
+			return nil, 0, err
+		}
 	}
 	c.Log(LogLevelDebug, "Received: %v", data)
 
-	if c.mode == ModeLoRa {
-		c.writeRegister(REG_FIFO_ADDR_PTR, 0x00) // Setting address pointer in FIFO data buffer
-	}
+	c.writeRegister(REG_FIFO_ADDR_PTR, 0x00) // Setting address pointer in FIFO data buffer
 
 	c.clearFlags() // Initializing flags
 	return
@@ -864,25 +1045,18 @@ func (c *Chip) SetMode(m int) (err error) {
 	return nil
 }
 
-func (c *Chip) getSNR() (snr int8, err error) {
+// getSNR returns the SNR of the last packet in dB, with a precision of 0.25 dB.
+func (c *Chip) getSNR() (snr float32, err error) {
 
 	c.Log(LogLevelDebug, "Starting 'getSNR'.")
 
 	if c.mode == ModeLoRa {
 		// LoRa mode
 		value, _ := c.readRegister(REG_PKT_SNR_VALUE)
+		// two's complement, in 0.25 dB steps
+		snr = float32(int8(value)) / 4
 
-		if value&0x80 != 0 {
-			// The SNR sign bit is 1
-			// Invert and divide by 4
-			value = ((0xff ^ value + 1) & 0xFF) >> 2
-			snr = -int8(value)
-		} else {
-			// Divide by 4
-			snr = int8((value & 0xFF) >> 2)
-		}
-
-		c.Log(LogLevelVerbose, "SNR value is %d.", snr)
+		c.Log(LogLevelVerbose, "SNR value is %.2f.", snr)
 	} else {
 		// forbidden command if FSK mode
 		c.Log(LogLevelWarning, "SNR does not exist in FSK mode.")
@@ -890,64 +1064,90 @@ func (c *Chip) getSNR() (snr int8, err error) {
 	return
 }
 
-func (c *Chip) GetRSSIpacket() (rssi int16, err error) {
-	// RSSIpacket only exists in LoRa
-
-	c.Log(LogLevelDebug, "Starting 'getRSSIpacket'.")
-
-	if c.mode == ModeLoRa {
-		// LoRa mode
+// rssiOffset returns the RSSI offset of the LoRa modem:
+// -139 (SX1272), -157 (SX1276 high frequency port), -164 (SX1276 low frequency port).
+func (c *Chip) rssiOffset() int16 {
+	if c.version == VersionSX1276 {
+		if c.GetFreq() < 779000000 {
+			return -(OFFSET_RSSI + 25)
+		}
+		return -(OFFSET_RSSI + 18)
+	}
+	return -OFFSET_RSSI
+}
 
-		snr, _ := c.getSNR()
+// getPacketRSSI returns the channel RSSI and the signal RSSI of the last packet (in dBm) and its SNR.
+// The signal RSSI is corrected by the SNR if the packet was received below the noise floor.
+func (c *Chip) getPacketRSSI() (channel float32, signal float32, snr float32, err error) {
 
-		// added by C. Pham
-		rssiv, _ := c.readRegister(REG_PKT_RSSI_VALUE)
-
-		if snr < 0 {
-			// commented by C. Pham
-			//_RSSIpacket = -NOISE_ABSOLUTE_ZERO + 10.0 * SignalBwLog[_bandwidth] + NOISE_FIGURE + ( double )_SNR;
-
-			// added by C. Pham, using Semtech SX1272 rev3 March 2015
-			// for SX1272 we use -139, for SX1276, we use -157
-			// then for SX1276 when using low-frequency (i.e. 433MHz) then we use -164
-			//_RSSIpacket = -(OFFSET_RSSI+(_board==SX1276Chip?18:0)+(_channel<CH_04_868?7:0)) + (double)_RSSIpacket + (double)_rawSNR*0.25;
-			if c.version == VersionSX1276 {
-				if c.channel < CH_04_868 {
-					rssi = -(OFFSET_RSSI + 25) + int16(rssiv) + int16(snr)/4
-				} else {
-					rssi = -(OFFSET_RSSI + 18) + int16(rssiv) + int16(snr)/4
-				}
-			} else {
-				if c.channel < CH_04_868 {
-					rssi = -(OFFSET_RSSI + 7) + int16(rssiv) + int16(snr)/4
-				} else {
-					rssi = -(OFFSET_RSSI + 18) + int16(rssiv) + int16(snr)/4
-				}
-			}
-		} else {
-			if c.version == VersionSX1276 {
-				if c.channel < CH_04_868 {
-					rssi = -(OFFSET_RSSI + 25) + int16(rssiv) + int16(snr)*16.0/15.0
-				} else {
-					rssi = -(OFFSET_RSSI + 18) + int16(rssiv) + int16(snr)*16.0/15.0
-				}
-			} else {
-				if c.channel < CH_04_868 {
-					rssi = -(OFFSET_RSSI + 7) + int16(rssiv) + int16(snr)*16.0/15.0
-				} else {
-					rssi = -(OFFSET_RSSI + 18) + int16(rssiv) + int16(snr)*16.0/15.0
-				}
-			}
-		}
+	c.Log(LogLevelDebug, "Starting 'getPacketRSSI'.")
 
-		c.Log(LogLevelVerbose, "RSSI packet value is %d.", rssi)
-	} else {
+	if c.mode != ModeLoRa {
 		// RSSI packet doesn't exist in FSK mode
 		c.Log(LogLevelWarning, "RSSI packet does not exist in FSK mode.")
+		return
+	}
+
+	snr, _ = c.getSNR()
+	rssiv, err := c.readRegister(REG_PKT_RSSI_VALUE)
+
+	// see "5.5.5. RSSI and SNR in LoRa Mode" of the SX1276 datasheet
+	channel = float32(c.rssiOffset()) + float32(rssiv)
+	if c.version == VersionSX1276 && snr >= 0 {
+		channel = float32(c.rssiOffset()) + float32(rssiv)*16/15
+	}
+	signal = channel
+	if snr < 0 {
+		signal = channel + snr
 	}
+
+	c.Log(LogLevelVerbose, "RSSI packet value is %.0f (signal %.0f).", channel, signal)
 	return
 }
 
+// GetRSSIpacket returns the signal RSSI of the last packet in dBm.
+func (c *Chip) GetRSSIpacket() (rssi int16, err error) {
+	_, signal, _, err := c.getPacketRSSI()
+	return int16(math.Round(float64(signal))), err
+}
+
+// getFreqError returns the frequency offset of the last packet in Hz, as estimated by the modem.
+func (c *Chip) getFreqError() (foff int32, err error) {
+
+	c.Log(LogLevelDebug, "Starting 'getFreqError'.")
+
+	if c.mode == ModemFSK {
+		v, err := c.readRegisters(REG_FEI_MSB, 2)
+		if err != nil {
+			return 0, err
+		}
+		// FeiValue in Fstep = Fxosc / 2^19
+		fei := int16(uint16(v[0])<<8 | uint16(v[1]))
+		return int32((int64(fei) * 32000000) >> 19), nil
+	}
+
+	v, err := c.readRegisters(REG_FEI_MSB_LORA, 3)
+	if err != nil {
+		return 0, err
+	}
+	// 20 bit two's complement
+	fei := int32(uint32(v[0]&0x0F)<<16|uint32(v[1])<<8|uint32(v[2])) << 12 >> 12
+	// Ferr = FreqError * 2^24 / Fxosc * BW / 500 kHz
+	foff = int32(int64(fei) * (1 << 24) * int64(bandwidthHz(c.bandwidth)) / (32000000 * 500000))
+	c.Log(LogLevelVerbose, "Frequency error is %d Hz.", foff)
+	return foff, nil
+}
+
+// bandwidthHz returns the LoRa bandwidth in Hz.
+func bandwidthHz(bw byte) uint32 {
+	for hz, b := range bandwidths {
+		if b == bw {
+			return hz
+		}
+	}
+	return 0
+}
+
 func (c *Chip) SetCR(cod byte) (err error) {
 
 	c.Log(LogLevelDebug, "Starting 'setCR'.")
@@ -1006,8 +1206,6 @@ func (c *Chip) SetCR(cod byte) (err error) {
 
 	c.writeRegister(REG_MODEM_CONFIG1, config1) // Update config1
 
-	delay(100)
-
 	config1, _ = c.readRegister(REG_MODEM_CONFIG1)
 
 	// added by C. Pham
@@ -1050,7 +1248,6 @@ func (c *Chip) SetCR(cod byte) (err error) {
 		c.Log(LogLevelError, "There has been an error while configuring Coding Rate parameter.")
 	}
 	c.writeRegister(REG_OP_MODE, st0) // Getting back to previous status
-	delay(100)
 	return
 }
 
@@ -1177,7 +1374,6 @@ func (c *Chip) SetSF(spr uint32) (err error) {
 	}
 
 	c.writeRegister(REG_OP_MODE, st0) // Getting back to previous status
-	delay(100)
 
 	c.getSF() // read from registers
 
@@ -1194,41 +1390,35 @@ func (c *Chip) SetSF(spr uint32) (err error) {
 func (c *Chip) SetCRC(on bool) (err error) {
 	c.Log(LogLevelDebug, "Starting 'SetCRC'.")
 
+	var reg, mask byte
 	if c.mode == ModeLoRa {
 		if c.version == VersionSX1272 {
-			conf1, _ := c.readRegister(REG_MODEM_CONFIG1)
-			conf1 = conf1 | 0x2 // 0B00000010
-			c.writeRegister(REG_MODEM_CONFIG1, conf1)
-			conf1, _ = c.readRegister(REG_MODEM_CONFIG1)
-			if conf1&0x2 != 0 {
-				c.Log(LogLevelVerbose, "CRC has been successfully set.")
-			} else {
-				c.Log(LogLevelError, "There has been an error while setting the CRC.")
-				err = fmt.Errorf("can not set CRC")
-			}
+			reg, mask = REG_MODEM_CONFIG1, 0x2 // 0B00000010
 		} else {
-			conf2, _ := c.readRegister(REG_MODEM_CONFIG2)
-			conf2 = conf2 | 0x4 // 0B00000100
-			c.writeRegister(REG_MODEM_CONFIG2, conf2)
-			conf2, _ = c.readRegister(REG_MODEM_CONFIG2)
-			if conf2&0x4 != 0 {
-				c.Log(LogLevelVerbose, "CRC has been successfully set.")
-			} else {
-				c.Log(LogLevelError, "There has been an error while setting the CRC.")
-				err = fmt.Errorf("can not set CRC")
-			}
+			reg, mask = REG_MODEM_CONFIG2, 0x4 // 0B00000100
 		}
 	} else {
-		conf1, _ := c.readRegister(REG_MODEM_CONFIG1)
-		conf1 = conf1 | 0x10 // 0B00010000
-		c.writeRegister(REG_MODEM_CONFIG1, conf1)
-		conf1, _ = c.readRegister(REG_MODEM_CONFIG1)
-		if conf1&0x10 != 0 {
+		reg, mask = REG_PACKET_CONFIG1, 0x10 // 0B00010000
+	}
+
+	config, _ := c.readRegister(reg)
+	if on {
+		config = config | mask
+	} else {
+		config = config &^ mask
+	}
+	c.writeRegister(reg, config)
+	config, _ = c.readRegister(reg)
+	if (config&mask != 0) == on {
+		c.crc = on
+		if on {
 			c.Log(LogLevelVerbose, "CRC has been successfully set.")
 		} else {
-			c.Log(LogLevelError, "There has been an error while setting the CRC.")
-			err = fmt.Errorf("can not set CRC")
+			c.Log(LogLevelVerbose, "CRC has been successfully unset.")
 		}
+	} else {
+		c.Log(LogLevelError, "There has been an error while setting the CRC.")
+		err = fmt.Errorf("can not set CRC")
 	}
 	return
 }
@@ -1313,8 +1503,6 @@ func (c *Chip) SetBW(bw byte) (err error) {
 
 	c.writeRegister(REG_MODEM_CONFIG1, config1) // Update config1
 
-	delay(100)
-
 	// now we check
 	config1, _ = c.readRegister(REG_MODEM_CONFIG1)
 
@@ -1406,7 +1594,6 @@ func (c *Chip) SetBW(bw byte) (err error) {
 	}
 
 	c.writeRegister(REG_OP_MODE, st0) // Getting back to previous status
-	delay(100)
 	return
 }
 
@@ -1498,7 +1685,6 @@ func (c *Chip) SetPowerDBM(power byte) (err error) {
 	}
 
 	c.writeRegister(REG_OP_MODE, st0) // Getting back to previous status
-	delay(100)
 	return
 }
 
@@ -1614,7 +1800,6 @@ func (c *Chip) setPower(p byte) (err error) {
 	}
 
 	c.writeRegister(REG_OP_MODE, st0) // Getting back to previous status
-	delay(100)
 	return
 }
 
@@ -1678,8 +1863,8 @@ func (c *Chip) setHeaderOFF() (err error) {
 
 	config1, _ = c.readRegister(REG_MODEM_CONFIG1)
 
-	if (c.version == VersionSX1272 && config1&Bit2 == HEADER_OFF) || (c.version == VersionSX1276 && config1&Bit0 == HEADER_OFF) {
-		c.header = true
+	if (c.version == VersionSX1272 && config1&Bit2 != 0) || (c.version == VersionSX1276 && config1&Bit0 == HEADER_OFF) {
+		c.header = false
 		c.Log(LogLevelVerbose, "Header has been deactivated.")
 	} else {
 		c.Log(LogLevelError, "Can not deactivate header.")
@@ -1781,7 +1966,93 @@ func (c *Chip) isSF(spr uint32) bool {
 
 var errOnlyLora = errors.New("modulation must be \"LORA\"")
 
+var _ lora.Radio = (*Chip)(nil)
+var _ lora.Notifier = (*Chip)(nil)
+var _ lora.ChannelSensor = (*Chip)(nil)
+var _ lora.TimedSender = (*Chip)(nil)
+
 func (c *Chip) Send(pkt *lora.TxPacket) (err error) {
+	return c.SendAt(pkt, time.Time{})
+}
+
+// SendAt implements lora.TimedSender.
+// The chip is configured and the packet is written to the FIFO first, the transmission starts at t.
+// ErrTooLate is returned if that took longer than t.
+func (c *Chip) SendAt(pkt *lora.TxPacket, t time.Time) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if pkt.Modulation == "FSK" {
+		return c.sendFSK(pkt, t)
+	}
+
+	if err := c.setChannelLoRa(pkt); err != nil {
+		return err
+	}
+	if err := c.SetPowerDBM(pkt.Power); err != nil {
+		return err
+	}
+
+	c.writeRegister(REG_OP_MODE, LORA_STANDBY_MODE) // Stdby mode to write in registers
+
+	// the packet settings are restored after sending
+	defer c.setPacketConfig(c.crc, c.header, c.preambleLength, c.invertIQ)
+
+	preamble := pkt.PreambleLength
+	if preamble == 0 {
+		preamble = DefaultPreambleLength
+	}
+	header := !pkt.NoHeader && pkt.Datarate != SF_6
+	if err := c.setPacketConfig(!pkt.NoCRC, header, preamble, pkt.InvertPolar); err != nil {
+		return err
+	}
+
+	if err := c.setPacket(pkt.Data); err != nil {
+		return err
+	}
+	return c.sendWithTimeout(10000, t)
+}
+
+// setPacketConfig sets the CRC, explicit header mode, preamble length and IQ inversion
+// of LoRa packets, if they differ from the current settings.
+func (c *Chip) setPacketConfig(crc bool, header bool, preamble uint16, invertIQ bool) error {
+	if c.crc != crc {
+		if err := c.SetCRC(crc); err != nil {
+			return err
+		}
+	}
+	if c.header != header {
+		var err error
+		if header {
+			err = c.setHeaderON()
+		} else {
+			err = c.setHeaderOFF()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if c.preambleLength != preamble {
+		if err := c.SetPreambleLength(preamble); err != nil {
+			return err
+		}
+	}
+	if c.invertIQ != invertIQ {
+		if err := c.SetIQInversion(invertIQ); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setChannelLoRa switches to the LoRa modem and sets the frequency, coderate, bandwidth and spreading factor of pkt.
+func (c *Chip) setChannelLoRa(pkt *lora.TxPacket) error {
+
+	if c.mode == ModemFSK {
+		if err := c.SetLORA(); err != nil {
+			return err
+		}
+	}
 
 	cr := pkt.LoRaCR - 4
 	bw := pkt.LoRaBW - 1
@@ -1802,29 +2073,26 @@ func (c *Chip) Send(pkt *lora.TxPacket) (err error) {
 			return err
 		}
 	}
+	return c.SetFreq(pkt.Freq)
+}
+
+func (c *Chip) sendFSK(pkt *lora.TxPacket, t time.Time) (err error) {
+
+	if err := c.configureFSK(pkt.Datarate, uint32(pkt.FreqDev)*1000, pkt.PreambleLength, !pkt.NoCRC); err != nil {
+		return err
+	}
 	if err := c.SetFreq(pkt.Freq); err != nil {
 		return err
 	}
 	if err := c.SetPowerDBM(pkt.Power); err != nil {
 		return err
 	}
-
-	if pkt.InvertPolar {
-		if err := c.SetIQInversion(true); err != nil {
-			return err
-		}
-	}
-
-	err = c.sendPacketTimeout(pkt.Data, 10000)
-
-	if pkt.InvertPolar {
-		c.SetIQInversion(false)
-	}
-
-	return err
+	return c.sendFSKWithTimeout(pkt.Data, 10000, t)
 }
 
 func (c *Chip) Write(payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	//c.setPacketType(PKT_TYPE_DATA | PKT_FLAG_DATA_DOWNLINK)
 	return c.sendPacketTimeout(payload, 10000)
 }
@@ -1837,7 +2105,7 @@ func (c *Chip) sendPacketTimeout(payload []byte, timeout uint16) (err error) {
 	// if err = c.setIQInversion(false); err != nil {
 	// 	return
 	// }
-	err = c.sendWithTimeout(timeout)
+	err = c.sendWithTimeout(timeout, time.Time{})
 	// c.setIQInversion(true)
 	return
 }
@@ -1868,8 +2136,8 @@ func (c *Chip) setPacket(payload []byte) (err error) {
 		//writeRegister(REG_FIFO, packet_sent.packnum);	// Writing the packet number in FIFO
 		// commented by C. Pham
 		//writeRegister(REG_FIFO, packet_sent.length); 	// Writing the packet length in FIFO
-		for _, b := range payload {
-			c.writeRegister(REG_FIFO, b)
+		if len(payload) != 0 {
+			err = c.writeRegisters(REG_FIFO, payload)
 		}
 
 		c.Log(LogLevelVerbose, "Send packet %v.", payload)
@@ -1902,9 +2170,10 @@ func (c *Chip) SetIQInversion(invert bool) (err error) {
 	i1, _ := c.readRegister(REG_INVERT_IQ)
 	i2, _ := c.readRegister(REG_INVERT_IQ2)
 
-	if (invert && ((i1 != 0x66) || (i2 != 0x19))) || (!invert && ((i1 != 0x26) || (i2 != 0x1D))) {
+	if (invert && ((i1 != 0x66) || (i2 != 0x19))) || (!invert && ((i1 != 0x27) || (i2 != 0x1D))) {
 		err = fmt.Errorf("can not change IQ inversion")
 	} else {
+		c.invertIQ = invert
 		if invert {
 			c.Log(LogLevelVerbose, "IQ inversion activated")
 		} else {
@@ -1916,12 +2185,23 @@ func (c *Chip) SetIQInversion(invert bool) (err error) {
 	return
 }
 
-func (c *Chip) sendWithTimeout(wait uint16) (err error) {
+// sendWithTimeout starts the transmission at t (if not zero) and waits until the packet has been sent.
+func (c *Chip) sendWithTimeout(wait uint16, t time.Time) (err error) {
 
 	c.Log(LogLevelDebug, "Starting 'sendWithTimeout'.")
 
 	var value byte
 
+	if err = waitUntil(t); err != nil {
+		c.Log(LogLevelError, "Can not send packet in time: %s late.", time.Since(t))
+		return err
+	}
+
+	if err = c.setAntenna(false, true); err != nil {
+		return err
+	}
+	defer c.setAntenna(false, false)
+
 	var startTime = time.Now()
 	var exitTime = startTime.Add(time.Millisecond * time.Duration(wait))
 
@@ -1934,7 +2214,7 @@ func (c *Chip) sendWithTimeout(wait uint16) (err error) {
 		// Wait until the packet is sent (TX Done flag) or the timeout expires
 		//while ((bitRead(value, 3) == 0) && (millis() - previous < wait))
 		for value&Bit3 == 0 && exitTime.After(time.Now()) {
-			delay(100)
+			delay(1)
 			value, _ = c.readRegister(REG_IRQ_FLAGS)
 			// Condition to avoid an overflow (DO NOT REMOVE)
 			//if( millis() < previous )
@@ -1949,7 +2229,7 @@ func (c *Chip) sendWithTimeout(wait uint16) (err error) {
 		// Wait until the packet is sent (Packet Sent flag) or the timeout expires
 		//while ((bitRead(value, 3) == 0) && (millis() - previous < wait))
 		for value&Bit3 == 0 && exitTime.After(time.Now()) {
-			delay(100)
+			delay(1)
 			value, _ = c.readRegister(REG_IRQ_FLAGS2)
 			// Condition to avoid an overflow (DO NOT REMOVE)
 			//if( millis() < previous )
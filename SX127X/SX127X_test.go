@@ -0,0 +1,519 @@
+package SX127X
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/SX127X/emu"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpiotest"
+)
+
+// testConn is the emulator with SPI transactions counted and, to test the read-back
+// checks of the driver, writes to a stuck register dropped.
+type testConn struct {
+	*emu.Emulator
+
+	mu    sync.Mutex
+	stuck int // register address, -1 for none
+	nTx   int
+}
+
+func (c *testConn) Tx(w, r []byte) error {
+	c.mu.Lock()
+	c.nTx++
+	stuck := c.stuck
+	c.mu.Unlock()
+	if len(w) != 0 && w[0]&0x80 != 0 && int(w[0]&0x7F) == stuck {
+		return nil
+	}
+	return c.Emulator.Tx(w, r)
+}
+
+func (c *testConn) setStuck(addr int) {
+	c.mu.Lock()
+	c.stuck = addr
+	c.mu.Unlock()
+}
+
+func (c *testConn) transactions() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nTx
+}
+
+func openChip(t *testing.T, version byte) (*Chip, *testConn) {
+	t.Helper()
+	conn := &testConn{Emulator: emu.New(version), stuck: -1}
+	c, err := Open(conn, &gpiotest.Pin{})
+	if err != nil {
+		t.Fatalf("can not open chip: %v", err)
+	}
+	return c, conn
+}
+
+var versions = []struct {
+	name    string
+	version byte
+}{
+	{"SX1272", emu.VersionSX1272},
+	{"SX1276", emu.VersionSX1276},
+}
+
+func TestOpen(t *testing.T) {
+	for _, v := range versions {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			t.Parallel()
+			c, conn := openChip(t, v.version)
+			if c.Name() != v.name {
+				t.Errorf("Name() = %q, expected %q", c.Name(), v.name)
+			}
+			if mode, isLoRa := conn.Mode(); mode != emu.ModeStandby || !isLoRa {
+				t.Errorf("chip is in mode %d (LoRa %v), expected LoRa standby", mode, isLoRa)
+			}
+			if sw := conn.Register(REG_SYNC_WORD); sw != PublicSyncWord {
+				t.Errorf("sync word is 0x%x, expected 0x%x", sw, PublicSyncWord)
+			}
+			if !c.crc || c.invertIQ {
+				t.Errorf("crc %v, invertIQ %v, expected CRC on and IQ not inverted", c.crc, c.invertIQ)
+			}
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		if _, err := Open(emu.New(0x99), &gpiotest.Pin{}); err == nil {
+			t.Error("Open succeeded with an unknown chip version")
+		}
+	})
+}
+
+func TestSetters(t *testing.T) {
+	for _, v := range versions {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			t.Parallel()
+			c, conn := openChip(t, v.version)
+
+			if err := c.SetSF(SF_9); err != nil {
+				t.Fatalf("SetSF: %v", err)
+			}
+			if sf := conn.Register(REG_MODEM_CONFIG2) >> 4; sf != SF_9 {
+				t.Errorf("SF in RegModemConfig2 is %d, expected 9", sf)
+			}
+			if err := c.SetBW(BW_250); err != nil {
+				t.Fatalf("SetBW: %v", err)
+			}
+			if err := c.SetCR(CR_7); err != nil {
+				t.Fatalf("SetCR: %v", err)
+			}
+			// 433 MHz is only in the range of the SX1276
+			if err := c.SetFreq(433175000); (err == nil) != (v.version == emu.VersionSX1276) {
+				t.Errorf("SetFreq(433.175 MHz) = %v", err)
+			}
+			if err := c.SetFreq(1100000000); !errors.Is(err, lora.ErrFreq) {
+				t.Errorf("SetFreq(1100 MHz) = %v, expected %v", err, lora.ErrFreq)
+			}
+			if err := c.SetFreq(868100000); err != nil {
+				t.Fatalf("SetFreq: %v", err)
+			}
+			if c.GetFreq() != conn.Freq() || conn.Freq() < 868099000 || conn.Freq() > 868101000 {
+				t.Errorf("frequency is %d Hz (chip %d Hz), expected 868.1 MHz", c.GetFreq(), conn.Freq())
+			}
+
+			// sending with the current settings does not change them
+			pkt := &lora.TxPacket{
+				Freq:     c.GetFreq(),
+				Power:    14,
+				LoRaBW:   BW_250 + 1,
+				LoRaCR:   CR_7 + 4,
+				Datarate: SF_9,
+				Data:     []byte("hello"),
+			}
+			if err := c.Send(pkt); err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			sent := conn.Sent()
+			if len(sent) != 1 {
+				t.Fatalf("%d frames sent, expected 1", len(sent))
+			}
+			f := sent[0]
+			if f.Modem != "LORA" || f.SF != 9 || f.BW != 250000 || f.CR != 7 || f.Freq != conn.Freq() {
+				t.Errorf("sent %s SF%d BW %d CR 4/%d at %d Hz, expected LORA SF9 BW 250000 CR 4/7 at %d Hz", f.Modem, f.SF, f.BW, f.CR, f.Freq, conn.Freq())
+			}
+			if !bytes.Equal(f.Data, pkt.Data) {
+				t.Errorf("sent %q, expected %q", f.Data, pkt.Data)
+			}
+			if mode, _ := conn.Mode(); mode != emu.ModeStandby {
+				t.Errorf("chip is in mode %d after sending, expected standby", mode)
+			}
+		})
+	}
+}
+
+// TestReadBack checks that the setters fail if the register can not be written.
+func TestReadBack(t *testing.T) {
+	c, conn := openChip(t, emu.VersionSX1276)
+
+	tests := []struct {
+		name string
+		reg  int
+		set  func() error
+	}{
+		{"SetSF", REG_MODEM_CONFIG2, func() error { return c.SetSF(SF_9) }},
+		{"SetBW", REG_MODEM_CONFIG1, func() error { return c.SetBW(BW_500) }},
+		{"SetCR", REG_MODEM_CONFIG1, func() error { return c.SetCR(CR_8) }},
+		{"SetFreq", REG_FRF_MSB, func() error { return c.SetFreq(915000000) }},
+		{"SetPreambleLength", REG_PREAMBLE_MSB_LORA, func() error { return c.SetPreambleLength(12) }},
+		{"SetSyncWord", REG_SYNC_WORD, func() error { return c.SetSyncWord(PrivateSyncWord) }},
+		{"SetIQInversion", REG_INVERT_IQ, func() error { return c.SetIQInversion(true) }},
+		{"SetCRC", REG_MODEM_CONFIG2, func() error { return c.SetCRC(false) }},
+		{"setHeaderOFF", REG_MODEM_CONFIG1, func() error { return c.setHeaderOFF() }},
+	}
+	for _, test := range tests {
+		conn.setStuck(test.reg)
+		if err := test.set(); err == nil {
+			t.Errorf("%s succeeded with register 0x%x stuck", test.name, test.reg)
+		}
+	}
+
+	conn.setStuck(-1)
+	for _, test := range tests {
+		if err := test.set(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestGetPacket(t *testing.T) {
+	for _, v := range versions {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			t.Parallel()
+			c, conn := openChip(t, v.version)
+
+			cfg := &lora.Config{
+				Freq:       868100000,
+				Modulation: "LORA",
+				LoRaBW:     125000,
+				LoRaCR:     "4/5",
+				Datarate:   SF_7,
+			}
+			if err := c.Receive(cfg); err != nil {
+				t.Fatalf("Receive: %v", err)
+			}
+			if pkts, err := c.GetPacket(); len(pkts) != 0 || err != nil {
+				t.Fatalf("GetPacket without reception: %v, %v", pkts, err)
+			}
+
+			data := bytes.Repeat([]byte{0x40, 0x01, 0x02}, 60)
+			rx := &emu.Packet{SF: 7, RSSI: -100, SNR: -5, FreqOffset: 1000, Data: data}
+			if err := conn.Receive(rx); err != nil {
+				t.Fatalf("can not receive: %v", err)
+			}
+			n := conn.transactions()
+			pkts, err := c.GetPacket()
+			if err != nil || len(pkts) != 1 {
+				t.Fatalf("GetPacket: %v, %v", pkts, err)
+			}
+			// the FIFO is read in a single transaction
+			if n := conn.transactions() - n; n > 40 {
+				t.Errorf("%d SPI transactions to get a packet of %d bytes", n, len(data))
+			}
+
+			pkt := pkts[0]
+			if !bytes.Equal(pkt.Data, data) {
+				t.Errorf("received %x, expected %x", pkt.Data, data)
+			}
+			if pkt.StatCRC != 1 || pkt.Modulation != "LORA" || pkt.Datarate != 7 || pkt.LoRaBW != BW_125+1 || pkt.LoRaCR != 5 {
+				t.Errorf("received CRC %d %s SF%d BW %d CR 4/%d, expected CRC 1 LORA SF7 BW %d CR 4/5", pkt.StatCRC, pkt.Modulation, pkt.Datarate, pkt.LoRaBW, pkt.LoRaCR, BW_125+1)
+			}
+			if pkt.LoRaSNR != -5 || pkt.RSSISignal != -100 || pkt.RSSI != -95 {
+				t.Errorf("received SNR %.2f, signal RSSI %.0f, RSSI %.0f, expected -5, -100, -95", pkt.LoRaSNR, pkt.RSSISignal, pkt.RSSI)
+			}
+			if pkt.FreqOffset < 990 || pkt.FreqOffset > 1010 {
+				t.Errorf("received frequency offset %d Hz, expected 1000 Hz", pkt.FreqOffset)
+			}
+
+			if err := c.Receive(cfg); err != nil {
+				t.Fatalf("Receive: %v", err)
+			}
+			rx = &emu.Packet{CRCError: true, Data: []byte{1, 2, 3}}
+			if err := conn.Receive(rx); err != nil {
+				t.Fatalf("can not receive: %v", err)
+			}
+			pkts, err = c.GetPacket()
+			if err != nil || len(pkts) != 1 || pkts[0].StatCRC != -1 {
+				t.Errorf("GetPacket of a packet with CRC error: %v, %v", pkts, err)
+			}
+		})
+	}
+}
+
+func TestPackets(t *testing.T) {
+	conn := emu.New(emu.VersionSX1276)
+	c, err := Open(conn, &gpiotest.Pin{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetDIO0(conn.DIO0()); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &lora.Config{Freq: 868100000, Modulation: "LORA", LoRaBW: 125000, LoRaCR: "4/5", Datarate: SF_7}
+
+	for i := 0; i < 3; i++ {
+		if err := c.Receive(cfg); err != nil {
+			t.Fatalf("Receive: %v", err)
+		}
+		data := []byte{byte(i)}
+		if err := conn.Receive(&emu.Packet{Data: data}); err != nil {
+			t.Fatalf("can not receive: %v", err)
+		}
+		select {
+		case pkt := <-c.Packets():
+			if !bytes.Equal(pkt.Data, data) || pkt.TimeFin.IsZero() {
+				t.Errorf("got %x at %v, expected %x", pkt.Data, pkt.TimeFin, data)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no packet on DIO0")
+		}
+	}
+}
+
+// noEdgePin is a pin without edge detection, WaitForEdge fails immediately.
+type noEdgePin struct {
+	gpiotest.Pin
+	waits int32
+}
+
+func (p *noEdgePin) WaitForEdge(timeout time.Duration) bool {
+	atomic.AddInt32(&p.waits, 1)
+	return false
+}
+
+func TestPacketsPolling(t *testing.T) {
+	conn := emu.New(emu.VersionSX1276)
+	c, err := Open(conn, &gpiotest.Pin{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin := &noEdgePin{Pin: gpiotest.Pin{EdgesChan: make(chan gpio.Level)}}
+	if err := c.SetDIO0(pin); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &lora.Config{Freq: 868100000, Modulation: "LORA", LoRaBW: 125000, LoRaCR: "4/5", Datarate: SF_7}
+	if err := c.Receive(cfg); err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	if err := conn.Receive(&emu.Packet{Data: []byte{42}}); err != nil {
+		t.Fatalf("can not receive: %v", err)
+	}
+	select {
+	case pkt := <-c.Packets():
+		if !bytes.Equal(pkt.Data, []byte{42}) {
+			t.Errorf("got %x, expected 2a", pkt.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("packet not polled")
+	}
+	time.Sleep(3 * dioPollInterval)
+	if n := atomic.LoadInt32(&pin.waits); n > 10 {
+		t.Errorf("WaitForEdge called %d times in %s", n, 3*dioPollInterval)
+	}
+}
+
+func TestChannelBusy(t *testing.T) {
+	c, conn := openChip(t, emu.VersionSX1276)
+	ctx := context.Background()
+
+	pkt := &lora.TxPacket{Freq: 868100000, LoRaBW: BW_125 + 1, LoRaCR: 5, Datarate: SF_7}
+	conn.SetRSSI(-110)
+	if busy, err := c.ChannelBusy(ctx, pkt, -90); busy || err != nil {
+		t.Errorf("ChannelBusy on a free channel: %v, %v", busy, err)
+	}
+	conn.SetActivity(true)
+	if busy, err := c.ChannelBusy(ctx, pkt, 0); !busy || err != nil {
+		t.Errorf("ChannelBusy with a preamble on the air: %v, %v", busy, err)
+	}
+	conn.SetActivity(false)
+	conn.SetRSSI(-80)
+	if busy, err := c.ChannelBusy(ctx, pkt, -90); !busy || err != nil {
+		t.Errorf("ChannelBusy with RSSI above the target: %v, %v", busy, err)
+	}
+	if mode, _ := conn.Mode(); mode != emu.ModeStandby {
+		t.Errorf("chip is in mode %d after ChannelBusy, expected standby", mode)
+	}
+
+	fsk := &lora.TxPacket{Freq: 868800000, Modulation: "FSK", Datarate: 50000, FreqDev: 25}
+	if busy, err := c.ChannelBusy(ctx, fsk, -90); !busy || err != nil {
+		t.Errorf("ChannelBusy of an FSK channel with RSSI above the target: %v, %v", busy, err)
+	}
+}
+
+func TestSendPacketSettings(t *testing.T) {
+	c, conn := openChip(t, emu.VersionSX1276)
+
+	pkt := &lora.TxPacket{
+		Freq:           869525000,
+		Power:          14,
+		LoRaBW:         BW_125 + 1,
+		LoRaCR:         5,
+		Datarate:       SF_9,
+		InvertPolar:    true,
+		NoCRC:          true,
+		NoHeader:       true,
+		PreambleLength: 12,
+		Data:           []byte("downlink"),
+	}
+	if err := c.Send(pkt); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	pkt = &lora.TxPacket{Freq: 869525000, Power: 14, LoRaBW: BW_125 + 1, LoRaCR: 5, Datarate: SF_9, Data: []byte("default")}
+	if err := c.Send(pkt); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	sent := conn.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("%d frames sent, expected 2", len(sent))
+	}
+	if f := sent[0]; !f.InvertIQ || f.CRC || !f.ImplicitHeader || f.Preamble != 12 {
+		t.Errorf("sent with InvertIQ %v, CRC %v, implicit header %v, preamble %d, expected true, false, true, 12", f.InvertIQ, f.CRC, f.ImplicitHeader, f.Preamble)
+	}
+	// the settings have been restored after the first packet
+	if f := sent[1]; f.InvertIQ || !f.CRC || f.ImplicitHeader || f.Preamble != DefaultPreambleLength {
+		t.Errorf("sent with InvertIQ %v, CRC %v, implicit header %v, preamble %d, expected false, true, false, %d", f.InvertIQ, f.CRC, f.ImplicitHeader, f.Preamble, DefaultPreambleLength)
+	}
+}
+
+func TestSendAtTooLate(t *testing.T) {
+	c, conn := openChip(t, emu.VersionSX1276)
+	pkt := &lora.TxPacket{Freq: 868100000, Power: 14, LoRaBW: BW_125 + 1, LoRaCR: 5, Datarate: SF_7, Data: []byte{1}}
+	if err := c.SendAt(pkt, time.Now().Add(-time.Second)); err != ErrTooLate {
+		t.Errorf("SendAt in the past: %v, expected ErrTooLate", err)
+	}
+	if len(conn.Sent()) != 0 {
+		t.Errorf("packet sent too late")
+	}
+}
+
+func TestFSK(t *testing.T) {
+	c, conn := openChip(t, emu.VersionSX1276)
+
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	pkt := &lora.TxPacket{Freq: 868800000, Power: 14, Modulation: "FSK", Datarate: 50000, FreqDev: 25, Data: data}
+	if err := c.Send(pkt); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	sent := conn.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("%d frames sent, expected 1", len(sent))
+	}
+	f := sent[0]
+	if f.Modem != "FSK" || f.Bitrate != 50000 || f.FreqDev < 24900 || f.FreqDev > 25100 || !f.CRC || f.Preamble != DefaultFSKPreamble {
+		t.Errorf("sent %s %d bit/s, fdev %d Hz, CRC %v, preamble %d, expected FSK 50000 bit/s, fdev 25 kHz, CRC, preamble %d", f.Modem, f.Bitrate, f.FreqDev, f.CRC, f.Preamble, DefaultFSKPreamble)
+	}
+	if !bytes.Equal(f.Data, data) {
+		t.Errorf("sent %x, expected %x", f.Data, data)
+	}
+
+	cfg := &lora.Config{Freq: 868800000, Modulation: "FSK", Datarate: 50000, FreqDev: 25000}
+	if err := c.Receive(cfg); err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	if mode, isLoRa := conn.Mode(); mode != emu.ModeRx || isLoRa {
+		t.Fatalf("chip is in mode %d (LoRa %v), expected FSK Rx", mode, isLoRa)
+	}
+	if err := conn.Receive(&emu.Packet{RSSI: -70, Data: data[:40]}); err != nil {
+		t.Fatalf("can not receive: %v", err)
+	}
+	pkts, err := c.GetPacket()
+	if err != nil || len(pkts) != 1 {
+		t.Fatalf("GetPacket: %v, %v", pkts, err)
+	}
+	rx := pkts[0]
+	if rx.Modulation != "FSK" || rx.Datarate != 50000 || rx.StatCRC != 1 || rx.RSSI != -70 {
+		t.Errorf("received %s %d bit/s, CRC %d, RSSI %.0f, expected FSK 50000 bit/s, CRC 1, RSSI -70", rx.Modulation, rx.Datarate, rx.StatCRC, rx.RSSI)
+	}
+	if !bytes.Equal(rx.Data, data[:40]) {
+		t.Errorf("received %x, expected %x", rx.Data, data[:40])
+	}
+
+	// packets longer than the FIFO are read while receiving
+	long := bytes.Repeat(data, 3)[:MAX_LENGTH]
+	if err := c.Receive(cfg); err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	if l := conn.Register(REG_PAYLOAD_LENGTH_FSK); l != MAX_LENGTH {
+		t.Errorf("RegPayloadLength is %d in FSK Rx, expected %d", l, MAX_LENGTH)
+	}
+	if err := conn.Receive(&emu.Packet{CRCError: true, Data: long}); err != nil {
+		t.Fatalf("can not receive: %v", err)
+	}
+	pkts, err = c.GetPacket()
+	if err != nil || len(pkts) != 1 {
+		t.Fatalf("GetPacket: %v, %v", pkts, err)
+	}
+	if rx := pkts[0]; !bytes.Equal(rx.Data, long) || rx.StatCRC != -1 {
+		t.Errorf("received %x with CRC %d, expected %x with CRC -1", rx.Data, rx.StatCRC, long)
+	}
+
+	// back to LoRa
+	pkt = &lora.TxPacket{Freq: 868100000, Power: 14, LoRaBW: BW_125 + 1, LoRaCR: 5, Datarate: SF_7, Data: []byte{1}}
+	if err := c.Send(pkt); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if sent := conn.Sent(); len(sent) != 2 || sent[1].Modem != "LORA" {
+		t.Errorf("second packet not sent with LoRa")
+	}
+}
+
+func TestFSKPackets(t *testing.T) {
+	conn := emu.New(emu.VersionSX1276)
+	c, err := Open(conn, &gpiotest.Pin{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetDIO0(conn.DIO0()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetDIO1(conn.DIO1()); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &lora.Config{Freq: 868800000, Modulation: "FSK", Datarate: 50000, FreqDev: 25000}
+
+	for _, n := range []int{10, 64, 200, MAX_LENGTH} {
+		if err := c.Receive(cfg); err != nil {
+			t.Fatalf("Receive: %v", err)
+		}
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = byte(n + i)
+		}
+		if err := conn.Receive(&emu.Packet{Data: data}); err != nil {
+			t.Fatalf("can not receive: %v", err)
+		}
+		select {
+		case pkt := <-c.Packets():
+			if !bytes.Equal(pkt.Data, data) || pkt.StatCRC != 1 {
+				t.Errorf("got %x with CRC %d, expected %x with CRC 1", pkt.Data, pkt.StatCRC, data)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("packet of %d bytes not received", n)
+		}
+	}
+	select {
+	case pkt := <-c.Packets():
+		t.Errorf("unexpected packet %x", pkt.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,225 @@
+package SX127X
+
+import (
+	"fmt"
+
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpioreg"
+	"periph.io/x/conn/v3/physic"
+	"periph.io/x/conn/v3/spi"
+	"periph.io/x/conn/v3/spi/spireg"
+)
+
+// BoardConfig describes how the SX127X is wired, as found in the "board_conf" section of the
+// "global_conf.json" file. Pins are given by name, like "GPIO17".
+// Empty fields are taken from the preset (if any) and then from the "default" preset.
+type BoardConfig struct {
+	Preset string `json:"preset"` // name of a board in Boards, e.g. "dragino"
+
+	SPI      string `json:"spi_port"`  // SPI port, e.g. "/dev/spidev0.0" or "SPI0.1"
+	SPISpeed int64  `json:"spi_speed"` // SPI clock in Hz
+
+	NSS   string `json:"pin_nss"`   // chip select pin if not driven by the SPI port itself
+	Reset string `json:"pin_reset"` // reset pin
+	DIO0  string `json:"pin_dio0"`  // DIO0 pin (RxDone / TxDone / CadDone)
+	DIO1  string `json:"pin_dio1"`  // DIO1 pin (RxTimeout / CadDetected)
+	RXEN  string `json:"pin_rxen"`  // antenna switch, high while receiving
+	TXEN  string `json:"pin_txen"`  // antenna switch, high while transmitting
+
+	PABoost *bool `json:"pa_boost"` // the antenna is connected to the PA_BOOST pin (instead of RFO)
+}
+
+var paBoost = true
+
+// Boards are presets for common boards (HATs).
+var Boards = map[string]BoardConfig{
+	// the Waziup WaziHat, this is the default configuration
+	"default": {
+		SPI:      "/dev/spidev0.0",
+		SPISpeed: 1000000,
+		Reset:    "GPIO17",
+		PABoost:  &paBoost,
+	},
+	// Dragino LoRa/GPS HAT
+	"dragino": {
+		SPI:      "/dev/spidev0.0",
+		SPISpeed: 1000000,
+		NSS:      "GPIO25",
+		Reset:    "GPIO17",
+		DIO0:     "GPIO4",
+		DIO1:     "GPIO23",
+		PABoost:  &paBoost,
+	},
+	// Adafruit LoRa Radio Bonnet with RFM95W
+	"rfm95-bonnet": {
+		SPI:      "/dev/spidev0.1",
+		SPISpeed: 1000000,
+		Reset:    "GPIO25",
+		DIO0:     "GPIO22",
+		DIO1:     "GPIO23",
+		PABoost:  &paBoost,
+	},
+}
+
+// resolve fills all empty fields from the preset and the default board.
+func (cfg BoardConfig) resolve() (BoardConfig, error) {
+	if cfg.Preset != "" {
+		preset, ok := Boards[cfg.Preset]
+		if !ok {
+			return cfg, fmt.Errorf("unknown board preset: %q", cfg.Preset)
+		}
+		cfg = cfg.merge(preset)
+	}
+	return cfg.merge(Boards["default"]), nil
+}
+
+func (cfg BoardConfig) merge(preset BoardConfig) BoardConfig {
+	if cfg.SPI == "" {
+		cfg.SPI = preset.SPI
+	}
+	if cfg.SPISpeed == 0 {
+		cfg.SPISpeed = preset.SPISpeed
+	}
+	if cfg.NSS == "" {
+		cfg.NSS = preset.NSS
+	}
+	if cfg.Reset == "" {
+		cfg.Reset = preset.Reset
+	}
+	if cfg.DIO0 == "" {
+		cfg.DIO0 = preset.DIO0
+	}
+	if cfg.DIO1 == "" {
+		cfg.DIO1 = preset.DIO1
+	}
+	if cfg.RXEN == "" {
+		cfg.RXEN = preset.RXEN
+	}
+	if cfg.TXEN == "" {
+		cfg.TXEN = preset.TXEN
+	}
+	if cfg.PABoost == nil {
+		cfg.PABoost = preset.PABoost
+	}
+	return cfg
+}
+
+func pinByName(name string) (gpio.PinIO, error) {
+	pin := gpioreg.ByName(name)
+	if pin == nil {
+		return nil, fmt.Errorf("unknown pin: %q", name)
+	}
+	return pin, nil
+}
+
+// DiscoverWith opens the SX127X that is wired as described by the board configuration.
+func DiscoverWith(cfg BoardConfig) (*Chip, error) {
+
+	cfg, err := cfg.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := spireg.Open(cfg.SPI)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn spi.Conn
+	conn, err = p.Connect(physic.Frequency(cfg.SPISpeed)*physic.Hertz, spi.Mode0, 8)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.NSS != "" {
+		pinNSS, err := pinByName(cfg.NSS)
+		if err != nil {
+			return nil, err
+		}
+		if err := pinNSS.Out(gpio.High); err != nil {
+			return nil, err
+		}
+		conn = &nssConn{Conn: conn, pin: pinNSS}
+	}
+
+	var pinRST gpio.PinIO
+	if cfg.Reset != "" {
+		pinRST, err = pinByName(cfg.Reset)
+		if err != nil {
+			return nil, err
+		}
+		if err := pinRST.Out(gpio.Low); err != nil {
+			return nil, err
+		}
+		delay(100)
+		if err := pinRST.Out(gpio.High); err != nil {
+			return nil, err
+		}
+		delay(100)
+	}
+
+	c, err := Open(conn, pinRST)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.PABoost != nil {
+		c.NeedPABOOST = *cfg.PABoost
+	}
+
+	if cfg.RXEN != "" || cfg.TXEN != "" {
+		var pinRXEN, pinTXEN gpio.PinOut
+		if cfg.RXEN != "" {
+			if pinRXEN, err = pinByName(cfg.RXEN); err != nil {
+				return nil, err
+			}
+		}
+		if cfg.TXEN != "" {
+			if pinTXEN, err = pinByName(cfg.TXEN); err != nil {
+				return nil, err
+			}
+		}
+		if err := c.SetAntennaSwitch(pinRXEN, pinTXEN); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.DIO0 != "" {
+		pin, err := pinByName(cfg.DIO0)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.SetDIO0(pin); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.DIO1 != "" {
+		pin, err := pinByName(cfg.DIO1)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.SetDIO1(pin); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// nssConn drives the chip select pin of boards that do not use the chip select line of the SPI port.
+type nssConn struct {
+	spi.Conn
+	pin gpio.PinOut
+}
+
+func (c *nssConn) Tx(w, r []byte) error {
+	if err := c.pin.Out(gpio.Low); err != nil {
+		return err
+	}
+	err := c.Conn.Tx(w, r)
+	if err2 := c.pin.Out(gpio.High); err == nil {
+		err = err2
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+package SX127X
+
+import (
+	"context"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// CAD runs a Channel Activity Detection on the current frequency and spreading factor
+// and reports whether a LoRa preamble has been detected.
+// The chip is left in standby mode.
+func (c *Chip) CAD(ctx context.Context) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cad(ctx)
+}
+
+func (c *Chip) cad(ctx context.Context) (detected bool, err error) {
+
+	c.Log(LogLevelDebug, "Starting 'CAD'.")
+
+	if c.mode != ModeLoRa {
+		return false, errOnlyLora
+	}
+
+	c.writeRegister(REG_OP_MODE, LORA_STANDBY_MODE)
+	c.clearFlags()
+	if err = c.setAntenna(true, false); err != nil {
+		return false, err
+	}
+
+	c.writeRegister(REG_OP_MODE, LORA_CAD_MODE) // LORA mode - CAD
+
+	// the chip gets back to standby mode when CadDone is set
+	value, err := c.readRegister(REG_IRQ_FLAGS)
+	for err == nil && value&Bit2 == 0 {
+		select {
+		case <-ctx.Done():
+			c.writeRegister(REG_OP_MODE, LORA_STANDBY_MODE)
+			c.clearFlags()
+			return false, ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+		value, err = c.readRegister(REG_IRQ_FLAGS)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	detected = value&Bit0 != 0
+	c.clearFlags()
+	c.Log(LogLevelVerbose, "CAD done, activity detected: %v.", detected)
+	return detected, nil
+}
+
+// getRSSI returns the current RSSI value. It puts the chip into receive mode
+// for a short while to measure it.
+func (c *Chip) getRSSI() (rssi int16, err error) {
+
+	c.Log(LogLevelDebug, "Starting 'getRSSI'.")
+
+	if err = c.setAntenna(true, false); err != nil {
+		return
+	}
+
+	if c.mode == ModemFSK {
+		c.writeRegister(REG_OP_MODE, FSK_RX_MODE)
+		delay(2)
+		rssi, err = c.getRSSIFSK()
+		c.writeRegister(REG_OP_MODE, FSK_STANDBY_MODE)
+		return
+	}
+
+	c.writeRegister(REG_OP_MODE, LORA_RX_MODE)
+	delay(2)
+	value, err := c.readRegister(REG_RSSI_VALUE_LORA)
+	c.writeRegister(REG_OP_MODE, LORA_STANDBY_MODE)
+
+	rssi = c.rssiOffset() + int16(value)
+	c.Log(LogLevelVerbose, "RSSI value is %d.", rssi)
+	return
+}
+
+// ChannelBusy implements lora.ChannelSensor.
+// LoRa channels are checked with CAD, FSK channels with the RSSI only.
+func (c *Chip) ChannelBusy(ctx context.Context, pkt *lora.TxPacket, rssiTarget int) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if pkt.Modulation == "FSK" {
+		if err := c.configureFSK(pkt.Datarate, uint32(pkt.FreqDev)*1000, pkt.PreambleLength, !pkt.NoCRC); err != nil {
+			return false, err
+		}
+		if err := c.SetFreq(pkt.Freq); err != nil {
+			return false, err
+		}
+	} else {
+		if err := c.setChannelLoRa(pkt); err != nil {
+			return false, err
+		}
+		detected, err := c.cad(ctx)
+		if err != nil || detected {
+			return detected, err
+		}
+	}
+
+	if rssiTarget == 0 {
+		return false, nil
+	}
+	rssi, err := c.getRSSI()
+	if err != nil {
+		return false, err
+	}
+	return int(rssi) > rssiTarget, nil
+}
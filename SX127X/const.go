@@ -70,8 +70,11 @@ const (
 	// end
 	REG_SYNC_CONFIG         = 0x27
 	REG_SYNC_VALUE1         = 0x28
+	REG_FEI_MSB_LORA        = 0x28
 	REG_SYNC_VALUE2         = 0x29
+	REG_FEI_MID_LORA        = 0x29
 	REG_SYNC_VALUE3         = 0x2A
+	REG_FEI_LSB_LORA        = 0x2A
 	REG_SYNC_VALUE4         = 0x2B
 	REG_SYNC_VALUE5         = 0x2C
 	REG_SYNC_VALUE6         = 0x2D
@@ -187,6 +190,7 @@ const (
 	LORA_STANDBY_MODE = 0x81
 	LORA_TX_MODE      = 0x83
 	LORA_RX_MODE      = 0x85
+	LORA_CAD_MODE     = 0x87
 )
 
 //FSK MODES:
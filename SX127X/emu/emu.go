@@ -0,0 +1,817 @@
+// Package emu emulates the register map of the SX1272 and SX1276 LoRa chips.
+//
+// The Emulator implements periph's spi.Conn, so it can be given to SX127X.New
+// or SX127X.Open in place of a real SPI connection to test the driver without hardware.
+package emu
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"periph.io/x/conn/v3"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpiotest"
+	"periph.io/x/conn/v3/spi"
+)
+
+const (
+	VersionSX1272 = 0x22
+	VersionSX1276 = 0x12
+)
+
+// Modes of the RegOpMode register (bits 2-0).
+const (
+	ModeSleep     = 0x00
+	ModeStandby   = 0x01
+	ModeFSTx      = 0x02
+	ModeTx        = 0x03
+	ModeFSRx      = 0x04
+	ModeRx        = 0x05 // LoRa: RxContinuous, FSK: Rx
+	ModeRxSingle  = 0x06 // LoRa only
+	ModeCAD       = 0x07 // LoRa only
+	LongRangeMode = 0x80
+)
+
+// LoRa IRQ flags (RegIrqFlags).
+const (
+	IrqRxTimeout         = 0x80
+	IrqRxDone            = 0x40
+	IrqPayloadCrcError   = 0x20
+	IrqValidHeader       = 0x10
+	IrqTxDone            = 0x08
+	IrqCadDone           = 0x04
+	IrqFhssChangeChannel = 0x02
+	IrqCadDetected       = 0x01
+)
+
+// FSK IRQ flags (RegIrqFlags2).
+const (
+	IrqFifoFull     = 0x80
+	IrqFifoEmpty    = 0x40
+	IrqFifoLevel    = 0x20
+	IrqFifoOverrun  = 0x10
+	IrqPacketSent   = 0x08
+	IrqPayloadReady = 0x04
+	IrqCrcOk        = 0x02
+	IrqLowBat       = 0x01
+)
+
+const (
+	regFifo            = 0x00
+	regOpMode          = 0x01
+	regBitrateMsb      = 0x02
+	regBitrateLsb      = 0x03
+	regFdevMsb         = 0x04
+	regFdevLsb         = 0x05
+	regFrfMsb          = 0x06
+	regFrfMid          = 0x07
+	regFrfLsb          = 0x08
+	regPaConfig        = 0x09
+	regFifoAddrPtr     = 0x0D // LoRa
+	regFifoTxBaseAddr  = 0x0E // LoRa
+	regFifoRxBaseAddr  = 0x0F // LoRa
+	regFifoRxCurrent   = 0x10 // LoRa
+	regRssiValueFsk    = 0x11 // FSK
+	regIrqFlags        = 0x12 // LoRa
+	regRxNbBytes       = 0x13 // LoRa
+	regPktSnrValue     = 0x19 // LoRa
+	regPktRssiValue    = 0x1A // LoRa
+	regRssiValueLora   = 0x1B // LoRa
+	regHopChannel      = 0x1C // LoRa
+	regModemConfig1    = 0x1D // LoRa
+	regFeiMsbFsk       = 0x1D // FSK
+	regModemConfig2    = 0x1E // LoRa
+	regFeiLsbFsk       = 0x1E // FSK
+	regPreambleMsbLora = 0x20 // LoRa
+	regPreambleLsbLora = 0x21 // LoRa
+	regPayloadLenLora  = 0x22 // LoRa
+	regPreambleMsbFsk  = 0x25 // FSK
+	regPreambleLsbFsk  = 0x26 // FSK
+	regModemConfig3    = 0x26 // LoRa
+	regSyncConfig      = 0x27 // FSK
+	regFeiMsbLora      = 0x28 // LoRa
+	regFeiMidLora      = 0x29 // LoRa
+	regFeiLsbLora      = 0x2A // LoRa
+	regPacketConfig1   = 0x30 // FSK
+	regPayloadLenFsk   = 0x32 // FSK
+	regInvertIQ        = 0x33 // LoRa
+	regSyncWord        = 0x39 // LoRa
+	regIrqFlags1       = 0x3E // FSK
+	regIrqFlags2       = 0x3F // FSK
+	regDioMapping1     = 0x40
+	regVersion         = 0x42
+)
+
+// Emulator is an emulated SX1272 or SX1276 chip.
+type Emulator struct {
+	mu      sync.Mutex
+	version byte
+
+	// registers 0x00 - 0x0C and 0x40 - 0x7F are shared between the LoRa and FSK modem,
+	// registers 0x0D - 0x3F depend on the LongRangeMode bit in RegOpMode
+	common [0x80]byte
+	lora   [0x40]byte
+	fsk    [0x40]byte
+
+	fifo    [256]byte // LoRa FIFO data buffer
+	fskFifo []byte    // FSK FIFO
+	fskTx   []byte    // FSK bytes that have been shifted out of the FIFO during Tx
+	fskRx   []byte    // FSK bytes of the packet being received that are not in the FIFO yet
+	fskCRC  bool      // CRC of the packet being received is correct
+
+	sent []*Frame
+
+	activity bool // a LoRa preamble is on the air, see SetActivity
+	rssi     int  // RSSI of the channel in dBm, see SetRSSI
+
+	dio0 *gpiotest.Pin
+	dio1 *gpiotest.Pin
+}
+
+// Frame is a packet that has been transmitted by the emulated chip,
+// together with the radio settings at the time of the transmission.
+type Frame struct {
+	Time  time.Time
+	Modem string // "LORA" or "FSK"
+	Freq  uint32 // Hz
+
+	PaConfig byte // RegPaConfig
+
+	CRC bool
+
+	// LoRa only
+	SF             uint32
+	BW             uint32 // Hz
+	CR             uint8  // coding rate 4/CR: 5 .. 8
+	ImplicitHeader bool
+	InvertIQ       bool
+	SyncWord       byte
+
+	// FSK only
+	Bitrate uint32 // bits per second
+	FreqDev uint32 // Hz
+
+	Preamble uint16 // preamble length in symbols (LoRa) or bytes (FSK)
+
+	Data []byte
+}
+
+// Packet is a packet to be received by the emulated chip.
+type Packet struct {
+	Freq uint32 // Hz, 0 to match any frequency
+	SF   uint32 // LoRa spreading factor, 0 to match any spreading factor
+
+	RSSI       int     // dBm, the signal strength
+	SNR        float32 // dB, LoRa only
+	FreqOffset int32   // Hz, as estimated by the modem
+	NoCRC      bool    // packet was sent without CRC
+	CRCError   bool    // packet was sent with CRC but CRC is incorrect
+
+	Data []byte
+}
+
+// ErrNotReceiving is returned by Receive if the chip is not in receive mode
+// or is tuned to a different frequency or spreading factor.
+var ErrNotReceiving = errors.New("emu: chip is not receiving")
+
+// fifoSizeFSK is the size of the FSK FIFO in bytes.
+const fifoSizeFSK = 64
+
+var bandwidthsSX1276 = []uint32{7800, 10400, 15600, 20800, 31250, 41700, 62500, 125000, 250000, 500000}
+var bandwidthsSX1272 = []uint32{125000, 250000, 500000}
+
+// New creates a new emulated chip with the given version (VersionSX1272 or VersionSX1276).
+// All registers are at their reset values.
+func New(version byte) *Emulator {
+	e := &Emulator{
+		version: version,
+		dio0: &gpiotest.Pin{
+			N:         "DIO0",
+			EdgesChan: make(chan gpio.Level, 16),
+		},
+		dio1: &gpiotest.Pin{
+			N:         "DIO1",
+			EdgesChan: make(chan gpio.Level, 16),
+		},
+		rssi: -120,
+	}
+	e.Reset()
+	return e
+}
+
+var _ spi.Conn = (*Emulator)(nil)
+
+// Reset sets all registers to the reset values of the chip and clears the FIFO.
+// Transmitted frames are kept.
+func (e *Emulator) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.common = [0x80]byte{}
+	e.lora = [0x40]byte{}
+	e.fsk = [0x40]byte{}
+	e.fifo = [256]byte{}
+	e.fskFifo = nil
+	e.fskTx = nil
+	e.fskRx = nil
+
+	c := &e.common
+	c[regOpMode] = ModeStandby
+	c[regBitrateMsb] = 0x1A
+	c[regBitrateLsb] = 0x0B
+	c[regFdevLsb] = 0x52
+	c[regFrfMsb] = 0x6C
+	c[regFrfMid] = 0x80
+	c[regPaConfig] = 0x4F
+	c[0x0A] = 0x09 // RegPaRamp
+	c[0x0B] = 0x2B // RegOcp
+	c[0x0C] = 0x20 // RegLna
+	c[regVersion] = e.version
+	if e.version == VersionSX1272 {
+		c[regPaConfig] = 0x0F
+		c[0x5A] = 0x84 // RegPaDac
+	} else {
+		c[regOpMode] |= 0x08 // LowFrequencyModeOn
+		c[0x4D] = 0x84       // RegPaDac
+	}
+
+	l := &e.lora
+	l[regFifoTxBaseAddr] = 0x80
+	l[regModemConfig2] = 0x70
+	l[0x1F] = 0x64 // RegSymbTimeoutLsb
+	l[regPreambleLsbLora] = 0x08
+	l[regPayloadLenLora] = 0x01
+	l[0x23] = 0xFF // RegMaxPayloadLength
+	l[0x31] = 0xC3 // RegDetectOptimize
+	l[regInvertIQ] = 0x27
+	l[0x37] = 0x0A // RegDetectionThreshold
+	l[regSyncWord] = 0x12
+	l[0x3B] = 0x1D // RegInvertIQ2
+	if e.version == VersionSX1272 {
+		l[regModemConfig1] = 0x08
+	} else {
+		l[regModemConfig1] = 0x72
+		l[regModemConfig3] = 0x04
+	}
+
+	f := &e.fsk
+	f[0x0D] = 0x0E // RegRxConfig
+	f[0x0E] = 0x02 // RegRssiConfig
+	f[0x12] = 0x15 // RegRxBw
+	f[0x13] = 0x0B // RegAfcBw
+	f[regPreambleLsbFsk] = 0x03
+	f[regSyncConfig] = 0x93
+	for i := 0x28; i <= 0x2F; i++ {
+		f[i] = 0x01 // RegSyncValue1-8
+	}
+	f[regPacketConfig1] = 0x90
+	f[0x31] = 0x40 // RegPacketConfig2
+	f[regPayloadLenFsk] = 0x40
+	f[0x35] = 0x0F // RegFifoThresh
+	f[0x3B] = 0x82 // RegImageCal
+	f[regIrqFlags1] = 0x80
+	f[regIrqFlags2] = IrqFifoEmpty
+
+	e.updateDIO()
+}
+
+// String implements conn.Resource.
+func (e *Emulator) String() string {
+	switch e.version {
+	case VersionSX1272:
+		return "emu.SX1272"
+	case VersionSX1276:
+		return "emu.SX1276"
+	}
+	return fmt.Sprintf("emu.SX127X(0x%x)", e.version)
+}
+
+// Duplex implements conn.Conn.
+func (e *Emulator) Duplex() conn.Duplex {
+	return conn.Full
+}
+
+// Tx implements conn.Conn.
+// The first byte of w is the register address with the MSB set for write access.
+// All following bytes are written to (or read from) consecutive registers,
+// except for the FIFO register which is accessed repeatedly.
+func (e *Emulator) Tx(w, r []byte) error {
+	if len(w) == 0 {
+		return nil
+	}
+	if r != nil && len(r) != len(w) {
+		return fmt.Errorf("emu: r and w must have the same length: %d != %d", len(r), len(w))
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	addr := w[0] & 0x7F
+	write := w[0]&0x80 != 0
+	if r != nil {
+		r[0] = 0
+	}
+	for i := 1; i < len(w); i++ {
+		if write {
+			e.write(addr, w[i])
+			if r != nil {
+				r[i] = 0
+			}
+		} else {
+			v := e.read(addr)
+			if r != nil {
+				r[i] = v
+			}
+		}
+		if addr != regFifo {
+			addr = (addr + 1) & 0x7F
+		}
+	}
+	e.updateDIO()
+	return nil
+}
+
+// TxPackets implements spi.Conn.
+func (e *Emulator) TxPackets(p []spi.Packet) error {
+	for _, pkt := range p {
+		if err := e.Tx(pkt.W, pkt.R); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Emulator) isLoRa() bool {
+	return e.common[regOpMode]&LongRangeMode != 0
+}
+
+func (e *Emulator) mode() byte {
+	return e.common[regOpMode] & 0x07
+}
+
+func (e *Emulator) reg(addr byte) *byte {
+	if addr < 0x0D || addr >= 0x40 {
+		return &e.common[addr]
+	}
+	if e.isLoRa() {
+		return &e.lora[addr]
+	}
+	return &e.fsk[addr]
+}
+
+func (e *Emulator) read(addr byte) byte {
+	if addr == regFifo {
+		if e.isLoRa() {
+			ptr := e.lora[regFifoAddrPtr]
+			e.lora[regFifoAddrPtr]++
+			return e.fifo[ptr]
+		}
+		if len(e.fskFifo) == 0 {
+			return 0
+		}
+		v := e.fskFifo[0]
+		e.fskFifo = e.fskFifo[1:]
+		e.receiveFSK()
+		e.updateFifoFlags()
+		return v
+	}
+	if addr == regRssiValueLora && e.isLoRa() {
+		return byte(e.rssi + e.rssiOffset())
+	}
+	return *e.reg(addr)
+}
+
+func (e *Emulator) write(addr byte, v byte) {
+	switch addr {
+	case regFifo:
+		if e.isLoRa() {
+			ptr := e.lora[regFifoAddrPtr]
+			e.lora[regFifoAddrPtr]++
+			e.fifo[ptr] = v
+		} else {
+			e.fskFifo = append(e.fskFifo, v)
+			if e.mode() == ModeTx {
+				e.transmitFSK()
+			}
+			e.updateFifoFlags()
+		}
+		return
+	case regOpMode:
+		e.setOpMode(v)
+		return
+	case regVersion:
+		return // read only
+	}
+
+	if e.isLoRa() {
+		switch addr {
+		case regIrqFlags:
+			e.lora[regIrqFlags] &^= v // write 1 to clear
+			return
+		case regFifoRxCurrent, regRxNbBytes, 0x14, 0x15, 0x16, 0x17, 0x18,
+			regPktSnrValue, regPktRssiValue, regRssiValueLora, regHopChannel, 0x25:
+			return // read only
+		}
+	} else {
+		switch addr {
+		case regIrqFlags1, regIrqFlags2:
+			// only FifoOverrun, LowBat, SyncAddressMatch, PreambleDetect and Rssi can be cleared,
+			// we accept clearing all flags except the FIFO status
+			*e.reg(addr) &^= v &^ (IrqFifoFull | IrqFifoEmpty | IrqFifoLevel)
+			if addr == regIrqFlags2 && v&IrqFifoOverrun != 0 {
+				e.fskFifo = nil
+				e.updateFifoFlags()
+			}
+			return
+		case regRssiValueFsk:
+			return // read only
+		}
+	}
+	*e.reg(addr) = v
+}
+
+func (e *Emulator) setOpMode(v byte) {
+	cur := e.common[regOpMode]
+	if cur&0x07 != ModeSleep {
+		// LongRangeMode can only be changed in sleep mode
+		v = (v &^ LongRangeMode) | (cur & LongRangeMode)
+	}
+	e.common[regOpMode] = v
+	if v&LongRangeMode != cur&LongRangeMode {
+		e.fskFifo = nil
+		e.updateFifoFlags()
+	}
+	if v&0x07 != ModeRx && len(e.fskRx) != 0 {
+		// the reception of the packet is aborted
+		e.fskRx = nil
+		e.fskFifo = nil
+		e.updateFifoFlags()
+	}
+
+	if v&0x07 == ModeCAD && cur&0x07 != ModeCAD && e.isLoRa() {
+		// the CAD is done immediately, the chip gets back to standby mode
+		e.lora[regIrqFlags] |= IrqCadDone
+		if e.activity {
+			e.lora[regIrqFlags] |= IrqCadDetected
+		}
+		e.common[regOpMode] = (v &^ 0x07) | ModeStandby
+	}
+
+	if v&0x07 == ModeTx && cur&0x07 != ModeTx {
+		if e.isLoRa() {
+			e.transmit()
+		} else {
+			e.fskTx = e.fskTx[:0]
+			e.transmitFSK()
+		}
+	}
+}
+
+// transmitFSK shifts the FSK FIFO out and transmits the packet as soon as it is complete.
+func (e *Emulator) transmitFSK() {
+	e.fskTx = append(e.fskTx, e.fskFifo...)
+	e.fskFifo = e.fskFifo[:0]
+	e.updateFifoFlags()
+	length := int(e.fsk[regPayloadLenFsk])
+	if e.fsk[regPacketConfig1]&0x80 != 0 {
+		// variable length packet: the first byte is the length
+		if len(e.fskTx) == 0 {
+			return
+		}
+		length = int(e.fskTx[0]) + 1
+	}
+	if len(e.fskTx) >= length {
+		e.transmit()
+	}
+}
+
+func (e *Emulator) updateFifoFlags() {
+	f := &e.fsk[regIrqFlags2]
+	*f &^= IrqFifoFull | IrqFifoEmpty | IrqFifoLevel
+	n := len(e.fskFifo)
+	if n == 0 {
+		*f |= IrqFifoEmpty
+	}
+	if n >= fifoSizeFSK {
+		*f |= IrqFifoFull
+	}
+	if n > int(e.fsk[0x35]&0x3F) {
+		*f |= IrqFifoLevel
+	}
+}
+
+func (e *Emulator) transmit() {
+	frame := &Frame{
+		Time:     time.Now(),
+		Freq:     e.freq(),
+		PaConfig: e.common[regPaConfig],
+	}
+	if e.isLoRa() {
+		frame.Modem = "LORA"
+		e.loraSettings(frame)
+		base := e.lora[regFifoTxBaseAddr]
+		length := int(e.lora[regPayloadLenLora])
+		frame.Data = make([]byte, length)
+		for i := 0; i < length; i++ {
+			frame.Data[i] = e.fifo[byte(int(base)+i)]
+		}
+		e.lora[regIrqFlags] |= IrqTxDone
+	} else {
+		frame.Modem = "FSK"
+		e.fskSettings(frame)
+		data := e.fskTx
+		if e.fsk[regPacketConfig1]&0x80 != 0 {
+			data = data[1 : int(data[0])+1]
+		} else {
+			data = data[:e.fsk[regPayloadLenFsk]]
+		}
+		frame.Data = append([]byte(nil), data...)
+		e.fskTx = e.fskTx[:0]
+		e.fsk[regIrqFlags2] |= IrqPacketSent
+	}
+	e.sent = append(e.sent, frame)
+	// the chip returns to standby after the packet has been sent
+	e.common[regOpMode] = (e.common[regOpMode] &^ 0x07) | ModeStandby
+}
+
+func (e *Emulator) freq() uint32 {
+	frf := uint64(e.common[regFrfMsb])<<16 | uint64(e.common[regFrfMid])<<8 | uint64(e.common[regFrfLsb])
+	return uint32((frf * 32000000) >> 19)
+}
+
+func (e *Emulator) loraSettings(f *Frame) {
+	l := &e.lora
+	mc1 := l[regModemConfig1]
+	mc2 := l[regModemConfig2]
+	f.SF = uint32(mc2 >> 4)
+	if e.version == VersionSX1272 {
+		if bw := int(mc1 >> 6); bw < len(bandwidthsSX1272) {
+			f.BW = bandwidthsSX1272[bw]
+		}
+		f.CR = (mc1>>3)&0x07 + 4
+		f.ImplicitHeader = mc1&0x04 != 0
+		f.CRC = mc1&0x02 != 0
+	} else {
+		if bw := int(mc1 >> 4); bw < len(bandwidthsSX1276) {
+			f.BW = bandwidthsSX1276[bw]
+		}
+		f.CR = (mc1>>1)&0x07 + 4
+		f.ImplicitHeader = mc1&0x01 != 0
+		f.CRC = mc2&0x04 != 0
+	}
+	f.InvertIQ = l[regInvertIQ]&0x01 == 0
+	f.SyncWord = l[regSyncWord]
+	f.Preamble = uint16(l[regPreambleMsbLora])<<8 | uint16(l[regPreambleLsbLora])
+}
+
+func (e *Emulator) fskSettings(f *Frame) {
+	br := uint32(e.common[regBitrateMsb])<<8 | uint32(e.common[regBitrateLsb])
+	if br != 0 {
+		f.Bitrate = 32000000 / br
+	}
+	fdev := uint64(e.common[regFdevMsb]&0x3F)<<8 | uint64(e.common[regFdevLsb])
+	f.FreqDev = uint32((fdev * 32000000) >> 19)
+	f.Preamble = uint16(e.fsk[regPreambleMsbFsk])<<8 | uint16(e.fsk[regPreambleLsbFsk])
+	f.CRC = e.fsk[regPacketConfig1]&0x10 != 0
+}
+
+// Receive simulates the reception of a packet.
+// The chip must be in receive mode and, if set in the packet, tuned to the packet's
+// frequency and spreading factor, or ErrNotReceiving is returned.
+func (e *Emulator) Receive(pkt *Packet) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if pkt.Freq != 0 && pkt.Freq != e.freq() {
+		return ErrNotReceiving
+	}
+
+	if e.isLoRa() {
+		mode := e.mode()
+		if mode != ModeRx && mode != ModeRxSingle {
+			return ErrNotReceiving
+		}
+		if pkt.SF != 0 && pkt.SF != uint32(e.lora[regModemConfig2]>>4) {
+			return ErrNotReceiving
+		}
+		l := &e.lora
+		base := l[regFifoRxBaseAddr]
+		for i, b := range pkt.Data {
+			e.fifo[byte(int(base)+i)] = b
+		}
+		l[regFifoRxCurrent] = base
+		l[regRxNbBytes] = byte(len(pkt.Data))
+		l[regPktSnrValue] = byte(int8(pkt.SNR * 4))
+		// inverse of "5.5.5. RSSI and SNR in LoRa Mode" of the SX1276 datasheet
+		rssi := pkt.RSSI + e.rssiOffset()
+		if pkt.SNR < 0 {
+			rssi -= int(pkt.SNR)
+		} else if e.version == VersionSX1276 {
+			rssi = rssi * 15 / 16
+		}
+		l[regPktRssiValue] = byte(rssi)
+		var frame Frame
+		e.loraSettings(&frame)
+		if frame.BW != 0 {
+			// FreqError = Ferr * Fxosc / 2^24 * 500 kHz / BW
+			fei := int64(pkt.FreqOffset) * 32000000 * 500000 / (int64(frame.BW) << 24)
+			l[regFeiMsbLora] = byte(fei>>16) & 0x0F
+			l[regFeiMidLora] = byte(fei >> 8)
+			l[regFeiLsbLora] = byte(fei)
+		}
+		if pkt.NoCRC {
+			l[regHopChannel] &^= 0x40
+		} else {
+			l[regHopChannel] |= 0x40
+		}
+		l[regIrqFlags] |= IrqValidHeader | IrqRxDone
+		if pkt.CRCError && !pkt.NoCRC {
+			l[regIrqFlags] |= IrqPayloadCrcError
+		}
+		if mode == ModeRxSingle {
+			e.common[regOpMode] = (e.common[regOpMode] &^ 0x07) | ModeStandby
+		}
+		e.updateDIO()
+		return nil
+	}
+
+	if e.mode() != ModeRx {
+		return ErrNotReceiving
+	}
+	f := &e.fsk
+	if f[regPacketConfig1]&0x80 != 0 && len(pkt.Data) > int(f[regPayloadLenFsk]) {
+		// variable length packets longer than PayloadLength are discarded by the chip
+		return nil
+	}
+	e.fskFifo = e.fskFifo[:0]
+	e.fskRx = e.fskRx[:0]
+	if f[regPacketConfig1]&0x80 != 0 {
+		// variable length packet
+		e.fskRx = append(e.fskRx, byte(len(pkt.Data)))
+	}
+	e.fskRx = append(e.fskRx, pkt.Data...)
+	e.fskCRC = !pkt.CRCError
+	f[regRssiValueFsk] = byte(-pkt.RSSI * 2)
+	// FeiValue = Ferr / Fstep
+	fei := int64(pkt.FreqOffset) << 19 / 32000000
+	f[regFeiMsbFsk] = byte(fei >> 8)
+	f[regFeiLsbFsk] = byte(fei)
+	e.receiveFSK()
+	e.updateFifoFlags()
+	e.updateDIO()
+	return nil
+}
+
+// receiveFSK moves the bytes of the packet being received into the FIFO, as far as there is room.
+// The bytes are assumed to be received as fast as the FIFO is read: it never overruns, but a packet
+// longer than the FIFO is only complete (PayloadReady) once the FIFO has been drained.
+func (e *Emulator) receiveFSK() {
+	if len(e.fskRx) == 0 {
+		return
+	}
+	n := fifoSizeFSK - len(e.fskFifo)
+	if n > len(e.fskRx) {
+		n = len(e.fskRx)
+	}
+	e.fskFifo = append(e.fskFifo, e.fskRx[:n]...)
+	e.fskRx = e.fskRx[n:]
+	if len(e.fskRx) == 0 {
+		e.fsk[regIrqFlags2] |= IrqPayloadReady
+		if e.fskCRC {
+			e.fsk[regIrqFlags2] |= IrqCrcOk
+		}
+	}
+}
+
+// DIO0 returns the pin that is connected to the DIO0 line of the emulated chip.
+// It can be given to SX127X.Chip.SetDIO0. A rising edge is signaled whenever the
+// IRQ flag that is mapped to DIO0 in RegDioMapping1 is set.
+func (e *Emulator) DIO0() *gpiotest.Pin {
+	return e.dio0
+}
+
+// dio0Level returns the level of DIO0 according to RegDioMapping1 and the IRQ flags.
+func (e *Emulator) dio0Level() gpio.Level {
+	mapping := e.common[regDioMapping1] >> 6
+	if e.isLoRa() {
+		flags := e.lora[regIrqFlags]
+		switch mapping {
+		case 0:
+			return flags&IrqRxDone != 0
+		case 1:
+			return flags&IrqTxDone != 0
+		case 2:
+			return flags&IrqCadDone != 0
+		}
+		return gpio.Low
+	}
+	if mapping == 0 {
+		flags := e.fsk[regIrqFlags2]
+		return flags&(IrqPayloadReady|IrqPacketSent) != 0
+	}
+	return gpio.Low
+}
+
+func (e *Emulator) updateDIO() {
+	updatePin(e.dio0, e.dio0Level())
+	updatePin(e.dio1, e.dio1Level())
+}
+
+// DIO1 returns the pin that is connected to the DIO1 line of the emulated chip.
+// It can be given to SX127X.Chip.SetDIO1. Only the default mapping is emulated:
+// FifoLevel (FSK) and RxTimeout (LoRa).
+func (e *Emulator) DIO1() *gpiotest.Pin {
+	return e.dio1
+}
+
+// dio1Level returns the level of DIO1 according to RegDioMapping1 and the IRQ flags.
+func (e *Emulator) dio1Level() gpio.Level {
+	if (e.common[regDioMapping1]>>4)&0x03 != 0 {
+		return gpio.Low
+	}
+	if e.isLoRa() {
+		return e.lora[regIrqFlags]&IrqRxTimeout != 0
+	}
+	return e.fsk[regIrqFlags2]&IrqFifoLevel != 0
+}
+
+// updatePin sets the level of a DIO pin and signals rising edges.
+func updatePin(pin *gpiotest.Pin, l gpio.Level) {
+	if l == pin.Read() {
+		return
+	}
+	if l == gpio.High {
+		select {
+		case pin.EdgesChan <- gpio.High:
+		default:
+		}
+	}
+	pin.Out(l)
+}
+
+func (e *Emulator) rssiOffset() int {
+	if e.version == VersionSX1272 {
+		return 139
+	}
+	if e.freq() < 779000000 {
+		return 164
+	}
+	return 157
+}
+
+// SetActivity sets whether a LoRa preamble is on the air.
+// If set, CAD reports CadDetected.
+func (e *Emulator) SetActivity(activity bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.activity = activity
+}
+
+// SetRSSI sets the RSSI of the channel in dBm, as read from RegRssiValue.
+// The default is -120 dBm.
+func (e *Emulator) SetRSSI(rssi int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rssi = rssi
+	e.fsk[regRssiValueFsk] = byte(-rssi * 2)
+}
+
+// Sent returns all frames that have been transmitted so far.
+func (e *Emulator) Sent() []*Frame {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	frames := make([]*Frame, len(e.sent))
+	copy(frames, e.sent)
+	return frames
+}
+
+// Register returns the value of a register without the side effects of a SPI read.
+// Registers 0x0D - 0x3F are taken from the bank of the current modem (LoRa or FSK).
+func (e *Emulator) Register(addr byte) byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return *e.reg(addr & 0x7F)
+}
+
+// SetRegister sets the value of a register without the side effects of a SPI write,
+// e.g. to simulate a hardware fault.
+func (e *Emulator) SetRegister(addr byte, v byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	*e.reg(addr & 0x7F) = v
+}
+
+// Mode returns the current mode (bits 2-0 of RegOpMode) and whether the LoRa modem is active.
+func (e *Emulator) Mode() (mode byte, lora bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.mode(), e.isLoRa()
+}
+
+// Freq returns the frequency in Hz the chip is tuned to.
+func (e *Emulator) Freq() uint32 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.freq()
+}
@@ -0,0 +1,314 @@
+package SX127X
+
+import (
+	"fmt"
+	"time"
+)
+
+// FSK settings as used by LoRaWAN (e.g. EU868 DR7).
+const (
+	DefaultFSKBitrate  = 50000 // bits per second
+	DefaultFSKFreqDev  = 25000 // Hz
+	DefaultFSKPreamble = 5     // bytes
+)
+
+// FSKSyncWord is the LoRaWAN FSK sync word.
+var FSKSyncWord = []byte{0xC1, 0x94, 0xC1}
+
+const fskFifoSize = 64
+
+// SetFSK switches the chip to the FSK modem.
+func (c *Chip) SetFSK() error {
+
+	c.Log(LogLevelDebug, "Starting 'SetFSK'.")
+
+	var st0 byte
+	for retry := 0; retry < 5; retry++ {
+		c.writeRegister(REG_OP_MODE, LORA_SLEEP_MODE) // Sleep mode (mandatory to change the modem)
+		c.writeRegister(REG_OP_MODE, FSK_SLEEP_MODE)  // FSK sleep mode
+		c.writeRegister(REG_OP_MODE, FSK_STANDBY_MODE)
+		delay(10 + 10*retry)
+		st0, _ = c.readRegister(REG_OP_MODE)
+		if st0&0x87 == FSK_STANDBY_MODE {
+			c.mode = ModemFSK
+			c.Log(LogLevelVerbose, "FSK mode has been successfully set.")
+			return nil
+		}
+	}
+	return fmt.Errorf("could not enable FSK mode: RegOpMode 0x%x", st0)
+}
+
+// fskRxBw returns the RegRxBw value for the smallest single side bandwidth >= bw (Hz).
+func fskRxBw(bw uint32) byte {
+	for exp := uint(7); exp >= 1; exp-- {
+		for m, mant := range []uint32{24, 20, 16} {
+			if 32000000/(mant<<(exp+2)) >= bw {
+				return byte(2-m)<<3 | byte(exp)
+			}
+		}
+	}
+	return 0x01 // 500 kHz
+}
+
+// SetFSKParams sets the FSK bitrate (bits per second), frequency deviation (Hz) and preamble length (bytes).
+// The receiver bandwidth is derived from the bitrate and frequency deviation.
+func (c *Chip) SetFSKParams(bitrate uint32, fdev uint32, preamble uint16) (err error) {
+
+	c.Log(LogLevelDebug, "Starting 'SetFSKParams'.")
+
+	if c.mode != ModemFSK {
+		return fmt.Errorf("FSK parameters can only be set in FSK mode")
+	}
+	if bitrate < 1200 || bitrate > 300000 {
+		return fmt.Errorf("invalid FSK bitrate: %d", bitrate)
+	}
+	if fdev == 0 || fdev > 200000 {
+		return fmt.Errorf("invalid FSK frequency deviation: %d", fdev)
+	}
+
+	st0, _ := c.readRegister(REG_OP_MODE) // Save the previous status
+	c.writeRegister(REG_OP_MODE, FSK_STANDBY_MODE)
+
+	br := uint16(32000000 / bitrate)
+	fd := uint16((uint64(fdev) << 19) / 32000000)
+	// RegBitrateMsb, RegBitrateLsb, RegFdevMsb and RegFdevLsb are contiguous
+	c.writeRegisters(REG_BITRATE_MSB, []byte{byte(br >> 8), byte(br), byte(fd>>8) & 0x3F, byte(fd)})
+
+	rxBw := fskRxBw(fdev + bitrate/2)
+	c.writeRegister(REG_RX_BW, rxBw)
+	c.writeRegister(REG_AFC_BW, rxBw)
+
+	c.writeRegisters(REG_PREAMBLE_MSB_FSK, []byte{byte(preamble >> 8), byte(preamble)})
+
+	v, _ := c.readRegisters(REG_BITRATE_MSB, 2)
+	if got := uint16(v[0])<<8 | uint16(v[1]); got != br {
+		c.Log(LogLevelError, "Can not set FSK bitrate: expected 0x%x, got 0x%x", br, got)
+		err = fmt.Errorf("can not set FSK bitrate")
+	} else {
+		c.bitrate = bitrate
+		c.Log(LogLevelVerbose, "FSK bitrate %d, fdev %d Hz, preamble %d has been successfully set.", bitrate, fdev, preamble)
+	}
+
+	c.writeRegister(REG_OP_MODE, st0) // Getting back to previous status
+	return
+}
+
+// setFSKPacketConfig sets up the FSK packet engine: variable length packets,
+// DC-free whitening, optional CRC and the LoRaWAN sync word.
+func (c *Chip) setFSKPacketConfig(crc bool) (err error) {
+
+	c.Log(LogLevelDebug, "Starting 'setFSKPacketConfig'.")
+
+	st0, _ := c.readRegister(REG_OP_MODE) // Save the previous status
+	c.writeRegister(REG_OP_MODE, FSK_STANDBY_MODE)
+
+	// AfcAutoOn, AgcAutoOn, RxTrigger = PreambleDetect
+	c.writeRegister(REG_RX_CONFIG, 0x1E)
+	// PreambleDetectorOn, 2 bytes, 10 chips tolerance
+	c.writeRegister(REG_PREAMBLE_DETECT, 0xAA)
+
+	// AutoRestartRxMode = on without PLL lock wait, SyncOn, SyncSize = len-1
+	c.writeRegister(REG_SYNC_CONFIG, 0x50|byte(len(FSKSyncWord)-1))
+	c.writeRegisters(REG_SYNC_VALUE1, FSKSyncWord)
+
+	// PacketFormat = variable, DcFree = whitening, AddressFiltering = none
+	config1 := byte(0x80 | 0x40)
+	if crc {
+		config1 |= 0x10 // CrcOn
+	}
+	c.writeRegister(REG_PACKET_CONFIG1, config1)
+	// DataMode = packet
+	c.writeRegister(REG_PACKET_CONFIG2, 0x40)
+	// TxStartCondition = FifoNotEmpty, FifoThreshold = 31
+	c.writeRegister(REG_FIFO_THRESH, 0x80|0x1F)
+
+	v, _ := c.readRegister(REG_PACKET_CONFIG1)
+	if v != config1 {
+		c.Log(LogLevelError, "Can not set FSK packet config: expected 0x%x, got 0x%x", config1, v)
+		err = fmt.Errorf("can not set FSK packet config")
+	}
+
+	c.writeRegister(REG_OP_MODE, st0) // Getting back to previous status
+	return
+}
+
+// configureFSK switches to the FSK modem and sets it up for LoRaWAN style FSK packets.
+// Zero values are replaced by the defaults.
+func (c *Chip) configureFSK(bitrate uint32, fdev uint32, preamble uint16, crc bool) error {
+	if c.mode != ModemFSK {
+		if err := c.SetFSK(); err != nil {
+			return err
+		}
+	}
+	if bitrate == 0 {
+		bitrate = DefaultFSKBitrate
+	}
+	if fdev == 0 {
+		fdev = DefaultFSKFreqDev
+	}
+	if preamble == 0 {
+		preamble = DefaultFSKPreamble
+	}
+	if err := c.SetFSKParams(bitrate, fdev, preamble); err != nil {
+		return err
+	}
+	return c.setFSKPacketConfig(crc)
+}
+
+func (c *Chip) getRSSIFSK() (rssi int16, err error) {
+	c.Log(LogLevelDebug, "Starting 'getRSSIFSK'.")
+	v, err := c.readRegister(REG_RSSI_VALUE_FSK)
+	rssi = -int16(v) / 2
+	c.Log(LogLevelVerbose, "RSSI value is %d.", rssi)
+	return
+}
+
+// errFifoOverrun is returned if an FSK packet has been lost because the FIFO was not drained in time.
+var errFifoOverrun = fmt.Errorf("FSK FIFO overrun")
+
+// getPacketFSK reads a variable length packet from the FSK FIFO.
+// Packets longer than the FIFO are read while receiving: the FIFO is drained whenever it is
+// filled above the threshold (FifoLevel), until the packet is complete (PayloadReady).
+func (c *Chip) getPacketFSK() (data []byte, crc int8, err error) {
+
+	value, _ := c.readRegister(REG_IRQ_FLAGS2)
+	if value&(Bit2|Bit5) == 0 {
+		// neither PayloadReady nor FifoLevel
+		return nil, 0, nil
+	}
+
+	// the longest packet, with preamble and sync word, plus some margin
+	bitrate := c.bitrate
+	if bitrate == 0 {
+		bitrate = DefaultFSKBitrate
+	}
+	var exitTime = time.Now().Add(time.Second*(MAX_LENGTH+16)*8/time.Duration(bitrate) + 10*time.Millisecond)
+
+	for value&Bit2 == 0 {
+		if value&Bit4 != 0 {
+			break
+		}
+		if value&Bit5 != 0 {
+			// FifoLevel: more than 31 bytes in the FIFO
+			b, err := c.readRegisters(REG_FIFO, fskFifoSize/2)
+			if err != nil {
+				return nil, 0, err
+			}
+			data = append(data, b...)
+		} else if time.Now().After(exitTime) {
+			c.Log(LogLevelError, "Timeout has expired while receiving FSK packet.")
+			c.writeRegister(REG_OP_MODE, FSK_STANDBY_MODE)
+			c.clearFlags()
+			return nil, 0, ErrTimeout
+		} else {
+			time.Sleep(time.Millisecond)
+		}
+		value, _ = c.readRegister(REG_IRQ_FLAGS2)
+	}
+	if value&Bit4 != 0 {
+		c.Log(LogLevelError, "FSK FIFO overrun, packet lost.")
+		c.writeRegister(REG_OP_MODE, FSK_STANDBY_MODE)
+		c.clearFlags() // FifoOverrun: clears the FIFO
+		return nil, 0, errFifoOverrun
+	}
+
+	config1, _ := c.readRegister(REG_PACKET_CONFIG1)
+	if config1&0x10 == 0 {
+		crc = 0
+		c.Log(LogLevelDebug, "Packet supposed to be correct as CRC is off.")
+	} else if value&Bit1 != 0 {
+		crc = 1
+		c.Log(LogLevelDebug, "Packet correctly received in FSK mode.")
+	} else {
+		crc = -1
+		c.Log(LogLevelDebug, "Packet incorrectly received in FSK mode.")
+	}
+
+	c.writeRegister(REG_OP_MODE, FSK_STANDBY_MODE) // Setting standby FSK mode
+
+	if len(data) == 0 {
+		// variable length packet: first byte is the length
+		if data, err = c.readRegisters(REG_FIFO, 1); err != nil {
+			return nil, 0, err
+		}
+	}
+	if n := 1 + int(data[0]) - len(data); n > 0 {
+		b, err := c.readRegisters(REG_FIFO, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		data = append(data, b...)
+	}
+	data = data[1 : 1+int(data[0])]
+	c.Log(LogLevelDebug, "Received: %v", data)
+
+	c.clearFlags() // Initializing flags
+	return
+}
+
+// sendFSKWithTimeout transmits a variable length FSK packet, starting at t (if not zero).
+// Packets longer than the FIFO are written while transmitting.
+func (c *Chip) sendFSKWithTimeout(payload []byte, wait uint16, t time.Time) (err error) {
+
+	c.Log(LogLevelDebug, "Starting 'sendFSKWithTimeout'.")
+
+	if len(payload) > MAX_LENGTH {
+		return fmt.Errorf("FSK payload too long: %d bytes", len(payload))
+	}
+
+	c.writeRegister(REG_OP_MODE, FSK_STANDBY_MODE)
+	c.clearFlags()
+
+	// the FIFO must be filled in standby, the transmission starts with the first byte in Tx mode
+	n := len(payload)
+	if n > fskFifoSize-1 {
+		n = fskFifoSize - 1
+	}
+	c.writeRegisters(REG_FIFO, append([]byte{byte(len(payload))}, payload[:n]...))
+	payload = payload[n:]
+
+	if err = waitUntil(t); err != nil {
+		c.Log(LogLevelError, "Can not send packet in time: %s late.", time.Since(t))
+		c.writeRegister(REG_IRQ_FLAGS2, Bit4) // FifoOverrun: clears the FIFO
+		return err
+	}
+
+	if err = c.setAntenna(false, true); err != nil {
+		return err
+	}
+	defer c.setAntenna(false, false)
+
+	var startTime = time.Now()
+	var exitTime = startTime.Add(time.Millisecond * time.Duration(wait))
+
+	c.writeRegister(REG_OP_MODE, FSK_TX_MODE) // FSK mode - Tx
+
+	value, _ := c.readRegister(REG_IRQ_FLAGS2)
+	for value&Bit3 == 0 && exitTime.After(time.Now()) {
+		if len(payload) != 0 && value&Bit5 == 0 {
+			// FifoLevel: less than 32 bytes in the FIFO
+			n := len(payload)
+			if n > fskFifoSize/2 {
+				n = fskFifoSize / 2
+			}
+			c.writeRegisters(REG_FIFO, payload[:n])
+			payload = payload[n:]
+		} else {
+			time.Sleep(time.Millisecond)
+		}
+		value, _ = c.readRegister(REG_IRQ_FLAGS2)
+	}
+
+	duration := time.Now().Sub(startTime)
+	c.Log(LogLevelNormal, "tx: %s", duration)
+
+	if value&Bit3 != 0 {
+		c.Log(LogLevelVerbose, "Packet successfully sent. %s", duration)
+	} else {
+		c.Log(LogLevelError, "Timeout has expired.")
+		err = ErrTimeout
+	}
+
+	c.clearFlags()
+	return
+}
@@ -0,0 +1,348 @@
+// Package basicstation implements the LNS protocol of LoRa Basics Station, that gateways use to
+// connect to a network server with WebSocket: the router-info discovery, the station version,
+// the router_config, the uplinks (updf, jreq and propdf), downlinks (dnmsg) and the dntxed
+// confirmations. See https://doc.sm.tc/station/tcproto.html.
+package basicstation
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/lora/lorawan"
+)
+
+// Message types (msgtype).
+const (
+	MsgVersion      = "version"
+	MsgRouterConfig = "router_config"
+	MsgUplinkData   = "updf"
+	MsgJoinRequest  = "jreq"
+	MsgProprietary  = "propdf"
+	MsgDownlink     = "dnmsg"
+	MsgTransmitted  = "dntxed"
+)
+
+// ProtocolVersion is the version of the LNS protocol.
+const ProtocolVersion = 2
+
+// Device classes (dC) of downlinks.
+const (
+	ClassA = 0
+	ClassB = 1
+	ClassC = 2
+)
+
+// EUI formats an EUI-64 like "01-23-45-67-89-AB-CD-EF".
+func EUI(eui uint64) string {
+	var b strings.Builder
+	for i := 7; i >= 0; i-- {
+		fmt.Fprintf(&b, "%02X", byte(eui>>(i*8)))
+		if i != 0 {
+			b.WriteByte('-')
+		}
+	}
+	return b.String()
+}
+
+// RouterInfoRequest is sent to the /router-info endpoint of the LNS to discover the traffic endpoint.
+type RouterInfoRequest struct {
+	Router string `json:"router"` // gateway EUI
+}
+
+// RouterInfo is the answer to a RouterInfoRequest.
+type RouterInfo struct {
+	Muxs  string `json:"muxs"`  // identifies the traffic endpoint
+	URI   string `json:"uri"`   // traffic endpoint, like wss://lns.example.com:8887/traffic/01-23-45-67-89-AB-CD-EF
+	Error string `json:"error"` // set if the gateway is not known to the LNS
+}
+
+// Version is the first message that the station sends on the traffic endpoint.
+type Version struct {
+	MsgType  string `json:"msgtype"` // MsgVersion
+	Station  string `json:"station"`
+	Firmware string `json:"firmware"`
+	Package  string `json:"package"`
+	Model    string `json:"model"`
+	Protocol int    `json:"protocol"`
+	Features string `json:"features"`
+}
+
+// RouterConfig is the answer of the LNS to the Version message, it sets the region and the
+// data rates of the station. Sx1301Conf is ignored by single channel gateways.
+type RouterConfig struct {
+	MsgType    string          `json:"msgtype"` // MsgRouterConfig
+	NetID      []int           `json:"NetID"`
+	JoinEUI    [][2]uint64     `json:"JoinEui"`
+	Region     string          `json:"region"`
+	HWSpec     string          `json:"hwspec"`
+	FreqRange  [2]uint32       `json:"freq_range"`
+	DRs        [][3]int        `json:"DRs"` // [SF, BW in kHz, downlink only] per data rate, SF 0 is FSK
+	Sx1301Conf json.RawMessage `json:"sx1301_conf,omitempty"`
+	NoCCA      bool            `json:"nocca"`
+	NoDC       bool            `json:"nodc"`
+	NoDwell    bool            `json:"nodwell"`
+	MuxTime    float64         `json:"MuxTime"`
+}
+
+// UpInfo describes the reception of an uplink.
+type UpInfo struct {
+	RCtx    int64   `json:"rctx"`
+	XTime   int64   `json:"xtime"`
+	GPSTime int64   `json:"gpstime"`
+	RSSI    float32 `json:"rssi"`
+	SNR     float32 `json:"snr"`
+}
+
+// UplinkDataFrame is a LoRaWAN data frame received by the station.
+type UplinkDataFrame struct {
+	MsgType    string  `json:"msgtype"` // MsgUplinkData
+	MHdr       uint8   `json:"MHdr"`
+	DevAddr    int32   `json:"DevAddr"`
+	FCtrl      uint8   `json:"FCtrl"`
+	FCnt       uint16  `json:"FCnt"`
+	FOpts      string  `json:"FOpts"`      // hex
+	FPort      int     `json:"FPort"`      // -1 if there is no FPort
+	FRMPayload string  `json:"FRMPayload"` // hex
+	MIC        int32   `json:"MIC"`
+	RefTime    float64 `json:"RefTime"`
+	DR         int     `json:"DR"`
+	Freq       uint32  `json:"Freq"`
+	UpInfo     UpInfo  `json:"upinfo"`
+}
+
+// JoinRequest is a LoRaWAN join request received by the station.
+type JoinRequest struct {
+	MsgType  string  `json:"msgtype"` // MsgJoinRequest
+	MHdr     uint8   `json:"MHdr"`
+	JoinEUI  string  `json:"JoinEui"`
+	DevEUI   string  `json:"DevEui"`
+	DevNonce uint16  `json:"DevNonce"`
+	MIC      int32   `json:"MIC"`
+	RefTime  float64 `json:"RefTime"`
+	DR       int     `json:"DR"`
+	Freq     uint32  `json:"Freq"`
+	UpInfo   UpInfo  `json:"upinfo"`
+}
+
+// ProprietaryFrame is a proprietary frame received by the station.
+type ProprietaryFrame struct {
+	MsgType    string  `json:"msgtype"`    // MsgProprietary
+	FRMPayload string  `json:"FRMPayload"` // hex, the whole frame
+	RefTime    float64 `json:"RefTime"`
+	DR         int     `json:"DR"`
+	Freq       uint32  `json:"Freq"`
+	UpInfo     UpInfo  `json:"upinfo"`
+}
+
+// DownlinkMessage is a downlink that the LNS sends to the station.
+// Class A downlinks are sent RxDelay seconds after the uplink with the XTime (RX1),
+// or one second later (RX2). Class C downlinks are sent immediately in RX2.
+type DownlinkMessage struct {
+	MsgType  string  `json:"msgtype"` // MsgDownlink
+	DevEUI   string  `json:"DevEui"`
+	DC       int     `json:"dC"` // device class
+	DIID     int64   `json:"diid"`
+	PDU      string  `json:"pdu"` // hex
+	RxDelay  int     `json:"RxDelay"`
+	RX1DR    int     `json:"RX1DR"`
+	RX1Freq  uint32  `json:"RX1Freq"`
+	RX2DR    int     `json:"RX2DR"`
+	RX2Freq  uint32  `json:"RX2Freq"`
+	Priority int     `json:"priority"`
+	XTime    int64   `json:"xtime"`
+	RCtx     int64   `json:"rctx"`
+	MuxTime  float64 `json:"MuxTime"`
+}
+
+// DownlinkTransmitted confirms that a DownlinkMessage has been sent.
+type DownlinkTransmitted struct {
+	MsgType string  `json:"msgtype"` // MsgTransmitted
+	DIID    int64   `json:"diid"`
+	DevEUI  string  `json:"DevEui"`
+	RCtx    int64   `json:"rctx"`
+	XTime   int64   `json:"xtime"`
+	TxTime  float64 `json:"txtime"`
+	GPSTime int64   `json:"gpstime"`
+}
+
+// Unmarshal decodes a message of any of the types above, depending on its msgtype.
+func Unmarshal(data []byte) (interface{}, error) {
+	var head struct {
+		MsgType string `json:"msgtype"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return nil, fmt.Errorf("can not parse message: %v", err)
+	}
+	var msg interface{}
+	switch head.MsgType {
+	case MsgVersion:
+		msg = &Version{}
+	case MsgRouterConfig:
+		msg = &RouterConfig{}
+	case MsgUplinkData:
+		msg = &UplinkDataFrame{}
+	case MsgJoinRequest:
+		msg = &JoinRequest{}
+	case MsgProprietary:
+		msg = &ProprietaryFrame{}
+	case MsgDownlink:
+		msg = &DownlinkMessage{}
+	case MsgTransmitted:
+		msg = &DownlinkTransmitted{}
+	default:
+		return nil, fmt.Errorf("unsupported msgtype %q", head.MsgType)
+	}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, fmt.Errorf("can not parse %s message: %v", head.MsgType, err)
+	}
+	return msg, nil
+}
+
+// XTime is the 64 bit timestamp of the station: the microsecond counter of the radio (48 bit),
+// with the session in bits 48 to 55. The session changes whenever the counter is restarted,
+// so that downlinks with timestamps of an old session can be detected.
+func XTime(session uint8, us int64) int64 {
+	return int64(session)<<48 | us&(1<<48-1)
+}
+
+// XTimeSession returns the session of the timestamp.
+func XTimeSession(xtime int64) uint8 {
+	return uint8(xtime >> 48)
+}
+
+// Uplink converts a received packet to an UplinkDataFrame, JoinRequest or ProprietaryFrame,
+// depending on the LoRaWAN message type. The data rate is the index of the packet's modulation
+// in the DRs of the RouterConfig.
+func Uplink(rx *lora.RxPacket, dr int, info UpInfo) (interface{}, error) {
+	phy, err := lorawan.Parse(rx.Data)
+	if err != nil {
+		return nil, err
+	}
+	mhdr := phy.MHDR.Byte()
+	mic := int32(binary.LittleEndian.Uint32(phy.MIC[:]))
+	switch mtype := phy.MHDR.MType; mtype {
+	case lorawan.JoinRequest:
+		return &JoinRequest{
+			MsgType:  MsgJoinRequest,
+			MHdr:     mhdr,
+			JoinEUI:  EUI(uint64(phy.JoinRequest.JoinEUI)),
+			DevEUI:   EUI(uint64(phy.JoinRequest.DevEUI)),
+			DevNonce: phy.JoinRequest.DevNonce,
+			MIC:      mic,
+			DR:       dr,
+			Freq:     rx.Freq,
+			UpInfo:   info,
+		}, nil
+
+	case lorawan.UnconfirmedDataUp, lorawan.ConfirmedDataUp:
+		mac := phy.MACPayload
+		return &UplinkDataFrame{
+			MsgType:    MsgUplinkData,
+			MHdr:       mhdr,
+			DevAddr:    int32(mac.FHDR.DevAddr),
+			FCtrl:      mac.FHDR.FCtrlByte(true),
+			FCnt:       mac.FHDR.FCnt,
+			FOpts:      hex.EncodeToString(mac.FHDR.FOpts),
+			FPort:      mac.FPort,
+			FRMPayload: hex.EncodeToString(mac.FRMPayload),
+			MIC:        mic,
+			DR:         dr,
+			Freq:       rx.Freq,
+			UpInfo:     info,
+		}, nil
+
+	case lorawan.Proprietary:
+		return &ProprietaryFrame{
+			MsgType:    MsgProprietary,
+			FRMPayload: hex.EncodeToString(rx.Data),
+			DR:         dr,
+			Freq:       rx.Freq,
+			UpInfo:     info,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported uplink message type %s", mtype)
+	}
+}
+
+// bandwidth codes of lora.RxPacket.LoRaBW and lora.TxPacket.LoRaBW, by kHz
+var bandwidths = map[int]uint8{125: 0x08, 250: 0x09, 500: 0x0a}
+
+// DR returns the index of the packet's modulation in the uplink data rates.
+func (c *RouterConfig) DR(rx *lora.RxPacket) (int, error) {
+	for dr, params := range c.DRs {
+		if params[2] != 0 {
+			continue // downlink only
+		}
+		if rx.Modulation == "FSK" {
+			if params[0] == 0 {
+				return dr, nil
+			}
+			continue
+		}
+		if params[0] == int(rx.Datarate) && bandwidths[params[1]] == rx.LoRaBW && rx.LoRaBW != 0 {
+			return dr, nil
+		}
+	}
+	if rx.Modulation == "FSK" {
+		return 0, fmt.Errorf("no FSK data rate in region %s", c.Region)
+	}
+	return 0, fmt.Errorf("no data rate for SF%d with bandwidth 0x%02x in region %s", rx.Datarate, rx.LoRaBW, c.Region)
+}
+
+// TxPacket converts a downlink to the packet that is sent in RX1 or, if rx2 is set, in RX2.
+// The counter of the returned packet (CountUs) is the lower 32 bits of the XTime,
+// as both count microseconds.
+func (c *RouterConfig) TxPacket(dn *DownlinkMessage, rx2 bool) (*lora.TxPacket, error) {
+	data, err := hex.DecodeString(dn.PDU)
+	if err != nil {
+		return nil, fmt.Errorf("can not decode pdu: %v", err)
+	}
+	pkt := &lora.TxPacket{
+		Power:       14,
+		LoRaCR:      5,
+		InvertPolar: true,
+		Data:        data,
+	}
+	dr, freq := dn.RX1DR, dn.RX1Freq
+	switch dn.DC {
+	case ClassA:
+		delay := int64(dn.RxDelay)
+		if delay == 0 {
+			delay = 1
+		}
+		if rx2 {
+			delay++
+			dr, freq = dn.RX2DR, dn.RX2Freq
+		}
+		pkt.CountUs = uint32(dn.XTime + delay*1000000)
+	case ClassC:
+		pkt.Immediate = true
+		dr, freq = dn.RX2DR, dn.RX2Freq
+	default:
+		return nil, fmt.Errorf("device class %d not supported", dn.DC)
+	}
+	if freq == 0 {
+		return nil, fmt.Errorf("no frequency for the downlink")
+	}
+	pkt.Freq = freq
+	if dr < 0 || dr >= len(c.DRs) {
+		return nil, fmt.Errorf("unknown data rate DR%d", dr)
+	}
+	if params := c.DRs[dr]; params[0] == 0 {
+		pkt.Modulation = "FSK"
+		pkt.Datarate = 50000
+		pkt.FreqDev = 25
+	} else {
+		pkt.Modulation = "LORA"
+		pkt.Datarate = uint32(params[0])
+		if pkt.LoRaBW = bandwidths[params[1]]; pkt.LoRaBW == 0 {
+			return nil, fmt.Errorf("unknown bandwidth %d kHz of DR%d", params[1], dr)
+		}
+	}
+	return pkt, nil
+}
@@ -0,0 +1,262 @@
+// Package fakelns implements a minimal LoRa Basics Station LNS that can be used in place of
+// ChirpStack or TTN, e.g. to test the packet forwarder together with a simulated radio.
+// It answers the router-info discovery, sends the router_config, records uplinks and dntxed
+// confirmations and sends downlinks (dnmsg) to the station.
+package fakelns
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/basicstation"
+	"github.com/gorilla/websocket"
+)
+
+// EU868 is the router_config sent by default: EU868 with DR0 (SF12) to DR6 (SF7 BW250) and DR7 (FSK).
+var EU868 = basicstation.RouterConfig{
+	MsgType:   basicstation.MsgRouterConfig,
+	Region:    "EU863",
+	HWSpec:    "sx1301/1",
+	FreqRange: [2]uint32{863000000, 870000000},
+	DRs: [][3]int{
+		{12, 125, 0}, {11, 125, 0}, {10, 125, 0}, {9, 125, 0},
+		{8, 125, 0}, {7, 125, 0}, {7, 250, 0}, {0, 0, 0},
+	},
+}
+
+// Server is a fake LNS.
+type Server struct {
+	ln       net.Listener
+	upgrader websocket.Upgrader
+
+	mu       sync.Mutex
+	changed  chan struct{} // closed and replaced whenever something is received
+	conn     *websocket.Conn
+	wmu      sync.Mutex // serializes writes to conn
+	version  *basicstation.Version
+	router   string // EUI of the connected station
+	uplinks  []interface{}
+	next     int // next uplink returned by WaitUplink
+	txed     map[int64]*basicstation.DownlinkTransmitted
+	lastDIID int64
+
+	// Config is sent to the station as router_config. Like Logger, it must be set before the station connects.
+	Config basicstation.RouterConfig
+
+	// Logger, if set, logs all messages.
+	Logger *log.Logger
+}
+
+// Listen creates a new server listening on addr (like ":8887").
+// Stations connect to ws://addr, the router-info endpoint is ws://addr/router-info.
+func Listen(addr string) (*Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		ln:      ln,
+		changed: make(chan struct{}),
+		txed:    make(map[int64]*basicstation.DownlinkTransmitted),
+		Config:  EU868,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/router-info", s.serveRouterInfo)
+	mux.HandleFunc("/traffic/", s.serveTraffic)
+	go http.Serve(ln, mux)
+	return s, nil
+}
+
+// URI returns the address that stations connect to, like ws://127.0.0.1:8887.
+func (s *Server) URI() string {
+	return "ws://" + s.ln.Addr().String()
+}
+
+// Close stops the server and closes the connection to the station.
+func (s *Server) Close() error {
+	err := s.ln.Close()
+	s.mu.Lock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.mu.Unlock()
+	return err
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+	}
+}
+
+// broadcast wakes up all waiting calls. s.mu must be held.
+func (s *Server) broadcast() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// wait waits until cond (called with s.mu held) returns true.
+func (s *Server) wait(timeout time.Duration, cond func() bool) bool {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		if cond() {
+			s.mu.Unlock()
+			return true
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+func (s *Server) serveRouterInfo(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.logf("(<- %s) router-info: %v", r.RemoteAddr, err)
+		return
+	}
+	defer conn.Close()
+	var req basicstation.RouterInfoRequest
+	if err := conn.ReadJSON(&req); err != nil {
+		s.logf("(<- %s) router-info: %v", r.RemoteAddr, err)
+		return
+	}
+	s.logf("(<- %s) router-info: %s", r.RemoteAddr, req.Router)
+	info := basicstation.RouterInfo{
+		Muxs: "fakelns",
+		URI:  "ws://" + r.Host + "/traffic/" + req.Router,
+	}
+	s.logf("(-> %s) router-info: %s", r.RemoteAddr, info.URI)
+	conn.WriteJSON(&info)
+}
+
+func (s *Server) serveTraffic(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.logf("(<- %s) traffic: %v", r.RemoteAddr, err)
+		return
+	}
+	defer conn.Close()
+
+	s.mu.Lock()
+	if s.conn != nil {
+		s.conn.Close() // the station has reconnected
+	}
+	s.conn = conn
+	s.router = r.URL.Path[len("/traffic/"):]
+	s.mu.Unlock()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			s.logf("(<- %s) %v", r.RemoteAddr, err)
+			break
+		}
+		s.logf("(<- %s) %s", r.RemoteAddr, data)
+		msg, err := basicstation.Unmarshal(data)
+		if err != nil {
+			s.logf("(<- %s) %v", r.RemoteAddr, err)
+			continue
+		}
+
+		s.mu.Lock()
+		switch msg := msg.(type) {
+		case *basicstation.Version:
+			s.version = msg
+		case *basicstation.UplinkDataFrame, *basicstation.JoinRequest, *basicstation.ProprietaryFrame:
+			s.uplinks = append(s.uplinks, msg)
+		case *basicstation.DownlinkTransmitted:
+			s.txed[msg.DIID] = msg
+		}
+		s.broadcast()
+		config := s.Config
+		s.mu.Unlock()
+
+		if _, ok := msg.(*basicstation.Version); ok {
+			s.send(conn, &config)
+		}
+	}
+
+	s.mu.Lock()
+	if s.conn == conn {
+		s.conn = nil
+	}
+	s.mu.Unlock()
+}
+
+func (s *Server) send(conn *websocket.Conn, msg interface{}) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.logf("(-> %s) %+v", conn.RemoteAddr(), msg)
+	return conn.WriteJSON(msg)
+}
+
+// WaitVersion waits until a station has connected and sent its version.
+// It returns the station's EUI (as in the traffic URI) and false if no station connected within the timeout.
+func (s *Server) WaitVersion(timeout time.Duration) (router string, version *basicstation.Version, ok bool) {
+	ok = s.wait(timeout, func() bool {
+		router, version = s.router, s.version
+		return s.conn != nil && version != nil
+	})
+	return
+}
+
+// Uplinks returns all uplinks (*basicstation.UplinkDataFrame, *basicstation.JoinRequest or
+// *basicstation.ProprietaryFrame) that have been received so far.
+func (s *Server) Uplinks() []interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs := make([]interface{}, len(s.uplinks))
+	copy(msgs, s.uplinks)
+	return msgs
+}
+
+// WaitUplink waits for the next uplink to be received.
+// It returns nil if no uplink was received within the timeout.
+func (s *Server) WaitUplink(timeout time.Duration) (msg interface{}) {
+	s.wait(timeout, func() bool {
+		if s.next < len(s.uplinks) {
+			msg = s.uplinks[s.next]
+			s.next++
+			return true
+		}
+		return false
+	})
+	return
+}
+
+// Downlink sends the downlink to the connected station.
+// If dn.DIID is 0, a new one is set. It can be used to wait for the dntxed confirmation.
+func (s *Server) Downlink(dn *basicstation.DownlinkMessage) (int64, error) {
+	s.mu.Lock()
+	conn := s.conn
+	if dn.DIID == 0 {
+		s.lastDIID++
+		dn.DIID = s.lastDIID
+	}
+	s.mu.Unlock()
+	if conn == nil {
+		return 0, fmt.Errorf("no station connected")
+	}
+	dn.MsgType = basicstation.MsgDownlink
+	return dn.DIID, s.send(conn, dn)
+}
+
+// WaitTransmitted waits for the dntxed confirmation of the downlink with the diid.
+// It returns false if the downlink was not confirmed within the timeout.
+func (s *Server) WaitTransmitted(diid int64, timeout time.Duration) (txed *basicstation.DownlinkTransmitted, ok bool) {
+	ok = s.wait(timeout, func() bool {
+		txed, ok = s.txed[diid]
+		return ok
+	})
+	return
+}
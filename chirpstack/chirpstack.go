@@ -0,0 +1,321 @@
+// Package chirpstack implements the JSON messages of the ChirpStack Gateway Bridge (v4), that
+// gateways exchange with ChirpStack over MQTT: uplinks (event/up), status reports (event/stats),
+// downlinks (command/down), their acknowledgements (event/ack) and the connection state (state/conn).
+// All topics are below the topic of the gateway, like "gateway/0102030405060708/event/up".
+package chirpstack
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// Topics, relative to the topic of the gateway.
+const (
+	TopicUp    = "event/up"
+	TopicStats = "event/stats"
+	TopicAck   = "event/ack"
+	TopicDown  = "command/down"
+	TopicConn  = "state/conn"
+)
+
+// GatewayTopic returns the topic of the gateway, like "gateway/0102030405060708" for the prefix "gateway".
+func GatewayTopic(prefix string, gwid uint64) string {
+	return fmt.Sprintf("%s/%016x", strings.TrimSuffix(prefix, "/"), gwid)
+}
+
+// GatewayID formats the gateway ID like "0102030405060708".
+func GatewayID(gwid uint64) string {
+	return fmt.Sprintf("%016x", gwid)
+}
+
+// Duration is a protobuf duration, like "1.5s" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + strconv.FormatFloat(time.Duration(d).Seconds(), 'f', -1, 64) + `s"`), nil
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("can not parse duration: %v", err)
+	}
+	sec, err := strconv.ParseFloat(strings.TrimSuffix(s, "s"), 64)
+	if err != nil || !strings.HasSuffix(s, "s") {
+		return fmt.Errorf("can not parse duration %q", s)
+	}
+	*d = Duration(sec * float64(time.Second))
+	return nil
+}
+
+// Modulation is either LoRa or FSK.
+type Modulation struct {
+	LoRa *LoRaModulationInfo `json:"lora,omitempty"`
+	FSK  *FSKModulationInfo  `json:"fsk,omitempty"`
+}
+
+type LoRaModulationInfo struct {
+	Bandwidth             uint32 `json:"bandwidth"` // in Hz
+	SpreadingFactor       uint32 `json:"spreadingFactor"`
+	CodeRate              string `json:"codeRate"` // like "CR_4_5"
+	PolarizationInversion bool   `json:"polarizationInversion"`
+}
+
+type FSKModulationInfo struct {
+	FrequencyDeviation uint32 `json:"frequencyDeviation"` // in Hz
+	Datarate           uint32 `json:"datarate"`
+}
+
+// Location is the location of the gateway.
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude"`
+	Source    string  `json:"source"` // "CONFIG" or "GPS"
+}
+
+// UplinkFrame is published on TopicUp for every received packet.
+type UplinkFrame struct {
+	PhyPayload []byte       `json:"phyPayload"`
+	TxInfo     UplinkTxInfo `json:"txInfo"`
+	RxInfo     UplinkRxInfo `json:"rxInfo"`
+}
+
+type UplinkTxInfo struct {
+	Frequency  uint32     `json:"frequency"`
+	Modulation Modulation `json:"modulation"`
+}
+
+type UplinkRxInfo struct {
+	GatewayID         string     `json:"gatewayId"`
+	UplinkID          uint32     `json:"uplinkId"`
+	GwTime            *time.Time `json:"gwTime,omitempty"`
+	TimeSinceGPSEpoch *Duration  `json:"timeSinceGpsEpoch,omitempty"`
+	RSSI              int32      `json:"rssi"`
+	SNR               float32    `json:"snr"`
+	Channel           uint32     `json:"channel"`
+	RfChain           uint32     `json:"rfChain"`
+	Context           []byte     `json:"context"`   // the counter (tmst) of the packet, 4 bytes big endian
+	CRCStatus         string     `json:"crcStatus"` // "CRC_OK", "BAD_CRC" or "NO_CRC"
+}
+
+// GatewayStats is published on TopicStats with every status report.
+type GatewayStats struct {
+	GatewayID           string    `json:"gatewayId"`
+	Time                time.Time `json:"time"`
+	Location            *Location `json:"location,omitempty"`
+	RxPacketsReceived   uint32    `json:"rxPacketsReceived"`
+	RxPacketsReceivedOK uint32    `json:"rxPacketsReceivedOk"`
+	TxPacketsReceived   uint32    `json:"txPacketsReceived"`
+	TxPacketsEmitted    uint32    `json:"txPacketsEmitted"`
+}
+
+// DownlinkFrame is received on TopicDown. The items are alternatives, like RX1 and RX2:
+// the first item that can be sent is sent.
+type DownlinkFrame struct {
+	DownlinkID uint32              `json:"downlinkId"`
+	GatewayID  string              `json:"gatewayId"`
+	Items      []DownlinkFrameItem `json:"items"`
+}
+
+type DownlinkFrameItem struct {
+	PhyPayload []byte         `json:"phyPayload"`
+	TxInfo     DownlinkTxInfo `json:"txInfo"`
+}
+
+type DownlinkTxInfo struct {
+	Frequency  uint32     `json:"frequency"`
+	Power      int32      `json:"power"`
+	Modulation Modulation `json:"modulation"`
+	Timing     Timing     `json:"timing"`
+	Context    []byte     `json:"context"` // the Context of the uplink, for Timing.Delay
+}
+
+// Timing is one of: immediately, after a delay (relative to the Context), or at a GPS time.
+type Timing struct {
+	Immediately *struct{}        `json:"immediately,omitempty"`
+	Delay       *DelayTimingInfo `json:"delay,omitempty"`
+	GPSEpoch    *GPSTimingInfo   `json:"gpsEpoch,omitempty"`
+}
+
+type DelayTimingInfo struct {
+	Delay Duration `json:"delay"`
+}
+
+type GPSTimingInfo struct {
+	TimeSinceGPSEpoch Duration `json:"timeSinceGpsEpoch"`
+}
+
+// DownlinkTxAck is published on TopicAck for every DownlinkFrame, with the status of each item.
+type DownlinkTxAck struct {
+	GatewayID  string              `json:"gatewayId"`
+	DownlinkID uint32              `json:"downlinkId"`
+	Items      []DownlinkTxAckItem `json:"items"`
+}
+
+type DownlinkTxAckItem struct {
+	Status string `json:"status"`
+}
+
+// StatusIgnored is the status of items that have not been tried, because an earlier item has been sent.
+const StatusIgnored = "IGNORED"
+
+// StatusInternalError is the status of items that can not be sent, e.g. because of an unknown modulation.
+const StatusInternalError = "INTERNAL_ERROR"
+
+var statusStr = []string{
+	"",
+	"OK",
+	"TOO_LATE",
+	"TOO_EARLY",
+	"COLLISION_PACKET",
+	"COLLISION_BEACON",
+	"TX_FREQ",
+	"TX_POWER",
+	"GPS_UNLOCKED",
+}
+
+// Status returns the acknowledgement status of a downlink item, like "OK" or "TOO_LATE".
+func Status(e fwd.TxAckError) string {
+	if e <= 0 || int(e) >= len(statusStr) {
+		return StatusInternalError
+	}
+	return statusStr[e]
+}
+
+// ConnState is published (retained) on TopicConn when the gateway connects, and as will when it disconnects.
+type ConnState struct {
+	GatewayID string `json:"gatewayId"`
+	State     string `json:"state"` // "ONLINE" or "OFFLINE"
+}
+
+// bandwidth codes of lora.RxPacket.LoRaBW and lora.TxPacket.LoRaBW, by Hz
+var bandwidths = []uint32{0, 7800, 10400, 15600, 20800, 31250, 41700, 62500, 125000, 250000, 500000}
+
+// Uplink converts a received packet. The uplinkID identifies the packet in the logs of ChirpStack.
+func Uplink(gwid uint64, uplinkID uint32, rx *lora.RxPacket) *UplinkFrame {
+	up := &UplinkFrame{
+		PhyPayload: rx.Data,
+		TxInfo: UplinkTxInfo{
+			Frequency: rx.Freq,
+		},
+		RxInfo: UplinkRxInfo{
+			GatewayID: GatewayID(gwid),
+			UplinkID:  uplinkID,
+			GwTime:    rx.Time,
+			RSSI:      int32(rx.RSSI),
+			SNR:       rx.LoRaSNR,
+			Channel:   uint32(rx.ChainIF),
+			RfChain:   uint32(rx.ChainRF),
+			Context:   make([]byte, 4),
+			CRCStatus: "NO_CRC",
+		},
+	}
+	binary.BigEndian.PutUint32(up.RxInfo.Context, rx.CountUs)
+	if !rx.TimeGPS.IsZero() {
+		d := Duration(rx.TimeGPS.Sub(lora.GPSEpoch))
+		up.RxInfo.TimeSinceGPSEpoch = &d
+	}
+	switch rx.StatCRC {
+	case 1:
+		up.RxInfo.CRCStatus = "CRC_OK"
+	case -1:
+		up.RxInfo.CRCStatus = "BAD_CRC"
+	}
+	if rx.Modulation == "FSK" {
+		up.TxInfo.Modulation.FSK = &FSKModulationInfo{
+			Datarate: rx.Datarate,
+		}
+	} else {
+		info := &LoRaModulationInfo{
+			SpreadingFactor: rx.Datarate,
+			CodeRate:        fmt.Sprintf("CR_4_%d", rx.LoRaCR),
+		}
+		if int(rx.LoRaBW) < len(bandwidths) {
+			info.Bandwidth = bandwidths[rx.LoRaBW]
+		}
+		up.TxInfo.Modulation.LoRa = info
+	}
+	return up
+}
+
+// Stats converts a status report.
+func Stats(gwid uint64, stat *fwd.Stat) *GatewayStats {
+	s := &GatewayStats{
+		GatewayID:           GatewayID(gwid),
+		Time:                time.Now().UTC(),
+		RxPacketsReceived:   stat.RxNb,
+		RxPacketsReceivedOK: stat.RxOk,
+		TxPacketsReceived:   stat.DwNb,
+		TxPacketsEmitted:    stat.TxNb,
+	}
+	if t, err := time.Parse(fwd.StatTimeFormat, stat.Time); err == nil {
+		s.Time = t
+	}
+	if stat.Lati != 0 || stat.Long != 0 {
+		s.Location = &Location{
+			Latitude:  stat.Lati,
+			Longitude: stat.Long,
+			Altitude:  float64(stat.Alti),
+			Source:    "CONFIG",
+		}
+	}
+	return s
+}
+
+// TxPacket converts a downlink item to the packet to send.
+// Items with GPS timing return fwd.ErrGPSUnloacked, as the forwarder has no GPS.
+func (item *DownlinkFrameItem) TxPacket() (*lora.TxPacket, error) {
+	info := &item.TxInfo
+	pkt := &lora.TxPacket{
+		Freq:  info.Frequency,
+		Power: uint8(info.Power),
+		Data:  item.PhyPayload,
+	}
+	switch {
+	case info.Timing.Immediately != nil:
+		pkt.Immediate = true
+	case info.Timing.Delay != nil:
+		if len(info.Context) != 4 {
+			return nil, fmt.Errorf("can not use delay timing: context must have 4 bytes, got %d", len(info.Context))
+		}
+		tmst := binary.BigEndian.Uint32(info.Context)
+		pkt.CountUs = tmst + uint32(time.Duration(info.Timing.Delay.Delay)/time.Microsecond)
+	case info.Timing.GPSEpoch != nil:
+		return nil, fwd.ErrGPSUnloacked
+	default:
+		return nil, fmt.Errorf("no timing")
+	}
+
+	switch mod := info.Modulation; {
+	case mod.LoRa != nil:
+		pkt.Modulation = "LORA"
+		pkt.Datarate = mod.LoRa.SpreadingFactor
+		pkt.InvertPolar = mod.LoRa.PolarizationInversion
+		for code, hz := range bandwidths {
+			if hz == mod.LoRa.Bandwidth && hz != 0 {
+				pkt.LoRaBW = uint8(code)
+			}
+		}
+		if pkt.LoRaBW == 0 {
+			return nil, fmt.Errorf("unknown bandwidth %d Hz", mod.LoRa.Bandwidth)
+		}
+		if _, err := fmt.Sscanf(mod.LoRa.CodeRate, "CR_4_%d", &pkt.LoRaCR); err != nil || pkt.LoRaCR < 5 || pkt.LoRaCR > 8 {
+			return nil, fmt.Errorf("unknown code rate %q", mod.LoRa.CodeRate)
+		}
+	case mod.FSK != nil:
+		pkt.Modulation = "FSK"
+		pkt.Datarate = mod.FSK.Datarate
+		pkt.FreqDev = uint8(mod.FSK.FrequencyDeviation / 1000)
+	default:
+		return nil, fmt.Errorf("no modulation")
+	}
+	return pkt, nil
+}
@@ -0,0 +1,174 @@
+package chirpstack
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+func TestUplink(t *testing.T) {
+	rxTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	rx := &lora.RxPacket{
+		Time:       &rxTime,
+		TimeGPS:    lora.GPSEpoch.Add(1500 * time.Millisecond),
+		CountUs:    0x01020304,
+		Freq:       868100000,
+		StatCRC:    1,
+		Modulation: "LORA",
+		LoRaBW:     0x08,
+		LoRaCR:     0x05,
+		Datarate:   7,
+		RSSI:       -57.6,
+		LoRaSNR:    9.5,
+		Data:       []byte{0x40, 0x01, 0x02},
+	}
+	up := Uplink(0x0102030405060708, 42, rx)
+
+	if !bytes.Equal(up.PhyPayload, rx.Data) || up.TxInfo.Frequency != 868100000 {
+		t.Errorf("uplink %+v, expected the data and frequency of the packet", up)
+	}
+	if lora := up.TxInfo.Modulation.LoRa; lora == nil || lora.Bandwidth != 125000 || lora.SpreadingFactor != 7 || lora.CodeRate != "CR_4_5" {
+		t.Errorf("modulation %+v, expected SF7 BW125 CR_4_5", lora)
+	}
+	info := up.RxInfo
+	if info.GatewayID != "0102030405060708" || info.UplinkID != 42 || info.RSSI != -57 || info.SNR != 9.5 || info.CRCStatus != "CRC_OK" {
+		t.Errorf("rxInfo %+v", info)
+	}
+	if !bytes.Equal(info.Context, []byte{0x01, 0x02, 0x03, 0x04}) {
+		t.Errorf("context %X, expected the counter 01020304", info.Context)
+	}
+	if info.GwTime == nil || !info.GwTime.Equal(rxTime) {
+		t.Errorf("gwTime %v, expected %v", info.GwTime, rxTime)
+	}
+	if info.TimeSinceGPSEpoch == nil || *info.TimeSinceGPSEpoch != Duration(1500*time.Millisecond) {
+		t.Errorf("timeSinceGpsEpoch %v, expected 1.5s", info.TimeSinceGPSEpoch)
+	}
+
+	rx = &lora.RxPacket{
+		StatCRC:    -1,
+		Modulation: "FSK",
+		Datarate:   50000,
+	}
+	up = Uplink(1, 1, rx)
+	if fsk := up.TxInfo.Modulation.FSK; fsk == nil || fsk.Datarate != 50000 || up.TxInfo.Modulation.LoRa != nil {
+		t.Errorf("modulation %+v, expected FSK 50000", up.TxInfo.Modulation)
+	}
+	if up.RxInfo.CRCStatus != "BAD_CRC" || up.RxInfo.GwTime != nil || up.RxInfo.TimeSinceGPSEpoch != nil {
+		t.Errorf("rxInfo %+v, expected BAD_CRC, no time", up.RxInfo)
+	}
+	if up = Uplink(1, 1, &lora.RxPacket{}); up.RxInfo.CRCStatus != "NO_CRC" {
+		t.Errorf("crcStatus %s, expected NO_CRC", up.RxInfo.CRCStatus)
+	}
+}
+
+func TestTxPacket(t *testing.T) {
+	lora125 := Modulation{LoRa: &LoRaModulationInfo{Bandwidth: 125000, SpreadingFactor: 9, CodeRate: "CR_4_5", PolarizationInversion: true}}
+	delay := func(d time.Duration) Timing {
+		return Timing{Delay: &DelayTimingInfo{Delay: Duration(d)}}
+	}
+	tests := []struct {
+		name    string
+		info    DownlinkTxInfo
+		countUs uint32
+		err     error // only checked for TX_ACK errors
+		ok      bool
+	}{
+		{"delay", DownlinkTxInfo{Modulation: lora125, Timing: delay(time.Second), Context: []byte{0, 0, 0x10, 0}}, 0x1000 + 1000000, nil, true},
+		{"delay across the counter wrap", DownlinkTxInfo{Modulation: lora125, Timing: delay(5 * time.Second), Context: []byte{0xff, 0xff, 0xff, 0xff}}, 5000000 - 1, nil, true},
+		{"immediately", DownlinkTxInfo{Modulation: lora125, Timing: Timing{Immediately: &struct{}{}}}, 0, nil, true},
+		{"fsk", DownlinkTxInfo{Modulation: Modulation{FSK: &FSKModulationInfo{Datarate: 50000, FrequencyDeviation: 25000}}, Timing: Timing{Immediately: &struct{}{}}}, 0, nil, true},
+		{"gps", DownlinkTxInfo{Modulation: lora125, Timing: Timing{GPSEpoch: &GPSTimingInfo{}}}, 0, fwd.ErrGPSUnloacked, false},
+		{"no timing", DownlinkTxInfo{Modulation: lora125}, 0, nil, false},
+		{"short context", DownlinkTxInfo{Modulation: lora125, Timing: delay(time.Second), Context: []byte{1, 2}}, 0, nil, false},
+		{"no modulation", DownlinkTxInfo{Timing: Timing{Immediately: &struct{}{}}}, 0, nil, false},
+		{"unknown bandwidth", DownlinkTxInfo{Modulation: Modulation{LoRa: &LoRaModulationInfo{Bandwidth: 100000, SpreadingFactor: 9, CodeRate: "CR_4_5"}}, Timing: Timing{Immediately: &struct{}{}}}, 0, nil, false},
+		{"unknown code rate", DownlinkTxInfo{Modulation: Modulation{LoRa: &LoRaModulationInfo{Bandwidth: 125000, SpreadingFactor: 9, CodeRate: "CR_4_9"}}, Timing: Timing{Immediately: &struct{}{}}}, 0, nil, false},
+	}
+	for _, test := range tests {
+		test.info.Frequency = 869525000
+		test.info.Power = 14
+		item := &DownlinkFrameItem{PhyPayload: []byte{0x60, 0x01}, TxInfo: test.info}
+		pkt, err := item.TxPacket()
+		if (err == nil) != test.ok {
+			t.Errorf("%s: TxPacket() = %v, expected ok %v", test.name, err, test.ok)
+			continue
+		}
+		if test.err != nil && err != test.err {
+			t.Errorf("%s: TxPacket() = %v, expected %v", test.name, err, test.err)
+		}
+		if !test.ok {
+			continue
+		}
+		if pkt.CountUs != test.countUs || pkt.Immediate != (test.info.Timing.Immediately != nil) {
+			t.Errorf("%s: CountUs %d, immediate %v, expected %d", test.name, pkt.CountUs, pkt.Immediate, test.countUs)
+		}
+		if pkt.Freq != 869525000 || pkt.Power != 14 || !bytes.Equal(pkt.Data, item.PhyPayload) {
+			t.Errorf("%s: packet %s, expected 869.525 MHz, 14 dBm", test.name, pkt)
+		}
+		if test.info.Modulation.LoRa != nil {
+			if pkt.Modulation != "LORA" || pkt.Datarate != 9 || pkt.LoRaBW != 0x08 || pkt.LoRaCR != 5 || !pkt.InvertPolar {
+				t.Errorf("%s: packet %s, expected LoRa SF9 BW125 CR 4/5, inverted", test.name, pkt)
+			}
+		} else if pkt.Modulation != "FSK" || pkt.Datarate != 50000 || pkt.FreqDev != 25 {
+			t.Errorf("%s: packet %s, expected FSK 50000, 25 kHz", test.name, pkt)
+		}
+	}
+}
+
+func TestDuration(t *testing.T) {
+	tests := []struct {
+		d    Duration
+		json string
+	}{
+		{Duration(time.Second), `"1s"`},
+		{Duration(1500 * time.Millisecond), `"1.5s"`},
+		{Duration(time.Microsecond), `"0.000001s"`},
+		{0, `"0s"`},
+	}
+	for _, test := range tests {
+		data, err := json.Marshal(test.d)
+		if err != nil || string(data) != test.json {
+			t.Errorf("Marshal(%s) = %s (%v), expected %s", time.Duration(test.d), data, err, test.json)
+		}
+		var d Duration
+		if err := json.Unmarshal([]byte(test.json), &d); err != nil || d != test.d {
+			t.Errorf("Unmarshal(%s) = %s (%v), expected %s", test.json, time.Duration(d), err, time.Duration(test.d))
+		}
+	}
+
+	for _, data := range []string{`1`, `"1"`, `"s"`, `"1m"`, `null`} {
+		var d Duration
+		if err := json.Unmarshal([]byte(data), &d); err == nil {
+			t.Errorf("Unmarshal(%s) = %s, expected an error", data, time.Duration(d))
+		}
+	}
+
+	// in a message
+	var timing Timing
+	if err := json.Unmarshal([]byte(`{"delay":{"delay":"5s"}}`), &timing); err != nil || timing.Delay == nil || timing.Delay.Delay != Duration(5*time.Second) {
+		t.Errorf("Unmarshal(delay timing) = %+v (%v), expected a delay of 5s", timing.Delay, err)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		e      fwd.TxAckError
+		status string
+	}{
+		{fwd.NoError, "OK"},
+		{fwd.ErrTooLate, "TOO_LATE"},
+		{fwd.ErrCollisionPacket, "COLLISION_PACKET"},
+		{fwd.ErrGPSUnloacked, "GPS_UNLOCKED"},
+		{0, StatusInternalError},
+		{100, StatusInternalError},
+	}
+	for _, test := range tests {
+		if status := Status(test.e); status != test.status {
+			t.Errorf("Status(%d) = %s, expected %s", test.e, status, test.status)
+		}
+	}
+}
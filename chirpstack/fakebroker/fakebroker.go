@@ -0,0 +1,329 @@
+// Package fakebroker implements a minimal MQTT 3.1.1 broker that can be used in place of the
+// broker of ChirpStack, e.g. to test the packet forwarder together with a simulated radio.
+// It supports QoS 0 and 1 (delivered with QoS 0), retained messages and wills, records all
+// published messages and can publish messages to the clients.
+package fakebroker
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Message is a published message.
+type Message struct {
+	Topic    string
+	Payload  []byte
+	Retained bool
+}
+
+// Broker is a fake MQTT broker.
+type Broker struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	changed  chan struct{} // closed and replaced whenever a message is published or a client subscribes
+	clients  map[*client]bool
+	retained map[string]*Message
+	messages []*Message
+	next     map[string]int // next message returned by WaitMessage, by filter
+
+	// Logger, if set, logs all packets.
+	Logger *log.Logger
+}
+
+type client struct {
+	conn    net.Conn
+	id      string
+	wmu     sync.Mutex // serializes writes to conn
+	filters []string   // guarded by Broker.mu
+}
+
+// Listen creates a new broker listening on addr (like ":1883").
+func Listen(addr string) (*Broker, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	b := &Broker{
+		ln:       ln,
+		changed:  make(chan struct{}),
+		clients:  make(map[*client]bool),
+		retained: make(map[string]*Message),
+		next:     make(map[string]int),
+	}
+	go b.serve()
+	return b, nil
+}
+
+// Addr returns the address that clients connect to, like tcp://127.0.0.1:1883.
+func (b *Broker) Addr() string {
+	return "tcp://" + b.ln.Addr().String()
+}
+
+// Close stops the broker and disconnects all clients, without publishing their wills.
+func (b *Broker) Close() error {
+	err := b.ln.Close()
+	b.mu.Lock()
+	for c := range b.clients {
+		c.conn.Close()
+	}
+	b.mu.Unlock()
+	return err
+}
+
+func (b *Broker) logf(format string, v ...interface{}) {
+	if b.Logger != nil {
+		b.Logger.Printf(format, v...)
+	}
+}
+
+// Match reports whether the topic matches the filter, that can contain the wildcards + and #.
+func Match(filter string, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+func (b *Broker) serve() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return // closed
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *Broker) handle(conn net.Conn) {
+	defer conn.Close()
+	c := &client{conn: conn}
+
+	pkt, err := packets.ReadPacket(conn)
+	if err != nil {
+		return
+	}
+	connect, ok := pkt.(*packets.ConnectPacket)
+	if !ok {
+		b.logf("(<- %s) expected CONNECT, got %s", conn.RemoteAddr(), pkt)
+		return
+	}
+	c.id = connect.ClientIdentifier
+	b.logf("(<- %s) %s", c.id, connect)
+	var will *Message
+	if connect.WillFlag {
+		will = &Message{Topic: connect.WillTopic, Payload: connect.WillMessage, Retained: connect.WillRetain}
+	}
+	if err := c.write(packets.NewControlPacket(packets.Connack)); err != nil {
+		return
+	}
+	b.mu.Lock()
+	b.clients[c] = true
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.clients, c)
+		b.mu.Unlock()
+	}()
+
+	for {
+		pkt, err := packets.ReadPacket(conn)
+		if err != nil {
+			b.logf("(<- %s) %v", c.id, err)
+			if will != nil {
+				b.Publish(will.Topic, will.Payload, will.Retained)
+			}
+			return
+		}
+		b.logf("(<- %s) %s", c.id, pkt)
+
+		switch pkt := pkt.(type) {
+		case *packets.PublishPacket:
+			if pkt.Qos == 1 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = pkt.MessageID
+				c.write(ack)
+			}
+			b.Publish(pkt.TopicName, pkt.Payload, pkt.Retain)
+
+		case *packets.SubscribePacket:
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = pkt.MessageID
+			var retained []*Message
+			b.mu.Lock()
+			for _, filter := range pkt.Topics {
+				c.filters = append(c.filters, filter)
+				ack.ReturnCodes = append(ack.ReturnCodes, 0) // QoS 0
+				for _, msg := range b.retained {
+					if Match(filter, msg.Topic) {
+						retained = append(retained, msg)
+					}
+				}
+			}
+			close(b.changed)
+			b.changed = make(chan struct{})
+			b.mu.Unlock()
+			c.write(ack)
+			for _, msg := range retained {
+				c.deliver(msg)
+			}
+
+		case *packets.UnsubscribePacket:
+			b.mu.Lock()
+			for _, topic := range pkt.Topics {
+				for i, filter := range c.filters {
+					if filter == topic {
+						c.filters = append(c.filters[:i], c.filters[i+1:]...)
+						break
+					}
+				}
+			}
+			b.mu.Unlock()
+			ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ack.MessageID = pkt.MessageID
+			c.write(ack)
+
+		case *packets.PingreqPacket:
+			c.write(packets.NewControlPacket(packets.Pingresp))
+
+		case *packets.DisconnectPacket:
+			return // no will
+		}
+	}
+}
+
+func (c *client) write(pkt packets.ControlPacket) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return pkt.Write(c.conn)
+}
+
+func (c *client) deliver(msg *Message) {
+	pkt := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pkt.TopicName = msg.Topic
+	pkt.Payload = msg.Payload
+	pkt.Retain = msg.Retained
+	c.write(pkt)
+}
+
+// Publish records the message and sends it to all subscribed clients.
+// If retained is set, it is also sent to clients that subscribe later, an empty payload clears
+// the retained message of the topic.
+func (b *Broker) Publish(topic string, payload []byte, retained bool) {
+	msg := &Message{Topic: topic, Payload: payload, Retained: retained}
+	b.logf("(-> *) publish %s: %s", topic, payload)
+
+	var receivers []*client
+	b.mu.Lock()
+	b.messages = append(b.messages, msg)
+	if retained {
+		if len(payload) == 0 {
+			delete(b.retained, topic)
+		} else {
+			b.retained[topic] = msg
+		}
+	}
+	for c := range b.clients {
+		for _, filter := range c.filters {
+			if Match(filter, topic) {
+				receivers = append(receivers, c)
+				break
+			}
+		}
+	}
+	close(b.changed)
+	b.changed = make(chan struct{})
+	b.mu.Unlock()
+
+	// subscribers get the message without the retain flag, as it is not an old message
+	live := &Message{Topic: topic, Payload: payload}
+	for _, c := range receivers {
+		c.deliver(live)
+	}
+}
+
+// Messages returns all messages that have been published so far on topics matching the filter.
+func (b *Broker) Messages(filter string) []*Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var msgs []*Message
+	for _, msg := range b.messages {
+		if Match(filter, msg.Topic) {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+// WaitMessage waits for the next message published on a topic matching the filter.
+// It returns nil if no message was published within the timeout.
+func (b *Broker) WaitMessage(filter string, timeout time.Duration) *Message {
+	deadline := time.After(timeout)
+	for {
+		b.mu.Lock()
+		for i := b.next[filter]; i < len(b.messages); i++ {
+			if Match(filter, b.messages[i].Topic) {
+				b.next[filter] = i + 1
+				msg := b.messages[i]
+				b.mu.Unlock()
+				return msg
+			}
+		}
+		b.next[filter] = len(b.messages)
+		changed := b.changed
+		b.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+			return nil
+		}
+	}
+}
+
+// WaitSubscribed waits until a client has subscribed to the filter (the same filter, not a matching one).
+// It returns false if no client subscribed within the timeout.
+func (b *Broker) WaitSubscribed(filter string, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		b.mu.Lock()
+		for c := range b.clients {
+			for _, f := range c.filters {
+				if f == filter {
+					b.mu.Unlock()
+					return true
+				}
+			}
+		}
+		changed := b.changed
+		b.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// Connected reports whether a client with the id is connected.
+func (b *Broker) Connected(id string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		if c.id == id {
+			return true
+		}
+	}
+	return false
+}
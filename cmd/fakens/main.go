@@ -0,0 +1,86 @@
+// Command fakens is a minimal network server for testing the packet forwarder without ChirpStack or TTN.
+// It acknowledges all datagrams, logs uplinks and status reports and can answer every uplink with a downlink.
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/fwd/fakens"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+func main() {
+	log.SetFlags(log.Ltime | log.Lmicroseconds)
+
+	up := flag.String("up", ":1700", "address for upstream datagrams (serv_port_up)")
+	down := flag.String("down", "", "address for downstream datagrams (serv_port_down), default: same as -up")
+	reply := flag.String("reply", "", "base64 payload to send as downlink for every uplink")
+	delay := flag.Duration("delay", time.Second, "downlink delay after the uplink (tmst), like the RX1 delay")
+	imme := flag.Bool("imme", false, "send the downlinks immediately instead of after -delay")
+	power := flag.Uint("power", 14, "downlink power in dBm")
+	noAck := flag.Bool("noack", false, "do not acknowledge PUSH_DATA and PULL_DATA")
+	flag.Parse()
+
+	var data []byte
+	if *reply != "" {
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(*reply); err != nil {
+			log.Fatalf("can not decode -reply: %v", err)
+		}
+	}
+
+	s, err := fakens.Listen(*up, *down)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.NoAck = *noAck
+	s.Logger = log.New(os.Stdout, "", log.Ltime|log.Lmicroseconds)
+	log.Printf("listening on %s (up) and %s (down)", s.UpAddr(), s.DownAddr())
+
+	for {
+		rx := s.WaitUplink(time.Hour)
+		if rx == nil {
+			continue
+		}
+		log.Printf("rx: %s", rx)
+		if data == nil {
+			continue
+		}
+		tx := &lora.TxPacket{
+			Immediate:   *imme,
+			CountUs:     rx.CountUs + uint32(*delay/time.Microsecond),
+			Freq:        rx.Freq,
+			Power:       uint8(*power),
+			Modulation:  rx.Modulation,
+			LoRaBW:      rx.LoRaBW,
+			LoRaCR:      rx.LoRaCR,
+			Datarate:    rx.Datarate,
+			InvertPolar: true,
+			Data:        data,
+		}
+		token, err := s.Downlink(tx)
+		if err != nil {
+			log.Printf("can not send downlink: %v", err)
+			continue
+		}
+		go func() {
+			if e, ok := s.WaitTxAck(token, *delay+time.Second*5); ok {
+				log.Printf("tx ack %s: %s", token, txAckStr(e))
+			} else {
+				log.Printf("tx ack %s: timeout", token)
+			}
+		}()
+	}
+}
+
+func txAckStr(e fwd.TxAckError) string {
+	if e == fwd.NoError {
+		return "ok"
+	}
+	return e.Error()
+}
@@ -1,11 +1,15 @@
 package main
 
-import "github.com/Waziup/single_chan_pkt_fwd/lora"
+import (
+	"github.com/Waziup/single_chan_pkt_fwd/SX127X"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
 
 // GlobalConfig represents a "global_config.json" file.
 type GlobalConfig struct {
-	SX127XConf    *lora.Config   `json:"SX127X_conf"`
-	GatewayConfig *GatewayConfig `json:"gateway_conf"`
+	SX127XConf    *lora.Config        `json:"SX127X_conf"`
+	BoardConfig   *SX127X.BoardConfig `json:"board_conf"`
+	GatewayConfig *GatewayConfig      `json:"gateway_conf"`
 }
 
 // GatewayConfig ha sht egateway ID and lists servers that we connect to.
@@ -16,5 +20,66 @@ type GatewayConfig struct {
 		PortUp   int    `json:"serv_port_up"`
 		PortDown int    `json:"serv_port_down"`
 		Enabled  bool   `json:"serv_enabled"`
+
+		ProtocolVersion int `json:"protocol_version"` // Semtech UDP protocol version, 1 or 2 (default)
+
+		Type      string `json:"serv_type"`  // "semtech" (UDP, default) or "basicstation" (LNS protocol, server_address is a ws:// or wss:// URI)
+		AuthToken string `json:"auth_token"` // LoRa Basics Station: Authorization header
+		CAFile    string `json:"ca_file"`    // LoRa Basics Station: trusted certificates (PEM) for wss://, instead of the system's
 	} `json:"servers"`
+	LBT  *LBTConfig  `json:"lbt"`
+	MQTT *MQTTConfig `json:"mqtt"`
+
+	Store *StoreConfig `json:"store"`
+
+	Keystore string `json:"keystore"` // file with session keys of ABP devices, to verify and decrypt their uplinks
+
+	Filter *FilterConfig `json:"filter"`
+
+	DownlinkAllow   []string `json:"downlink_allow"`    // IPs or networks (CIDR) that the server address must be in for downlinks to be accepted
+	DownlinkMaxRate int      `json:"downlink_max_rate"` // downlinks accepted per minute and server (0 = unlimited)
+
+	TxLeadTime   int `json:"tx_lead_time"`   // time to prepare the radio before a downlink, in ms (default 30)
+	TxGuardTime  int `json:"tx_guard_time"`  // time between the end of a downlink and the preparation of the next, in ms (default 10)
+	TxStartDelay int `json:"tx_start_delay"` // TX start latency of the radio, in µs: downlinks are started earlier by that time
+
+	StatInterval int     `json:"stat_interval"` // interval of the status reports, in seconds (default 30)
+	RefLatitude  float64 `json:"ref_latitude"`  // location of the gateway, in degree
+	RefLongitude float64 `json:"ref_longitude"` // location of the gateway, in degree
+	RefAltitude  int     `json:"ref_altitude"`  // altitude of the gateway, in meter
+}
+
+// LBTConfig configures listen before talk: downlinks are only sent if the channel is free.
+type LBTConfig struct {
+	Enabled    bool `json:"enable"`
+	RSSITarget int  `json:"rssi_target"` // in dBm, the channel is busy if the RSSI is above (0 = CAD only)
+	MaxTries   int  `json:"max_tries"`   // number of times the channel is checked before the downlink is dropped
+}
+
+// MQTTConfig configures the MQTT bridge: received packets are published to the broker and downlinks
+// are received from it, with the topics and messages of the ChirpStack Gateway Bridge.
+type MQTTConfig struct {
+	Enabled     bool   `json:"enable"`
+	Server      string `json:"server"` // broker, like tcp://127.0.0.1:1883 or ssl://broker.example.com:8883
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	ClientID    string `json:"client_id"`    // default: the gateway ID
+	TopicPrefix string `json:"topic_prefix"` // topics are <topic_prefix>/<gateway ID>/..., default "gateway"
+	QoS         byte   `json:"qos"`
+	CAFile      string `json:"ca_file"` // trusted certificates (PEM) for ssl://, instead of the system's
+}
+
+// FilterConfig configures the uplink filter: only the uplinks of the own network are forwarded.
+type FilterConfig struct {
+	DevAddrs []string `json:"dev_addr"` // DevAddr prefixes like "26000000/7", data uplinks of other DevAddrs are dropped
+	JoinEUIs []string `json:"join_eui"` // JoinEUIs (AppEUIs in 1.0.x), join requests for other JoinEUIs are dropped
+}
+
+// StoreConfig configures store-and-forward: received packets are kept on disk until the servers
+// have acknowledged them, and sent in order once they are reachable again.
+type StoreConfig struct {
+	Enabled bool   `json:"enable"`
+	Dir     string `json:"dir"`      // directory of the stores, one per server (default "store")
+	MaxAge  int    `json:"max_age"`  // in seconds, older packets are dropped (default 86400)
+	MaxSize int    `json:"max_size"` // in kB per server, the oldest packets are dropped (default 10240)
 }
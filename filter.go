@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora/lorawan"
+)
+
+// uplinkFilter drops the uplinks of other networks, by the DevAddr of data frames and the JoinEUI
+// of (re)join requests. Frames that can not be parsed are kept, the servers decide about them.
+type uplinkFilter struct {
+	devAddrs []devAddrPrefix // if empty, data frames of all DevAddrs are kept
+	joinEUIs []lorawan.EUI   // if empty, join requests for all JoinEUIs are kept
+}
+
+// devAddrPrefix is a DevAddr range like 26000000/7 (the NetID type and NwkID of a network).
+type devAddrPrefix struct {
+	addr lorawan.DevAddr
+	bits uint
+}
+
+func (p devAddrPrefix) contains(a lorawan.DevAddr) bool {
+	mask := ^lorawan.DevAddr(0) << (32 - p.bits)
+	return a&mask == p.addr&mask
+}
+
+func (p devAddrPrefix) String() string {
+	return fmt.Sprintf("%s/%d", p.addr, p.bits)
+}
+
+// newUplinkFilter parses the filter config.
+func newUplinkFilter(cfg *FilterConfig) (*uplinkFilter, error) {
+	f := &uplinkFilter{}
+	for _, str := range cfg.DevAddrs {
+		p := devAddrPrefix{bits: 32}
+		if i := strings.IndexByte(str, '/'); i >= 0 {
+			bits, err := strconv.ParseUint(str[i+1:], 10, 8)
+			if err != nil || bits > 32 {
+				return nil, fmt.Errorf("invalid DevAddr prefix length: %q", str)
+			}
+			p.bits = uint(bits)
+			str = str[:i]
+		}
+		addr, err := strconv.ParseUint(str, 16, 32)
+		if err != nil || len(str) != 8 {
+			return nil, fmt.Errorf("invalid DevAddr: %q", str)
+		}
+		p.addr = lorawan.DevAddr(addr)
+		f.devAddrs = append(f.devAddrs, p)
+	}
+	for _, str := range cfg.JoinEUIs {
+		eui, err := strconv.ParseUint(str, 16, 64)
+		if err != nil || len(str) != 16 {
+			return nil, fmt.Errorf("invalid JoinEUI: %q", str)
+		}
+		f.joinEUIs = append(f.joinEUIs, lorawan.EUI(eui))
+	}
+	return f, nil
+}
+
+// accept checks if the uplink frame is kept. The error tells why it is dropped.
+func (f *uplinkFilter) accept(data []byte) error {
+	phy, err := lorawan.Parse(data)
+	if err != nil {
+		return nil
+	}
+	switch {
+	case phy.MACPayload != nil:
+		if !phy.MHDR.MType.Uplink() || len(f.devAddrs) == 0 {
+			return nil
+		}
+		for _, p := range f.devAddrs {
+			if p.contains(phy.MACPayload.FHDR.DevAddr) {
+				return nil
+			}
+		}
+		return fmt.Errorf("DevAddr %s not in %v", phy.MACPayload.FHDR.DevAddr, f.devAddrs)
+	case phy.JoinRequest != nil:
+		return f.acceptJoinEUI(phy.JoinRequest.JoinEUI)
+	case phy.RejoinRequest != nil && phy.RejoinRequest.Type == 1:
+		return f.acceptJoinEUI(phy.RejoinRequest.JoinEUI)
+	}
+	return nil
+}
+
+func (f *uplinkFilter) acceptJoinEUI(eui lorawan.EUI) error {
+	if len(f.joinEUIs) == 0 {
+		return nil
+	}
+	for _, e := range f.joinEUIs {
+		if e == eui {
+			return nil
+		}
+	}
+	return fmt.Errorf("JoinEUI %s not in %v", eui, f.joinEUIs)
+}
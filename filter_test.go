@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+func TestUplinkFilter(t *testing.T) {
+	f, err := newUplinkFilter(&FilterConfig{
+		DevAddrs: []string{"26000000/7", "49BE7DF1"},
+		JoinEUIs: []string{"0102030405060708"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		frame string
+		ok    bool
+	}{
+		{"DevAddr in the prefix", "40 DA1B0126 00 0200 01 95437876 2B11FF0D", true},
+		{"last DevAddr of the prefix", "40 FFFFFF27 00 0200 01 95437876 2B11FF0D", true},
+		{"DevAddr after the prefix", "40 00000028 00 0200 01 95437876 2B11FF0D", false},
+		{"single DevAddr", "80 F17DBE49 00 0200 01 95437876 2B11FF0D", true},
+		{"other DevAddr", "40 F27DBE49 00 0200 01 95437876 2B11FF0D", false},
+		{"downlink of another DevAddr", "60 F27DBE49 00 0200 01 95437876 2B11FF0D", true},
+		{"join request", "00 0807060504030201 1817161514131211 3412 AABBCCDD", true},
+		{"join request for another JoinEUI", "00 0907060504030201 1817161514131211 3412 AABBCCDD", false},
+		{"rejoin request type 1 for another JoinEUI", "C0 01 0907060504030201 1817161514131211 0200 AABBCCDD", false},
+		{"rejoin request type 0", "C0 00 030201 1817161514131211 0100 AABBCCDD", true},
+		{"proprietary", "E0 0102", true},
+		{"not LoRaWAN", "40 F27DBE49", true},
+	}
+	for _, test := range tests {
+		data, _ := hex.DecodeString(strings.Replace(test.frame, " ", "", -1))
+		if err := f.accept(data); (err == nil) != test.ok {
+			t.Errorf("%s: accept() = %v, expected ok %v", test.name, err, test.ok)
+		}
+	}
+
+	// empty lists let all frames pass
+	f, _ = newUplinkFilter(&FilterConfig{JoinEUIs: []string{"0102030405060708"}})
+	if err := f.accept([]byte{0x40, 0xF2, 0x7D, 0xBE, 0x49, 0x00, 0x02, 0x00, 0x2B, 0x11, 0xFF, 0x0D}); err != nil {
+		t.Errorf("accept() = %v without DevAddr prefixes, expected ok", err)
+	}
+	f, _ = newUplinkFilter(&FilterConfig{DevAddrs: []string{"00000000/0"}})
+	if err := f.accept([]byte{0x40, 0xF2, 0x7D, 0xBE, 0x49, 0x00, 0x02, 0x00, 0x2B, 0x11, 0xFF, 0x0D}); err != nil {
+		t.Errorf("accept() = %v with prefix /0, expected ok", err)
+	}
+
+	for _, cfg := range []FilterConfig{
+		{DevAddrs: []string{"26000000/33"}},
+		{DevAddrs: []string{"26000000/"}},
+		{DevAddrs: []string{"260000/7"}},
+		{DevAddrs: []string{"2600000G"}},
+		{JoinEUIs: []string{"01020304050607"}},
+		{JoinEUIs: []string{"010203040506070X"}},
+	} {
+		if _, err := newUplinkFilter(&cfg); err == nil {
+			t.Errorf("newUplinkFilter(%+v) = ok, expected an error", cfg)
+		}
+	}
+}
+
+func TestUplinkFilterRun(t *testing.T) {
+	defer func(d time.Duration) { checkReceived = d }(checkReceived)
+	checkReceived = 10 * time.Millisecond
+
+	gw := newGateway(1)
+	var err error
+	if gw.filter, err = newUplinkFilter(&FilterConfig{DevAddrs: []string{"49BE7DF1"}}); err != nil {
+		t.Fatal(err)
+	}
+	radio, stop := runGateway(gw)
+	defer stop()
+
+	inject := func(data []byte, crc int8) {
+		radio.Inject(&lora.RxPacket{Freq: 868100000, Modulation: "LORA", Datarate: 7, LoRaBW: 8, LoRaCR: 5, StatCRC: crc, Data: data})
+	}
+	inject([]byte{0x40, 0xF2, 0x7D, 0xBE, 0x49, 0x00, 0x02, 0x00, 0x2B, 0x11, 0xFF, 0x0D}, 1)  // dropped
+	inject([]byte{0x40, 0xF2, 0x7D, 0xBE, 0x49, 0x00, 0x02, 0x00, 0x2B, 0x11, 0xFF, 0x0D}, -1) // bad CRC: forwarded
+	inject([]byte{0x40, 0xF1, 0x7D, 0xBE, 0x49, 0x00, 0x02, 0x00, 0x2B, 0x11, 0xFF, 0x0D}, 1)  // forwarded
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		gw.stats.Lock()
+		rxNb, rxFw := gw.stats.RxNb, gw.stats.RxFw
+		gw.stats.Unlock()
+		if rxNb == 3 {
+			if rxFw != 2 {
+				t.Errorf("%d of 3 packets forwarded, expected 2", rxFw)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d packets received, expected 3", rxNb)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
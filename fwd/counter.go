@@ -0,0 +1,55 @@
+package fwd
+
+import (
+	"time"
+)
+
+// Counter emulates the internal 32 bit microsecond counter of a concentrator,
+// as used for the "tmst" timestamps of received and transmitted packets.
+// The counter wraps around every 2^32 µs (about 71.6 minutes).
+type Counter struct {
+	base  time.Time
+	clock func() time.Time
+}
+
+// NewCounter creates a counter that starts at 0 now.
+// The clock returns the current time, time.Now is used if it is nil.
+func NewCounter(clock func() time.Time) *Counter {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &Counter{
+		base:  clock(),
+		clock: clock,
+	}
+}
+
+// Now returns the current counter value.
+func (c *Counter) Now() uint32 {
+	return c.At(c.clock())
+}
+
+// At returns the counter value at t.
+func (c *Counter) At(t time.Time) uint32 {
+	return uint32(int64(t.Sub(c.base) / time.Microsecond))
+}
+
+// At64 returns the counter value at t, extended to 64 bits so that it does not wrap around.
+// The lower 32 bits are the value returned by At.
+func (c *Counter) At64(t time.Time) int64 {
+	return int64(t.Sub(c.base) / time.Microsecond)
+}
+
+// Time returns the time at which the counter has (or had) the value tmst.
+// As the counter wraps around, this is the time closest to now, at most ~35 minutes
+// in the past or in the future.
+func (c *Counter) Time(tmst uint32) time.Time {
+	now := c.clock()
+	return now.Add(time.Duration(int32(tmst-c.At(now))) * time.Microsecond)
+}
+
+// Until returns the duration until the counter has the value tmst (negative if tmst has passed).
+func (c *Counter) Until(tmst uint32) time.Duration {
+	now := c.clock()
+	return time.Duration(int32(tmst-c.At(now))) * time.Microsecond
+}
@@ -0,0 +1,157 @@
+package fwd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// wrap is the period of the counter.
+const wrap = time.Duration(1<<32) * time.Microsecond
+
+func TestCounterWrap(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := base
+	c := NewCounter(func() time.Time { return now })
+
+	if c.Now() != 0 {
+		t.Fatalf("Now() = %d at start, expected 0", c.Now())
+	}
+
+	// one second before the counter wraps around
+	now = base.Add(wrap - time.Second)
+	if got := c.Now(); got != 1<<32-1000000 {
+		t.Errorf("Now() = %d, expected %d", got, uint32(1<<32-1000000))
+	}
+	later := now.Add(2 * time.Second)
+	if got := c.At(later); got != 1000000 {
+		t.Errorf("At(now+2s) = %d, expected 1000000", got)
+	}
+	if got := c.At64(later); got != 1<<32+1000000 || uint32(got) != c.At(later) {
+		t.Errorf("At64(now+2s) = %d, expected %d", got, int64(1<<32+1000000))
+	}
+	if got := c.Time(1000000); !got.Equal(later) {
+		t.Errorf("Time(1000000) = %v, expected %v", got, later)
+	}
+	if got := c.Until(1000000); got != 2*time.Second {
+		t.Errorf("Until(1000000) = %s, expected 2s", got)
+	}
+	if got := c.Time(1<<32 - 2000000); !got.Equal(now.Add(-time.Second)) {
+		t.Errorf("Time(-2s) = %v, expected %v", got, now.Add(-time.Second))
+	}
+
+	// one second after the counter wrapped around
+	now = base.Add(wrap + time.Second)
+	if got := c.Now(); got != 1000000 {
+		t.Errorf("Now() = %d after the wrap, expected 1000000", got)
+	}
+	if got := c.At64(now); got != 1<<32+1000000 {
+		t.Errorf("At64(now) = %d after the wrap, expected %d", got, int64(1<<32+1000000))
+	}
+	if got := c.Until(1<<32 - 1000000); got != -2*time.Second {
+		t.Errorf("Until(-2s) = %s after the wrap, expected -2s", got)
+	}
+	if got := c.Time(1<<32 - 1000000); !got.Equal(now.Add(-2 * time.Second)) {
+		t.Errorf("Time(-2s) = %v after the wrap, expected %v", got, now.Add(-2*time.Second))
+	}
+
+	// the closest time is at most half a period away
+	if got := c.Until(1000000 + 1<<31 - 1); got != time.Duration(1<<31-1)*time.Microsecond {
+		t.Errorf("Until(now+2^31-1 µs) = %s", got)
+	}
+	if got := c.Until(1000000 + 1<<31); got != -time.Duration(1<<31)*time.Microsecond {
+		t.Errorf("Until(now+2^31 µs) = %s", got)
+	}
+}
+
+func downlink(countUs uint32) *Packet {
+	return &Packet{
+		Ident: PullResp,
+		TxPacket: &lora.TxPacket{
+			CountUs:    countUs,
+			Freq:       869525000,
+			Modulation: "LORA",
+			Datarate:   7,
+			LoRaBW:     8, // BW125K
+			LoRaCR:     5,
+			Data:       make([]byte, 10),
+		},
+	}
+}
+
+func TestJITQueueWrap(t *testing.T) {
+	q := NewJITQueue()
+	now := uint32(1<<32 - 100000) // 100 ms before the counter wraps around
+
+	after := downlink(now + 1000000) // 1 s, wrapped to 900000
+	if after.TxPacket.CountUs != 900000 {
+		t.Fatalf("CountUs = %d, expected 900000", after.TxPacket.CountUs)
+	}
+	if err := q.Enqueue(after, now); err != NoError {
+		t.Fatalf("Enqueue across the wrap: %v", err)
+	}
+	before := downlink(now + 500000) // 500 ms, wrapped to 400000
+	if err := q.Enqueue(before, now); err != NoError {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	if d, ok := q.Next(now); !ok || d != 500*time.Millisecond-q.Lead {
+		t.Errorf("Next() = %s, %v, expected %s", d, ok, 500*time.Millisecond-q.Lead)
+	}
+
+	if err := q.Enqueue(downlink(now+1000000), now); err != ErrCollisionPacket {
+		t.Errorf("Enqueue of a colliding packet: %v, expected %v", err, ErrCollisionPacket)
+	}
+	// 50 ms in the past, before the wrap
+	if err := q.Enqueue(downlink(now-50000), now); err != ErrTooLate {
+		t.Errorf("Enqueue in the past: %v, expected %v", err, ErrTooLate)
+	}
+	if err := q.Enqueue(downlink(now+uint32(q.MaxAdvance/time.Microsecond)+1000000), now); err != ErrTooEarly {
+		t.Errorf("Enqueue too far in the future: %v, expected %v", err, ErrTooEarly)
+	}
+
+	if q.Len() != 2 {
+		t.Fatalf("Len() = %d, expected 2", q.Len())
+	}
+	if pkt := q.Pop(); pkt != before {
+		t.Errorf("first packet is at %d, expected %d", pkt.TxPacket.CountUs, before.TxPacket.CountUs)
+	}
+	// after the wrap
+	now += 700000
+	if d, ok := q.Next(now); !ok || d != 300*time.Millisecond-q.Lead {
+		t.Errorf("Next() = %s, %v after the wrap, expected %s", d, ok, 300*time.Millisecond-q.Lead)
+	}
+	if pkt := q.Pop(); pkt != after {
+		t.Errorf("second packet is at %d, expected %d", pkt.TxPacket.CountUs, after.TxPacket.CountUs)
+	}
+}
+
+func TestJITQueueGuard(t *testing.T) {
+	q := NewJITQueue()
+	now := uint32(0)
+	first := downlink(500000)
+	if err := q.Enqueue(first, now); err != NoError {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	end := 500*time.Millisecond + first.TxPacket.TimeOnAir()
+
+	// the next packet can be prepared Guard after the end of the first one
+	next := uint32((end + q.Guard + q.Lead) / time.Microsecond)
+	if err := q.Enqueue(downlink(next-1000), now); err != ErrCollisionPacket {
+		t.Errorf("Enqueue 1 ms within the guard: %v, expected %v", err, ErrCollisionPacket)
+	}
+	if err := q.Enqueue(downlink(next), now); err != NoError {
+		t.Errorf("Enqueue after the guard: %v, expected %v", err, NoError)
+	}
+	// the same before the first packet
+	prev := uint32((500*time.Millisecond - q.Lead - q.Guard - downlink(0).TxPacket.TimeOnAir()) / time.Microsecond)
+	if err := q.Enqueue(downlink(prev+1000), now); err != ErrCollisionPacket {
+		t.Errorf("Enqueue 1 ms within the guard before: %v, expected %v", err, ErrCollisionPacket)
+	}
+	if err := q.Enqueue(downlink(prev), now); err != NoError {
+		t.Errorf("Enqueue before the guard: %v, expected %v", err, NoError)
+	}
+	if q.Len() != 3 {
+		t.Errorf("Len() = %d, expected 3", q.Len())
+	}
+}
@@ -0,0 +1,243 @@
+// Package fakens implements a minimal network server for the Semtech UDP protocol that can be
+// used in place of ChirpStack or TTN, e.g. to test the packet forwarder together with a simulated radio.
+// It acknowledges PUSH_DATA and PULL_DATA, records uplinks, status reports and TX_ACKs
+// and sends downlinks (PULL_RESP) to the gateway.
+package fakens
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// Server is a fake network server.
+type Server struct {
+	up   *net.UDPConn
+	down *net.UDPConn
+
+	mu       sync.Mutex
+	changed  chan struct{} // closed and replaced whenever something is received
+	rx       []*lora.RxPacket
+	next     int // next uplink returned by WaitUplink
+	stats    []*fwd.Stat
+	txAcks   map[fwd.Token]fwd.TxAckError
+	pullAddr *net.UDPAddr // address of the last PULL_DATA
+	gwid     uint64       // gateway of the last PULL_DATA
+	version  uint8        // protocol version of the last PULL_DATA
+
+	// NoAck, if set, disables PUSH_ACK and PULL_ACK, e.g. to simulate an unreachable server.
+	// Like Logger, it must be set before the gateway starts sending.
+	NoAck bool
+
+	// Logger, if set, logs all datagrams.
+	Logger *log.Logger
+}
+
+// Listen creates a new server listening for upstream datagrams on upAddr and for downstream
+// datagrams on downAddr (like ":1700"). If downAddr is empty, upAddr is used for both.
+func Listen(upAddr string, downAddr string) (*Server, error) {
+	s := &Server{
+		changed: make(chan struct{}),
+		txAcks:  make(map[fwd.Token]fwd.TxAckError),
+	}
+	var err error
+	if s.up, err = listen(upAddr); err != nil {
+		return nil, err
+	}
+	s.down = s.up
+	if downAddr != "" && downAddr != upAddr {
+		if s.down, err = listen(downAddr); err != nil {
+			s.up.Close()
+			return nil, err
+		}
+		go s.serve(s.down)
+	}
+	go s.serve(s.up)
+	return s, nil
+}
+
+func listen(addr string) (*net.UDPConn, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP("udp", laddr)
+}
+
+// UpAddr returns the address that upstream datagrams are received on.
+func (s *Server) UpAddr() *net.UDPAddr {
+	return s.up.LocalAddr().(*net.UDPAddr)
+}
+
+// DownAddr returns the address that downstream datagrams are received on.
+func (s *Server) DownAddr() *net.UDPAddr {
+	return s.down.LocalAddr().(*net.UDPAddr)
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	err := s.up.Close()
+	if s.down != s.up {
+		if err2 := s.down.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+	}
+}
+
+// broadcast wakes up all waiting calls. s.mu must be held.
+func (s *Server) broadcast() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// wait waits until cond (called with s.mu held) returns true.
+func (s *Server) wait(timeout time.Duration, cond func() bool) bool {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		if cond() {
+			s.mu.Unlock()
+			return true
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+func (s *Server) serve(conn *net.UDPConn) {
+	var buf [65536]byte
+	for {
+		n, raddr, err := conn.ReadFromUDP(buf[:])
+		if err != nil {
+			return // closed
+		}
+		pkt := &fwd.Packet{}
+		if err := pkt.UnmarshalBinary(buf[:n]); err != nil {
+			s.logf("(<- %s) %v", raddr, err)
+			continue
+		}
+		s.logf("(<- %s) %s", raddr, pkt)
+
+		var ack fwd.Ident
+		s.mu.Lock()
+		switch pkt.Ident {
+		case fwd.PushData:
+			s.rx = append(s.rx, pkt.RxPackets...)
+			if pkt.Stat != nil {
+				s.stats = append(s.stats, pkt.Stat)
+			}
+			ack = fwd.PushAck
+		case fwd.PullData:
+			s.pullAddr = raddr
+			s.gwid = pkt.GatewayID
+			s.version = pkt.Version
+			ack = fwd.PullAck
+		case fwd.TxAck:
+			s.txAcks[pkt.Token] = pkt.TxAck
+		}
+		s.broadcast()
+		s.mu.Unlock()
+
+		if ack != 0 && !s.NoAck {
+			s.send(conn, raddr, &fwd.Packet{Version: pkt.Version, Token: pkt.Token, Ident: ack})
+		}
+	}
+}
+
+func (s *Server) send(conn *net.UDPConn, raddr *net.UDPAddr, pkt *fwd.Packet) error {
+	data, err := pkt.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	s.logf("(-> %s) %s", raddr, pkt)
+	_, err = conn.WriteToUDP(data, raddr)
+	return err
+}
+
+// Uplinks returns all packets that have been received so far.
+func (s *Server) Uplinks() []*lora.RxPacket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pkts := make([]*lora.RxPacket, len(s.rx))
+	copy(pkts, s.rx)
+	return pkts
+}
+
+// WaitUplink waits for the next packet to be received.
+// It returns nil if no packet was received within the timeout.
+func (s *Server) WaitUplink(timeout time.Duration) (pkt *lora.RxPacket) {
+	s.wait(timeout, func() bool {
+		if s.next < len(s.rx) {
+			pkt = s.rx[s.next]
+			s.next++
+			return true
+		}
+		return false
+	})
+	return
+}
+
+// Stats returns all status reports that have been received so far.
+func (s *Server) Stats() []*fwd.Stat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make([]*fwd.Stat, len(s.stats))
+	copy(stats, s.stats)
+	return stats
+}
+
+// WaitPull waits until a gateway has sent PULL_DATA, so that downlinks can be sent.
+// It returns the gateway ID and false if no PULL_DATA was received within the timeout.
+func (s *Server) WaitPull(timeout time.Duration) (gwid uint64, ok bool) {
+	ok = s.wait(timeout, func() bool {
+		gwid = s.gwid
+		return s.pullAddr != nil
+	})
+	return
+}
+
+// Downlink sends the packet in a PULL_RESP to the gateway that sent the last PULL_DATA.
+// Set pkt.Immediate or pkt.CountUs (tmst) to choose when the packet is sent.
+// The token can be used to wait for the TX_ACK (protocol version 2 only).
+func (s *Server) Downlink(pkt *lora.TxPacket) (fwd.Token, error) {
+	s.mu.Lock()
+	raddr, version := s.pullAddr, s.version
+	s.mu.Unlock()
+	if raddr == nil {
+		return fwd.Token{}, fmt.Errorf("no gateway has sent PULL_DATA")
+	}
+	token := fwd.RndToken()
+	return token, s.send(s.down, raddr, &fwd.Packet{
+		Version:  version,
+		Token:    token,
+		Ident:    fwd.PullResp,
+		TxPacket: pkt,
+	})
+}
+
+// WaitTxAck waits for the TX_ACK of the downlink with the token.
+// It returns false if no TX_ACK was received within the timeout.
+func (s *Server) WaitTxAck(token fwd.Token, timeout time.Duration) (e fwd.TxAckError, ok bool) {
+	ok = s.wait(timeout, func() bool {
+		e, ok = s.txAcks[token]
+		return ok
+	})
+	return
+}
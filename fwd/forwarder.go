@@ -10,9 +10,23 @@ import (
 	"github.com/Waziup/single_chan_pkt_fwd/lora"
 )
 
+// Stat is a gateway status report, sent upstream in a PUSH_DATA packet.
 type Stat struct {
+	Time string  `json:"time"`           // UTC system time of the gateway, see StatTimeFormat
+	Lati float64 `json:"lati,omitempty"` // GPS latitude of the gateway in degree (float, N is +)
+	Long float64 `json:"long,omitempty"` // GPS longitude of the gateway in degree (float, E is +)
+	Alti int     `json:"alti,omitempty"` // GPS altitude of the gateway in meter RX (integer)
+	RxNb uint32  `json:"rxnb"`           // Number of radio packets received
+	RxOk uint32  `json:"rxok"`           // Number of radio packets received with a valid PHY CRC
+	RxFw uint32  `json:"rxfw"`           // Number of radio packets forwarded
+	AckR float64 `json:"ackr"`           // Percentage of upstream datagrams that were acknowledged
+	DwNb uint32  `json:"dwnb"`           // Number of downlink datagrams received
+	TxNb uint32  `json:"txnb"`           // Number of packets emitted
 }
 
+// StatTimeFormat is the time format of Stat.Time, e.g. "2014-01-12 08:59:28 GMT".
+const StatTimeFormat = "2006-01-02 15:04:05 GMT"
+
 type TxAckError int
 
 const (
@@ -26,19 +40,40 @@ const (
 	ErrGPSUnloacked                          // Rejected because GPS is unlocked, so GPS timestamp cannot be used
 )
 
+var txAckErrStr = []string{
+	"",
+	"NONE",
+	"TOO_LATE",
+	"TOO_EARLY",
+	"COLLISION_PACKET",
+	"COLLISION_BEACON",
+	"TX_FREQ",
+	"TX_POWER",
+	"GPS_UNLOCKED",
+}
+
 func (err TxAckError) MarshalJSON() ([]byte, error) {
-	var errStr = []string{
-		"",
-		"NONE",
-		"TOO_LATE",
-		"TOO_EARLY",
-		"COLLISION_PACKET",
-		"COLLISION_BEACON",
-		"TX_FREQ",
-		"TX_POWER",
-		"GPS_UNLOCKED",
-	}
-	return []byte(fmt.Sprintf("{\"error\":\"%s\"}", errStr[err])), nil
+	return []byte(fmt.Sprintf("{\"error\":\"%s\"}", txAckErrStr[err])), nil
+}
+
+func (err *TxAckError) UnmarshalJSON(data []byte) error {
+	var msg struct {
+		Error string `json:"error"`
+	}
+	if e := json.Unmarshal(data, &msg); e != nil {
+		return e
+	}
+	if msg.Error == "" {
+		*err = NoError // e.g. only a warning
+		return nil
+	}
+	for i, str := range txAckErrStr {
+		if i != 0 && str == msg.Error {
+			*err = TxAckError(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown TX_ACK error: %q", msg.Error)
 }
 
 func (err TxAckError) Error() string {
@@ -68,7 +103,14 @@ func (t Token) String() string {
 	return fmt.Sprintf("%X", int(t[1])<<8+int(t[0]))
 }
 
+// Versions of the Semtech UDP protocol.
+const (
+	ProtocolVersion1 = 0x01 // legacy version without TX_ACK, PULL_RESP tokens are unused
+	ProtocolVersion2 = 0x02
+)
+
 type Packet struct {
+	Version   uint8            `json:"-"` // protocol version, 0 is ProtocolVersion2
 	Token     Token            `json:"-"`
 	Ident     Ident            `json:"-"`
 	GatewayID uint64           `json:"-"`
@@ -85,6 +127,9 @@ func (pkt *Packet) String() string {
 	case PullAck:
 		return fmt.Sprintf("%s: Token: %s", pkt.Ident, pkt.Token)
 	case PushData:
+		if pkt.Stat != nil {
+			return fmt.Sprintf("%s: Token: %s, Gateway ID: %X, %d rx packets, stat", pkt.Ident, pkt.Token, pkt.GatewayID, len(pkt.RxPackets))
+		}
 		return fmt.Sprintf("%s: Token: %s, Gateway ID: %X, %d rx packets", pkt.Ident, pkt.Token, pkt.GatewayID, len(pkt.RxPackets))
 	case PushAck:
 		return fmt.Sprintf("%s: Token: %s", pkt.Ident, pkt.Token)
@@ -126,11 +171,24 @@ func RndToken() [2]byte {
 	return token
 }
 
+// MarshalBinary encodes the packet as a Semtech UDP datagram.
 func (p *Packet) MarshalBinary() ([]byte, error) {
 
+	version := p.Version
+	if version == 0 {
+		version = ProtocolVersion2
+	}
+	if version != ProtocolVersion1 && version != ProtocolVersion2 {
+		return nil, fmt.Errorf("unknown protocol version: %d", version)
+	}
+
 	var buf bytes.Buffer
-	buf.WriteByte(0x02)   // protocol version = 2
-	buf.Write(p.Token[:]) // random token
+	buf.WriteByte(version) // protocol version
+	if p.Ident == PullResp && version == ProtocolVersion1 {
+		buf.Write([]byte{0, 0}) // unused
+	} else {
+		buf.Write(p.Token[:]) // random token
+	}
 
 	switch p.Ident {
 	case PushData:
@@ -144,9 +202,29 @@ func (p *Packet) MarshalBinary() ([]byte, error) {
 		buf.WriteByte(byte(PullData))                     // PULL_DATA identifier 0x02
 		binary.Write(&buf, binary.BigEndian, p.GatewayID) // Gateway unique identifier (MAC address)
 		return buf.Bytes(), nil
+	case PushAck, PullAck:
+		buf.WriteByte(byte(p.Ident)) // PUSH_ACK identifier 0x01 or PULL_ACK identifier 0x04
+		return buf.Bytes(), nil
+	case PullResp:
+		buf.WriteByte(byte(PullResp)) // PULL_RESP identifier 0x03
+		if p.TxPacket == nil {
+			return nil, fmt.Errorf("PULL_RESP without tx packet")
+		}
+		encoder := json.NewEncoder(&buf)
+		err := encoder.Encode(p)
+		return buf.Bytes(), err
 	case TxAck:
+		if version == ProtocolVersion1 {
+			return nil, fmt.Errorf("TX_ACK requires protocol version 2")
+		}
 		buf.WriteByte(byte(TxAck))                        // TX_ACK identifier 0x05
 		binary.Write(&buf, binary.BigEndian, p.GatewayID) // Gateway unique identifier (MAC address)
+		if p.TxAck != 0 && p.TxAck != NoError {
+			// the JSON object is only needed to report an error
+			encoder := json.NewEncoder(&buf)
+			err := encoder.Encode(p)
+			return buf.Bytes(), err
+		}
 		return buf.Bytes(), nil
 
 	default:
@@ -154,16 +232,26 @@ func (p *Packet) MarshalBinary() ([]byte, error) {
 	}
 }
 
+// UnmarshalBinary decodes a Semtech UDP datagram of any type.
 func (p *Packet) UnmarshalBinary(buf []byte) error {
 
 	if len(buf) < 4 {
 		return fmt.Errorf("buffer to short")
 	}
-	if buf[0] != 0x02 {
+	if buf[0] != ProtocolVersion1 && buf[0] != ProtocolVersion2 {
 		return fmt.Errorf("can not handle version: 0x%x", buf[0])
 	}
+	p.Version = buf[0]
 	copy(p.Token[:], buf[1:3])
 	p.Ident = Ident(buf[3])
+	if p.Version == ProtocolVersion1 {
+		switch p.Ident {
+		case PullResp:
+			p.Token = Token{} // unused
+		case TxAck:
+			return fmt.Errorf("TX_ACK requires protocol version 2")
+		}
+	}
 	switch p.Ident {
 	case PushAck, PullAck:
 		return nil
@@ -172,8 +260,32 @@ func (p *Packet) UnmarshalBinary(buf []byte) error {
 		if err != nil {
 			return fmt.Errorf("can not unmarshal PULL_RESP packet: %q", err)
 		}
+		if p.TxPacket == nil {
+			return fmt.Errorf("can not unmarshal PULL_RESP packet: no txpk")
+		}
+		return nil
+	case PushData, PullData, TxAck:
+		if len(buf) < 12 {
+			return fmt.Errorf("buffer to short for %s", p.Ident)
+		}
+		p.GatewayID = binary.BigEndian.Uint64(buf[4:12])
+		switch p.Ident {
+		case PushData:
+			err := json.Unmarshal(buf[12:], p)
+			if err != nil {
+				return fmt.Errorf("can not unmarshal PUSH_DATA packet: %q", err)
+			}
+		case TxAck:
+			p.TxAck = NoError // the JSON object is optional without error
+			if len(bytes.TrimSpace(buf[12:])) != 0 {
+				err := json.Unmarshal(buf[12:], p)
+				if err != nil {
+					return fmt.Errorf("can not unmarshal TX_ACK packet: %q", err)
+				}
+			}
+		}
 		return nil
 	default:
-		return fmt.Errorf("can not unmarshal downstream packet type 0x%x", buf[3])
+		return fmt.Errorf("can not unmarshal packet type 0x%x", buf[3])
 	}
 }
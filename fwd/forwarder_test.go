@@ -0,0 +1,173 @@
+package fwd
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+func TestPacketBinary(t *testing.T) {
+	rx := &lora.RxPacket{CountUs: 3512348611, Freq: 868100000, StatCRC: 1, Modulation: "LORA", LoRaBW: 8, LoRaCR: 5, Datarate: 7, RSSI: -35, LoRaSNR: 5.5, Data: []byte("uplink")}
+	tx := &lora.TxPacket{CountUs: 3512348611, Freq: 869525000, Power: 14, Modulation: "LORA", LoRaBW: 8, LoRaCR: 5, Datarate: 9, InvertPolar: true, Data: []byte("downlink")}
+	stat := &Stat{Time: "2014-01-12 08:59:28 GMT", RxNb: 2, RxOk: 2, RxFw: 2, AckR: 100, DwNb: 2, TxNb: 2}
+	token := Token{0x12, 0x34}
+
+	tests := []struct {
+		name   string
+		pkt    *Packet
+		header []byte // version, token, identifier and gateway ID
+	}{
+		{"PUSH_DATA", &Packet{Version: ProtocolVersion2, Token: token, Ident: PushData, GatewayID: 0x0102030405060708, RxPackets: []*lora.RxPacket{rx}},
+			[]byte{2, 0x12, 0x34, 0, 1, 2, 3, 4, 5, 6, 7, 8}},
+		{"PUSH_DATA with stat", &Packet{Version: ProtocolVersion2, Token: token, Ident: PushData, GatewayID: 0x0102030405060708, Stat: stat},
+			[]byte{2, 0x12, 0x34, 0, 1, 2, 3, 4, 5, 6, 7, 8}},
+		{"PUSH_ACK", &Packet{Version: ProtocolVersion2, Token: token, Ident: PushAck},
+			[]byte{2, 0x12, 0x34, 1}},
+		{"PULL_DATA", &Packet{Version: ProtocolVersion2, Token: token, Ident: PullData, GatewayID: 0x0102030405060708},
+			[]byte{2, 0x12, 0x34, 2, 1, 2, 3, 4, 5, 6, 7, 8}},
+		{"PULL_RESP", &Packet{Version: ProtocolVersion2, Token: token, Ident: PullResp, TxPacket: tx},
+			[]byte{2, 0x12, 0x34, 3}},
+		{"PULL_ACK", &Packet{Version: ProtocolVersion2, Token: token, Ident: PullAck},
+			[]byte{2, 0x12, 0x34, 4}},
+		{"TX_ACK", &Packet{Version: ProtocolVersion2, Token: token, Ident: TxAck, GatewayID: 0x0102030405060708, TxAck: NoError},
+			[]byte{2, 0x12, 0x34, 5, 1, 2, 3, 4, 5, 6, 7, 8}},
+		{"TX_ACK with error", &Packet{Version: ProtocolVersion2, Token: token, Ident: TxAck, GatewayID: 0x0102030405060708, TxAck: ErrCollisionPacket},
+			[]byte{2, 0x12, 0x34, 5, 1, 2, 3, 4, 5, 6, 7, 8}},
+	}
+	for _, test := range tests {
+		data, err := test.pkt.MarshalBinary()
+		if err != nil {
+			t.Errorf("%s: MarshalBinary() = %v", test.name, err)
+			continue
+		}
+		if len(data) < len(test.header) || !reflect.DeepEqual(data[:len(test.header)], test.header) {
+			t.Errorf("%s: MarshalBinary() = % X, expected the header % X", test.name, data, test.header)
+			continue
+		}
+		var pkt Packet
+		if err := pkt.UnmarshalBinary(data); err != nil {
+			t.Errorf("%s: UnmarshalBinary(%q) = %v", test.name, data, err)
+			continue
+		}
+		if !reflect.DeepEqual(&pkt, test.pkt) {
+			t.Errorf("%s: UnmarshalBinary(%q) = %+v, expected %+v", test.name, data, &pkt, test.pkt)
+		}
+	}
+
+	// a TX_ACK without error has no JSON object
+	data, _ := (&Packet{Token: token, Ident: TxAck, GatewayID: 1}).MarshalBinary()
+	if len(data) != 12 {
+		t.Errorf("TX_ACK without error = %q, expected only the header", data)
+	}
+	// the version defaults to 2
+	if data[0] != ProtocolVersion2 {
+		t.Errorf("TX_ACK without version = % X, expected version 2", data)
+	}
+}
+
+func TestPacketBinaryInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"too short", []byte{2, 0x12, 0x34}},
+		{"unknown version", []byte{3, 0x12, 0x34, 1}},
+		{"unknown identifier", []byte{2, 0x12, 0x34, 6}},
+		{"PUSH_DATA without gateway ID", []byte{2, 0x12, 0x34, 0, 1, 2, 3}},
+		{"PUSH_DATA with invalid JSON", append([]byte{2, 0x12, 0x34, 0, 1, 2, 3, 4, 5, 6, 7, 8}, `{"rxpk":`...)},
+		{"PULL_RESP without txpk", append([]byte{2, 0x12, 0x34, 3}, `{}`...)},
+		{"TX_ACK with unknown error", append([]byte{2, 0x12, 0x34, 5, 1, 2, 3, 4, 5, 6, 7, 8}, `{"txpk_ack":{"error":"BUSY"}}`...)},
+	}
+	for _, test := range tests {
+		var pkt Packet
+		if err := pkt.UnmarshalBinary(test.data); err == nil {
+			t.Errorf("%s: UnmarshalBinary(% X) = %+v, expected an error", test.name, test.data, &pkt)
+		}
+	}
+
+	if data, err := (&Packet{Ident: PullResp}).MarshalBinary(); err == nil {
+		t.Errorf("MarshalBinary(PULL_RESP without txpk) = % X, expected an error", data)
+	}
+	if data, err := (&Packet{Ident: 6}).MarshalBinary(); err == nil {
+		t.Errorf("MarshalBinary(unknown identifier) = % X, expected an error", data)
+	}
+}
+
+func TestTxAckErrorJSON(t *testing.T) {
+	tests := []struct {
+		data string
+		err  TxAckError
+	}{
+		{`{"error":"NONE"}`, NoError},
+		{`{"error":"TOO_LATE"}`, ErrTooLate},
+		{`{"error":"TOO_EARLY"}`, ErrTooEarly},
+		{`{"error":"COLLISION_PACKET"}`, ErrCollisionPacket},
+		{`{"error":"COLLISION_BEACON"}`, ErrCollisionBeacon},
+		{`{"error":"TX_FREQ"}`, ErrTxFreq},
+		{`{"error":"TX_POWER"}`, ErrTxPower},
+		{`{"error":"GPS_UNLOCKED"}`, ErrGPSUnloacked},
+	}
+	for _, test := range tests {
+		var err TxAckError
+		if e := json.Unmarshal([]byte(test.data), &err); e != nil || err != test.err {
+			t.Errorf("UnmarshalJSON(%s) = %d (%v), expected %d", test.data, err, e, test.err)
+		}
+		if data, _ := json.Marshal(test.err); string(data) != test.data {
+			t.Errorf("MarshalJSON(%d) = %s, expected %s", test.err, data, test.data)
+		}
+	}
+
+	// a warning without error
+	var err TxAckError
+	if e := json.Unmarshal([]byte(`{"warn":"TX_POWER"}`), &err); e != nil || err != NoError {
+		t.Errorf("UnmarshalJSON(warning) = %d (%v), expected NoError", err, e)
+	}
+	for _, data := range []string{`{"error":"BUSY"}`, `{"error":""`, `"TOO_LATE"`} {
+		if e := json.Unmarshal([]byte(data), &err); e == nil {
+			t.Errorf("UnmarshalJSON(%s) = %d, expected an error", data, err)
+		}
+	}
+}
+
+func TestPacketVersion1(t *testing.T) {
+	tx := &lora.TxPacket{CountUs: 1, Freq: 869525000, Modulation: "LORA", LoRaBW: 8, LoRaCR: 5, Datarate: 9, Data: []byte("downlink")}
+	token := Token{0x12, 0x34}
+
+	// the version byte is written, PULL_RESP has no token
+	tests := []struct {
+		name   string
+		pkt    *Packet
+		header []byte
+	}{
+		{"PUSH_DATA", &Packet{Version: ProtocolVersion1, Token: token, Ident: PushData, GatewayID: 1}, []byte{1, 0x12, 0x34, 0}},
+		{"PUSH_ACK", &Packet{Version: ProtocolVersion1, Token: token, Ident: PushAck}, []byte{1, 0x12, 0x34, 1}},
+		{"PULL_DATA", &Packet{Version: ProtocolVersion1, Token: token, Ident: PullData, GatewayID: 1}, []byte{1, 0x12, 0x34, 2}},
+		{"PULL_RESP", &Packet{Version: ProtocolVersion1, Token: token, Ident: PullResp, TxPacket: tx}, []byte{1, 0, 0, 3}},
+		{"PULL_ACK", &Packet{Version: ProtocolVersion1, Token: token, Ident: PullAck}, []byte{1, 0x12, 0x34, 4}},
+	}
+	for _, test := range tests {
+		data, err := test.pkt.MarshalBinary()
+		if err != nil || len(data) < 4 || !reflect.DeepEqual(data[:4], test.header) {
+			t.Errorf("%s: MarshalBinary() = % X (%v), expected the header % X", test.name, data, err, test.header)
+		}
+	}
+
+	// the token of a received PULL_RESP is ignored
+	data := append([]byte{1, 0x12, 0x34, 3}, `{"txpk":{"imme":true,"freq":869.525,"modu":"LORA","datr":"SF9BW125","codr":"4/5","data":""}}`...)
+	var pkt Packet
+	if err := pkt.UnmarshalBinary(data); err != nil || pkt.Version != ProtocolVersion1 || pkt.Token != (Token{}) {
+		t.Errorf("UnmarshalBinary(PULL_RESP v1) = %+v (%v), expected version 1 without token", &pkt, err)
+	}
+
+	// there is no TX_ACK in version 1
+	if data, err := (&Packet{Version: ProtocolVersion1, Token: token, Ident: TxAck, GatewayID: 1}).MarshalBinary(); err == nil {
+		t.Errorf("MarshalBinary(TX_ACK v1) = % X, expected an error", data)
+	}
+	data = []byte{1, 0x12, 0x34, 5, 1, 2, 3, 4, 5, 6, 7, 8}
+	if err := pkt.UnmarshalBinary(data); err == nil {
+		t.Errorf("UnmarshalBinary(TX_ACK v1) = %+v, expected an error", &pkt)
+	}
+}
@@ -0,0 +1,106 @@
+package fwd
+
+import (
+	"time"
+)
+
+// Defaults for the JITQueue.
+const (
+	DefaultTxLead       = 30 * time.Millisecond
+	DefaultTxGuard      = 10 * time.Millisecond
+	DefaultTxMaxAdvance = 384 * time.Second // 3 beacon periods
+)
+
+// JITQueue is a "just in time" queue for downlink packets, ordered by the time they must
+// be sent at (TxPacket.CountUs). Timestamps are values of the forwarder's Counter
+// and might wrap around.
+type JITQueue struct {
+	// Lead is the time it takes to prepare the radio before a packet is sent.
+	// Packets must be enqueued at least Lead before they are sent, and Next returns
+	// the time until Lead before the first packet.
+	Lead time.Duration
+	// Guard is the time between the end of a packet and the preparation of the next packet
+	// (Lead before its start), e.g. for the radio to leave TX mode.
+	Guard time.Duration
+	// MaxAdvance is the maximum time a packet can be enqueued before it is sent.
+	MaxAdvance time.Duration
+
+	pkts []*Packet
+}
+
+// NewJITQueue creates an empty queue with the default settings.
+func NewJITQueue() *JITQueue {
+	return &JITQueue{
+		Lead:       DefaultTxLead,
+		Guard:      DefaultTxGuard,
+		MaxAdvance: DefaultTxMaxAdvance,
+	}
+}
+
+// since returns the time from now until the counter value t (negative if t has passed).
+func since(t uint32, now uint32) time.Duration {
+	return time.Duration(int32(t-now)) * time.Microsecond
+}
+
+// Enqueue adds the PULL_RESP packet to the queue, now is the current counter value.
+// Immediate packets are scheduled as soon as possible.
+// If the packet can not be sent in time, it is not added and an error is returned:
+// ErrTooLate, ErrTooEarly or ErrCollisionPacket if it overlaps with a queued packet.
+func (q *JITQueue) Enqueue(pkt *Packet, now uint32) TxAckError {
+	tx := pkt.TxPacket
+	if tx.Immediate {
+		tx.CountUs = now + uint32(q.Lead/time.Microsecond)
+	}
+
+	start := since(tx.CountUs, now)
+	if start < q.Lead {
+		return ErrTooLate
+	}
+	if start > q.MaxAdvance {
+		return ErrTooEarly
+	}
+	end := start + tx.TimeOnAir()
+
+	// the radio is busy with a packet from Lead before its start until Guard after its end
+	i := 0
+	for ; i < len(q.pkts); i++ {
+		other := q.pkts[i].TxPacket
+		otherStart := since(other.CountUs, now)
+		otherEnd := otherStart + other.TimeOnAir()
+		if start-q.Lead < otherEnd+q.Guard && otherStart-q.Lead < end+q.Guard {
+			return ErrCollisionPacket
+		}
+		if otherStart > start {
+			break
+		}
+	}
+
+	q.pkts = append(q.pkts, nil)
+	copy(q.pkts[i+1:], q.pkts[i:])
+	q.pkts[i] = pkt
+	return NoError
+}
+
+// Next returns the time from now until the first packet must be prepared for sending,
+// or false if the queue is empty.
+func (q *JITQueue) Next(now uint32) (time.Duration, bool) {
+	if len(q.pkts) == 0 {
+		return 0, false
+	}
+	return since(q.pkts[0].TxPacket.CountUs, now) - q.Lead, true
+}
+
+// Pop removes and returns the first packet of the queue, or nil if the queue is empty.
+func (q *JITQueue) Pop() *Packet {
+	if len(q.pkts) == 0 {
+		return nil
+	}
+	pkt := q.pkts[0]
+	q.pkts = q.pkts[1:]
+	return pkt
+}
+
+// Len returns the number of packets in the queue.
+func (q *JITQueue) Len() int {
+	return len(q.pkts)
+}
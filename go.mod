@@ -3,6 +3,9 @@ module github.com/Waziup/single_chan_pkt_fwd
 go 1.13
 
 require (
+	github.com/eclipse/paho.mqtt.golang v1.2.0
+	github.com/gorilla/websocket v1.5.0
+	golang.org/x/net v0.0.0-20200425230154-ff2c4b7c35a0 // indirect
 	golang.org/x/sys v0.0.0-20210119212857-b64e53b001e4
 	periph.io/x/conn/v3 v3.6.7
 	periph.io/x/host/v3 v3.6.7
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"sync"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora/lorawan"
+)
+
+// keystore holds the LoRaWAN 1.0.x session keys of devices, so that the MIC of their uplinks can be
+// verified and the payload decrypted without a network server.
+type keystore struct {
+	mu      sync.Mutex
+	devices map[lorawan.DevAddr]*device
+}
+
+type device struct {
+	nwkSKey lorawan.AES128Key
+	appSKey lorawan.AES128Key
+	fCnt    uint32 // of the last valid uplink
+	seen    bool   // whether fCnt is known
+}
+
+// keystoreEntry is an entry of the keystore file, with hex encoded fields.
+type keystoreEntry struct {
+	DevAddr string `json:"dev_addr"`
+	NwkSKey string `json:"nwk_s_key"`
+	AppSKey string `json:"app_s_key"`
+}
+
+// decrypted is a data uplink of a device of the keystore, with valid MIC.
+type decrypted struct {
+	devAddr lorawan.DevAddr
+	fCnt    uint32 // full frame counter
+	fPort   int    // -1 if the frame has no payload
+	payload []byte // decrypted FRMPayload
+}
+
+// loadKeystore reads a keystore file, a JSON list of keystoreEntry.
+func loadKeystore(file string) (*keystore, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("can not read keystore: %v", err)
+	}
+	var entries []keystoreEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("can not parse keystore %s: %v", file, err)
+	}
+	ks := &keystore{devices: make(map[lorawan.DevAddr]*device)}
+	for i, entry := range entries {
+		devAddr, err := strconv.ParseUint(entry.DevAddr, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("keystore %s, entry %d: can not parse dev_addr: %v", file, i+1, err)
+		}
+		dev := new(device)
+		if dev.nwkSKey, err = parseKey(entry.NwkSKey); err != nil {
+			return nil, fmt.Errorf("keystore %s, entry %d: can not parse nwk_s_key: %v", file, i+1, err)
+		}
+		if dev.appSKey, err = parseKey(entry.AppSKey); err != nil {
+			return nil, fmt.Errorf("keystore %s, entry %d: can not parse app_s_key: %v", file, i+1, err)
+		}
+		ks.devices[lorawan.DevAddr(devAddr)] = dev
+	}
+	return ks, nil
+}
+
+func parseKey(s string) (key lorawan.AES128Key, err error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return key, err
+	}
+	if len(b) != len(key) {
+		return key, fmt.Errorf("must have %d bytes, got %d", len(key), len(b))
+	}
+	copy(key[:], b)
+	return key, nil
+}
+
+// len returns the number of devices.
+func (ks *keystore) len() int {
+	return len(ks.devices)
+}
+
+// decrypt verifies the MIC of a data uplink and decrypts its payload.
+// It returns nil if the frame is not a data uplink of a device of the keystore.
+func (ks *keystore) decrypt(data []byte) (*decrypted, error) {
+	phy, err := lorawan.Parse(data)
+	if err != nil || !phy.MHDR.MType.Uplink() || phy.MACPayload == nil {
+		return nil, nil
+	}
+	mac := phy.MACPayload
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	dev, ok := ks.devices[mac.FHDR.DevAddr]
+	if !ok {
+		return nil, nil
+	}
+
+	// the frame has the lower 16 bits of the counter, the upper bits follow the last valid uplink
+	fCnt := uint32(mac.FHDR.FCnt)
+	candidates := []uint32{fCnt}
+	if dev.seen {
+		full := dev.fCnt&^0xffff | fCnt
+		if full < dev.fCnt {
+			full += 0x10000
+		}
+		if full != fCnt {
+			// fCnt alone is still tried, for devices that have been reset
+			candidates = []uint32{full, fCnt}
+		}
+	}
+	for _, fCnt := range candidates {
+		if ok, err := phy.ValidDataMIC(dev.nwkSKey, fCnt); err != nil || !ok {
+			continue
+		}
+		dev.fCnt, dev.seen = fCnt, true
+		d := &decrypted{
+			devAddr: mac.FHDR.DevAddr,
+			fCnt:    fCnt,
+			fPort:   mac.FPort,
+		}
+		if mac.FPort >= 0 {
+			key := dev.appSKey
+			if mac.FPort == 0 {
+				key = dev.nwkSKey
+			}
+			d.payload = lorawan.EncryptFRMPayload(key, true, mac.FHDR.DevAddr, fCnt, mac.FRMPayload)
+		}
+		return d, nil
+	}
+	return nil, fmt.Errorf("DevAddr %s, FCnt %d: invalid MIC", mac.FHDR.DevAddr, mac.FHDR.FCnt)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora/lorawan"
+)
+
+var (
+	testNwkSKey = lorawan.AES128Key{0x44, 0x02, 0x42, 0x41, 0xed, 0x4c, 0xe9, 0xa6, 0x8c, 0x6a, 0x8b, 0xc0, 0x55, 0x23, 0x3f, 0xd3}
+	testAppSKey = lorawan.AES128Key{0xec, 0x92, 0x58, 0x02, 0xae, 0x43, 0x0c, 0xa7, 0x7f, 0xd3, 0xdd, 0x73, 0xcb, 0x2c, 0xc5, 0x88}
+)
+
+// uplink builds a data uplink of the device 49BE7DF1 with the full frame counter fCnt.
+func uplink(t *testing.T, fCnt uint32, fPort int, payload string) []byte {
+	p := &lorawan.PHYPayload{
+		MHDR: lorawan.MHDR{MType: lorawan.UnconfirmedDataUp},
+		MACPayload: &lorawan.MACPayload{
+			FHDR:  lorawan.FHDR{DevAddr: 0x49BE7DF1, FCnt: uint16(fCnt)},
+			FPort: fPort,
+		},
+	}
+	if fPort >= 0 {
+		key := testAppSKey
+		if fPort == 0 {
+			key = testNwkSKey
+		}
+		p.MACPayload.FRMPayload = lorawan.EncryptFRMPayload(key, true, 0x49BE7DF1, fCnt, []byte(payload))
+	}
+	var err error
+	if p.MIC, err = p.DataMIC(testNwkSKey, fCnt); err != nil {
+		t.Fatal(err)
+	}
+	data, err := p.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestKeystoreDecrypt(t *testing.T) {
+	ks := &keystore{devices: map[lorawan.DevAddr]*device{
+		0x49BE7DF1: {nwkSKey: testNwkSKey, appSKey: testAppSKey},
+	}}
+
+	tests := []struct {
+		name    string
+		frame   []byte
+		fCnt    uint32 // 0: not decrypted
+		fPort   int
+		payload string
+	}{
+		{"known frame", []byte{0x40, 0xF1, 0x7D, 0xBE, 0x49, 0x00, 0x02, 0x00, 0x01, 0x95, 0x43, 0x78, 0x76, 0x2B, 0x11, 0xFF, 0x0D}, 2, 1, "test"},
+		{"next frame", uplink(t, 0xfffe, 2, "a"), 0xfffe, 2, "a"},
+		{"16 bit rollover", uplink(t, 0x10001, 2, "b"), 0x10001, 2, "b"},
+		{"same upper bits", uplink(t, 0x10005, 2, "c"), 0x10005, 2, "c"},
+		{"32 bit counter with a 16 bit counter below the last", uplink(t, 0x20003, 2, "d"), 0x20003, 2, "d"},
+		{"device reset", uplink(t, 1, 2, "e"), 1, 2, "e"},
+		{"counter after the reset", uplink(t, 2, 3, "f"), 2, 3, "f"},
+		{"MAC commands, with the NwkSKey", uplink(t, 3, 0, "\x02"), 3, 0, "\x02"},
+		{"no FPort", uplink(t, 4, -1, ""), 4, -1, ""},
+		{"upper bits too far ahead", uplink(t, 0x20005, 1, "g"), 0, 0, ""},
+	}
+	for _, test := range tests {
+		d, err := ks.decrypt(test.frame)
+		if test.fCnt == 0 {
+			if err == nil {
+				t.Errorf("%s: decrypt() = %+v, expected an invalid MIC", test.name, d)
+			}
+			continue
+		}
+		if err != nil || d == nil {
+			t.Errorf("%s: decrypt() = %+v (%v), expected FCnt %d", test.name, d, err, test.fCnt)
+			continue
+		}
+		if d.devAddr != 0x49BE7DF1 || d.fCnt != test.fCnt || d.fPort != test.fPort || string(d.payload) != test.payload {
+			t.Errorf("%s: decrypt() = %+v, expected FCnt %d, FPort %d, %q", test.name, d, test.fCnt, test.fPort, test.payload)
+		}
+	}
+
+	// a wrong MIC does not change the counter
+	frame := uplink(t, 5, 1, "h")
+	frame[len(frame)-1] ^= 0xff
+	if d, err := ks.decrypt(frame); err == nil {
+		t.Errorf("decrypt(wrong MIC) = %+v, expected an error", d)
+	}
+	if dev := ks.devices[0x49BE7DF1]; dev.fCnt != 4 {
+		t.Errorf("FCnt %d after an invalid MIC, expected 4", dev.fCnt)
+	}
+
+	// frames that are not data uplinks of a device of the keystore are skipped
+	other := uplink(t, 1, 1, "i")
+	other[1] ^= 0xff
+	down := uplink(t, 1, 1, "j")
+	down[0] = byte(lorawan.UnconfirmedDataDown) << 5
+	for name, frame := range map[string][]byte{
+		"unknown DevAddr": other,
+		"downlink":        down,
+		"join request":    {0x00, 8, 7, 6, 5, 4, 3, 2, 1, 8, 7, 6, 5, 4, 3, 2, 1, 0x34, 0x12, 1, 2, 3, 4},
+		"not LoRaWAN":     {0x40, 0xF1},
+	} {
+		if d, err := ks.decrypt(frame); d != nil || err != nil {
+			t.Errorf("%s: decrypt() = %+v (%v), expected nil", name, d, err)
+		}
+	}
+}
+
+func TestLoadKeystore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		data string
+		ok   bool
+	}{
+		{"valid", `[
+			{"dev_addr": "49BE7DF1", "nwk_s_key": "44024241ed4ce9a68c6a8bc055233fd3", "app_s_key": "EC925802AE430CA77FD3DD73CB2CC588"},
+			{"dev_addr": "26011bda", "nwk_s_key": "000102030405060708090A0B0C0D0E0F", "app_s_key": "000102030405060708090A0B0C0D0E0F"}
+		]`, true},
+		{"empty", `[]`, true},
+		{"not a list", `{"dev_addr": "49BE7DF1"}`, false},
+		{"invalid JSON", `[{"dev_addr": "49BE7DF1",}]`, false},
+		{"invalid dev_addr", `[{"dev_addr": "49BE7DF1X", "nwk_s_key": "44024241ed4ce9a68c6a8bc055233fd3", "app_s_key": "ec925802ae430ca77fd3dd73cb2cc588"}]`, false},
+		{"dev_addr too long", `[{"dev_addr": "149BE7DF1", "nwk_s_key": "44024241ed4ce9a68c6a8bc055233fd3", "app_s_key": "ec925802ae430ca77fd3dd73cb2cc588"}]`, false},
+		{"short nwk_s_key", `[{"dev_addr": "49BE7DF1", "nwk_s_key": "44024241ed4ce9a68c6a8bc055233f", "app_s_key": "ec925802ae430ca77fd3dd73cb2cc588"}]`, false},
+		{"no app_s_key", `[{"dev_addr": "49BE7DF1", "nwk_s_key": "44024241ed4ce9a68c6a8bc055233fd3"}]`, false},
+		{"app_s_key not hex", `[{"dev_addr": "49BE7DF1", "nwk_s_key": "44024241ed4ce9a68c6a8bc055233fd3", "app_s_key": "ec925802ae430ca77fd3dd73cb2cc58g"}]`, false},
+	}
+	for _, test := range tests {
+		file := filepath.Join(dir, test.name)
+		if err := ioutil.WriteFile(file, []byte(test.data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadKeystore(file); (err == nil) != test.ok {
+			t.Errorf("%s: loadKeystore() = %v, expected ok %v", test.name, err, test.ok)
+		}
+	}
+
+	ks, err := loadKeystore(filepath.Join(dir, "valid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks.len() != 2 {
+		t.Fatalf("%d devices, expected 2", ks.len())
+	}
+	if dev := ks.devices[0x49BE7DF1]; dev == nil || dev.nwkSKey != testNwkSKey || dev.appSKey != testAppSKey || dev.seen {
+		t.Errorf("device 49BE7DF1 %+v, expected the keys of the file", dev)
+	}
+	if ks.devices[0x26011BDA] == nil {
+		t.Error("device 26011BDA not loaded")
+	}
+
+	if _, err := loadKeystore(filepath.Join(dir, "missing")); err == nil {
+		t.Error("loadKeystore(missing file) = ok, expected an error")
+	}
+}
@@ -0,0 +1,61 @@
+package lora
+
+import (
+	"math"
+	"time"
+)
+
+// bandwidthsHz are the LoRa bandwidths in Hz by their LoRaBW index.
+var bandwidthsHz = []float64{0, 7800, 10400, 15600, 20800, 31250, 41700, 62500, 125000, 250000, 500000}
+
+// TimeOnAir returns the duration of the transmission of the packet,
+// as described in the SX1276 datasheet (LoRa) and for LoRaWAN style FSK packets
+// (preamble, 3 bytes sync word, length byte, payload and CRC).
+func (tx *TxPacket) TimeOnAir() time.Duration {
+	if tx.Modulation == "FSK" {
+		if tx.Datarate == 0 {
+			return 0
+		}
+		preamble := int(tx.PreambleLength)
+		if preamble == 0 {
+			preamble = 5
+		}
+		bytes := preamble + 3 + 1 + len(tx.Data)
+		if !tx.NoCRC {
+			bytes += 2
+		}
+		return time.Duration(bytes*8) * time.Second / time.Duration(tx.Datarate)
+	}
+
+	if int(tx.LoRaBW) >= len(bandwidthsHz) || tx.LoRaBW == 0 {
+		return 0
+	}
+	sf := float64(tx.Datarate)
+	tsym := math.Exp2(sf) / bandwidthsHz[tx.LoRaBW] // in seconds
+
+	preamble := float64(tx.PreambleLength)
+	if preamble == 0 {
+		preamble = 8
+	}
+	tPreamble := (preamble + 4.25) * tsym
+
+	de := 0.0
+	if tsym > 0.016 {
+		de = 1 // LowDataRateOptimize
+	}
+	crc, ih := 1.0, 0.0
+	if tx.NoCRC {
+		crc = 0
+	}
+	if tx.NoHeader || tx.Datarate == 6 {
+		ih = 1
+	}
+	cr := float64(tx.LoRaCR) - 4
+	if cr < 1 {
+		cr = 1
+	}
+	n := math.Ceil((8*float64(len(tx.Data))-4*sf+28+16*crc-20*ih)/(4*(sf-2*de))) * (cr + 4)
+	payloadSymbols := 8 + math.Max(n, 0)
+
+	return time.Duration((tPreamble + payloadSymbols*tsym) * float64(time.Second))
+}
@@ -5,7 +5,12 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora/lorawan"
 )
 
 // TxPacket
@@ -32,6 +37,8 @@ type TxPacket struct {
 
 	InvertPolar bool // Lora modulation polarization inversion
 
+	NoHeader bool // Implicit header mode, e.g. for beacons (not part of the txpk JSON)
+
 	// LoRa: LoRa spreading factor: SF7 (0x07) to SF12 (0x0c)
 	// FSK: Datarate (bits per second)
 	Datarate uint32
@@ -41,7 +48,7 @@ type TxPacket struct {
 	NoCRC bool // No CRC
 
 	// FSK only
-	FreqDev uint8 // FSK frequency deviation, in Hz
+	FreqDev uint8 // FSK frequency deviation, in kHz
 
 	Data []byte // packet payload
 }
@@ -74,58 +81,19 @@ func (tx *TxPacket) UnmarshalJSON(data []byte) error {
 	tx.Immediate = txpk.Immediate
 	tx.CountUs = txpk.CountUs
 	tx.NoCRC = txpk.NoCRC
-	tx.Freq = uint32(txpk.Freq * 1.0e6)
+	tx.Freq = uint32(math.Round(txpk.Freq * 1e6))
 	tx.ChainRF = txpk.ChainRF
 	tx.Power = txpk.Power
 	switch txpk.Modulation {
 	case "LORA":
 		tx.Modulation = "LORA"
-		var bw int
 
-		datr, ok := txpk.Datarate.(string)
-		if !ok {
-			return fmt.Errorf("can not parse lora datarate (not a string): %+v", txpk.Datarate)
+		var err error
+		if tx.Datarate, tx.LoRaBW, err = parseLoRaDatarate(txpk.Datarate); err != nil {
+			return err
 		}
-
-		_, err := fmt.Sscanf(datr, "SF%dBW%d", &tx.Datarate, &bw)
-		if err != nil {
-			return fmt.Errorf("can not parse lora datarate %q: %v", datr, err)
-		}
-		switch bw {
-		case 7:
-			tx.LoRaBW = 1
-		case 10:
-			tx.LoRaBW = 2
-		case 15:
-			tx.LoRaBW = 3
-		case 20:
-			tx.LoRaBW = 4
-		case 31:
-			tx.LoRaBW = 5
-		case 41:
-			tx.LoRaBW = 6
-		case 62:
-			tx.LoRaBW = 7
-		case 125:
-			tx.LoRaBW = 8
-		case 250:
-			tx.LoRaBW = 9
-		case 500:
-			tx.LoRaBW = 10
-		default:
-			return fmt.Errorf("can not parse lora datarate %v: unknown bandwidth %d", datr, bw)
-		}
-		switch txpk.Coderate {
-		case "4/5":
-			tx.LoRaCR = 5
-		case "4/6", "2/3":
-			tx.LoRaCR = 6
-		case "4/7":
-			tx.LoRaCR = 7
-		case "4/8", "2/4", "1/2":
-			tx.LoRaCR = 8
-		default:
-			return fmt.Errorf("can not parse lora coderate: %q", txpk.Coderate)
+		if tx.LoRaCR, err = parseLoRaCoderate(txpk.Coderate); err != nil {
+			return err
 		}
 		tx.InvertPolar = txpk.InvertPolar
 		tx.PreambleLength = txpk.PreambleLength
@@ -145,7 +113,7 @@ func (tx *TxPacket) UnmarshalJSON(data []byte) error {
 		return fmt.Errorf("unknown modulation: %q", txpk.Modulation)
 	}
 
-	data, err := base64.StdEncoding.DecodeString(txpk.Data)
+	data, err := decodeData(txpk.Data)
 	if err != nil {
 		return fmt.Errorf("can not decode data: %v", err)
 	}
@@ -153,15 +121,103 @@ func (tx *TxPacket) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// decodeData decodes a base64 payload, the padding is optional.
+func decodeData(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// parseLoRaDatarate parses a LoRa datarate like "SF7BW125".
+func parseLoRaDatarate(v interface{}) (sf uint32, bw uint8, err error) {
+	datr, ok := v.(string)
+	if !ok {
+		return 0, 0, fmt.Errorf("can not parse lora datarate (not a string): %+v", v)
+	}
+
+	var khz int
+	_, err = fmt.Sscanf(datr, "SF%dBW%d", &sf, &khz)
+	if err != nil {
+		return 0, 0, fmt.Errorf("can not parse lora datarate %q: %v", datr, err)
+	}
+	switch khz {
+	case 7:
+		bw = 1
+	case 10:
+		bw = 2
+	case 15:
+		bw = 3
+	case 20:
+		bw = 4
+	case 31:
+		bw = 5
+	case 41:
+		bw = 6
+	case 62:
+		bw = 7
+	case 125:
+		bw = 8
+	case 250:
+		bw = 9
+	case 500:
+		bw = 10
+	default:
+		return 0, 0, fmt.Errorf("can not parse lora datarate %v: unknown bandwidth %d", datr, khz)
+	}
+	return sf, bw, nil
+}
+
+// parseLoRaCoderate parses a LoRa coderate like "4/5".
+func parseLoRaCoderate(codr string) (uint8, error) {
+	switch codr {
+	case "4/5":
+		return 5, nil
+	case "4/6", "2/3":
+		return 6, nil
+	case "4/7":
+		return 7, nil
+	case "4/8", "2/4", "1/2":
+		return 8, nil
+	default:
+		return 0, fmt.Errorf("can not parse lora coderate: %q", codr)
+	}
+}
+
+func (tx *TxPacket) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "{")
+	if tx.Immediate {
+		fmt.Fprint(&buf, "\"imme\":true")
+	} else {
+		fmt.Fprintf(&buf, "\"tmst\":%d", tx.CountUs)
+	}
+	fmt.Fprintf(&buf, ",\"freq\":%s", strconv.FormatFloat(float64(tx.Freq)/1e6, 'f', -1, 64))
+	fmt.Fprintf(&buf, ",\"rfch\":%d", tx.ChainRF)
+	fmt.Fprintf(&buf, ",\"powe\":%d", tx.Power)
+	if tx.Modulation == "LORA" {
+		fmt.Fprint(&buf, ",\"modu\":\"LORA\"")
+		fmt.Fprintf(&buf, ",\"datr\":\"SF%d%s\"", tx.Datarate, bwStr[tx.LoRaBW])
+		fmt.Fprintf(&buf, ",\"codr\":\"4/%d\"", tx.LoRaCR)
+		fmt.Fprintf(&buf, ",\"ipol\":%t", tx.InvertPolar)
+	} else {
+		fmt.Fprint(&buf, ",\"modu\":\"FSK\"")
+		fmt.Fprintf(&buf, ",\"datr\":%d", tx.Datarate)
+		fmt.Fprintf(&buf, ",\"fdev\":%d", uint32(tx.FreqDev)*1000)
+	}
+	if tx.PreambleLength != 0 {
+		fmt.Fprintf(&buf, ",\"prea\":%d", tx.PreambleLength)
+	}
+	if tx.NoCRC {
+		fmt.Fprint(&buf, ",\"ncrc\":true")
+	}
+	fmt.Fprintf(&buf, ",\"size\":%d", len(tx.Data))
+	fmt.Fprintf(&buf, ",\"data\":\"%s\"}", base64.StdEncoding.EncodeToString(tx.Data))
+	return buf.Bytes(), nil
+}
+
 func (tx *TxPacket) String() string {
 	data := base64.StdEncoding.EncodeToString(tx.Data)
 	if tx.Modulation == "LORA" {
-		versionMajor := tx.Data[0] & 0b11
-		if versionMajor == LoRaWANR1 {
-			mtype := MType(tx.Data[0] >> 5)
-			devAddr := uint32(tx.Data[1])<<24 + uint32(tx.Data[2])<<16 + uint32(tx.Data[3])<<8 + uint32(tx.Data[4])
-			fCnt := uint16(tx.Data[6])<<8 + uint16(tx.Data[7])
-			return fmt.Sprintf("LoRaWAN %s: %.2f MHz, SF%d %s CR4/%d, Mote %08X, FCnt %d, Data: %s", mtype, float64(tx.Freq)/1e6, tx.Datarate, bwStr[tx.LoRaBW], tx.LoRaCR, devAddr, fCnt, data)
+		if phy, err := lorawan.Parse(tx.Data); err == nil {
+			return fmt.Sprintf("LoRaWAN %s: %.2f MHz, SF%d %s CR4/%d, Data: %s", phy, float64(tx.Freq)/1e6, tx.Datarate, bwStr[tx.LoRaBW], tx.LoRaCR, data)
 		}
 		return fmt.Sprintf("LoRa: %.2f MHz, SF%d %s CR4/%d, Data: %s", float64(tx.Freq)/1e6, tx.Datarate, bwStr[tx.LoRaBW], tx.LoRaCR, data)
 	}
@@ -187,9 +243,9 @@ var bwStr = []string{
 
 // RxPacket
 type RxPacket struct {
-	Time *time.Time // UTC time of pkt RX
-	// TimeGPS time.Time // GPS time of pkt RX
-	// TimeFin time.Time // Internal timestamp of "RX finished" event
+	Time    *time.Time // UTC time of pkt RX
+	TimeGPS time.Time  // GPS time of pkt RX, zero if unknown
+	TimeFin time.Time  // Internal timestamp of "RX finished" event
 
 	CountUs uint32 // internal concentrator counter for timestamping, 1 microsecond resolution
 
@@ -210,20 +266,32 @@ type RxPacket struct {
 	// FSK: Datarate (bits per second)
 	Datarate uint32
 
-	RSSI float32 // average packet RSSI in dB
+	RSSI float32 // average packet RSSI (channel RSSI) in dB
+
+	RSSISignal float32 // signal RSSI in dB, 0 if unknown
 
 	LoRaSNR float32 // average packet SNR, in dB
 
+	FreqOffset int32 // frequency offset of the packet in Hz
+
 	Data []byte // packet payload
 }
 
+// RxTimeFormat is the format of the rxpk time, ISO 8601 'compact' format with microseconds.
+const RxTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// GPSEpoch is the start of the GPS time (tmms).
+var GPSEpoch = time.Date(1980, time.January, 6, 0, 0, 0, 0, time.UTC)
+
 func (rx *RxPacket) MarshalJSON() ([]byte, error) {
 	var buf bytes.Buffer
 	fmt.Fprintf(&buf, "{")
+	fmt.Fprintf(&buf, "\"tmst\":%d", rx.CountUs)
 	if rx.Time != nil {
-		fmt.Fprintf(&buf, "\"time\":\"%s\"", rx.Time.Format(time.RFC3339)) /* ISO 8601 format */
-	} else {
-		fmt.Fprintf(&buf, "\"tmst\":%d", rx.CountUs)
+		fmt.Fprintf(&buf, ",\"time\":\"%s\"", rx.Time.UTC().Format(RxTimeFormat))
+	}
+	if !rx.TimeGPS.IsZero() {
+		fmt.Fprintf(&buf, ",\"tmms\":%d", rx.TimeGPS.Sub(GPSEpoch)/time.Millisecond)
 	}
 	fmt.Fprintf(&buf, ",\"chan\":%d", rx.ChainIF)
 	fmt.Fprintf(&buf, ",\"rfch\":%d", rx.ChainRF)
@@ -233,47 +301,101 @@ func (rx *RxPacket) MarshalJSON() ([]byte, error) {
 		fmt.Fprint(&buf, ",\"modu\":\"LORA\"")
 		fmt.Fprintf(&buf, ",\"datr\":\"SF%d%s\"", rx.Datarate, bwStr[rx.LoRaBW])
 		fmt.Fprintf(&buf, ",\"codr\":\"4/%d\"", rx.LoRaCR)
-		fmt.Fprintf(&buf, ",\"lsnr\":%.1f", rx.LoRaSNR)
+		fmt.Fprintf(&buf, ",\"lsnr\":%s", strconv.FormatFloat(float64(rx.LoRaSNR), 'f', -1, 32))
 	} else {
 		fmt.Fprint(&buf, ",\"modu\":\"FSK\"")
 		fmt.Fprintf(&buf, ",\"datr\":%d", rx.Datarate)
 	}
 	fmt.Fprintf(&buf, ",\"rssi\":%.0f", rx.RSSI)
+	if rx.RSSISignal != 0 {
+		fmt.Fprintf(&buf, ",\"rssis\":%.0f", rx.RSSISignal)
+	}
+	fmt.Fprintf(&buf, ",\"foff\":%d", rx.FreqOffset)
 	fmt.Fprintf(&buf, ",\"size\":%d", len(rx.Data))
 	fmt.Fprintf(&buf, ",\"data\":\"%s\"}", base64.StdEncoding.EncodeToString(rx.Data))
 	return buf.Bytes(), nil
 }
 
-const LoRaWANR1 = 0x00
+func (rx *RxPacket) UnmarshalJSON(data []byte) error {
+
+	var rxpk = struct {
+		Time       string      `json:"time"`  // UTC time of pkt RX, ISO 8601 'compact' format
+		TimeGPS    *int64      `json:"tmms"`  // GPS time of pkt RX, milliseconds since GPSEpoch
+		CountUs    uint32      `json:"tmst"`  // internal timestamp of "RX finished" event
+		ChainIF    uint8       `json:"chan"`  // concentrator "IF" channel used for RX
+		ChainRF    uint8       `json:"rfch"`  // concentrator "RF chain" used for RX
+		Freq       float64     `json:"freq"`  // RX central frequency in MHz
+		StatCRC    int8        `json:"stat"`  // CRC status: 1 = OK, -1 = fail, 0 = no CRC
+		Modulation string      `json:"modu"`  // modulation identifier "LORA" or "FSK"
+		Datarate   interface{} `json:"datr"`  // LoRa datarate identifier or FSK datarate
+		Coderate   string      `json:"codr"`  // LoRa ECC coding rate identifier
+		RSSI       float32     `json:"rssi"`  // RSSI in dBm
+		RSSISignal float32     `json:"rssis"` // signal RSSI in dBm
+		LoRaSNR    float32     `json:"lsnr"`  // LoRa SNR ratio in dB
+		FreqOffset int32       `json:"foff"`  // frequency offset in Hz
+		Data       string      `json:"data"`  // base64 encoded RF packet payload, padded
+	}{}
 
-type MType byte
+	if err := json.Unmarshal(data, &rxpk); err != nil {
+		return err
+	}
 
-var mTypeStr = []string{
-	"Join Request",
-	"Join Accept",
-	"Unconfirmed Data Up",
-	"Unconfirmed Data Down",
-	"Confirmed Data Up",
-	"Confirmed Data Down",
-	"RFU",
-	"Proprietary",
-}
+	if rxpk.Time != "" {
+		t, err := time.Parse(time.RFC3339Nano, rxpk.Time)
+		if err != nil {
+			return fmt.Errorf("can not parse time: %v", err)
+		}
+		rx.Time = &t
+	}
+	if rxpk.TimeGPS != nil {
+		rx.TimeGPS = GPSEpoch.Add(time.Duration(*rxpk.TimeGPS) * time.Millisecond)
+	}
+	rx.CountUs = rxpk.CountUs
+	rx.ChainIF = rxpk.ChainIF
+	rx.ChainRF = rxpk.ChainRF
+	rx.Freq = uint32(math.Round(rxpk.Freq * 1e6))
+	rx.StatCRC = rxpk.StatCRC
+	rx.RSSI = rxpk.RSSI
+	rx.RSSISignal = rxpk.RSSISignal
+	rx.FreqOffset = rxpk.FreqOffset
+	switch rxpk.Modulation {
+	case "LORA":
+		rx.Modulation = "LORA"
 
-func (t MType) String() string {
-	return mTypeStr[t]
+		var err error
+		if rx.Datarate, rx.LoRaBW, err = parseLoRaDatarate(rxpk.Datarate); err != nil {
+			return err
+		}
+		if rx.LoRaCR, err = parseLoRaCoderate(rxpk.Coderate); err != nil {
+			return err
+		}
+		rx.LoRaSNR = rxpk.LoRaSNR
+	case "FSK":
+		rx.Modulation = "FSK"
+
+		datr, ok := rxpk.Datarate.(float64)
+		if !ok {
+			return fmt.Errorf("can not parse fsk datarate (not a number): %+v", rxpk.Datarate)
+		}
+		rx.Datarate = uint32(datr)
+
+	default:
+		return fmt.Errorf("unknown modulation: %q", rxpk.Modulation)
+	}
+
+	data, err := decodeData(rxpk.Data)
+	if err != nil {
+		return fmt.Errorf("can not decode data: %v", err)
+	}
+	rx.Data = data
+	return nil
 }
 
 func (rx *RxPacket) String() string {
 	data := base64.StdEncoding.EncodeToString(rx.Data)
 	if rx.Modulation == "LORA" {
-		if len(rx.Data) > 8 {
-			versionMajor := rx.Data[0] & 0b11
-			if versionMajor == LoRaWANR1 {
-				mtype := MType(rx.Data[0] >> 5)
-				devAddr := uint32(rx.Data[1])<<24 + uint32(rx.Data[2])<<16 + uint32(rx.Data[3])<<8 + uint32(rx.Data[4])
-				fCnt := uint16(rx.Data[6])<<8 + uint16(rx.Data[7])
-				return fmt.Sprintf("LoRaWAN %s: %.2f MHz, SF%d %s CR4/%d, Mote %08X, FCnt %d, Data: %s", mtype, float64(rx.Freq)/1e6, rx.Datarate, bwStr[rx.LoRaBW], rx.LoRaCR, devAddr, fCnt, data)
-			}
+		if phy, err := lorawan.Parse(rx.Data); err == nil {
+			return fmt.Sprintf("LoRaWAN %s: %.2f MHz, SF%d %s CR4/%d, Data: %s", phy, float64(rx.Freq)/1e6, rx.Datarate, bwStr[rx.LoRaBW], rx.LoRaCR, data)
 		}
 		return fmt.Sprintf("LoRa: %.2f MHz, SF%d %s CR4/%d, Data: %s", float64(rx.Freq)/1e6, rx.Datarate, bwStr[rx.LoRaBW], rx.LoRaCR, data)
 	}
@@ -297,5 +419,8 @@ type Config struct {
 	// FSK: Datarate (bits per second)
 	Datarate uint32 `json:"spread_factor"`
 
-	PreambleLength uint16 // RF preamble size
+	// FSK: Frequency deviation in Hz
+	FreqDev uint32 `json:"freq_dev"`
+
+	PreambleLength uint16 `json:"preamble"` // RF preamble size
 }
@@ -0,0 +1,189 @@
+package lora
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRxPacketJSON(t *testing.T) {
+	rxTime := time.Date(2013, time.March, 31, 16, 21, 17, 528002000, time.UTC)
+	tests := []struct {
+		name string
+		rx   *RxPacket
+	}{
+		{"LoRa", &RxPacket{
+			Time:       &rxTime,
+			CountUs:    3512348611,
+			Freq:       868100000,
+			ChainIF:    2,
+			ChainRF:    1,
+			StatCRC:    1,
+			Modulation: "LORA",
+			LoRaBW:     8,
+			LoRaCR:     5,
+			Datarate:   7,
+			RSSI:       -35,
+			LoRaSNR:    5.1,
+			Data:       []byte{0x40, 0xF1, 0x7D, 0xBE, 0x49, 0x00, 0x02, 0x00, 0x01, 0x95, 0x43, 0x78, 0x76, 0x2B, 0x11, 0xFF, 0x0D},
+		}},
+		{"LoRa with GPS time and signal RSSI", &RxPacket{
+			Time:       &rxTime,
+			TimeGPS:    time.Date(2020, time.June, 1, 12, 0, 0, 123000000, time.UTC),
+			CountUs:    1,
+			Freq:       869525000,
+			StatCRC:    -1,
+			Modulation: "LORA",
+			LoRaBW:     9,
+			LoRaCR:     8,
+			Datarate:   12,
+			RSSI:       -120,
+			RSSISignal: -118,
+			LoRaSNR:    -12.25,
+			FreqOffset: -1250,
+			Data:       []byte("data"),
+		}},
+		{"FSK without time", &RxPacket{
+			CountUs:    3512348514,
+			Freq:       863000000,
+			Modulation: "FSK",
+			Datarate:   50000,
+			RSSI:       -75,
+			Data:       []byte{},
+		}},
+	}
+	for _, test := range tests {
+		data, err := json.Marshal(test.rx)
+		if err != nil {
+			t.Errorf("%s: MarshalJSON() = %v", test.name, err)
+			continue
+		}
+		var rx RxPacket
+		if err := json.Unmarshal(data, &rx); err != nil {
+			t.Errorf("%s: UnmarshalJSON(%s) = %v", test.name, data, err)
+			continue
+		}
+		if !reflect.DeepEqual(&rx, test.rx) {
+			t.Errorf("%s: UnmarshalJSON(%s) = %+v, expected %+v", test.name, data, &rx, test.rx)
+		}
+	}
+}
+
+func TestRxPacketUnmarshalJSONInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"not an object", `[]`},
+		{"unknown modulation", `{"modu":"FM","datr":"SF7BW125","codr":"4/5","data":""}`},
+		{"LoRa datarate not a string", `{"modu":"LORA","datr":7,"codr":"4/5","data":""}`},
+		{"unknown bandwidth", `{"modu":"LORA","datr":"SF7BW100","codr":"4/5","data":""}`},
+		{"unknown coderate", `{"modu":"LORA","datr":"SF7BW125","codr":"4/9","data":""}`},
+		{"FSK datarate not a number", `{"modu":"FSK","datr":"SF7BW125","data":""}`},
+		{"invalid time", `{"time":"yesterday","modu":"FSK","datr":50000,"data":""}`},
+		{"invalid data", `{"modu":"FSK","datr":50000,"data":"!"}`},
+	}
+	for _, test := range tests {
+		var rx RxPacket
+		if err := json.Unmarshal([]byte(test.data), &rx); err == nil {
+			t.Errorf("%s: UnmarshalJSON(%s) = %+v, expected an error", test.name, test.data, &rx)
+		}
+	}
+}
+
+func TestTxPacketJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		tx   *TxPacket
+	}{
+		{"LoRa on timestamp", &TxPacket{
+			CountUs:     3512348611,
+			Freq:        869525000,
+			Power:       14,
+			Modulation:  "LORA",
+			LoRaBW:      8,
+			LoRaCR:      5,
+			Datarate:    9,
+			InvertPolar: true,
+			Data:        []byte{0x60, 0xF1, 0x7D, 0xBE, 0x49, 0x00, 0x02, 0x00},
+		}},
+		{"LoRa immediately", &TxPacket{
+			Immediate:      true,
+			Freq:           868100000,
+			ChainRF:        1,
+			Modulation:     "LORA",
+			LoRaBW:         10,
+			LoRaCR:         8,
+			Datarate:       12,
+			PreambleLength: 10,
+			NoCRC:          true,
+			Data:           []byte("data"),
+		}},
+		{"FSK", &TxPacket{
+			CountUs:        1,
+			Freq:           863000000,
+			Power:          27,
+			Modulation:     "FSK",
+			Datarate:       50000,
+			FreqDev:        25,
+			PreambleLength: 5,
+			Data:           []byte{},
+		}},
+	}
+	for _, test := range tests {
+		data, err := json.Marshal(test.tx)
+		if err != nil {
+			t.Errorf("%s: MarshalJSON() = %v", test.name, err)
+			continue
+		}
+		var tx TxPacket
+		if err := json.Unmarshal(data, &tx); err != nil {
+			t.Errorf("%s: UnmarshalJSON(%s) = %v", test.name, data, err)
+			continue
+		}
+		if !reflect.DeepEqual(&tx, test.tx) {
+			t.Errorf("%s: UnmarshalJSON(%s) = %+v, expected %+v", test.name, data, &tx, test.tx)
+		}
+	}
+
+	// the txpk example of the Semtech protocol
+	var tx TxPacket
+	data := `{"imme":true,"freq":864.123456,"rfch":0,"powe":14,"modu":"LORA","datr":"SF11BW125","codr":"4/6","ipol":false,"size":32,"data":"H3P3N2i9qc4yt7rK7ldqoeCVJGBybzPY5h1Dd7P7p8v"}`
+	if err := json.Unmarshal([]byte(data), &tx); err != nil {
+		t.Fatalf("UnmarshalJSON(%s) = %v", data, err)
+	}
+	if !tx.Immediate || tx.Freq != 864123456 || tx.Power != 14 || tx.Datarate != 11 || tx.LoRaBW != 8 || tx.LoRaCR != 6 || len(tx.Data) != 32 {
+		t.Errorf("UnmarshalJSON(%s) = %+v", data, &tx)
+	}
+}
+
+func TestRxPacketMarshalJSON(t *testing.T) {
+	rxTime := time.Date(2013, time.March, 31, 16, 21, 17, 528002000, time.FixedZone("CEST", 2*3600))
+	tests := []struct {
+		name string
+		rx   *RxPacket
+		json string
+	}{
+		{"tmst and time", &RxPacket{
+			Time: &rxTime, CountUs: 3512348611, Freq: 866349812, ChainIF: 2, ChainRF: 0, StatCRC: 1,
+			Modulation: "LORA", LoRaBW: 8, LoRaCR: 6, Datarate: 7, RSSI: -35, LoRaSNR: 5.1, Data: []byte("uplink"),
+		}, `{"tmst":3512348611,"time":"2013-03-31T14:21:17.528002Z","chan":2,"rfch":0,"freq":866.350,"stat":1,"modu":"LORA","datr":"SF7BW125","codr":"4/6","lsnr":5.1,"rssi":-35,"foff":0,"size":6,"data":"dXBsaW5r"}`},
+		{"tmms, rssis and foff", &RxPacket{
+			Time: &rxTime, TimeGPS: time.Date(2020, time.June, 1, 12, 0, 0, 123456789, time.UTC), CountUs: 1, Freq: 868100000, StatCRC: -1,
+			Modulation: "LORA", LoRaBW: 9, LoRaCR: 5, Datarate: 12, RSSI: -119.6, RSSISignal: -121.4, LoRaSNR: -12.25, FreqOffset: -1250, Data: []byte{},
+		}, `{"tmst":1,"time":"2013-03-31T14:21:17.528002Z","tmms":1275048000123,"chan":0,"rfch":0,"freq":868.100,"stat":-1,"modu":"LORA","datr":"SF12BW250","codr":"4/5","lsnr":-12.25,"rssi":-120,"rssis":-121,"foff":-1250,"size":0,"data":""}`},
+		{"quarter dB SNR", &RxPacket{
+			CountUs: 2, Freq: 868100000, Modulation: "LORA", LoRaBW: 8, LoRaCR: 5, Datarate: 7, RSSI: -80, LoRaSNR: 7.75, FreqOffset: 312, Data: []byte{1},
+		}, `{"tmst":2,"chan":0,"rfch":0,"freq":868.100,"stat":0,"modu":"LORA","datr":"SF7BW125","codr":"4/5","lsnr":7.75,"rssi":-80,"foff":312,"size":1,"data":"AQ=="}`},
+		{"FSK", &RxPacket{
+			CountUs: 3, Freq: 863000000, StatCRC: 1, Modulation: "FSK", Datarate: 50000, RSSI: -75, Data: []byte{1, 2},
+		}, `{"tmst":3,"chan":0,"rfch":0,"freq":863.000,"stat":1,"modu":"FSK","datr":50000,"rssi":-75,"foff":0,"size":2,"data":"AQI="}`},
+	}
+	for _, test := range tests {
+		data, err := json.Marshal(test.rx)
+		if err != nil || string(data) != test.json {
+			t.Errorf("%s: MarshalJSON() = %s (%v)\nexpected %s", test.name, data, err, test.json)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package lorawan
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+)
+
+// AES128Key is a session or root key.
+type AES128Key [16]byte
+
+// block returns the block A_i of the payload encryption (flag 0x01, last is i) or
+// the block B0 of the MIC (flag 0x49, last is the message length).
+func block(flag byte, uplink bool, devAddr DevAddr, fCnt uint32, last byte) []byte {
+	b := make([]byte, 16)
+	b[0] = flag
+	if !uplink {
+		b[5] = 1
+	}
+	binary.LittleEndian.PutUint32(b[6:10], uint32(devAddr))
+	binary.LittleEndian.PutUint32(b[10:14], fCnt)
+	b[15] = last
+	return b
+}
+
+// DataMIC computes the MIC of a data frame with the NwkSKey of LoRaWAN 1.0.x, that is the
+// FNwkSIntKey of LoRaWAN 1.1 for downlinks. fCnt is the full 32 bit frame counter.
+// For parsed frames, the MIC is computed over the received bytes, not over the fields.
+func (p *PHYPayload) DataMIC(nwkSKey AES128Key, fCnt uint32) ([4]byte, error) {
+	var mic [4]byte
+	if p.MACPayload == nil {
+		return mic, fmt.Errorf("%s is not a data frame", p.MHDR.MType)
+	}
+	data := p.raw
+	if data == nil {
+		var err error
+		if data, err = p.MarshalBinary(); err != nil {
+			return mic, err
+		}
+	}
+	msg := data[:len(data)-4]
+	b0 := block(0x49, p.MHDR.MType.Uplink(), p.MACPayload.FHDR.DevAddr, fCnt, byte(len(msg)))
+	copy(mic[:], cmac(nwkSKey, append(b0, msg...)))
+	return mic, nil
+}
+
+// ValidDataMIC reports whether the MIC of the data frame is valid, see DataMIC.
+func (p *PHYPayload) ValidDataMIC(nwkSKey AES128Key, fCnt uint32) (bool, error) {
+	mic, err := p.DataMIC(nwkSKey, fCnt)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(mic[:], p.MIC[:]) == 1, nil
+}
+
+// EncryptFRMPayload encrypts or decrypts (that is the same) the FRMPayload of a data frame,
+// with the AppSKey or, for FPort 0, the NwkSKey (NwkSEncKey in LoRaWAN 1.1).
+func EncryptFRMPayload(key AES128Key, uplink bool, devAddr DevAddr, fCnt uint32, data []byte) []byte {
+	c, _ := aes.NewCipher(key[:])
+	out := make([]byte, len(data))
+	s := make([]byte, 16)
+	for i := 0; i < len(data); i += 16 {
+		c.Encrypt(s, block(0x01, uplink, devAddr, fCnt, byte(i/16+1)))
+		for j := i; j < len(data) && j < i+16; j++ {
+			out[j] = data[j] ^ s[j-i]
+		}
+	}
+	return out
+}
+
+// cmac computes the AES-CMAC of the message (RFC 4493).
+func cmac(key AES128Key, msg []byte) []byte {
+	c, _ := aes.NewCipher(key[:])
+	k1, k2 := cmacSubkeys(c)
+
+	n := (len(msg) + 15) / 16
+	complete := n != 0 && len(msg)%16 == 0
+	if n == 0 {
+		n = 1
+	}
+	last := make([]byte, 16)
+	if complete {
+		copy(last, msg[(n-1)*16:])
+		xor(last, k1)
+	} else {
+		copy(last, msg[(n-1)*16:])
+		last[len(msg)-(n-1)*16] = 0x80
+		xor(last, k2)
+	}
+
+	x := make([]byte, 16)
+	for i := 0; i < n-1; i++ {
+		xor(x, msg[i*16:(i+1)*16])
+		c.Encrypt(x, x)
+	}
+	xor(x, last)
+	c.Encrypt(x, x)
+	return x
+}
+
+func cmacSubkeys(c cipher.Block) (k1, k2 []byte) {
+	l := make([]byte, 16)
+	c.Encrypt(l, l)
+	k1 = shift(l)
+	k2 = shift(k1)
+	return k1, k2
+}
+
+// shift shifts the block left by one bit and applies the constant Rb if the msb was set.
+func shift(b []byte) []byte {
+	out := make([]byte, 16)
+	for i := 0; i < 15; i++ {
+		out[i] = b[i]<<1 | b[i+1]>>7
+	}
+	out[15] = b[15] << 1
+	if b[0]&0x80 != 0 {
+		out[15] ^= 0x87
+	}
+	return out
+}
+
+func xor(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
@@ -0,0 +1,123 @@
+package lorawan
+
+import (
+	"bytes"
+	"crypto/aes"
+	"testing"
+)
+
+func key(t *testing.T, s string) (k AES128Key) {
+	copy(k[:], unhex(t, s))
+	return k
+}
+
+// RFC 4493, section 4
+func TestCMAC(t *testing.T) {
+	k := key(t, "2b7e151628aed2a6abf7158809cf4f3c")
+	msg := unhex(t, "6bc1bee22e409f96e93d7e117393172a ae2d8a571e03ac9c9eb76fac45af8e51 30c81c46a35ce411e5fbc1191a0a52ef f69f2445df4f9b17ad2b417be66c3710")
+	tests := []struct {
+		len int
+		mac string
+	}{
+		{0, "bb1d6929e95937287fa37d129b756746"},
+		{16, "070a16b46b4d4144f79bdd9dd04a287c"},
+		{40, "dfa66747de9ae63030ca32611497c827"},
+		{64, "51f0bebf7e3b9d92fc49741779363cfe"},
+	}
+	for _, test := range tests {
+		if mac := cmac(k, msg[:test.len]); !bytes.Equal(mac, unhex(t, test.mac)) {
+			t.Errorf("cmac(%d bytes) = %x, expected %s", test.len, mac, test.mac)
+		}
+	}
+
+	c, _ := aes.NewCipher(k[:])
+	k1, k2 := cmacSubkeys(c)
+	if !bytes.Equal(k1, unhex(t, "fbeed618357133667c85e08f7236a8de")) || !bytes.Equal(k2, unhex(t, "f7ddac306ae266ccf90bc11ee46d513b")) {
+		t.Errorf("subkeys %x, %x, expected the subkeys of RFC 4493", k1, k2)
+	}
+}
+
+func TestBlock(t *testing.T) {
+	tests := []struct {
+		flag   byte
+		uplink bool
+		fCnt   uint32
+		last   byte
+		block  string
+	}{
+		// B0 of the MIC: flag, 4 zero bytes, direction, DevAddr, FCnt, zero byte, message length
+		{0x49, true, 0x00012345, 13, "49 00000000 00 F17DBE49 45230100 00 0D"},
+		// A_i of the encryption: flag, 4 zero bytes, direction, DevAddr, FCnt, zero byte, i
+		{0x01, false, 2, 1, "01 00000000 01 F17DBE49 02000000 00 01"},
+	}
+	for _, test := range tests {
+		if b := block(test.flag, test.uplink, 0x49BE7DF1, test.fCnt, test.last); !bytes.Equal(b, unhex(t, test.block)) {
+			t.Errorf("block(%02X, %v, %d, %d) = %X, expected %s", test.flag, test.uplink, test.fCnt, test.last, b, test.block)
+		}
+	}
+}
+
+func TestDataFrame(t *testing.T) {
+	nwkSKey := key(t, "44024241ed4ce9a68c6a8bc055233fd3")
+	appSKey := key(t, "ec925802ae430ca77fd3dd73cb2cc588")
+	p, err := Parse(unhex(t, "40F17DBE4900020001954378762B11FF0D"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := p.MACPayload
+	if mac.FHDR.DevAddr != 0x49BE7DF1 || mac.FHDR.FCnt != 2 || mac.FPort != 1 {
+		t.Fatalf("parsed %s, expected DevAddr 49BE7DF1, FCnt 2, FPort 1", p)
+	}
+
+	if ok, err := p.ValidDataMIC(nwkSKey, 2); !ok || err != nil {
+		t.Errorf("ValidDataMIC() = %v, %v, expected a valid MIC", ok, err)
+	}
+	for _, fCnt := range []uint32{3, 0x10002} {
+		if ok, _ := p.ValidDataMIC(nwkSKey, fCnt); ok {
+			t.Errorf("ValidDataMIC(FCnt %d) = true, expected an invalid MIC", fCnt)
+		}
+	}
+	if ok, _ := p.ValidDataMIC(appSKey, 2); ok {
+		t.Error("ValidDataMIC(AppSKey) = true, expected an invalid MIC")
+	}
+
+	data := EncryptFRMPayload(appSKey, true, mac.FHDR.DevAddr, 2, mac.FRMPayload)
+	if string(data) != "test" {
+		t.Errorf("EncryptFRMPayload() = %q, expected \"test\"", data)
+	}
+
+	// a built frame gets the same MIC
+	built := &PHYPayload{MHDR: p.MHDR, MACPayload: mac}
+	if mic, err := built.DataMIC(nwkSKey, 2); err != nil || mic != p.MIC {
+		t.Errorf("DataMIC() = %X (%v), expected %X", mic, err, p.MIC)
+	}
+	if _, err := (&PHYPayload{MHDR: MHDR{MType: JoinRequest}, JoinRequest: &JoinRequestPayload{}}).DataMIC(nwkSKey, 0); err == nil {
+		t.Error("DataMIC(join request) = ok, expected an error")
+	}
+}
+
+func TestEncryptFRMPayload(t *testing.T) {
+	k := key(t, "ec925802ae430ca77fd3dd73cb2cc588")
+	data := []byte("a payload that is longer than one block")
+	enc := EncryptFRMPayload(k, false, 0x01020304, 7, data)
+	if bytes.Equal(enc[:16], data[:16]) || bytes.Equal(enc[16:32], data[16:32]) {
+		t.Fatalf("EncryptFRMPayload() = %X, expected every block encrypted", enc)
+	}
+
+	// the key stream of every block is the encrypted A_i
+	c, _ := aes.NewCipher(k[:])
+	s := make([]byte, 16)
+	c.Encrypt(s, block(0x01, false, 0x01020304, 7, 3))
+	for i := 32; i < len(data); i++ {
+		if enc[i] != data[i]^s[i-32] {
+			t.Fatalf("EncryptFRMPayload() = %X, expected the third block encrypted with A_3", enc)
+		}
+	}
+
+	if dec := EncryptFRMPayload(k, false, 0x01020304, 7, enc); !bytes.Equal(dec, data) {
+		t.Errorf("EncryptFRMPayload(encrypted) = %q, expected %q", dec, data)
+	}
+	if dec := EncryptFRMPayload(k, true, 0x01020304, 7, enc); bytes.Equal(dec, data) {
+		t.Error("EncryptFRMPayload(uplink) decrypts a downlink, expected the direction to be part of the key stream")
+	}
+}
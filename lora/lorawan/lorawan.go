@@ -0,0 +1,447 @@
+// Package lorawan parses and builds LoRaWAN frames (PHYPayloads) of LoRaWAN 1.0.x and 1.1.
+// Multi-byte fields are little-endian on air, the types of this package hold them as numbers.
+// Encrypted parts (FRMPayload, FOpts in LoRaWAN 1.1 and Join Accepts) are kept as they are.
+package lorawan
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// MType is the message type of a frame.
+type MType byte
+
+const (
+	JoinRequest         MType = 0
+	JoinAccept          MType = 1
+	UnconfirmedDataUp   MType = 2
+	UnconfirmedDataDown MType = 3
+	ConfirmedDataUp     MType = 4
+	ConfirmedDataDown   MType = 5
+	RejoinRequest       MType = 6 // LoRaWAN 1.1, RFU in 1.0.x
+	Proprietary         MType = 7
+)
+
+var mTypeStr = []string{
+	"Join Request",
+	"Join Accept",
+	"Unconfirmed Data Up",
+	"Unconfirmed Data Down",
+	"Confirmed Data Up",
+	"Confirmed Data Down",
+	"Rejoin Request",
+	"Proprietary",
+}
+
+func (t MType) String() string {
+	return mTypeStr[t&7]
+}
+
+// Uplink reports whether frames of the type are sent by end devices.
+func (t MType) Uplink() bool {
+	return t == JoinRequest || t == UnconfirmedDataUp || t == ConfirmedDataUp || t == RejoinRequest
+}
+
+// LoRaWANR1 is the major version of LoRaWAN 1.0.x and 1.1 frames, the only one.
+const LoRaWANR1 = 0x00
+
+// MHDR is the first byte of a frame.
+type MHDR struct {
+	MType MType
+	Major uint8
+}
+
+// ParseMHDR splits the MHDR byte.
+func ParseMHDR(b byte) MHDR {
+	return MHDR{MType: MType(b >> 5), Major: b & 0x03}
+}
+
+// Byte returns the MHDR byte.
+func (h MHDR) Byte() byte {
+	return byte(h.MType&7)<<5 | h.Major&0x03
+}
+
+// DevAddr is the address of an end device.
+type DevAddr uint32
+
+func (a DevAddr) String() string {
+	return fmt.Sprintf("%08X", uint32(a))
+}
+
+// EUI is a 64 bit extended unique identifier, like the DevEUI and the JoinEUI (AppEUI in 1.0.x).
+type EUI uint64
+
+func (e EUI) String() string {
+	return fmt.Sprintf("%016X", uint64(e))
+}
+
+// FCtrl is the frame control byte of data frames, without FOptsLen (the length of FHDR.FOpts).
+type FCtrl struct {
+	ADR       bool
+	ADRACKReq bool // uplinks only
+	ACK       bool
+	ClassB    bool // uplinks only
+	FPending  bool // downlinks only
+}
+
+// FHDR is the frame header of data frames.
+type FHDR struct {
+	DevAddr DevAddr
+	FCtrl   FCtrl
+	FCnt    uint16 // lower 16 bits of the frame counter
+	FOpts   []byte // MAC commands, up to 15 bytes, encrypted in LoRaWAN 1.1
+}
+
+// MACPayload is the payload of data frames.
+type MACPayload struct {
+	FHDR       FHDR
+	FPort      int    // -1 if the frame has no FPort (and no FRMPayload), 0 for MAC commands
+	FRMPayload []byte // encrypted
+}
+
+// JoinRequestPayload is the payload of Join Requests.
+type JoinRequestPayload struct {
+	JoinEUI  EUI
+	DevEUI   EUI
+	DevNonce uint16
+}
+
+// RejoinRequestPayload is the payload of Rejoin Requests (LoRaWAN 1.1).
+// Types 0 and 2 carry the NetID, type 1 the JoinEUI.
+type RejoinRequestPayload struct {
+	Type    uint8
+	NetID   uint32 // types 0 and 2, 24 bit
+	JoinEUI EUI    // type 1
+	DevEUI  EUI
+	RJCount uint16 // RJcount0 for types 0 and 2, RJcount1 for type 1
+}
+
+// DLSettings are the downlink settings of a Join Accept.
+type DLSettings struct {
+	OptNeg      bool // LoRaWAN 1.1: the network server implements 1.1, RFU in 1.0.x
+	RX1DROffset uint8
+	RX2DataRate uint8
+}
+
+// JoinAcceptPayload is the payload of a Join Accept. Join Accepts are encrypted on air, together
+// with the MIC, so that PHYPayload only holds the encrypted bytes: the payload can only be
+// unmarshaled after decryption.
+type JoinAcceptPayload struct {
+	JoinNonce  uint32 // 24 bit, AppNonce in LoRaWAN 1.0.x
+	NetID      uint32 // 24 bit
+	DevAddr    DevAddr
+	DLSettings DLSettings
+	RxDelay    uint8
+	CFList     []byte // optional, 16 bytes
+}
+
+// PHYPayload is a LoRaWAN frame. Depending on MHDR.MType, one of the payloads is set.
+type PHYPayload struct {
+	MHDR MHDR
+
+	MACPayload    *MACPayload           // data frames
+	JoinRequest   *JoinRequestPayload   // Join Requests
+	RejoinRequest *RejoinRequestPayload // Rejoin Requests
+
+	// Join Accepts: the encrypted payload and MIC, 16 or 32 bytes.
+	// Proprietary frames: everything after the MHDR, as there is no MIC at a known position.
+	Payload []byte
+
+	MIC [4]byte // not for Join Accepts and proprietary frames
+
+	// raw is the frame as received, set by UnmarshalBinary. The MIC is computed over these bytes,
+	// as MarshalBinary does not keep bits that are not parsed, like the RFU bit of FCtrl in 1.0.x.
+	raw []byte
+}
+
+// Parse parses the frame.
+func Parse(data []byte) (*PHYPayload, error) {
+	p := new(PHYPayload)
+	if err := p.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// UnmarshalBinary parses the frame.
+func (p *PHYPayload) UnmarshalBinary(data []byte) error {
+	*p = PHYPayload{}
+	if len(data) == 0 {
+		return fmt.Errorf("empty frame")
+	}
+	p.raw = append([]byte(nil), data...)
+	p.MHDR = ParseMHDR(data[0])
+	if p.MHDR.Major != LoRaWANR1 {
+		return fmt.Errorf("unknown major version %d", p.MHDR.Major)
+	}
+	payload := data[1:]
+
+	switch p.MHDR.MType {
+	case JoinAccept:
+		if len(payload) != 16 && len(payload) != 32 {
+			return fmt.Errorf("join accept must have 17 or 33 bytes, got %d", len(data))
+		}
+		p.Payload = append([]byte(nil), payload...)
+		return nil
+
+	case Proprietary:
+		p.Payload = append([]byte(nil), payload...)
+		return nil
+	}
+
+	if len(payload) < 4 {
+		return fmt.Errorf("%s too short: %d bytes", p.MHDR.MType, len(data))
+	}
+	mic := len(payload) - 4
+	copy(p.MIC[:], payload[mic:])
+	payload = payload[:mic]
+
+	switch p.MHDR.MType {
+	case JoinRequest:
+		if len(payload) != 18 {
+			return fmt.Errorf("join request must have 23 bytes, got %d", len(data))
+		}
+		p.JoinRequest = &JoinRequestPayload{
+			JoinEUI:  EUI(binary.LittleEndian.Uint64(payload[0:8])),
+			DevEUI:   EUI(binary.LittleEndian.Uint64(payload[8:16])),
+			DevNonce: binary.LittleEndian.Uint16(payload[16:18]),
+		}
+
+	case RejoinRequest:
+		if len(payload) == 0 {
+			return fmt.Errorf("rejoin request too short: %d bytes", len(data))
+		}
+		rj := &RejoinRequestPayload{Type: payload[0]}
+		switch rj.Type {
+		case 0, 2:
+			if len(payload) != 14 {
+				return fmt.Errorf("rejoin request type %d must have 19 bytes, got %d", rj.Type, len(data))
+			}
+			rj.NetID = uint32(payload[1]) | uint32(payload[2])<<8 | uint32(payload[3])<<16
+			rj.DevEUI = EUI(binary.LittleEndian.Uint64(payload[4:12]))
+			rj.RJCount = binary.LittleEndian.Uint16(payload[12:14])
+		case 1:
+			if len(payload) != 19 {
+				return fmt.Errorf("rejoin request type 1 must have 24 bytes, got %d", len(data))
+			}
+			rj.JoinEUI = EUI(binary.LittleEndian.Uint64(payload[1:9]))
+			rj.DevEUI = EUI(binary.LittleEndian.Uint64(payload[9:17]))
+			rj.RJCount = binary.LittleEndian.Uint16(payload[17:19])
+		default:
+			return fmt.Errorf("unknown rejoin request type %d", rj.Type)
+		}
+		p.RejoinRequest = rj
+
+	default: // data frames
+		if len(payload) < 7 {
+			return fmt.Errorf("data frame must have at least 12 bytes, got %d", len(data))
+		}
+		uplink := p.MHDR.MType.Uplink()
+		fctrl := payload[4]
+		fopts := 7 + int(fctrl&0x0f)
+		if fopts > len(payload) {
+			return fmt.Errorf("data frame too short for %d bytes FOpts", fctrl&0x0f)
+		}
+		mac := &MACPayload{
+			FHDR: FHDR{
+				DevAddr: DevAddr(binary.LittleEndian.Uint32(payload[0:4])),
+				FCtrl: FCtrl{
+					ADR:       fctrl&0x80 != 0,
+					ADRACKReq: uplink && fctrl&0x40 != 0,
+					ACK:       fctrl&0x20 != 0,
+					ClassB:    uplink && fctrl&0x10 != 0,
+					FPending:  !uplink && fctrl&0x10 != 0,
+				},
+				FCnt: binary.LittleEndian.Uint16(payload[5:7]),
+			},
+			FPort: -1,
+		}
+		if fopts > 7 {
+			mac.FHDR.FOpts = append([]byte(nil), payload[7:fopts]...)
+		}
+		if fopts < len(payload) {
+			mac.FPort = int(payload[fopts])
+			mac.FRMPayload = append([]byte(nil), payload[fopts+1:]...)
+		}
+		p.MACPayload = mac
+	}
+	return nil
+}
+
+// MarshalBinary builds the frame.
+func (p *PHYPayload) MarshalBinary() ([]byte, error) {
+	if p.MHDR.Major != LoRaWANR1 {
+		return nil, fmt.Errorf("unknown major version %d", p.MHDR.Major)
+	}
+	data := []byte{p.MHDR.Byte()}
+
+	switch p.MHDR.MType {
+	case JoinAccept:
+		if len(p.Payload) != 16 && len(p.Payload) != 32 {
+			return nil, fmt.Errorf("encrypted join accept must have 16 or 32 bytes, got %d", len(p.Payload))
+		}
+		return append(data, p.Payload...), nil
+
+	case Proprietary:
+		return append(data, p.Payload...), nil
+
+	case JoinRequest:
+		jr := p.JoinRequest
+		if jr == nil {
+			return nil, fmt.Errorf("join request without payload")
+		}
+		data = appendUint64(data, uint64(jr.JoinEUI))
+		data = appendUint64(data, uint64(jr.DevEUI))
+		data = appendUint16(data, jr.DevNonce)
+
+	case RejoinRequest:
+		rj := p.RejoinRequest
+		if rj == nil {
+			return nil, fmt.Errorf("rejoin request without payload")
+		}
+		data = append(data, rj.Type)
+		switch rj.Type {
+		case 0, 2:
+			data = append(data, byte(rj.NetID), byte(rj.NetID>>8), byte(rj.NetID>>16))
+		case 1:
+			data = appendUint64(data, uint64(rj.JoinEUI))
+		default:
+			return nil, fmt.Errorf("unknown rejoin request type %d", rj.Type)
+		}
+		data = appendUint64(data, uint64(rj.DevEUI))
+		data = appendUint16(data, rj.RJCount)
+
+	default: // data frames
+		mac := p.MACPayload
+		if mac == nil {
+			return nil, fmt.Errorf("%s without payload", p.MHDR.MType)
+		}
+		var err error
+		if data, err = mac.FHDR.append(data, p.MHDR.MType.Uplink()); err != nil {
+			return nil, err
+		}
+		if mac.FPort < 0 {
+			if len(mac.FRMPayload) != 0 {
+				return nil, fmt.Errorf("FRMPayload without FPort")
+			}
+		} else {
+			if mac.FPort > 255 {
+				return nil, fmt.Errorf("invalid FPort %d", mac.FPort)
+			}
+			if mac.FPort == 0 && len(mac.FHDR.FOpts) != 0 {
+				return nil, fmt.Errorf("FOpts must be empty for FPort 0")
+			}
+			data = append(data, byte(mac.FPort))
+			data = append(data, mac.FRMPayload...)
+		}
+	}
+	return append(data, p.MIC[:]...), nil
+}
+
+// FCtrlByte returns the FCtrl byte of an uplink or downlink, with FOptsLen.
+func (h *FHDR) FCtrlByte(uplink bool) byte {
+	fctrl := byte(len(h.FOpts)) & 0x0f
+	if h.FCtrl.ADR {
+		fctrl |= 0x80
+	}
+	if uplink && h.FCtrl.ADRACKReq {
+		fctrl |= 0x40
+	}
+	if h.FCtrl.ACK {
+		fctrl |= 0x20
+	}
+	if uplink && h.FCtrl.ClassB || !uplink && h.FCtrl.FPending {
+		fctrl |= 0x10
+	}
+	return fctrl
+}
+
+func (h *FHDR) append(data []byte, uplink bool) ([]byte, error) {
+	if len(h.FOpts) > 15 {
+		return nil, fmt.Errorf("FOpts must have at most 15 bytes, got %d", len(h.FOpts))
+	}
+	data = appendUint32(data, uint32(h.DevAddr))
+	data = append(data, h.FCtrlByte(uplink))
+	data = appendUint16(data, h.FCnt)
+	return append(data, h.FOpts...), nil
+}
+
+// UnmarshalBinary parses a decrypted Join Accept payload, without MHDR and MIC.
+func (ja *JoinAcceptPayload) UnmarshalBinary(data []byte) error {
+	if len(data) != 12 && len(data) != 28 {
+		return fmt.Errorf("join accept payload must have 12 or 28 bytes, got %d", len(data))
+	}
+	*ja = JoinAcceptPayload{
+		JoinNonce: uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16,
+		NetID:     uint32(data[3]) | uint32(data[4])<<8 | uint32(data[5])<<16,
+		DevAddr:   DevAddr(binary.LittleEndian.Uint32(data[6:10])),
+		DLSettings: DLSettings{
+			OptNeg:      data[10]&0x80 != 0,
+			RX1DROffset: data[10] >> 4 & 0x07,
+			RX2DataRate: data[10] & 0x0f,
+		},
+		RxDelay: data[11],
+	}
+	if len(data) == 28 {
+		ja.CFList = append([]byte(nil), data[12:]...)
+	}
+	return nil
+}
+
+// MarshalBinary builds the Join Accept payload, without MHDR and MIC, before encryption.
+func (ja *JoinAcceptPayload) MarshalBinary() ([]byte, error) {
+	if len(ja.CFList) != 0 && len(ja.CFList) != 16 {
+		return nil, fmt.Errorf("CFList must have 16 bytes, got %d", len(ja.CFList))
+	}
+	dl := ja.DLSettings.RX1DROffset&0x07<<4 | ja.DLSettings.RX2DataRate&0x0f
+	if ja.DLSettings.OptNeg {
+		dl |= 0x80
+	}
+	data := []byte{
+		byte(ja.JoinNonce), byte(ja.JoinNonce >> 8), byte(ja.JoinNonce >> 16),
+		byte(ja.NetID), byte(ja.NetID >> 8), byte(ja.NetID >> 16),
+	}
+	data = appendUint32(data, uint32(ja.DevAddr))
+	data = append(data, dl, ja.RxDelay)
+	return append(data, ja.CFList...), nil
+}
+
+// String returns a short description of the frame, like
+// "Unconfirmed Data Up, DevAddr 26011BDA, FCnt 3, FPort 1".
+func (p *PHYPayload) String() string {
+	switch {
+	case p.MACPayload != nil:
+		mac := p.MACPayload
+		s := fmt.Sprintf("%s, DevAddr %s, FCnt %d", p.MHDR.MType, mac.FHDR.DevAddr, mac.FHDR.FCnt)
+		if mac.FHDR.FCtrl.ACK {
+			s += ", ACK"
+		}
+		if len(mac.FHDR.FOpts) != 0 {
+			s += fmt.Sprintf(", FOpts %X", mac.FHDR.FOpts)
+		}
+		if mac.FPort >= 0 {
+			s += fmt.Sprintf(", FPort %d", mac.FPort)
+		}
+		return s
+	case p.JoinRequest != nil:
+		jr := p.JoinRequest
+		return fmt.Sprintf("%s, JoinEUI %s, DevEUI %s, DevNonce %d", p.MHDR.MType, jr.JoinEUI, jr.DevEUI, jr.DevNonce)
+	case p.RejoinRequest != nil:
+		rj := p.RejoinRequest
+		return fmt.Sprintf("%s type %d, DevEUI %s, RJcount %d", p.MHDR.MType, rj.Type, rj.DevEUI, rj.RJCount)
+	default:
+		return p.MHDR.MType.String()
+	}
+}
+
+func appendUint16(data []byte, v uint16) []byte {
+	return append(data, byte(v), byte(v>>8))
+}
+
+func appendUint32(data []byte, v uint32) []byte {
+	return append(data, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendUint64(data []byte, v uint64) []byte {
+	return appendUint32(appendUint32(data, uint32(v)), uint32(v>>32))
+}
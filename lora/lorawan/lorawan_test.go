@@ -0,0 +1,322 @@
+package lorawan
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestPHYPayload(t *testing.T) {
+	mic := [4]byte{0xAA, 0xBB, 0xCC, 0xDD}
+	tests := []struct {
+		name  string
+		frame string
+		phy   PHYPayload
+	}{
+		{
+			"join request",
+			"00 0807060504030201 1817161514131211 3412 AABBCCDD",
+			PHYPayload{
+				MHDR:        MHDR{MType: JoinRequest},
+				JoinRequest: &JoinRequestPayload{JoinEUI: 0x0102030405060708, DevEUI: 0x1112131415161718, DevNonce: 0x1234},
+				MIC:         mic,
+			},
+		},
+		{
+			"join accept",
+			"20 000102030405060708090A0B0C0D0E0F",
+			PHYPayload{
+				MHDR:    MHDR{MType: JoinAccept},
+				Payload: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+			},
+		},
+		{
+			"join accept with CFList",
+			"20 000102030405060708090A0B0C0D0E0F 000102030405060708090A0B0C0D0E0F",
+			PHYPayload{
+				MHDR:    MHDR{MType: JoinAccept},
+				Payload: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+			},
+		},
+		{
+			"unconfirmed data up",
+			"40 F17DBE49 00 0200 01 95437876 2B11FF0D",
+			PHYPayload{
+				MHDR: MHDR{MType: UnconfirmedDataUp},
+				MACPayload: &MACPayload{
+					FHDR:       FHDR{DevAddr: 0x49BE7DF1, FCnt: 2},
+					FPort:      1,
+					FRMPayload: []byte{0x95, 0x43, 0x78, 0x76},
+				},
+				MIC: [4]byte{0x2B, 0x11, 0xFF, 0x0D},
+			},
+		},
+		{
+			"unconfirmed data down, FOpts without FPort",
+			"60 F17DBE49 33 0500 030507 AABBCCDD",
+			PHYPayload{
+				MHDR: MHDR{MType: UnconfirmedDataDown},
+				MACPayload: &MACPayload{
+					FHDR:  FHDR{DevAddr: 0x49BE7DF1, FCtrl: FCtrl{ACK: true, FPending: true}, FCnt: 5, FOpts: []byte{3, 5, 7}},
+					FPort: -1,
+				},
+				MIC: mic,
+			},
+		},
+		{
+			"confirmed data up, MAC commands in FRMPayload",
+			"80 04030201 D0 0A00 00 0102 AABBCCDD",
+			PHYPayload{
+				MHDR: MHDR{MType: ConfirmedDataUp},
+				MACPayload: &MACPayload{
+					FHDR:       FHDR{DevAddr: 0x01020304, FCtrl: FCtrl{ADR: true, ADRACKReq: true, ClassB: true}, FCnt: 10},
+					FPort:      0,
+					FRMPayload: []byte{1, 2},
+				},
+				MIC: mic,
+			},
+		},
+		{
+			"confirmed data down, empty FRMPayload",
+			"A0 04030201 A0 FFFF DF AABBCCDD",
+			PHYPayload{
+				MHDR: MHDR{MType: ConfirmedDataDown},
+				MACPayload: &MACPayload{
+					FHDR:  FHDR{DevAddr: 0x01020304, FCtrl: FCtrl{ADR: true, ACK: true}, FCnt: 0xFFFF},
+					FPort: 0xDF,
+				},
+				MIC: mic,
+			},
+		},
+		{
+			"rejoin request type 0",
+			"C0 00 030201 1817161514131211 0100 AABBCCDD",
+			PHYPayload{
+				MHDR:          MHDR{MType: RejoinRequest},
+				RejoinRequest: &RejoinRequestPayload{Type: 0, NetID: 0x010203, DevEUI: 0x1112131415161718, RJCount: 1},
+				MIC:           mic,
+			},
+		},
+		{
+			"rejoin request type 1",
+			"C0 01 0807060504030201 1817161514131211 0200 AABBCCDD",
+			PHYPayload{
+				MHDR:          MHDR{MType: RejoinRequest},
+				RejoinRequest: &RejoinRequestPayload{Type: 1, JoinEUI: 0x0102030405060708, DevEUI: 0x1112131415161718, RJCount: 2},
+				MIC:           mic,
+			},
+		},
+		{
+			"proprietary",
+			"E0 0102",
+			PHYPayload{
+				MHDR:    MHDR{MType: Proprietary},
+				Payload: []byte{1, 2},
+			},
+		},
+	}
+	for _, test := range tests {
+		frame := unhex(t, test.frame)
+		p, err := Parse(frame)
+		if err != nil {
+			t.Errorf("%s: Parse() = %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(p.raw, frame) {
+			t.Errorf("%s: raw %X, expected the frame", test.name, p.raw)
+		}
+		p.raw = nil
+		if !reflect.DeepEqual(*p, test.phy) {
+			t.Errorf("%s: Parse() = %+v, expected %+v", test.name, *p, test.phy)
+		}
+		data, err := test.phy.MarshalBinary()
+		if err != nil || !bytes.Equal(data, frame) {
+			t.Errorf("%s: MarshalBinary() = %X (%v), expected %X", test.name, data, err, frame)
+		}
+	}
+}
+
+func TestPHYPayloadInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame string
+	}{
+		{"empty", ""},
+		{"major version 1", "41 F17DBE49 00 0200 01 95437876 2B11FF0D"},
+		{"join accept too short", "20 000102030405060708090A0B0C0D0E"},
+		{"join accept too long", "20 000102030405060708090A0B0C0D0E0F10"},
+		{"join request too short", "00 0807060504030201 1817161514131211 34 AABBCCDD"},
+		{"join request too long", "00 0807060504030201 1817161514131211 341200 AABBCCDD"},
+		{"no MIC", "40 F17D"},
+		{"data frame without FCnt", "40 F17DBE49 00 02 AABBCCDD"},
+		{"FOpts longer than the frame", "40 F17DBE49 05 0200 0102 AABBCCDD"},
+		{"FOpts up to the MIC", "40 F17DBE49 0F 0200 0102030405060708090A0B0C0D0E AABBCCDD"},
+		{"rejoin request without type", "C0 AABBCCDD"},
+		{"rejoin request type 3", "C0 03 030201 1817161514131211 0100 AABBCCDD"},
+		{"rejoin request type 0 too long", "C0 00 0807060504030201 1817161514131211 0200 AABBCCDD"},
+		{"rejoin request type 1 too short", "C0 01 030201 1817161514131211 0100 AABBCCDD"},
+	}
+	for _, test := range tests {
+		if p, err := Parse(unhex(t, test.frame)); err == nil {
+			t.Errorf("%s: Parse() = %s, expected an error", test.name, p)
+		}
+	}
+
+	// every truncation of a valid data frame is either invalid or another valid frame
+	frame := unhex(t, "40 F17DBE49 03 0200 030507 01 95437876 2B11FF0D")
+	for n := 0; n < len(frame); n++ {
+		p, err := Parse(frame[:n])
+		if n < 15 && err == nil {
+			t.Errorf("Parse(%X) = %s, expected an error", frame[:n], p)
+		}
+		if n >= 15 && err != nil {
+			t.Errorf("Parse(%X) = %v, expected a frame with a shorter FRMPayload", frame[:n], err)
+		}
+	}
+}
+
+func TestFOpts(t *testing.T) {
+	data := func(fOpts []byte, fPort int) *PHYPayload {
+		return &PHYPayload{
+			MHDR: MHDR{MType: UnconfirmedDataUp},
+			MACPayload: &MACPayload{
+				FHDR:  FHDR{DevAddr: 0x01020304, FCnt: 1, FOpts: fOpts},
+				FPort: fPort,
+			},
+		}
+	}
+	fOpts := make([]byte, 15)
+	for i := range fOpts {
+		fOpts[i] = byte(i + 1)
+	}
+
+	// 15 bytes are the maximum, with or without FPort
+	for _, fPort := range []int{-1, 1} {
+		frame, err := data(fOpts, fPort).MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary(15 bytes FOpts, FPort %d) = %v", fPort, err)
+		}
+		if frame[5] != 0x0f {
+			t.Errorf("FCtrl %02X, expected FOptsLen 15", frame[5])
+		}
+		p, err := Parse(frame)
+		if err != nil {
+			t.Fatalf("Parse(%X) = %v", frame, err)
+		}
+		if mac := p.MACPayload; !bytes.Equal(mac.FHDR.FOpts, fOpts) || mac.FPort != fPort {
+			t.Errorf("Parse(%X): FOpts %X, FPort %d, expected %X, %d", frame, mac.FHDR.FOpts, mac.FPort, fOpts, fPort)
+		}
+	}
+
+	tests := []struct {
+		name string
+		p    *PHYPayload
+	}{
+		{"16 bytes FOpts", data(append(fOpts, 16), -1)},
+		{"FOpts with FPort 0", data([]byte{2}, 0)},
+		{"FRMPayload without FPort", &PHYPayload{
+			MHDR:       MHDR{MType: UnconfirmedDataUp},
+			MACPayload: &MACPayload{FPort: -1, FRMPayload: []byte{1}},
+		}},
+		{"FPort 256", data(nil, 256)},
+		{"data frame without payload", &PHYPayload{MHDR: MHDR{MType: UnconfirmedDataUp}}},
+		{"join request without payload", &PHYPayload{MHDR: MHDR{MType: JoinRequest}}},
+		{"encrypted join accept of 12 bytes", &PHYPayload{MHDR: MHDR{MType: JoinAccept}, Payload: make([]byte, 12)}},
+	}
+	for _, test := range tests {
+		if frame, err := test.p.MarshalBinary(); err == nil {
+			t.Errorf("%s: MarshalBinary() = %X, expected an error", test.name, frame)
+		}
+	}
+}
+
+func TestFCtrlByte(t *testing.T) {
+	tests := []struct {
+		mtype MType
+		fctrl byte // received
+		byte  byte // without the bits that are not used in the direction
+	}{
+		{UnconfirmedDataUp, 0x00, 0x00},
+		{UnconfirmedDataUp, 0xF0, 0xF0},
+		{ConfirmedDataUp, 0xA2, 0xA2},
+		{UnconfirmedDataDown, 0xB1, 0xB1},
+		{UnconfirmedDataDown, 0x40, 0x00}, // RFU
+	}
+	for _, test := range tests {
+		frame := []byte{byte(test.mtype) << 5, 0x04, 0x03, 0x02, 0x01, test.fctrl, 0x01, 0x00}
+		frame = append(frame, make([]byte, int(test.fctrl&0x0f))...) // FOpts
+		frame = append(frame, 0x01, 0x02, 0x03, 0x04)                // MIC
+		p, err := Parse(frame)
+		if err != nil {
+			t.Fatalf("Parse(%X) = %v", frame, err)
+		}
+		if b := p.MACPayload.FHDR.FCtrlByte(test.mtype == UnconfirmedDataUp || test.mtype == ConfirmedDataUp); b != test.byte {
+			t.Errorf("%s FCtrl %02X: FCtrlByte() = %02X, expected %02X", test.mtype, test.fctrl, b, test.byte)
+		}
+	}
+}
+
+func TestJoinAcceptPayload(t *testing.T) {
+	tests := []struct {
+		payload string
+		ja      JoinAcceptPayload
+	}{
+		{
+			"030201 130000 04030201 A2 01",
+			JoinAcceptPayload{JoinNonce: 0x010203, NetID: 0x13, DevAddr: 0x01020304, DLSettings: DLSettings{OptNeg: true, RX1DROffset: 2, RX2DataRate: 2}, RxDelay: 1},
+		},
+		{
+			"030201 130000 04030201 03 05 000102030405060708090A0B0C0D0E0F",
+			JoinAcceptPayload{JoinNonce: 0x010203, NetID: 0x13, DevAddr: 0x01020304, DLSettings: DLSettings{RX2DataRate: 3}, RxDelay: 5, CFList: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}},
+		},
+	}
+	for _, test := range tests {
+		payload := unhex(t, test.payload)
+		var ja JoinAcceptPayload
+		if err := ja.UnmarshalBinary(payload); err != nil || !reflect.DeepEqual(ja, test.ja) {
+			t.Errorf("UnmarshalBinary(%X) = %+v (%v), expected %+v", payload, ja, err, test.ja)
+		}
+		if data, err := test.ja.MarshalBinary(); err != nil || !bytes.Equal(data, payload) {
+			t.Errorf("MarshalBinary(%+v) = %X (%v), expected %X", test.ja, data, err, payload)
+		}
+	}
+
+	var ja JoinAcceptPayload
+	if err := ja.UnmarshalBinary(make([]byte, 13)); err == nil {
+		t.Errorf("UnmarshalBinary(13 bytes) = %+v, expected an error", ja)
+	}
+	ja = JoinAcceptPayload{CFList: make([]byte, 15)}
+	if data, err := ja.MarshalBinary(); err == nil {
+		t.Errorf("MarshalBinary(15 bytes CFList) = %X, expected an error", data)
+	}
+}
+
+// The MIC covers the frame as received: bits that are not parsed must not change it.
+func TestDataMICReceived(t *testing.T) {
+	nwkSKey := AES128Key{0x44, 0x02, 0x42, 0x41, 0xed, 0x4c, 0xe9, 0xa6, 0x8c, 0x6a, 0x8b, 0xc0, 0x55, 0x23, 0x3f, 0xd3}
+	// RFU bit 0x40 of a downlink FCtrl
+	frame := unhex(t, "60 F17DBE49 60 0200 01 95437876 00000000")
+	msg := frame[:len(frame)-4]
+	copy(frame[len(msg):], cmac(nwkSKey, append(block(0x49, false, 0x49BE7DF1, 2, byte(len(msg))), msg...)))
+
+	p, err := Parse(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := p.MarshalBinary(); bytes.Equal(data, frame) {
+		t.Fatalf("MarshalBinary() = %X, expected the RFU bit to be cleared", data)
+	}
+	if ok, err := p.ValidDataMIC(nwkSKey, 2); !ok || err != nil {
+		t.Errorf("ValidDataMIC() = %v, %v, expected the MIC of the received frame to be valid", ok, err)
+	}
+}
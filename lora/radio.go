@@ -0,0 +1,52 @@
+package lora
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrTooLate is returned by TimedSender.SendAt if the transmission could not be started in time.
+var ErrTooLate = errors.New("too late to send packet")
+
+// ErrFreq is returned by Receive, Send and SendAt if the frequency is out of the range of the radio.
+var ErrFreq = errors.New("frequency not supported by the radio")
+
+// Radio is a single channel LoRa transceiver as used by the packet forwarder.
+// The SX127X.Chip implements it for real hardware, the sim.Radio implements it
+// in software.
+type Radio interface {
+	// Name returns a human readable name of the radio, like "SX1276".
+	Name() string
+	// Receive configures the radio with cfg and puts it into receive mode.
+	Receive(cfg *Config) error
+	// GetPacket returns the packets received since the last call or nil if there are none.
+	// The radio might leave receive mode after a packet has been received.
+	GetPacket() ([]*RxPacket, error)
+	// Send transmits the packet. The radio leaves receive mode.
+	Send(pkt *TxPacket) error
+}
+
+// Notifier is implemented by radios that deliver received packets on a channel
+// as soon as they have been received, instead of being polled with GetPacket.
+type Notifier interface {
+	// Packets returns the channel that received packets are delivered on.
+	// A nil channel means that the radio must be polled with GetPacket.
+	Packets() <-chan *RxPacket
+}
+
+// ChannelSensor is implemented by radios that can check if a channel is in use
+// before sending (listen before talk).
+type ChannelSensor interface {
+	// ChannelBusy tunes the radio to the channel of pkt and reports whether it is in use,
+	// that is if a LoRa preamble has been detected or, if rssiTarget is not 0,
+	// the RSSI is above rssiTarget (in dBm). The radio leaves receive mode.
+	ChannelBusy(ctx context.Context, pkt *TxPacket, rssiTarget int) (bool, error)
+}
+
+// TimedSender is implemented by radios that can start a transmission at a precise time.
+type TimedSender interface {
+	// SendAt is like Send, but the radio is prepared first and the transmission starts at t.
+	// It fails with ErrTooLate without sending if the radio could not be prepared in time.
+	SendAt(pkt *TxPacket, t time.Time) error
+}
@@ -1,37 +1,31 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"io/ioutil"
 	logger "log"
 	"math"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/Waziup/single_chan_pkt_fwd/SX127X"
 	"github.com/Waziup/single_chan_pkt_fwd/fwd"
 	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/sim"
 
 	"periph.io/x/host/v3"
 	_ "periph.io/x/periph/host/rpi"
 )
 
-var gwid uint64
-
 var tx = make(chan *lora.TxPacket)
 
-var servers []*net.UDPAddr
-
-var laddr = &net.UDPAddr{
-	Port: 0,
-	IP:   net.ParseIP("0.0.0.0"),
-}
-
-var socket *net.UDPConn
-
 const LogLevelNone = 0
 const LogLevelDebug = 5
 const LogLevelVerbose = 4
@@ -66,6 +60,8 @@ func main() {
 	logger.SetFlags(0)
 
 	ll := flag.String("l", "", "log level: error, warn, verbose, debug, none")
+	simulate := flag.Bool("sim", false, "use a simulated radio instead of the SX127X chip")
+	dio0 := flag.String("dio0", "", "GPIO connected to the DIO0 line of the SX127X, e.g. GPIO4 (overrides board_conf)")
 	flag.Parse()
 
 	switch *ll {
@@ -112,78 +108,238 @@ func main() {
 		globalConfig.SX127XConf.LoRaCR = "4/5" //CR 4/5
 	}
 
+	id, err := strconv.ParseUint(globalConfig.GatewayConfig.GatewayID, 16, 64)
+	if err != nil {
+		fatal("can not parse gateway_ID: %v", err)
+	}
+	gw := newGateway(id)
+
 	log(LogLevelVerbose, "using %d servers for upstream", len(globalConfig.GatewayConfig.Servers))
 
-	servers = make([]*net.UDPAddr, 0, len(globalConfig.GatewayConfig.Servers))
+	gw.servers = make([]*server, 0, len(globalConfig.GatewayConfig.Servers))
 	i := 0
 	for _, server := range globalConfig.GatewayConfig.Servers {
 		if server.Enabled {
 
 			i++
-			ip := net.ParseIP(server.Address)
-			if ip == nil {
-				addr, err := net.LookupIP(server.Address)
+			switch server.Type {
+			case "", "semtech":
+			case "basicstation":
+				log(LogLevelVerbose, " server %d: %s, LoRa Basics Station", i, server.Address)
+				st, err := newStation(gw, server.Address, server.AuthToken, server.CAFile)
 				if err != nil {
-					log(LogLevelError, " server %d: %s:%d: %v", i, server.Address, server.PortUp, err)
-					continue
+					fatal("server %d: %v", i, err)
 				}
-				ip = addr[0]
-				log(LogLevelVerbose, " server %d: %s:%d (%s:%d)", i, server.Address, server.PortUp, ip, server.PortUp)
-			} else {
-				log(LogLevelVerbose, " server %d: %s:%d", i, server.Address, server.PortUp)
+				gw.stations = append(gw.stations, st)
+				continue
+			default:
+				fatal("server %d: unknown serv_type: %q", i, server.Type)
 			}
-			servers = append(servers, &net.UDPAddr{
-				Port: server.PortUp,
-				IP:   ip,
-			})
+			if server.PortDown == 0 {
+				server.PortDown = server.PortUp
+			}
+			switch server.ProtocolVersion {
+			case 0:
+				server.ProtocolVersion = fwd.ProtocolVersion2
+			case fwd.ProtocolVersion1, fwd.ProtocolVersion2:
+			default:
+				fatal("server %d: unknown protocol_version: %d", i, server.ProtocolVersion)
+			}
+			log(LogLevelVerbose, " server %d: %s, ports %d/%d, protocol version %d", i, server.Address, server.PortUp, server.PortDown, server.ProtocolVersion)
+			gw.servers = append(gw.servers, newServer(gw, server.Address, server.PortUp, server.PortDown, uint8(server.ProtocolVersion)))
 		}
 	}
 
-	gwid, err = strconv.ParseUint(globalConfig.GatewayConfig.GatewayID, 16, 64)
-	if err != nil {
-		fatal("can not parse gateway_ID: %v", err)
+	if cfg := globalConfig.GatewayConfig.Store; cfg != nil && cfg.Enabled {
+		if cfg.Dir == "" {
+			cfg.Dir = "store"
+		}
+		if cfg.MaxAge == 0 {
+			cfg.MaxAge = 86400
+		}
+		if cfg.MaxSize == 0 {
+			cfg.MaxSize = 10240
+		}
+		for _, server := range gw.servers {
+			dir := filepath.Join(cfg.Dir, storeName(server))
+			if server.store, err = openStore(dir, time.Duration(cfg.MaxAge)*time.Second, int64(cfg.MaxSize)*1024); err != nil {
+				fatal("server %s: %v", server, err)
+			}
+			log(LogLevelVerbose, " server %s: store %s, %d datagrams waiting", server, dir, server.store.len())
+		}
 	}
 
 	log(LogLevelVerbose, "center frequency: %.2f Mhz", float64(globalConfig.SX127XConf.Freq)/1e6)
-	log(LogLevelVerbose, "spreading factor: SF%d", globalConfig.SX127XConf.Datarate)
+	if globalConfig.SX127XConf.Modulation == "FSK" {
+		log(LogLevelVerbose, "FSK bitrate: %d", globalConfig.SX127XConf.Datarate)
+	} else {
+		log(LogLevelVerbose, "spreading factor: SF%d", globalConfig.SX127XConf.Datarate)
+	}
+
+	log(LogLevelVerbose, "this is gateway id %X", gw.id)
+
+	var radio lora.Radio
+	if *simulate {
+		radio = sim.New()
+	} else {
+		var board SX127X.BoardConfig
+		if globalConfig.BoardConfig != nil {
+			board = *globalConfig.BoardConfig
+		}
+		if *dio0 != "" {
+			board.DIO0 = *dio0
+		}
+		chip, err := SX127X.DiscoverWith(board)
+		if err != nil {
+			fatal("can not activate radio: %v", err)
+		}
+		chip.Logger = logger.New(os.Stdout, "", 0)
+		chip.LogLevel = logLevel
+		radio = chip
+	}
+
+	log(LogLevelNormal, "radio %s activated.", radio.Name())
+
+	if lbt := globalConfig.GatewayConfig.LBT; lbt != nil && lbt.Enabled {
+		if _, ok := radio.(lora.ChannelSensor); !ok {
+			fatal("radio %s does not support listen before talk", radio.Name())
+		}
+		if lbt.MaxTries <= 0 {
+			lbt.MaxTries = 1
+		}
+		log(LogLevelVerbose, "listen before talk: rssi target %d dBm, %d tries", lbt.RSSITarget, lbt.MaxTries)
+		gw.lbt = lbt
+	}
+
+	if cfg := globalConfig.GatewayConfig.MQTT; cfg != nil && cfg.Enabled {
+		if gw.bridge, err = newMQTTBridge(gw, cfg); err != nil {
+			fatal("can not use mqtt: %v", err)
+		}
+		log(LogLevelVerbose, "mqtt: %s, topic %s", gw.bridge, gw.bridge.topic)
+	}
+
+	if file := globalConfig.GatewayConfig.Keystore; file != "" {
+		if gw.keys, err = loadKeystore(file); err != nil {
+			fatal("%v", err)
+		}
+		log(LogLevelVerbose, "keystore: %s, %d devices", file, gw.keys.len())
+	}
 
-	log(LogLevelVerbose, "this is gateway id %X", gwid)
+	if cfg := globalConfig.GatewayConfig.Filter; cfg != nil {
+		if gw.filter, err = newUplinkFilter(cfg); err != nil {
+			fatal("can not parse filter: %v", err)
+		}
+		log(LogLevelVerbose, "filter: DevAddrs %v, JoinEUIs %v", gw.filter.devAddrs, gw.filter.joinEUIs)
+	}
 
-	socket, err = net.ListenUDP("udp", laddr)
+	gw.downlinkAllow, err = parseAllowlist(globalConfig.GatewayConfig.DownlinkAllow)
 	if err != nil {
-		fatal("%v", err)
+		fatal("can not parse downlink_allow: %v", err)
 	}
-	laddr = socket.LocalAddr().(*net.UDPAddr)
-	log(LogLevelNormal, "listening on %s", laddr)
+	gw.downlinkMaxRate = globalConfig.GatewayConfig.DownlinkMaxRate
 
-	upstream(&fwd.Packet{
-		Ident: fwd.PullData,
-		Token: fwd.RndToken(),
-	})
+	if globalConfig.GatewayConfig.TxLeadTime != 0 {
+		gw.jit.Lead = time.Duration(globalConfig.GatewayConfig.TxLeadTime) * time.Millisecond
+	}
+	if globalConfig.GatewayConfig.TxGuardTime != 0 {
+		gw.jit.Guard = time.Duration(globalConfig.GatewayConfig.TxGuardTime) * time.Millisecond
+	}
+	gw.txStartDelay = time.Duration(globalConfig.GatewayConfig.TxStartDelay) * time.Microsecond
 
-	go downstream()
-	run(globalConfig.SX127XConf)
+	if globalConfig.GatewayConfig.StatInterval != 0 {
+		gw.statInterval = time.Duration(globalConfig.GatewayConfig.StatInterval) * time.Second
+	}
+	gw.stats.Lati = globalConfig.GatewayConfig.RefLatitude
+	gw.stats.Long = globalConfig.GatewayConfig.RefLongitude
+	gw.stats.Alti = globalConfig.GatewayConfig.RefAltitude
+
+	gw.connect()
+	gw.run(context.Background(), radio, globalConfig.SX127XConf)
 }
 
-var baseTime = time.Now()
+// gateway is the packet forwarder: it receives packets with the radio, forwards them to the
+// network servers and sends the downlinks of the servers.
+type gateway struct {
+	id       uint64
+	servers  []*server
+	stations []*station
+	bridge   *mqttBridge   // nil if disabled
+	keys     *keystore     // session keys of ABP devices, nil if there is no keystore
+	filter   *uplinkFilter // uplinks of other networks are dropped, nil if disabled
+	lbt      *LBTConfig    // listen before talk, nil if disabled
+
+	// downlinkAllow are the networks that the server address must be in for downlinks to be accepted (if not empty).
+	downlinkAllow []*net.IPNet
+	// downlinkMaxRate is the number of downlinks accepted per minute and server (0 = unlimited).
+	downlinkMaxRate int
+
+	// txStartDelay is the time between starting a transmission and the radio actually sending.
+	txStartDelay time.Duration
+	// statInterval is the interval of the gateway status reports.
+	statInterval time.Duration
+
+	// counter is the internal microsecond counter, as used for the rxpk and txpk timestamps.
+	counter *fwd.Counter
+	// jit is the downlink queue.
+	jit *fwd.JITQueue
+	// chanTx passes the downlinks of all servers to the run loop.
+	chanTx chan downlink
+
+	// stats collects the counters for the next gateway status report.
+	// The location (Lati, Long and Alti) is set once and kept.
+	stats struct {
+		sync.Mutex
+		fwd.Stat
+	}
+}
 
-var never = time.Duration(math.MaxInt64)
+func newGateway(id uint64) *gateway {
+	return &gateway{
+		id:           id,
+		statInterval: time.Second * 30,
+		counter:      fwd.NewCounter(nil),
+		jit:          fwd.NewJITQueue(),
+		chanTx:       make(chan downlink),
+	}
+}
 
-var checkReceived = time.Millisecond * 500
+// connect connects to the servers in the background.
+func (gw *gateway) connect() {
+	for _, server := range gw.servers {
+		// the downstream sockets are read and PULL_DATA is sent as soon as the server has been resolved
+		go server.keepResolved()
+		if server.store != nil {
+			go server.forward()
+		}
+	}
+	for _, st := range gw.stations {
+		go st.keepConnected()
+	}
+	if gw.bridge != nil {
+		go gw.bridge.connect()
+	}
+}
 
-var tickerKeepalive = time.NewTicker(time.Second * 60)
+var never = time.Duration(math.MaxInt64)
 
-func run(cfg *lora.Config) {
+var checkReceived = time.Millisecond * 500
 
-	radio, err := SX127X.Discover()
-	if err != nil {
-		fatal("can not activate radio: %v", err)
+// resetTimer stops the timer and resets it to d, even if it has already fired.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
 	}
+	t.Reset(d)
+}
 
-	log(LogLevelNormal, "radio %s activated.", radio.Name())
+// keepaliveInterval is the interval of the PULL_DATA that keep the downstream sockets open.
+var keepaliveInterval = time.Second * 60
 
-	radio.Logger = logger.New(os.Stdout, "", 0)
-	radio.LogLevel = logLevel
+// run receives packets and sends downlinks with the radio until ctx is done.
+func (gw *gateway) run(ctx context.Context, radio lora.Radio, cfg *lora.Config) {
 
 	var timeReceive = time.Now()
 	time.Sleep(time.Millisecond * 500)
@@ -207,7 +363,93 @@ func run(cfg *lora.Config) {
 	// }
 
 	doReceive := false
+	// timerSend fires when the next downlink must be prepared, jit.Lead before it is sent
 	timerSend := time.NewTimer(never)
+	// timerStart fires when the downlink starting must be sent, for radios that are not a TimedSender
+	timerStart := time.NewTimer(never)
+	var starting *fwd.Packet
+
+	// origin is the server that sent each queued downlink, that the TX_ACK is sent to
+	origin := make(map[*fwd.Packet]backend)
+
+	// sent acknowledges the downlink once the radio has sent it (or failed to)
+	sent := func(pkt *fwd.Packet, err error) {
+		from := origin[pkt]
+		delete(origin, pkt)
+		if err != nil {
+			log(LogLevelError, "tx: can not send packet: %v", err)
+			from.txAck(pkt, err)
+			return
+		}
+		log(LogLevelNormal, "tx: ok")
+		gw.stats.Lock()
+		gw.stats.TxNb++
+		gw.stats.Unlock()
+		from.txAck(pkt, nil)
+	}
+
+	// radios with a DIO0 interrupt deliver packets on a channel, all others are polled
+	var packets <-chan *lora.RxPacket
+	if notifier, ok := radio.(lora.Notifier); ok {
+		packets = notifier.Packets()
+	}
+	poll := checkReceived
+	if packets != nil {
+		poll = never
+	}
+
+	received := func(pkts []*lora.RxPacket) {
+		doReceive = false
+		fw := make([]*lora.RxPacket, 0, len(pkts))
+		for _, pkt := range pkts {
+			// pkt.StatCRC = 1
+			if pkt.TimeFin.IsZero() {
+				pkt.TimeFin = time.Now()
+			}
+			timeReceive = pkt.TimeFin
+			pkt.CountUs = gw.counter.At(pkt.TimeFin)
+			if pkt.Time == nil {
+				t := pkt.TimeFin.UTC()
+				pkt.Time = &t
+			}
+			log(LogLevelNormal, "rx: %s", pkt)
+			// packets with a bad CRC are forwarded, as their header can not be trusted
+			if gw.filter != nil && pkt.StatCRC != -1 {
+				if err := gw.filter.accept(pkt.Data); err != nil {
+					log(LogLevelVerbose, "rx: packet dropped: %v", err)
+					continue
+				}
+			}
+			if gw.keys != nil && pkt.StatCRC != -1 {
+				gw.payload(pkt)
+			}
+			fw = append(fw, pkt)
+		}
+		gw.stats.Lock()
+		for _, pkt := range pkts {
+			gw.stats.RxNb++
+			if pkt.StatCRC == 1 {
+				gw.stats.RxOk++
+			}
+		}
+		gw.stats.RxFw += uint32(len(fw))
+		gw.stats.Unlock()
+		if len(fw) == 0 {
+			return
+		}
+		log(LogLevelNormal, "received %d packets, pushing to upstream ...", len(fw))
+		gw.upstream(&fwd.Packet{
+			Token:     fwd.RndToken(),
+			Ident:     fwd.PushData,
+			RxPackets: fw,
+		})
+	}
+
+	timerReceive := time.NewTimer(poll)
+	tickerStat := time.NewTicker(gw.statInterval)
+	defer tickerStat.Stop()
+	tickerKeepalive := time.NewTicker(keepaliveInterval)
+	defer tickerKeepalive.Stop()
 
 	for true {
 
@@ -220,121 +462,98 @@ func run(cfg *lora.Config) {
 			doReceive = true
 		}
 
-		timerReceive := time.NewTimer(checkReceived)
-
 		select {
-		case pkt := <-chanTx:
+		case <-ctx.Done():
+			return
 
-			log(LogLevelNormal, "received packet from upstream")
+		case dl := <-gw.chanTx:
 
-			if pkt.Immediate {
-				log(LogLevelNormal, "sending immediate packet ...")
-				doReceive = false
-				if err = radio.Send(pkt); err != nil {
-					log(LogLevelError, "can not send packet: %v", err)
-				}
+			log(LogLevelNormal, "received packet from upstream")
 
-				continue
+			pkt := dl.pkt
+			tx := pkt.TxPacket
+			if !tx.Immediate {
+				tx.Power = 14
 			}
-
-			pkt.Power = 14
-			doReceive = false
-
-			timeSend := baseTime.Add(time.Duration(pkt.CountUs) * time.Microsecond)
-			timeSend.Add(time.Second)
-			diff := timeSend.Sub(time.Now())
-			log(LogLevelNormal, "sending packet in %s, %s since last received", diff, timeSend.Sub(timeReceive))
-			// diff -= 200 * time.Microsecond
-			// time.Sleep(diff)
-			// tools.Nanosleep(int32(diff / time.Nanosecond))
-			log(LogLevelNormal, "tx: %s", pkt)
-			if err = radio.Send(pkt); err != nil {
-				log(LogLevelError, "can not send packet: %v", err)
+			if e := gw.jit.Enqueue(pkt, gw.counter.Now()); e != fwd.NoError {
+				log(LogLevelWarning, "tx: packet rejected: %v", e)
+				dl.origin.txAck(pkt, e)
+				break
 			}
-			log(LogLevelNormal, "tx: ok")
-
-			// enqueue packet
-			// if queue == nil {
-			// 	queue = &Queue{pkt: pkt}
-			// } else {
-			// 	if queue.pkt.CountUs > pkt.CountUs {
-			// 		queue = &Queue{
-			// 			next: queue,
-			// 			pkt:  pkt,
-			// 		}
-			// 	} else {
-			// 		for q := queue; ; q = q.next {
-			// 			if q.next == nil {
-			// 				q.next = &Queue{pkt: pkt}
-			// 				break
-			// 			}
-			// 			if q.next.pkt.CountUs > pkt.CountUs {
-			// 				q.next = &Queue{
-			// 					next: q.next,
-			// 					pkt:  pkt,
-			// 				}
-			// 				break
-			// 			}
-			// 		}
-			// 	}
-			// }
-			// queueSize++
-
-			// diff = 0 * time.Millisecond
-			// log(LogLevelNormal, "tx queue: %d packets, next packet in %s", queueSize, diff)
-			// timerSend.Reset(diff)
+			origin[pkt] = dl.origin
+			next, _ := gw.jit.Next(gw.counter.Now())
+			log(LogLevelNormal, "tx queue: %d packets, next packet in %s", gw.jit.Len(), next+gw.jit.Lead)
+			resetTimer(timerSend, next)
+
+		case pkt := <-packets:
+			received([]*lora.RxPacket{pkt})
 
 		case <-timerReceive.C:
 			pkts, err := radio.GetPacket()
 			if err != nil {
 				fatal("can not receive packets: %v", err)
 			}
-			timeReceive = time.Now()
 			if pkts != nil {
-				doReceive = false
-				for _, pkt := range pkts {
-					// pkt.StatCRC = 1
-					pkt.CountUs = uint32(time.Now().Sub(baseTime) / time.Microsecond)
-					log(LogLevelNormal, "rx: %s", pkt)
-				}
-				log(LogLevelNormal, "received %d packets, pushing to upstream ...", len(pkts))
-				upstream(&fwd.Packet{
-					Token:     fwd.RndToken(),
-					Ident:     fwd.PushData,
-					RxPackets: pkts,
-				})
+				received(pkts)
 			}
-			timerReceive.Reset(checkReceived)
+			timerReceive.Reset(poll)
 
 		case <-timerSend.C:
-			if queue == nil {
+			pkt := gw.jit.Pop()
+			if pkt == nil {
 				break
 			}
-			pkt := queue.pkt
-			queue = queue.next
-			queueSize--
-
-			log(LogLevelNormal, "tx: %s", pkt)
-
+			tx := pkt.TxPacket
 			doReceive = false
-			if err = radio.Send(pkt); err != nil {
-				log(LogLevelError, "tx: can not send packet: %v", err)
-			}
 
-			log(LogLevelNormal, "tx: ok")
+			if !gw.clearToSend(radio, tx) {
+				log(LogLevelWarning, "tx: channel is busy, packet dropped")
+				origin[pkt].txAck(pkt, fwd.ErrCollisionPacket)
+				delete(origin, pkt)
+			} else {
+				timeSend := gw.counter.Time(tx.CountUs).Add(-gw.txStartDelay)
+				log(LogLevelNormal, "tx: %s", tx)
+				log(LogLevelVerbose, "tx: sending in %s, %s since last received", time.Until(timeSend), timeSend.Sub(timeReceive))
+				if sender, ok := radio.(lora.TimedSender); ok {
+					// the radio is prepared now and starts the transmission jit.Lead later
+					sent(pkt, sender.SendAt(tx, timeSend))
+				} else {
+					// the radio keeps receiving until the packet is sent
+					starting = pkt
+					resetTimer(timerStart, time.Until(timeSend))
+				}
+			}
 
-			if queue == nil {
+			if next, ok := gw.jit.Next(gw.counter.Now()); ok {
+				log(LogLevelNormal, "tx queue: %d packets, next packet in %s", gw.jit.Len(), next+gw.jit.Lead)
+				timerSend.Reset(next)
+			} else {
 				timerSend.Reset(never)
 				log(LogLevelNormal, "tx queue: 0 packets (no pending packets)")
-			} else {
-				diff := baseTime.Add(time.Duration(queue.pkt.CountUs) * time.Microsecond).Sub(time.Now())
-				log(LogLevelNormal, "tx queue: %d packets, next packet in %s", queueSize, diff)
-				timerSend.Reset(diff)
 			}
 
+		case <-timerStart.C:
+			pkt := starting
+			starting = nil
+			if pkt == nil {
+				break
+			}
+			doReceive = false
+			sent(pkt, radio.Send(pkt.TxPacket))
+
+		case <-tickerStat.C:
+
+			stat := gw.statReport()
+			log(LogLevelVerbose, "stat: %d packets received (%d ok, %d forwarded), %d downlinks received, %d packets sent, %.1f%% acknowledged", stat.RxNb, stat.RxOk, stat.RxFw, stat.DwNb, stat.TxNb, stat.AckR)
+			gw.upstream(&fwd.Packet{
+				Ident: fwd.PushData,
+				Token: fwd.RndToken(),
+				Stat:  stat,
+			})
+
 		case <-tickerKeepalive.C:
 
-			upstream(&fwd.Packet{
+			gw.upstream(&fwd.Packet{
 				Ident: fwd.PullData,
 				Token: fwd.RndToken(),
 			})
@@ -342,16 +561,50 @@ func run(cfg *lora.Config) {
 	}
 }
 
-func upstream(pkt *fwd.Packet) {
-	pkt.GatewayID = gwid
-	data, err := pkt.MarshalBinary()
+// payload logs and publishes the decrypted payload of data uplinks of the devices of the keystore.
+func (gw *gateway) payload(rx *lora.RxPacket) {
+	d, err := gw.keys.decrypt(rx.Data)
 	if err != nil {
-		log(LogLevelError, "can not upstream packet: %v", err)
-		log(LogLevelError, "packet: %+v", pkt)
+		log(LogLevelWarning, "rx: %v", err)
 		return
 	}
+	if d == nil {
+		return
+	}
+	if d.fPort < 0 {
+		log(LogLevelNormal, "rx: DevAddr %s, FCnt %d: MIC ok, no payload", d.devAddr, d.fCnt)
+		return
+	}
+	log(LogLevelNormal, "rx: DevAddr %s, FCnt %d, FPort %d: MIC ok, payload %X", d.devAddr, d.fCnt, d.fPort, d.payload)
+	if gw.bridge != nil {
+		gw.bridge.payload(d)
+	}
+}
 
-	log(LogLevelDebug, "(-> *) raw: %q", data)
+// upstream sends the packet to all servers.
+// Received packets are also sent to the LoRa Basics Station servers and, like status reports,
+// published by the MQTT bridge.
+func (gw *gateway) upstream(pkt *fwd.Packet) {
+	gw.sendTo(gw.servers, pkt)
+	if pkt.Ident != fwd.PushData {
+		return
+	}
+	if pkt.RxPackets != nil {
+		for _, st := range gw.stations {
+			st.uplink(pkt.RxPackets)
+		}
+		if gw.bridge != nil {
+			gw.bridge.uplink(pkt.RxPackets)
+		}
+	}
+	if pkt.Stat != nil && gw.bridge != nil {
+		gw.bridge.stats(pkt.Stat)
+	}
+}
+
+// sendTo sends the packet to the servers, on the socket that is used for the packet type.
+func (gw *gateway) sendTo(servers []*server, pkt *fwd.Packet) {
+	pkt.GatewayID = gw.id
 
 	if logLevel >= LogLevelDebug {
 		pktJSON, err := json.Marshal(pkt)
@@ -359,22 +612,62 @@ func upstream(pkt *fwd.Packet) {
 	}
 
 	for _, server := range servers {
-		if _, err = socket.WriteToUDP(data, server); err != nil {
-			log(LogLevelError, "(-> %s) can not write upstream: %v", server, err)
+		pkt.Version = server.version
+		data, err := pkt.MarshalBinary()
+		if err != nil {
+			log(LogLevelError, "(-> %s) can not upstream packet: %v", server, err)
+			log(LogLevelError, "packet: %+v", pkt)
+			continue
+		}
+		log(LogLevelDebug, "(-> %s) raw: %q", server, data)
+
+		conn := server.conn(pkt.Ident)
+		// with a store, received packets are kept until they have been acknowledged
+		var keep []byte
+		if server.store != nil && pkt.Ident == fwd.PushData && pkt.RxPackets != nil {
+			if conn == nil || server.isUnreachable() {
+				// sent in order by forward, after the datagrams that are already waiting
+				server.storePush(pkt.Token, data)
+				continue
+			}
+			keep = data
+		}
+
+		if conn == nil {
+			log(LogLevelVerbose, "(-> %s) server address unresolved, %s dropped", server, pkt.Ident)
+			continue
+		}
+		// the token must be known before the acknowledgement arrives
+		server.sent(pkt.Token, pkt.Ident, keep)
+		if _, err = conn.Write(data); err != nil {
+			log(LogLevelError, "(-> %s) can not write upstream: %v", conn.RemoteAddr(), err)
+			server.forget(pkt.Token)
+			if keep != nil {
+				server.storePush(pkt.Token, keep)
+			}
 		} else {
-			log(LogLevelNormal, "(-> %s) %s", server, pkt)
+			log(LogLevelNormal, "(-> %s) %s", conn.RemoteAddr(), pkt)
 		}
 	}
 }
 
-func downstream() {
+// downstreamRetryDelay is the delay after a failed read, e.g. when the server port is unreachable.
+var downstreamRetryDelay = time.Second
+
+// downstream reads the datagrams that the server sends on the socket.
+func (s *server) downstream(conn *net.UDPConn) {
 
 	var buffer [2048]byte
 
 	for true {
-		l, raddr, err := socket.ReadFromUDP(buffer[:])
+		l, raddr, err := conn.ReadFromUDP(buffer[:])
 		if err != nil {
-			fatal("%v", err)
+			if !s.connected(conn) {
+				return // the server address has changed and the socket has been closed
+			}
+			log(LogLevelError, "(<- %s) can not read downstream: %v", conn.RemoteAddr(), err)
+			time.Sleep(downstreamRetryDelay)
+			continue
 		}
 
 		log(LogLevelDebug, "(<- %s) raw: %q", raddr, buffer[:l])
@@ -389,26 +682,107 @@ func downstream() {
 
 		log(LogLevelNormal, "(<- %s) %s", raddr, pkt)
 
-		if pkt.TxPacket != nil {
+		switch pkt.Ident {
+		case fwd.PushAck, fwd.PullAck:
+			if rtt, ok := s.acked(pkt.Token, pkt.Ident); ok {
+				log(LogLevelVerbose, "(<- %s) %s: round trip time %s", raddr, pkt.Ident, rtt)
+			} else {
+				log(LogLevelWarning, "(<- %s) %s with unknown token %s", raddr, pkt.Ident, pkt.Token)
+			}
+		case fwd.PullResp:
+			if err := s.acceptDownlink(conn, raddr); err != nil {
+				log(LogLevelWarning, "(<- %s) downlink rejected: %v", raddr, err)
+				continue
+			}
+			s.gw.stats.Lock()
+			s.gw.stats.DwNb++
+			s.gw.stats.Unlock()
+		}
 
-			chanTx <- pkt.TxPacket
+		if pkt.Ident == fwd.PullResp && pkt.TxPacket != nil {
 
-			upstream(&fwd.Packet{
-				Token: pkt.Token,
-				Ident: fwd.TxAck,
-				TxAck: fwd.NoError,
-			})
+			s.gw.chanTx <- downlink{origin: s, pkt: pkt}
 		}
 	}
 }
 
-var chanTx = make(chan *lora.TxPacket)
+// backend is a network server that downlinks are received from.
+type backend interface {
+	// txAck reports to the server if the downlink has been sent (err is nil).
+	// err is a fwd.TxAckError if the downlink has been rejected, or the error of the radio.
+	txAck(pkt *fwd.Packet, err error)
+}
 
-type Queue struct {
-	pkt  *lora.TxPacket
-	next *Queue
+// downlink is a downlink and the server that sent it.
+type downlink struct {
+	origin backend
+	pkt    *fwd.Packet
 }
 
-var queue *Queue
+// txAckError returns the TX_ACK error for the result of a downlink: NoError if err is nil,
+// err itself if it is a TX_ACK error, ErrTooLate if the radio could not send in time and
+// ErrTxFreq if the frequency is out of its range.
+// ok is false for other radio errors, TX_ACK has no error for them.
+func txAckError(err error) (e fwd.TxAckError, ok bool) {
+	if err == nil {
+		return fwd.NoError, true
+	}
+	if e, ok := err.(fwd.TxAckError); ok {
+		return e, true
+	}
+	if errors.Is(err, lora.ErrTooLate) {
+		return fwd.ErrTooLate, true
+	}
+	if errors.Is(err, lora.ErrFreq) {
+		return fwd.ErrTxFreq, true
+	}
+	return 0, false
+}
 
-var queueSize int
+// txAck acknowledges a downlink to the server that sent it.
+// Servers using protocol version 1 do not get a TX_ACK, nor do downlinks that failed with a
+// radio error that TX_ACK has no error for: any error code would be wrong, and no error
+// would report the downlink as sent.
+func (s *server) txAck(pkt *fwd.Packet, err error) {
+	if s.version == fwd.ProtocolVersion1 {
+		log(LogLevelVerbose, "(-> %s) no TxAck with protocol version 1", s)
+		return
+	}
+	e, ok := txAckError(err)
+	if !ok {
+		log(LogLevelError, "(-> %s) no TX_ACK, the downlink failed: %v", s, err)
+		return
+	}
+	s.gw.sendTo([]*server{s}, &fwd.Packet{
+		Token: pkt.Token,
+		Ident: fwd.TxAck,
+		TxAck: e,
+	})
+}
+
+var lbtRetryDelay = time.Millisecond * 5
+
+// clearToSend checks with listen before talk (if enabled) if the channel of the packet is free.
+func (gw *gateway) clearToSend(radio lora.Radio, pkt *lora.TxPacket) bool {
+	if gw.lbt == nil || !gw.lbt.Enabled {
+		return true
+	}
+	sensor := radio.(lora.ChannelSensor)
+	for try := 1; try <= gw.lbt.MaxTries; try++ {
+		if try != 1 {
+			time.Sleep(lbtRetryDelay)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		busy, err := sensor.ChannelBusy(ctx, pkt, gw.lbt.RSSITarget)
+		cancel()
+		if err != nil {
+			log(LogLevelError, "lbt: can not check channel: %v", err)
+			return false
+		}
+		if !busy {
+			return true
+		}
+		log(LogLevelVerbose, "lbt: channel %.2f MHz is busy (try %d/%d)", float64(pkt.Freq)/1e6, try, gw.lbt.MaxTries)
+	}
+	return false
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/SX127X"
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/fwd/fakens"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/Waziup/single_chan_pkt_fwd/sim"
+)
+
+func TestTxAckError(t *testing.T) {
+	tests := []struct {
+		err error
+		e   fwd.TxAckError
+		ok  bool
+	}{
+		{nil, fwd.NoError, true},
+		{fwd.ErrCollisionPacket, fwd.ErrCollisionPacket, true},
+		{SX127X.ErrTooLate, fwd.ErrTooLate, true},
+		{fmt.Errorf("can not send: %w", SX127X.ErrTooLate), fwd.ErrTooLate, true},
+		{fmt.Errorf("can not set frequency: %w", lora.ErrFreq), fwd.ErrTxFreq, true},
+		{SX127X.ErrTimeout, 0, false},
+		{fmt.Errorf("can not set spr"), 0, false},
+	}
+	for _, test := range tests {
+		e, ok := txAckError(test.err)
+		if e != test.e || ok != test.ok {
+			t.Errorf("txAckError(%v) = %v, %v, expected %v, %v", test.err, e, ok, test.e, test.ok)
+		}
+	}
+}
+
+// runGateway runs the gateway with a simulated radio on 868.1 MHz, SF7, until stop is called.
+func runGateway(gw *gateway) (radio *sim.Radio, stop func()) {
+	radio = sim.New()
+	return radio, runGatewayWith(gw, radio)
+}
+
+// runGatewayWith runs the gateway with the radio on 868.1 MHz, SF7, until stop is called.
+func runGatewayWith(gw *gateway, radio lora.Radio) (stop func()) {
+	cfg := &lora.Config{Freq: 868100000, Modulation: "LORA", LoRaBW: 125000, LoRaCR: "4/5", Datarate: 7}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		gw.run(ctx, radio, cfg)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// untimedRadio is a simulated radio that is not a lora.TimedSender (nor a lora.ChannelSensor).
+type untimedRadio struct {
+	r *sim.Radio
+}
+
+func (u untimedRadio) Name() string                         { return u.r.Name() }
+func (u untimedRadio) Receive(cfg *lora.Config) error       { return u.r.Receive(cfg) }
+func (u untimedRadio) GetPacket() ([]*lora.RxPacket, error) { return u.r.GetPacket() }
+func (u untimedRadio) Send(pkt *lora.TxPacket) error        { return u.r.Send(pkt) }
+
+// ackRecorder is a backend that passes the results of its downlinks on.
+type ackRecorder chan error
+
+func (a ackRecorder) txAck(pkt *fwd.Packet, err error) {
+	a <- err
+}
+
+// queueDownlink passes a downlink, to be sent in d, to the run loop of the gateway.
+func queueDownlink(gw *gateway, acks ackRecorder, d time.Duration) *fwd.Packet {
+	pkt := &fwd.Packet{
+		Token: fwd.RndToken(),
+		Ident: fwd.PullResp,
+		TxPacket: &lora.TxPacket{
+			CountUs:    gw.counter.Now() + uint32(d/time.Microsecond),
+			Freq:       868100000,
+			Modulation: "LORA",
+			Datarate:   7,
+			LoRaBW:     8,
+			LoRaCR:     5,
+			Data:       []byte("downlink"),
+		},
+	}
+	gw.chanTx <- downlink{origin: acks, pkt: pkt}
+	return pkt
+}
+
+// The run loop keeps receiving while it waits to send a downlink with a radio that can not
+// send at a given time.
+func TestSendUntimed(t *testing.T) {
+	defer func(d time.Duration) { checkReceived = d }(checkReceived)
+	checkReceived = 10 * time.Millisecond
+
+	gw := newGateway(1)
+	gw.jit.Lead = 300 * time.Millisecond
+	radio := sim.New()
+	stop := runGatewayWith(gw, untimedRadio{radio})
+	defer stop()
+
+	time.Sleep(600 * time.Millisecond) // the gateway starts receiving after 500ms
+
+	acks := make(ackRecorder, 1)
+	pkt := queueDownlink(gw, acks, 500*time.Millisecond)
+	time.Sleep(300 * time.Millisecond) // prepared, waiting to send
+
+	radio.Inject(&lora.RxPacket{Freq: 868100000, Modulation: "LORA", Datarate: 7, LoRaBW: 8, LoRaCR: 5, StatCRC: 1, Data: []byte("uplink")})
+	deadline := time.Now().Add(150 * time.Millisecond)
+	for {
+		gw.stats.Lock()
+		rxNb := gw.stats.RxNb
+		gw.stats.Unlock()
+		if rxNb == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("uplink not received while waiting to send the downlink")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := len(radio.Downlinks()); n != 0 {
+		t.Fatalf("%d downlinks sent before the uplink was received, expected 0", n)
+	}
+
+	if tx := radio.WaitDownlink(time.Second); tx == nil || string(tx.Data) != "downlink" {
+		t.Fatalf("sent %v, expected the downlink", tx)
+	}
+	if late := time.Since(gw.counter.Time(pkt.TxPacket.CountUs)); late < 0 || late > 50*time.Millisecond {
+		t.Errorf("downlink sent %s after its time, expected at its time", late)
+	}
+	select {
+	case err := <-acks:
+		if err != nil {
+			t.Errorf("downlink acknowledged with %v, expected no error", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("downlink not acknowledged")
+	}
+}
+
+func TestForward(t *testing.T) {
+	defer func(d time.Duration) { checkReceived = d }(checkReceived)
+	checkReceived = 10 * time.Millisecond
+
+	ns, err := fakens.Listen("127.0.0.1:0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+
+	gw := newGateway(0x0102030405060708)
+	s := newServer(gw, "127.0.0.1", ns.UpAddr().Port, ns.UpAddr().Port, fwd.ProtocolVersion2)
+	gw.servers = []*server{s}
+	gw.connect()
+	radio, stop := runGateway(gw)
+	defer func() {
+		stop()
+		closeServer(s)
+	}()
+
+	if id, ok := ns.WaitPull(5 * time.Second); !ok || id != gw.id {
+		t.Fatalf("PULL_DATA from %X (%v), expected %X", id, ok, gw.id)
+	}
+
+	radio.Inject(&lora.RxPacket{
+		Freq:       868100000,
+		Modulation: "LORA",
+		Datarate:   7,
+		LoRaBW:     8,
+		LoRaCR:     5,
+		RSSI:       -80,
+		LoRaSNR:    7.5,
+		StatCRC:    1,
+		Data:       []byte("uplink"),
+	})
+	rx := ns.WaitUplink(5 * time.Second)
+	if rx == nil {
+		t.Fatal("no uplink received")
+	}
+	if string(rx.Data) != "uplink" || rx.Freq != 868100000 || rx.Datarate != 7 || rx.RSSI != -80 {
+		t.Errorf("received %s, expected the injected packet", rx)
+	}
+
+	// RX1, one second after the uplink
+	tmst := rx.CountUs + 1000000
+	token, err := ns.Downlink(&lora.TxPacket{
+		CountUs:    tmst,
+		Freq:       868100000,
+		Modulation: "LORA",
+		Datarate:   7,
+		LoRaBW:     8,
+		LoRaCR:     5,
+		Data:       []byte("downlink"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := radio.WaitDownlink(5 * time.Second)
+	if tx == nil {
+		t.Fatal("no downlink sent")
+	}
+	if late := time.Since(gw.counter.Time(tmst)); late < 0 || late > 200*time.Millisecond {
+		t.Errorf("downlink sent %s after tmst, expected at tmst", late)
+	}
+	if string(tx.Data) != "downlink" || tx.CountUs != tmst {
+		t.Errorf("sent %s, expected the downlink at %d", tx, tmst)
+	}
+	if e, ok := ns.WaitTxAck(token, 5*time.Second); !ok || e != fwd.NoError {
+		t.Errorf("TX_ACK %v (%v), expected %v", e, ok, fwd.NoError)
+	}
+
+	// too late to be queued
+	token, err = ns.Downlink(&lora.TxPacket{
+		CountUs:    gw.counter.Now(),
+		Freq:       868100000,
+		Modulation: "LORA",
+		Datarate:   7,
+		LoRaBW:     8,
+		LoRaCR:     5,
+		Data:       []byte("late"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := ns.WaitTxAck(token, 5*time.Second); !ok || e != fwd.ErrTooLate {
+		t.Errorf("TX_ACK %v (%v), expected %v", e, ok, fwd.ErrTooLate)
+	}
+	if pkts := radio.Downlinks(); len(pkts) != 1 {
+		t.Errorf("%d downlinks sent, expected 1", len(pkts))
+	}
+}
+
+func TestListenBeforeTalk(t *testing.T) {
+	tests := []struct {
+		name  string
+		busy  int // number of checks the channel is busy for
+		tries int // expected number of checks
+		ack   error
+	}{
+		{"free", 0, 1, nil},
+		{"busy, then free", 2, 3, nil},
+		{"busy", 5, 3, fwd.ErrCollisionPacket},
+	}
+	for _, test := range tests {
+		var mu sync.Mutex
+		tries := 0
+		radio := sim.New()
+		radio.Busy = func(pkt *lora.TxPacket) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			tries++
+			return tries <= test.busy
+		}
+		gw := newGateway(1)
+		gw.lbt = &LBTConfig{Enabled: true, RSSITarget: -80, MaxTries: 3}
+		stop := runGatewayWith(gw, radio)
+		time.Sleep(600 * time.Millisecond) // the gateway starts receiving after 500ms
+
+		acks := make(ackRecorder, 1)
+		queueDownlink(gw, acks, 200*time.Millisecond)
+		select {
+		case err := <-acks:
+			if err != test.ack {
+				t.Errorf("%s: downlink acknowledged with %v, expected %v", test.name, err, test.ack)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: downlink not acknowledged", test.name)
+		}
+		stop()
+
+		mu.Lock()
+		if tries != test.tries {
+			t.Errorf("%s: channel checked %d times, expected %d", test.name, tries, test.tries)
+		}
+		mu.Unlock()
+		if n, sent := len(radio.Downlinks()), test.ack == nil; (n == 1) != sent {
+			t.Errorf("%s: %d downlinks sent, expected sent %v", test.name, n, sent)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/chirpstack"
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttRetry is the first delay after a failed connection to the broker, it is doubled up to mqttRetryMax.
+var mqttRetry = time.Second * 5
+
+// mqttRetryMax is the maximum delay between two connection attempts.
+var mqttRetryMax = time.Minute * 5
+
+// mqttTopicPayload is the topic of the decrypted payloads of the devices of the keystore.
+// It is not a topic of the ChirpStack Gateway Bridge.
+const mqttTopicPayload = "event/payload"
+
+// mqttPayload is a decrypted payload, in the style of the ChirpStack messages.
+type mqttPayload struct {
+	GatewayID string `json:"gatewayId"`
+	DevAddr   string `json:"devAddr"`
+	FCnt      uint32 `json:"fCnt"`
+	FPort     int    `json:"fPort"`
+	Data      []byte `json:"data"`
+}
+
+// mqttBridge publishes received packets and status reports to an MQTT broker and receives
+// downlinks from it, with the topics and JSON messages of the ChirpStack Gateway Bridge.
+type mqttBridge struct {
+	gw     *gateway
+	server string // broker address
+	client mqtt.Client
+	topic  string // topic of the gateway, like gateway/0102030405060708
+	qos    byte
+
+	mu      sync.Mutex
+	pending map[*fwd.Packet]*mqttDownlink
+}
+
+// mqttDownlink is a downlink frame, of which the item with the index item is queued.
+type mqttDownlink struct {
+	frame *chirpstack.DownlinkFrame
+	item  int
+	acks  []chirpstack.DownlinkTxAckItem
+}
+
+func newMQTTBridge(gw *gateway, cfg *MQTTConfig) (*mqttBridge, error) {
+	prefix := cfg.TopicPrefix
+	if prefix == "" {
+		prefix = "gateway"
+	}
+	b := &mqttBridge{
+		gw:      gw,
+		server:  cfg.Server,
+		topic:   chirpstack.GatewayTopic(prefix, gw.id),
+		qos:     cfg.QoS,
+		pending: make(map[*fwd.Packet]*mqttDownlink),
+	}
+
+	clientID := cfg.ClientID
+	if clientID == "" {
+		clientID = chirpstack.GatewayID(gw.id)
+	}
+	offline, _ := json.Marshal(&chirpstack.ConnState{GatewayID: chirpstack.GatewayID(gw.id), State: "OFFLINE"})
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Server).
+		SetClientID(clientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(mqttRetryMax).
+		SetBinaryWill(b.topic+"/"+chirpstack.TopicConn, offline, 1, true).
+		SetOnConnectHandler(b.connected).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log(LogLevelError, "(<- %s) connection lost: %v", b, err)
+		})
+	if cfg.CAFile != "" {
+		tlsConfig, err := trust(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	b.client = mqtt.NewClient(opts)
+	return b, nil
+}
+
+func (b *mqttBridge) String() string {
+	return b.server
+}
+
+// connect connects to the broker. Failed connections are retried with an increasing delay,
+// once connected the client reconnects by itself.
+func (b *mqttBridge) connect() {
+	retry := mqttRetry
+	for {
+		t := b.client.Connect()
+		if t.Wait(); t.Error() == nil {
+			return
+		}
+		log(LogLevelError, "(-> %s) can not connect: %v, retrying in %s", b, t.Error(), retry)
+		time.Sleep(retry)
+		if retry *= 2; retry > mqttRetryMax {
+			retry = mqttRetryMax
+		}
+	}
+}
+
+// connected publishes the ONLINE state and subscribes to the downlinks, after every (re)connection.
+func (b *mqttBridge) connected(client mqtt.Client) {
+	log(LogLevelNormal, "(-> %s) connected, topic %s", b, b.topic)
+	online, _ := json.Marshal(&chirpstack.ConnState{GatewayID: chirpstack.GatewayID(b.gw.id), State: "ONLINE"})
+	client.Publish(b.topic+"/"+chirpstack.TopicConn, 1, true, online)
+	t := client.Subscribe(b.topic+"/"+chirpstack.TopicDown, b.qos, b.downlink)
+	if t.Wait(); t.Error() != nil {
+		log(LogLevelError, "(-> %s) can not subscribe to downlinks: %v", b, t.Error())
+	}
+}
+
+// publish publishes the message on the topic below the gateway topic, without waiting for the broker.
+func (b *mqttBridge) publish(topic string, msg interface{}) {
+	if !b.client.IsConnected() {
+		log(LogLevelVerbose, "(-> %s) not connected, %s dropped", b, topic)
+		return
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log(LogLevelError, "(-> %s) can not marshal %s: %v", b, topic, err)
+		return
+	}
+	log(LogLevelDebug, "(-> %s) %s: %s", b, topic, data)
+	b.client.Publish(b.topic+"/"+topic, b.qos, false, data)
+}
+
+// uplink publishes the received packets.
+func (b *mqttBridge) uplink(pkts []*lora.RxPacket) {
+	for _, rx := range pkts {
+		up := chirpstack.Uplink(b.gw.id, rand.Uint32(), rx)
+		log(LogLevelNormal, "(-> %s) %s: uplink %d", b, chirpstack.TopicUp, up.RxInfo.UplinkID)
+		b.publish(chirpstack.TopicUp, up)
+	}
+}
+
+// stats publishes the status report.
+func (b *mqttBridge) stats(stat *fwd.Stat) {
+	b.publish(chirpstack.TopicStats, chirpstack.Stats(b.gw.id, stat))
+}
+
+// payload publishes the decrypted payload of an uplink.
+func (b *mqttBridge) payload(d *decrypted) {
+	b.publish(mqttTopicPayload, &mqttPayload{
+		GatewayID: chirpstack.GatewayID(b.gw.id),
+		DevAddr:   d.devAddr.String(),
+		FCnt:      d.fCnt,
+		FPort:     d.fPort,
+		Data:      d.payload,
+	})
+}
+
+// downlink handles a downlink frame received from the broker. It is called by the MQTT client.
+func (b *mqttBridge) downlink(_ mqtt.Client, msg mqtt.Message) {
+	b.gw.stats.Lock()
+	b.gw.stats.DwNb++
+	b.gw.stats.Unlock()
+
+	var frame chirpstack.DownlinkFrame
+	if err := json.Unmarshal(msg.Payload(), &frame); err != nil {
+		log(LogLevelWarning, "(<- %s) can not parse downlink: %v", b, err)
+		return
+	}
+	log(LogLevelNormal, "(<- %s) %s: downlink %d, %d items", b, chirpstack.TopicDown, frame.DownlinkID, len(frame.Items))
+	dl := &mqttDownlink{
+		frame: &frame,
+		acks:  make([]chirpstack.DownlinkTxAckItem, len(frame.Items)),
+	}
+	for i := range dl.acks {
+		dl.acks[i].Status = chirpstack.StatusIgnored
+	}
+	// the handler must not wait for the run loop, that would stop the client from receiving messages
+	go b.schedule(dl)
+}
+
+// schedule passes the current item of the downlink to the downlink queue.
+// Items that can not be sent are skipped, the downlink is acknowledged if no item is left.
+func (b *mqttBridge) schedule(dl *mqttDownlink) {
+	for ; dl.item < len(dl.frame.Items); dl.item++ {
+		tx, err := dl.frame.Items[dl.item].TxPacket()
+		if err != nil {
+			log(LogLevelWarning, "(<- %s) downlink %d, item %d rejected: %v", b, dl.frame.DownlinkID, dl.item, err)
+			dl.acks[dl.item].Status = chirpstack.StatusInternalError
+			if e, ok := err.(fwd.TxAckError); ok {
+				dl.acks[dl.item].Status = chirpstack.Status(e)
+			}
+			continue
+		}
+		pkt := &fwd.Packet{
+			Token:    fwd.RndToken(),
+			Ident:    fwd.PullResp,
+			TxPacket: tx,
+		}
+		b.mu.Lock()
+		b.pending[pkt] = dl
+		b.mu.Unlock()
+		b.gw.chanTx <- downlink{origin: b, pkt: pkt}
+		return
+	}
+	b.ack(dl)
+}
+
+// txAck publishes the acknowledgement of the downlink if it has been sent, or tries the next item.
+func (b *mqttBridge) txAck(pkt *fwd.Packet, err error) {
+	b.mu.Lock()
+	dl, ok := b.pending[pkt]
+	delete(b.pending, pkt)
+	b.mu.Unlock()
+	if !ok {
+		return
+	}
+	if e, ok := txAckError(err); ok {
+		dl.acks[dl.item].Status = chirpstack.Status(e)
+	} else {
+		dl.acks[dl.item].Status = chirpstack.StatusInternalError
+	}
+	if err == nil {
+		b.ack(dl)
+		return
+	}
+	log(LogLevelVerbose, "(<- %s) downlink %d, item %d: %v", b, dl.frame.DownlinkID, dl.item, err)
+	dl.item++
+	// the run loop that called txAck is the receiver of the downlink queue
+	go b.schedule(dl)
+}
+
+func (b *mqttBridge) ack(dl *mqttDownlink) {
+	log(LogLevelNormal, "(-> %s) %s: downlink %d", b, chirpstack.TopicAck, dl.frame.DownlinkID)
+	b.publish(chirpstack.TopicAck, &chirpstack.DownlinkTxAck{
+		GatewayID:  chirpstack.GatewayID(b.gw.id),
+		DownlinkID: dl.frame.DownlinkID,
+		Items:      dl.acks,
+	})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/chirpstack"
+	"github.com/Waziup/single_chan_pkt_fwd/chirpstack/fakebroker"
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// connectBridge connects the MQTT bridge of the gateway to a new fakebroker and waits until it
+// has subscribed to the downlinks. stop disconnects the bridge and closes the broker.
+func connectBridge(t *testing.T, gw *gateway) (broker *fakebroker.Broker, stop func()) {
+	broker, err := fakebroker.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gw.bridge, err = newMQTTBridge(gw, &MQTTConfig{Enabled: true, Server: broker.Addr()}); err != nil {
+		broker.Close()
+		t.Fatal(err)
+	}
+	gw.bridge.connect()
+	stop = func() {
+		gw.bridge.client.Disconnect(100)
+		broker.Close()
+	}
+	if !broker.WaitSubscribed(gw.bridge.topic+"/"+chirpstack.TopicDown, 5*time.Second) {
+		stop()
+		t.Fatal("bridge has not subscribed to the downlinks")
+	}
+	return broker, stop
+}
+
+// publishDownlink publishes the downlink frame on the downlink topic of the bridge.
+func publishDownlink(t *testing.T, broker *fakebroker.Broker, b *mqttBridge, frame *chirpstack.DownlinkFrame) {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.Publish(b.topic+"/"+chirpstack.TopicDown, data, false)
+}
+
+// waitAck waits for the next acknowledgement that the bridge publishes.
+func waitAck(t *testing.T, broker *fakebroker.Broker, b *mqttBridge) *chirpstack.DownlinkTxAck {
+	msg := broker.WaitMessage(b.topic+"/"+chirpstack.TopicAck, 5*time.Second)
+	if msg == nil {
+		t.Fatal("no downlink acknowledged")
+	}
+	var ack chirpstack.DownlinkTxAck
+	if err := json.Unmarshal(msg.Payload, &ack); err != nil {
+		t.Fatal(err)
+	}
+	return &ack
+}
+
+// delayItem returns a downlink item that is sent delay after the uplink with the counter tmst.
+func delayItem(tmst uint32, delay time.Duration, freq uint32) chirpstack.DownlinkFrameItem {
+	ctx := make([]byte, 4)
+	binary.BigEndian.PutUint32(ctx, tmst)
+	return chirpstack.DownlinkFrameItem{
+		PhyPayload: []byte{0x60, 0xF1, 0x7D, 0xBE, 0x49},
+		TxInfo: chirpstack.DownlinkTxInfo{
+			Frequency: freq,
+			Power:     14,
+			Modulation: chirpstack.Modulation{LoRa: &chirpstack.LoRaModulationInfo{
+				Bandwidth:             125000,
+				SpreadingFactor:       7,
+				CodeRate:              "CR_4_5",
+				PolarizationInversion: true,
+			}},
+			Timing:  chirpstack.Timing{Delay: &chirpstack.DelayTimingInfo{Delay: chirpstack.Duration(delay)}},
+			Context: ctx,
+		},
+	}
+}
+
+func checkAck(t *testing.T, ack *chirpstack.DownlinkTxAck, downlinkID uint32, status ...string) {
+	var got []string
+	for _, item := range ack.Items {
+		got = append(got, item.Status)
+	}
+	if ack.DownlinkID != downlinkID || ack.GatewayID != "0102030405060708" || fmt.Sprint(got) != fmt.Sprint(status) {
+		t.Errorf("ack of downlink %d with %v, expected downlink %d with %v", ack.DownlinkID, got, downlinkID, status)
+	}
+}
+
+func TestMQTTBridgeItems(t *testing.T) {
+	gw := newGateway(0x0102030405060708)
+	broker, stop := connectBridge(t, gw)
+	defer stop()
+	b := gw.bridge
+
+	gps := delayItem(0, time.Second, 868100000)
+	gps.TxInfo.Timing = chirpstack.Timing{GPSEpoch: &chirpstack.GPSTimingInfo{}}
+	publishDownlink(t, broker, b, &chirpstack.DownlinkFrame{
+		DownlinkID: 1,
+		Items:      []chirpstack.DownlinkFrameItem{gps, delayItem(0, time.Second, 868100000), delayItem(0, 2*time.Second, 869525000)},
+	})
+
+	// the GPS item can not be sent, the RX1 item is too late, the RX2 item is sent
+	dl := nextDownlink(gw, 5*time.Second)
+	if dl == nil {
+		t.Fatal("RX1 item not queued")
+	}
+	if tx := dl.pkt.TxPacket; tx.CountUs != 1000000 || tx.Freq != 868100000 {
+		t.Errorf("queued %s, expected RX1", tx)
+	}
+	dl.origin.txAck(dl.pkt, fwd.ErrTooLate)
+	dl = nextDownlink(gw, 5*time.Second)
+	if dl == nil {
+		t.Fatal("RX2 item not queued")
+	}
+	if tx := dl.pkt.TxPacket; tx.CountUs != 2000000 || tx.Freq != 869525000 {
+		t.Errorf("queued %s, expected RX2", tx)
+	}
+	dl.origin.txAck(dl.pkt, nil)
+	checkAck(t, waitAck(t, broker, b), 1, "GPS_UNLOCKED", "TOO_LATE", "OK")
+
+	// the items after the one that has been sent are ignored
+	publishDownlink(t, broker, b, &chirpstack.DownlinkFrame{
+		DownlinkID: 2,
+		Items:      []chirpstack.DownlinkFrameItem{delayItem(0, time.Second, 868100000), delayItem(0, 2*time.Second, 869525000)},
+	})
+	// downlinks are received while the run loop has not taken the previous one
+	noTiming := delayItem(0, time.Second, 868100000)
+	noTiming.TxInfo.Timing = chirpstack.Timing{}
+	publishDownlink(t, broker, b, &chirpstack.DownlinkFrame{
+		DownlinkID: 3,
+		Items:      []chirpstack.DownlinkFrameItem{noTiming},
+	})
+	checkAck(t, waitAck(t, broker, b), 3, chirpstack.StatusInternalError)
+
+	dl = nextDownlink(gw, 5*time.Second)
+	if dl == nil {
+		t.Fatal("downlink 2 not queued")
+	}
+	dl.origin.txAck(dl.pkt, nil)
+	checkAck(t, waitAck(t, broker, b), 2, "OK", chirpstack.StatusIgnored)
+
+	// radio errors have no status of their own
+	publishDownlink(t, broker, b, &chirpstack.DownlinkFrame{
+		DownlinkID: 4,
+		Items:      []chirpstack.DownlinkFrameItem{delayItem(0, time.Second, 868100000)},
+	})
+	dl = nextDownlink(gw, 5*time.Second)
+	if dl == nil {
+		t.Fatal("downlink 4 not queued")
+	}
+	dl.origin.txAck(dl.pkt, fmt.Errorf("can not set frequency"))
+	checkAck(t, waitAck(t, broker, b), 4, chirpstack.StatusInternalError)
+
+	gw.stats.Lock()
+	dwNb := gw.stats.DwNb
+	gw.stats.Unlock()
+	if dwNb != 4 {
+		t.Errorf("%d downlinks counted, expected 4", dwNb)
+	}
+}
+
+func TestMQTTBridgeRoundTrip(t *testing.T) {
+	defer func(d time.Duration) { checkReceived = d }(checkReceived)
+	checkReceived = 10 * time.Millisecond
+
+	gw := newGateway(0x0102030405060708)
+	gw.statInterval = 500 * time.Millisecond
+	broker, stopBridge := connectBridge(t, gw)
+	defer stopBridge()
+	b := gw.bridge
+	radio, stop := runGateway(gw)
+	defer stop()
+
+	radio.Inject(&lora.RxPacket{
+		Freq:       868100000,
+		Modulation: "LORA",
+		Datarate:   7,
+		LoRaBW:     8,
+		LoRaCR:     5,
+		RSSI:       -80,
+		StatCRC:    1,
+		Data:       []byte{0x40, 0xF1, 0x7D, 0xBE, 0x49, 0x00, 0x02, 0x00, 0x01, 0x95, 0x43, 0x78, 0x76, 0x2B, 0x11, 0xFF, 0x0D},
+	})
+	msg := broker.WaitMessage(b.topic+"/"+chirpstack.TopicUp, 5*time.Second)
+	if msg == nil {
+		t.Fatal("no uplink published")
+	}
+	var up chirpstack.UplinkFrame
+	if err := json.Unmarshal(msg.Payload, &up); err != nil {
+		t.Fatal(err)
+	}
+	if len(up.PhyPayload) != 17 || up.TxInfo.Frequency != 868100000 || up.RxInfo.RSSI != -80 || up.RxInfo.CRCStatus != "CRC_OK" || len(up.RxInfo.Context) != 4 {
+		t.Fatalf("uplink %+v, expected the injected packet", up)
+	}
+
+	// RX1, with the context of the uplink
+	tmst := binary.BigEndian.Uint32(up.RxInfo.Context)
+	publishDownlink(t, broker, b, &chirpstack.DownlinkFrame{
+		DownlinkID: 7,
+		Items:      []chirpstack.DownlinkFrameItem{delayItem(tmst, time.Second, 868100000)},
+	})
+	tx := radio.WaitDownlink(5 * time.Second)
+	if tx == nil {
+		t.Fatal("no downlink sent")
+	}
+	if tx.CountUs != tmst+1000000 || !bytes.Equal(tx.Data, []byte{0x60, 0xF1, 0x7D, 0xBE, 0x49}) {
+		t.Errorf("sent %s, expected the downlink at %d", tx, tmst+1000000)
+	}
+	checkAck(t, waitAck(t, broker, b), 7, "OK")
+
+	// the status reports count the packets
+	var stats chirpstack.GatewayStats
+	for stats.TxPacketsEmitted == 0 {
+		msg := broker.WaitMessage(b.topic+"/"+chirpstack.TopicStats, 5*time.Second)
+		if msg == nil {
+			t.Fatalf("stats %+v, expected 1 packet received and 1 sent", stats)
+		}
+		var s chirpstack.GatewayStats
+		if err := json.Unmarshal(msg.Payload, &s); err != nil {
+			t.Fatal(err)
+		}
+		stats.RxPacketsReceived += s.RxPacketsReceived
+		stats.TxPacketsReceived += s.TxPacketsReceived
+		stats.TxPacketsEmitted += s.TxPacketsEmitted
+	}
+	if stats.RxPacketsReceived != 1 || stats.TxPacketsReceived != 1 || stats.TxPacketsEmitted != 1 {
+		t.Errorf("stats %+v, expected 1 packet received and 1 sent", stats)
+	}
+}
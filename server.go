@@ -0,0 +1,408 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+)
+
+// maxMissedPullAcks is the number of PULL_ACKs in a row a server can miss before it is unreachable.
+const maxMissedPullAcks = 3
+
+// ackTimeout is the time after which an upstream datagram is no longer expected to be acknowledged.
+var ackTimeout = time.Second * 30
+
+// resolveInterval is the interval that server hostnames are resolved again.
+var resolveInterval = time.Minute * 10
+
+// resolveRetry is the first delay after a failed resolution, it is doubled up to resolveInterval.
+var resolveRetry = time.Second * 5
+
+// server is a network server that the forwarder is connected to.
+// As with the Semtech reference forwarder, PUSH_DATA is sent on the upstream socket (to the up port)
+// and PULL_DATA and TX_ACK on the downstream socket (to the down port), where PULL_RESP is received.
+// The server keeps track of the upstream datagrams that have not been acknowledged yet.
+type server struct {
+	gw       *gateway
+	host     string // hostname or IP (v4 or v6)
+	portUp   int
+	portDown int
+	version  uint8 // protocol version
+
+	mu sync.Mutex
+
+	// the active addresses and sockets, nil as long as the hostname could not be resolved
+	up       *net.UDPAddr
+	down     *net.UDPAddr
+	upConn   *net.UDPConn
+	downConn *net.UDPConn
+
+	pending     map[fwd.Token]pendingDatagram
+	pushNb      uint32        // PUSH_DATA datagrams sent, not counting those sent again from the store
+	pushAckNb   uint32        // PUSH_ACK datagrams received for them
+	interval    int           // stat interval, PUSH_ACKs only count in the interval of their PUSH_DATA
+	rttSum      time.Duration // sum of all round trip times
+	rttNb       int           // number of round trip times in rttSum
+	missedPulls int           // PULL_DATA in a row without PULL_ACK
+	unreachable bool
+
+	dwTokens   float64   // downlinks that can be accepted now (rate limit)
+	dwLast     time.Time // last time dwTokens was updated
+	dwRejected uint32    // downlinks rejected
+
+	store     *store        // PUSH_DATA that have not been acknowledged, nil if disabled
+	storeWake chan struct{} // wakes up forward
+	storeName string        // the stored datagram that has been sent last
+	storeSent time.Time
+}
+
+type pendingDatagram struct {
+	ident    fwd.Ident
+	sent     time.Time
+	data     []byte // PUSH_DATA that is stored if it is not acknowledged in time, nil without store
+	stored   bool   // sent again from the store, not counted in the statistics
+	name     string // of the stored datagram, removed from the store when it is acknowledged
+	interval int    // stat interval the datagram was sent in
+}
+
+func newServer(gw *gateway, host string, portUp int, portDown int, version uint8) *server {
+	return &server{
+		gw:        gw,
+		host:      host,
+		portUp:    portUp,
+		portDown:  portDown,
+		version:   version,
+		pending:   make(map[fwd.Token]pendingDatagram),
+		storeWake: make(chan struct{}, 1),
+	}
+}
+
+func (s *server) String() string {
+	return net.JoinHostPort(s.host, strconv.Itoa(s.portUp))
+}
+
+// lookupIP and dialUDP look up the addresses of a hostname and connect a socket.
+var (
+	lookupIP = net.LookupIP
+	dialUDP  = net.DialUDP
+)
+
+// resolve looks up the hostname and connects the sockets to the new address if it has changed.
+// The current address is kept as long as it is among the resolved addresses. Otherwise the
+// addresses are tried in order, e.g. an IPv6 address can not be used without an IPv6 route.
+// A PULL_DATA is sent right away on the new sockets, so that downlinks can be received.
+func (s *server) resolve() error {
+	ips := []net.IP{net.ParseIP(s.host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = lookupIP(s.host); err != nil {
+			return err
+		}
+		if len(ips) == 0 {
+			return fmt.Errorf("no address for %s", s.host)
+		}
+	}
+
+	s.mu.Lock()
+	current := s.up
+	s.mu.Unlock()
+	if current != nil {
+		for _, ip := range ips {
+			if ip.Equal(current.IP) {
+				return nil
+			}
+		}
+	}
+
+	var up, down *net.UDPAddr
+	var upConn, downConn *net.UDPConn
+	var err error
+	for _, ip := range ips {
+		up = &net.UDPAddr{IP: ip, Port: s.portUp}
+		down = &net.UDPAddr{IP: ip, Port: s.portDown}
+		if upConn, downConn, err = dial(up, down); err == nil {
+			break
+		}
+		log(LogLevelVerbose, "(%s) can not use address %s: %v", s, ip, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	oldUpConn, oldDownConn := s.upConn, s.downConn
+	s.up, s.down = up, down
+	s.upConn, s.downConn = upConn, downConn
+	s.mu.Unlock()
+
+	if oldUpConn != nil {
+		oldUpConn.Close()
+		oldDownConn.Close()
+		log(LogLevelWarning, "(%s) address changed from %s to %s", s, current.IP, up.IP)
+	}
+	log(LogLevelNormal, "(%s) upstream %s on %s, downstream %s on %s", s, up, upConn.LocalAddr(), down, downConn.LocalAddr())
+
+	go s.downstream(upConn)
+	go s.downstream(downConn)
+
+	s.gw.sendTo([]*server{s}, &fwd.Packet{
+		Ident: fwd.PullData,
+		Token: fwd.RndToken(),
+	})
+	return nil
+}
+
+// dial connects the upstream and downstream socket.
+func dial(up, down *net.UDPAddr) (upConn, downConn *net.UDPConn, err error) {
+	if upConn, err = dialUDP("udp", nil, up); err != nil {
+		return nil, nil, err
+	}
+	if downConn, err = dialUDP("udp", nil, down); err != nil {
+		upConn.Close()
+		return nil, nil, err
+	}
+	return upConn, downConn, nil
+}
+
+// keepResolved resolves the hostname now and then every resolveInterval, with a backoff after failures.
+func (s *server) keepResolved() {
+	err := s.resolve()
+	retry := resolveRetry
+	for {
+		delay := resolveInterval
+		if err != nil {
+			log(LogLevelError, "(%s) can not resolve server address: %v (retry in %s)", s, err, retry)
+			delay = retry
+			if retry *= 2; retry > resolveInterval {
+				retry = resolveInterval
+			}
+		} else {
+			if net.ParseIP(s.host) != nil {
+				return // nothing to resolve
+			}
+			retry = resolveRetry
+		}
+		time.Sleep(delay)
+		err = s.resolve()
+	}
+}
+
+// conn returns the socket that datagrams of the type are sent on, or nil if the server is not resolved.
+func (s *server) conn(ident fwd.Ident) *net.UDPConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ident == fwd.PushData {
+		return s.upConn
+	}
+	return s.downConn
+}
+
+// connected reports whether conn is one of the active sockets of the server.
+func (s *server) connected(conn *net.UDPConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return conn == s.upConn || conn == s.downConn
+}
+
+// sent remembers the token of a PUSH_DATA or PULL_DATA datagram.
+// A PULL_DATA that is still pending when the next one is sent counts as a missed PULL_ACK.
+// If data is set, the PUSH_DATA is stored if it is not acknowledged in time (see persist).
+func (s *server) sent(token fwd.Token, ident fwd.Ident, data []byte) {
+	if ident != fwd.PushData && ident != fwd.PullData {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for t, p := range s.pending {
+		if p.ident == fwd.PullData && ident == fwd.PullData {
+			delete(s.pending, t)
+			s.missedPulls++
+			if s.missedPulls >= maxMissedPullAcks && !s.unreachable {
+				s.unreachable = true
+				log(LogLevelWarning, "(-> %s) server unreachable: %d PULL_DATA not acknowledged", s, s.missedPulls)
+				if s.store != nil {
+					s.wake() // stores the pending PUSH_DATA
+				}
+			}
+		} else if p.data == nil && now.Sub(p.sent) > ackTimeout {
+			delete(s.pending, t)
+		}
+	}
+	if ident == fwd.PushData {
+		s.pushNb++
+	}
+	s.pending[token] = pendingDatagram{ident: ident, sent: now, data: data, interval: s.interval}
+}
+
+// forget removes the token of a datagram that could not be sent.
+func (s *server) forget(token fwd.Token) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.pending[token]; ok {
+		delete(s.pending, token)
+		if p.ident == fwd.PushData && !p.stored && p.interval == s.interval {
+			s.pushNb--
+		}
+	}
+}
+
+// isUnreachable reports whether the server has missed too many PULL_ACKs.
+func (s *server) isUnreachable() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.unreachable
+}
+
+// acked matches a PUSH_ACK or PULL_ACK with a pending datagram and returns the round trip time.
+// An acknowledged stored datagram is removed from the store.
+func (s *server) acked(token fwd.Token, ident fwd.Ident) (rtt time.Duration, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.pending[token]
+	if !ok || (ident == fwd.PushAck && p.ident != fwd.PushData) || (ident == fwd.PullAck && p.ident != fwd.PullData) {
+		return 0, false
+	}
+	delete(s.pending, token)
+	rtt = time.Since(p.sent)
+	s.rttSum += rtt
+	s.rttNb++
+
+	if ident == fwd.PushAck {
+		if p.stored {
+			s.storeAcked(p.name)
+		} else if p.interval == s.interval {
+			s.pushAckNb++
+		}
+	} else {
+		s.missedPulls = 0
+		if s.unreachable {
+			s.unreachable = false
+			log(LogLevelNormal, "(<- %s) server reachable again", s)
+		}
+	}
+	return rtt, true
+}
+
+// parseAllowlist parses a list of IPs and networks in CIDR notation.
+func parseAllowlist(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, str := range list {
+		if !strings.Contains(str, "/") {
+			ip := net.ParseIP(str)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP: %q", str)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(str)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// acceptDownlink checks if a PULL_RESP received on conn from raddr can be accepted.
+// Downlinks are only accepted on the downstream socket, from the server address, if that is in an
+// allowed network (downlinkAllow does not add other sources) and if the rate limit is not exceeded.
+// Rejected downlinks are counted.
+func (s *server) acceptDownlink(conn *net.UDPConn, raddr *net.UDPAddr) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	defer func() {
+		if err != nil {
+			s.dwRejected++
+		}
+	}()
+
+	if conn != s.downConn {
+		return fmt.Errorf("not received on the downstream socket")
+	}
+	if !raddr.IP.Equal(s.down.IP) || raddr.Port != s.down.Port {
+		return fmt.Errorf("unknown source %s", raddr)
+	}
+	if len(s.gw.downlinkAllow) != 0 {
+		allowed := false
+		for _, n := range s.gw.downlinkAllow {
+			if n.Contains(raddr.IP) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("source %s is not allowed", raddr.IP)
+		}
+	}
+	if s.gw.downlinkMaxRate != 0 {
+		now := time.Now()
+		max := float64(s.gw.downlinkMaxRate)
+		if s.dwLast.IsZero() {
+			s.dwTokens = max
+		} else {
+			s.dwTokens += now.Sub(s.dwLast).Minutes() * max
+			if s.dwTokens > max {
+				s.dwTokens = max
+			}
+		}
+		s.dwLast = now
+		if s.dwTokens < 1 {
+			return fmt.Errorf("rate limit of %d downlinks per minute exceeded", s.gw.downlinkMaxRate)
+		}
+		s.dwTokens--
+	}
+	return nil
+}
+
+// serverStat are the acknowledgement statistics of a server since the last call to stat.
+type serverStat struct {
+	pushNb      uint32
+	pushAckNb   uint32
+	rtt         time.Duration // average round trip time
+	unreachable bool
+	dwRejected  uint32
+	addr        string
+}
+
+// stat returns the acknowledgement statistics and resets the counters.
+// PUSH_ACKs received later for PUSH_DATA of this interval are not counted, so that at most all
+// PUSH_DATA of an interval are acknowledged.
+func (s *server) stat() serverStat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stat := serverStat{
+		pushNb:      s.pushNb,
+		pushAckNb:   s.pushAckNb,
+		unreachable: s.unreachable,
+		dwRejected:  s.dwRejected,
+	}
+	if s.up != nil {
+		stat.addr = s.up.IP.String()
+	} else {
+		stat.addr = "unresolved"
+	}
+	if s.rttNb != 0 {
+		stat.rtt = s.rttSum / time.Duration(s.rttNb)
+	}
+	s.pushNb, s.pushAckNb = 0, 0
+	s.interval++
+	s.rttSum, s.rttNb = 0, 0
+	s.dwRejected = 0
+	return stat
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+func TestAcceptDownlink(t *testing.T) {
+	up, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	down, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer down.Close()
+
+	gw := newGateway(1)
+	s := newServer(gw, "127.0.0.1", 1700, 1701, 2)
+	s.up = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1700}
+	s.down = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1701}
+	s.upConn, s.downConn = up, down
+	other := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1701}
+
+	tests := []struct {
+		name   string
+		allow  []string
+		conn   *net.UDPConn
+		raddr  *net.UDPAddr
+		accept bool
+	}{
+		{"server", nil, down, s.down, true},
+		{"upstream socket", nil, up, s.down, false},
+		{"other port", nil, down, s.up, false},
+		{"other source", nil, down, other, false},
+		{"server allowed", []string{"127.0.0.0/8"}, down, s.down, true},
+		{"server not allowed", []string{"10.0.0.0/8"}, down, s.down, false},
+		// the allowlist does not add sources
+		{"other source allowed", []string{"10.0.0.0/8"}, down, other, false},
+		{"server IP allowed", []string{"10.0.0.1", "127.0.0.1"}, down, s.down, true},
+	}
+	for _, test := range tests {
+		if gw.downlinkAllow, err = parseAllowlist(test.allow); err != nil {
+			t.Fatal(err)
+		}
+		err := s.acceptDownlink(test.conn, test.raddr)
+		if (err == nil) != test.accept {
+			t.Errorf("%s: acceptDownlink(%s) = %v, expected accepted %v", test.name, test.raddr, err, test.accept)
+		}
+	}
+	if stat := s.stat(); stat.dwRejected != 5 {
+		t.Errorf("%d downlinks rejected, expected 5", stat.dwRejected)
+	}
+
+	gw.downlinkAllow, gw.downlinkMaxRate = nil, 2
+	for i := 0; i < 3; i++ {
+		err := s.acceptDownlink(down, s.down)
+		if (err == nil) != (i < 2) {
+			t.Errorf("downlink %d with a rate limit of 2: %v", i+1, err)
+		}
+	}
+}
+
+func TestResolveFallback(t *testing.T) {
+	ns, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	port := ns.LocalAddr().(*net.UDPAddr).Port
+
+	unreachable := net.ParseIP("2001:db8::1")
+	defer func(l func(string) ([]net.IP, error), d func(string, *net.UDPAddr, *net.UDPAddr) (*net.UDPConn, error)) {
+		lookupIP, dialUDP = l, d
+	}(lookupIP, dialUDP)
+	lookupIP = func(host string) ([]net.IP, error) {
+		return []net.IP{unreachable, net.IPv4(127, 0, 0, 1)}, nil
+	}
+	dialUDP = func(network string, laddr, raddr *net.UDPAddr) (*net.UDPConn, error) {
+		if raddr.IP.Equal(unreachable) {
+			return nil, &net.OpError{Op: "dial", Net: network, Addr: raddr, Err: fmt.Errorf("network is unreachable")}
+		}
+		return net.DialUDP(network, laddr, raddr)
+	}
+
+	s := newServer(newGateway(1), "ns.example.com", port, port, 2)
+	if err := s.resolve(); err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	defer closeServer(s)
+	if stat := s.stat(); stat.addr != "127.0.0.1" {
+		t.Errorf("server address is %s, expected 127.0.0.1", stat.addr)
+	}
+
+	// the PULL_DATA is sent right away
+	var buf [64]byte
+	ns.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := ns.ReadFromUDP(buf[:])
+	if err != nil {
+		t.Fatalf("no PULL_DATA: %v", err)
+	}
+	var pkt fwd.Packet
+	if err := pkt.UnmarshalBinary(buf[:n]); err != nil || pkt.Ident != fwd.PullData {
+		t.Errorf("received %s (%v), expected PULL_DATA", pkt.Ident, err)
+	}
+}
+
+// closeServer closes the sockets of the server, which stops its downstream goroutines.
+func closeServer(s *server) {
+	s.mu.Lock()
+	up, down := s.upConn, s.downConn
+	s.upConn, s.downConn = nil, nil
+	s.mu.Unlock()
+	if up != nil {
+		up.Close()
+		down.Close()
+	}
+}
+
+func TestTxAck(t *testing.T) {
+	ns, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	port := ns.LocalAddr().(*net.UDPAddr).Port
+
+	s := newServer(newGateway(1), "127.0.0.1", port, port, fwd.ProtocolVersion2)
+	if err := s.resolve(); err != nil {
+		t.Fatal(err)
+	}
+	defer closeServer(s)
+	if pkt, _ := readDatagram(t, ns, time.Second); pkt == nil || pkt.Ident != fwd.PullData {
+		t.Fatalf("received %v, expected PULL_DATA", pkt)
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		ack  fwd.TxAckError // 0: no TX_ACK
+	}{
+		{"sent", nil, fwd.NoError},
+		{"too late", fmt.Errorf("can not send: %w", lora.ErrTooLate), fwd.ErrTooLate},
+		{"frequency out of range", fmt.Errorf("can not send: %w", lora.ErrFreq), fwd.ErrTxFreq},
+		{"collision", fwd.ErrCollisionPacket, fwd.ErrCollisionPacket},
+		{"other radio error", fmt.Errorf("can not set spreading factor"), 0},
+	}
+	for _, test := range tests {
+		dl := &fwd.Packet{Token: fwd.RndToken(), Ident: fwd.PullResp}
+		s.txAck(dl, test.err)
+		pkt, _ := readDatagram(t, ns, 200*time.Millisecond)
+		switch {
+		case test.ack == 0 && pkt != nil:
+			t.Errorf("%s: sent %s with %s, expected no TX_ACK", test.name, pkt.Ident, pkt.TxAck)
+		case test.ack == 0:
+		case pkt == nil || pkt.Ident != fwd.TxAck:
+			t.Errorf("%s: received %v, expected TX_ACK", test.name, pkt)
+		case pkt.Token != dl.Token || pkt.TxAck != test.ack:
+			t.Errorf("%s: TX_ACK %s with %s, expected %s with %s", test.name, pkt.Token, pkt.TxAck, dl.Token, test.ack)
+		}
+	}
+}
+
+func TestTxAckVersion1(t *testing.T) {
+	ns, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	port := ns.LocalAddr().(*net.UDPAddr).Port
+
+	s := newServer(newGateway(1), "127.0.0.1", port, port, fwd.ProtocolVersion1)
+	if err := s.resolve(); err != nil {
+		t.Fatal(err)
+	}
+	defer closeServer(s)
+	if pkt, _ := readDatagram(t, ns, time.Second); pkt == nil || pkt.Ident != fwd.PullData || pkt.Version != fwd.ProtocolVersion1 {
+		t.Fatalf("received %v, expected PULL_DATA with version 1", pkt)
+	}
+
+	for _, err := range []error{nil, fwd.ErrCollisionPacket} {
+		s.txAck(&fwd.Packet{Token: fwd.RndToken(), Ident: fwd.PullResp, Version: fwd.ProtocolVersion1}, err)
+		if pkt, _ := readDatagram(t, ns, 200*time.Millisecond); pkt != nil {
+			t.Errorf("txAck(%v) sent %s to a version 1 server, expected nothing", err, pkt)
+		}
+	}
+}
+
+func TestPending(t *testing.T) {
+	defer func(d time.Duration) { ackTimeout = d }(ackTimeout)
+	ackTimeout = 50 * time.Millisecond
+
+	s := newServer(newGateway(1), "127.0.0.1", 1700, 1700, fwd.ProtocolVersion2)
+	push, pull := fwd.Token{1}, fwd.Token{2}
+	s.sent(push, fwd.PushData, nil)
+	s.sent(pull, fwd.PullData, nil)
+	s.sent(fwd.Token{3}, fwd.TxAck, nil) // not acknowledged, not pending
+
+	tests := []struct {
+		name  string
+		token fwd.Token
+		ident fwd.Ident
+		ok    bool
+	}{
+		{"unknown token", fwd.Token{9}, fwd.PushAck, false},
+		{"TX_ACK", fwd.Token{3}, fwd.PushAck, false},
+		{"PULL_ACK for a PUSH_DATA", push, fwd.PullAck, false},
+		{"PUSH_ACK for a PULL_DATA", pull, fwd.PushAck, false},
+		{"PUSH_ACK", push, fwd.PushAck, true},
+		{"PUSH_ACK again", push, fwd.PushAck, false},
+		{"PULL_ACK", pull, fwd.PullAck, true},
+	}
+	for _, test := range tests {
+		if rtt, ok := s.acked(test.token, test.ident); ok != test.ok || rtt < 0 {
+			t.Errorf("%s: acked(%s, %s) = %s, %v, expected %v", test.name, test.token, test.ident, rtt, ok, test.ok)
+		}
+	}
+	if stat := s.stat(); stat.pushNb != 1 || stat.pushAckNb != 1 || stat.rtt < 0 {
+		t.Errorf("%d of %d PUSH_DATA acknowledged (round trip time %s), expected 1 of 1", stat.pushAckNb, stat.pushNb, stat.rtt)
+	}
+
+	// a PUSH_DATA that could not be sent is not counted
+	s.sent(push, fwd.PushData, nil)
+	s.forget(push)
+	if _, ok := s.acked(push, fwd.PushAck); ok {
+		t.Error("acked(forgotten PUSH_DATA) = true, expected false")
+	}
+	if stat := s.stat(); stat.pushNb != 0 {
+		t.Errorf("%d PUSH_DATA sent after forget, expected 0", stat.pushNb)
+	}
+
+	// PUSH_DATA that are not acknowledged in time are dropped with the next datagram
+	s.sent(push, fwd.PushData, nil)
+	time.Sleep(2 * ackTimeout)
+	s.sent(fwd.Token{4}, fwd.PushData, nil)
+	if _, ok := s.acked(push, fwd.PushAck); ok {
+		t.Error("acked(timed out PUSH_DATA) = true, expected false")
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	s := newServer(newGateway(1), "127.0.0.1", 1700, 1700, fwd.ProtocolVersion2)
+	var token fwd.Token
+	for i := 1; i <= maxMissedPullAcks; i++ {
+		token = fwd.Token{byte(i)}
+		s.sent(token, fwd.PullData, nil)
+		// the previous PULL_DATA is missed when the next one is sent
+		if s.isUnreachable() {
+			t.Fatalf("unreachable after %d missed PULL_ACKs, expected %d", i-1, maxMissedPullAcks)
+		}
+	}
+	s.sent(fwd.Token{0xff}, fwd.PullData, nil)
+	if !s.isUnreachable() {
+		t.Fatalf("reachable after %d missed PULL_ACKs", maxMissedPullAcks)
+	}
+	if stat := s.stat(); !stat.unreachable {
+		t.Error("stat() reports the server reachable, expected unreachable")
+	}
+
+	// a missed PULL_DATA can not be acknowledged anymore
+	if _, ok := s.acked(token, fwd.PullAck); ok || !s.isUnreachable() {
+		t.Errorf("acked(missed PULL_DATA) = %v, expected false and the server unreachable", ok)
+	}
+	if _, ok := s.acked(fwd.Token{0xff}, fwd.PullAck); !ok || s.isUnreachable() {
+		t.Errorf("acked(last PULL_DATA) = %v, expected true and the server reachable", ok)
+	}
+
+	// the count of missed PULL_ACKs starts again
+	for i := 1; i < maxMissedPullAcks; i++ {
+		s.sent(fwd.Token{byte(i)}, fwd.PullData, nil)
+	}
+	s.sent(fwd.Token{0xff}, fwd.PullData, nil)
+	if s.isUnreachable() {
+		t.Errorf("unreachable after %d missed PULL_ACKs, expected %d", maxMissedPullAcks-1, maxMissedPullAcks)
+	}
+}
+
+func TestPorts(t *testing.T) {
+	listen := func() (*net.UDPConn, int) {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, conn.LocalAddr().(*net.UDPAddr).Port
+	}
+	up, portUp := listen()
+	defer up.Close()
+	down, portDown := listen()
+	defer down.Close()
+
+	gw := newGateway(1)
+	s := newServer(gw, "127.0.0.1", portUp, portDown, fwd.ProtocolVersion2)
+	gw.servers = []*server{s}
+	if err := s.resolve(); err != nil {
+		t.Fatal(err)
+	}
+	defer closeServer(s)
+
+	tests := []struct {
+		ident fwd.Ident
+		send  func()
+		conn  *net.UDPConn // the socket of the port the packet is sent to
+		other *net.UDPConn
+	}{
+		{fwd.PullData, func() {}, down, up}, // sent by resolve
+		{fwd.PushData, func() {
+			gw.sendTo(gw.servers, &fwd.Packet{Token: fwd.RndToken(), Ident: fwd.PushData, Stat: &fwd.Stat{}})
+		}, up, down},
+		{fwd.TxAck, func() {
+			s.txAck(&fwd.Packet{Token: fwd.RndToken(), Ident: fwd.PullResp}, nil)
+		}, down, up},
+	}
+	for _, test := range tests {
+		test.send()
+		if pkt, _ := readDatagram(t, test.conn, time.Second); pkt == nil || pkt.Ident != test.ident {
+			t.Errorf("%s: received %v on port %s, expected %s", test.ident, pkt, test.conn.LocalAddr(), test.ident)
+		}
+		if pkt, _ := readDatagram(t, test.other, 100*time.Millisecond); pkt != nil {
+			t.Errorf("%s: received %s on port %s, expected nothing", test.ident, pkt, test.other.LocalAddr())
+		}
+	}
+}
+
+func TestDownlinkCount(t *testing.T) {
+	ns, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	port := ns.LocalAddr().(*net.UDPAddr).Port
+
+	gw := newGateway(1)
+	gw.downlinkMaxRate = 1
+	s := newServer(gw, "127.0.0.1", port, port, fwd.ProtocolVersion2)
+	gw.servers = []*server{s}
+	if err := s.resolve(); err != nil {
+		t.Fatal(err)
+	}
+	defer closeServer(s)
+	_, gwAddr := readDatagram(t, ns, time.Second) // PULL_DATA
+	if gwAddr == nil {
+		t.Fatal("no PULL_DATA")
+	}
+
+	data, err := (&fwd.Packet{Token: fwd.RndToken(), Ident: fwd.PullResp, TxPacket: &lora.TxPacket{
+		Immediate: true, Freq: 869525000, Modulation: "LORA", LoRaBW: 8, LoRaCR: 5, Datarate: 9, Data: []byte("downlink"),
+	}}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second downlink exceeds the rate limit
+	for i, accepted := range []bool{true, false} {
+		if _, err := ns.WriteToUDP(data, gwAddr); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-gw.chanTx:
+			if !accepted {
+				t.Errorf("downlink %d accepted, expected rejected", i+1)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if accepted {
+				t.Errorf("downlink %d rejected, expected accepted", i+1)
+			}
+		}
+	}
+
+	gw.stats.Lock()
+	dwNb := gw.stats.DwNb
+	gw.stats.Unlock()
+	if dwNb != 1 {
+		t.Errorf("%d downlinks counted, expected only the accepted one", dwNb)
+	}
+	if stat := s.stat(); stat.dwRejected != 1 {
+		t.Errorf("%d downlinks rejected, expected 1", stat.dwRejected)
+	}
+}
@@ -0,0 +1,193 @@
+// Package sim implements a pure software radio that can be used in place of the
+// SX127X chip, e.g. to run the packet forwarder on machines without a SPI bus.
+package sim
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// Radio is a simulated lora.Radio.
+// Uplinks are injected with Inject and returned by GetPacket,
+// downlinks given to Send are recorded and can be read with Downlinks.
+type Radio struct {
+	mu        sync.Mutex
+	cfg       *lora.Config
+	receiving bool
+	rx        []*lora.RxPacket
+	tx        []*lora.TxPacket
+	sent      chan *lora.TxPacket
+
+	// OnSend, if set, is called for every packet given to Send.
+	// A non nil error is returned from Send and the packet is not recorded.
+	OnSend func(pkt *lora.TxPacket) error
+
+	// Busy, if set, is called by ChannelBusy to check if the channel of the packet is in use.
+	Busy func(pkt *lora.TxPacket) bool
+}
+
+// New creates a new simulated radio.
+func New() *Radio {
+	return &Radio{
+		sent: make(chan *lora.TxPacket, 64),
+	}
+}
+
+var _ lora.Radio = (*Radio)(nil)
+var _ lora.ChannelSensor = (*Radio)(nil)
+var _ lora.TimedSender = (*Radio)(nil)
+
+// Name implements lora.Radio.
+func (r *Radio) Name() string {
+	return "simulated radio"
+}
+
+// Receive implements lora.Radio.
+func (r *Radio) Receive(cfg *lora.Config) error {
+	if _, ok := bandwidths[cfg.LoRaBW]; !ok {
+		return fmt.Errorf("unknown bandwidth: %d", cfg.LoRaBW)
+	}
+	if _, ok := coderates[cfg.LoRaCR]; !ok {
+		return fmt.Errorf("unknown coderate: %s", cfg.LoRaCR)
+	}
+	r.mu.Lock()
+	r.cfg = cfg
+	r.receiving = true
+	r.mu.Unlock()
+	return nil
+}
+
+// GetPacket implements lora.Radio.
+// It returns all injected packets if the radio is in receive mode.
+func (r *Radio) GetPacket() ([]*lora.RxPacket, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.receiving || len(r.rx) == 0 {
+		return nil, nil
+	}
+	pkts := r.rx
+	r.rx = nil
+	r.receiving = false
+	return pkts, nil
+}
+
+// Send implements lora.Radio.
+func (r *Radio) Send(pkt *lora.TxPacket) error {
+	if r.OnSend != nil {
+		if err := r.OnSend(pkt); err != nil {
+			return err
+		}
+	}
+	r.mu.Lock()
+	r.receiving = false
+	r.tx = append(r.tx, pkt)
+	r.mu.Unlock()
+	select {
+	case r.sent <- pkt:
+	default:
+	}
+	return nil
+}
+
+// SendAt implements lora.TimedSender.
+// It waits until t and calls Send.
+func (r *Radio) SendAt(pkt *lora.TxPacket, t time.Time) error {
+	d := time.Until(t)
+	if d < 0 {
+		return fmt.Errorf("%w: %s late", lora.ErrTooLate, -d)
+	}
+	time.Sleep(d)
+	return r.Send(pkt)
+}
+
+// ChannelBusy implements lora.ChannelSensor.
+// The channel is busy if Busy is set and returns true.
+func (r *Radio) ChannelBusy(ctx context.Context, pkt *lora.TxPacket, rssiTarget int) (bool, error) {
+	r.mu.Lock()
+	r.receiving = false
+	r.mu.Unlock()
+	return r.Busy != nil && r.Busy(pkt), nil
+}
+
+// Inject queues an uplink packet that will be returned by the next call to GetPacket.
+// Unset fields (frequency, modulation, datarate, bandwidth and coderate) are
+// taken from the configuration that was given to Receive.
+func (r *Radio) Inject(pkt *lora.RxPacket) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cfg := r.cfg; cfg != nil {
+		if pkt.Freq == 0 {
+			pkt.Freq = cfg.Freq
+		}
+		if pkt.Modulation == "" {
+			pkt.Modulation = "LORA"
+		}
+		if pkt.Datarate == 0 {
+			pkt.Datarate = cfg.Datarate
+		}
+		if pkt.LoRaBW == 0 {
+			pkt.LoRaBW = bandwidths[cfg.LoRaBW]
+		}
+		if pkt.LoRaCR == 0 {
+			pkt.LoRaCR = coderates[cfg.LoRaCR]
+		}
+	}
+	if pkt.StatCRC == 0 {
+		pkt.StatCRC = 1
+	}
+	r.rx = append(r.rx, pkt)
+}
+
+// Downlinks returns all packets that have been sent so far.
+func (r *Radio) Downlinks() []*lora.TxPacket {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pkts := make([]*lora.TxPacket, len(r.tx))
+	copy(pkts, r.tx)
+	return pkts
+}
+
+// WaitDownlink waits for the next packet to be sent.
+// It returns nil if no packet was sent within the timeout.
+func (r *Radio) WaitDownlink(timeout time.Duration) *lora.TxPacket {
+	select {
+	case pkt := <-r.sent:
+		return pkt
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+// Receiving reports whether the radio is in receive mode.
+func (r *Radio) Receiving() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.receiving
+}
+
+var bandwidths = map[uint32]uint8{
+	7800:   0x01,
+	10400:  0x02,
+	15600:  0x03,
+	20800:  0x04,
+	31250:  0x05,
+	41700:  0x06,
+	62500:  0x07,
+	125000: 0x08,
+	250000: 0x09,
+	500000: 0x0a,
+}
+
+var coderates = map[string]uint8{
+	"4/5": 0x05,
+	"4/6": 0x06,
+	"2/3": 0x06,
+	"4/7": 0x07,
+	"4/8": 0x08,
+	"2/4": 0x08,
+	"1/2": 0x08,
+}
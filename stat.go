@@ -0,0 +1,58 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+)
+
+// statReport returns the status report and resets the counters.
+func (gw *gateway) statReport() *fwd.Stat {
+	gw.stats.Lock()
+	defer gw.stats.Unlock()
+
+	stat := gw.stats.Stat
+	stat.Time = time.Now().UTC().Format(fwd.StatTimeFormat)
+
+	var pushNb, pushAckNb uint32
+	for _, server := range gw.servers {
+		s := server.stat()
+		pushNb += s.pushNb
+		pushAckNb += s.pushAckNb
+		if s.unreachable {
+			log(LogLevelWarning, "stat: server %s (%s): unreachable", server, s.addr)
+		} else if s.pushNb != 0 {
+			log(LogLevelVerbose, "stat: server %s (%s): %d of %d PUSH_DATA acknowledged, round trip time %s", server, s.addr, s.pushAckNb, s.pushNb, s.rtt)
+		} else {
+			log(LogLevelVerbose, "stat: server %s (%s): round trip time %s", server, s.addr, s.rtt)
+		}
+		if server.store != nil {
+			if n := server.store.len(); n != 0 {
+				log(LogLevelWarning, "stat: server %s (%s): %d PUSH_DATA waiting in store", server, s.addr, n)
+			}
+		}
+		if s.dwRejected != 0 {
+			log(LogLevelWarning, "stat: server %s (%s): %d downlinks rejected", server, s.addr, s.dwRejected)
+		}
+	}
+	for _, st := range gw.stations {
+		if connected, upNb := st.stat(); !connected {
+			log(LogLevelWarning, "stat: server %s: not connected", st)
+		} else {
+			log(LogLevelVerbose, "stat: server %s: %d uplinks sent", st, upNb)
+		}
+	}
+	if gw.bridge != nil && !gw.bridge.client.IsConnected() {
+		log(LogLevelWarning, "stat: mqtt %s: not connected", gw.bridge)
+	}
+	if pushNb != 0 {
+		stat.AckR = 100 * float64(pushAckNb) / float64(pushNb)
+	}
+
+	gw.stats.Stat = fwd.Stat{
+		Lati: stat.Lati,
+		Long: stat.Long,
+		Alti: stat.Alti,
+	}
+	return &stat
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+)
+
+func TestStatReport(t *testing.T) {
+	gw := newGateway(1)
+	s := newServer(gw, "127.0.0.1", 1700, 1700, fwd.ProtocolVersion2)
+	gw.servers = []*server{s}
+	gw.stats.Stat = fwd.Stat{Lati: 46.24, Long: 6.05, Alti: 400, RxNb: 3, RxOk: 2, RxFw: 2, DwNb: 1, TxNb: 1}
+
+	t1, t2, t3 := fwd.Token{1}, fwd.Token{2}, fwd.Token{3}
+	s.sent(t1, fwd.PushData, nil)
+	s.sent(t2, fwd.PushData, nil)
+	s.acked(t1, fwd.PushAck)
+	stat := gw.statReport()
+	if stat.AckR != 50 || stat.RxNb != 3 || stat.RxOk != 2 || stat.RxFw != 2 || stat.DwNb != 1 || stat.TxNb != 1 || stat.Time == "" {
+		t.Errorf("statReport() = %+v, expected 1 of 2 PUSH_DATA acknowledged and the counters", stat)
+	}
+
+	// the late PUSH_ACK belongs to the previous report
+	s.sent(t3, fwd.PushData, nil)
+	s.acked(t2, fwd.PushAck)
+	s.acked(t3, fwd.PushAck)
+	stat = gw.statReport()
+	if stat.AckR != 100 {
+		t.Errorf("statReport() with a late PUSH_ACK = %.0f%% acknowledged, expected 100%%", stat.AckR)
+	}
+	if stat.RxNb != 0 || stat.RxOk != 0 || stat.RxFw != 0 || stat.DwNb != 0 || stat.TxNb != 0 {
+		t.Errorf("statReport() = %+v, expected the counters reset", stat)
+	}
+	if stat.Lati != 46.24 || stat.Long != 6.05 || stat.Alti != 400 {
+		t.Errorf("statReport() = %+v, expected the position kept", stat)
+	}
+
+	// a PUSH_DATA of the previous report that could not be sent is not taken off this one
+	t4, t5 := fwd.Token{4}, fwd.Token{5}
+	s.sent(t4, fwd.PushData, nil)
+	gw.statReport()
+	s.sent(t5, fwd.PushData, nil)
+	s.forget(t4)
+	s.acked(t5, fwd.PushAck)
+	if stat = gw.statReport(); stat.AckR != 100 {
+		t.Errorf("statReport() after forget = %.0f%% acknowledged, expected 100%%", stat.AckR)
+	}
+
+	if stat = gw.statReport(); stat.AckR != 0 {
+		t.Errorf("statReport() without PUSH_DATA = %.0f%% acknowledged, expected 0", stat.AckR)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/basicstation"
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/gorilla/websocket"
+)
+
+// stationRetry is the first delay after a failed LNS connection, it is doubled up to stationRetryMax.
+var stationRetry = time.Second * 5
+
+// stationRetryMax is the maximum delay between two LNS connection attempts.
+var stationRetryMax = time.Minute * 5
+
+// stationTimeout is the time the LNS has to answer the router-info request, and to accept a message.
+var stationTimeout = time.Second * 30
+
+// stationQueueLen is the number of messages that can wait to be sent to the LNS.
+const stationQueueLen = 32
+
+// station is a network server that the forwarder is connected to with the LNS protocol of
+// LoRa Basics Station, instead of the Semtech UDP protocol.
+// Received packets are sent as updf, jreq or propdf messages. Downlinks (dnmsg) are queued like
+// PULL_RESP and confirmed with a dntxed message once they have been sent.
+type station struct {
+	gw     *gateway
+	uri    string // LNS address, like wss://lns.example.com:8887
+	dialer websocket.Dialer
+	header http.Header
+
+	mu      sync.Mutex
+	send    chan interface{}           // messages to the LNS, nil if not connected
+	session uint8                      // xtime session, changed with every connection
+	config  *basicstation.RouterConfig // nil until the router_config has been received
+	pending map[*fwd.Packet]stationDownlink
+	upNb    uint32 // uplinks sent
+}
+
+// stationDownlink is a downlink that has been queued in RX1 or RX2.
+type stationDownlink struct {
+	msg *basicstation.DownlinkMessage
+	rx2 bool
+}
+
+// newStation creates a station for the LNS at uri. The authToken, if set, is sent as Authorization
+// header. The caFile, if set, contains the certificates (PEM) that are trusted for wss:// URIs,
+// instead of the system's certificates.
+func newStation(gw *gateway, uri string, authToken string, caFile string) (*station, error) {
+	st := &station{
+		gw:      gw,
+		uri:     strings.TrimSuffix(uri, "/"),
+		header:  make(http.Header),
+		pending: make(map[*fwd.Packet]stationDownlink),
+	}
+	if !strings.HasPrefix(st.uri, "ws://") && !strings.HasPrefix(st.uri, "wss://") {
+		return nil, fmt.Errorf("can not use %q: not a ws:// or wss:// URI", uri)
+	}
+	if authToken != "" {
+		st.header.Set("Authorization", authToken)
+	}
+	st.dialer = websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: stationTimeout,
+	}
+	if caFile != "" {
+		var err error
+		if st.dialer.TLSClientConfig, err = trust(caFile); err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// trust returns a TLS configuration that trusts the certificates (PEM) in caFile, instead of the system's.
+func trust(caFile string) (*tls.Config, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("can not read ca_file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("can not read ca_file %s: no PEM certificates", caFile)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+func (st *station) String() string {
+	return st.uri
+}
+
+// keepConnected connects to the LNS and reconnects whenever the connection is lost.
+// Failed connections are retried with an increasing delay.
+func (st *station) keepConnected() {
+	retry := stationRetry
+	for {
+		configured, err := st.connect()
+		if configured {
+			retry = stationRetry
+		}
+		log(LogLevelError, "(<- %s) %v, reconnecting in %s", st, err, retry)
+		time.Sleep(retry)
+		if retry *= 2; retry > stationRetryMax {
+			retry = stationRetryMax
+		}
+	}
+}
+
+// discover asks the router-info endpoint of the LNS for the traffic endpoint of the gateway.
+func (st *station) discover() (string, error) {
+	conn, _, err := st.dialer.Dial(st.uri+"/router-info", st.header)
+	if err != nil {
+		return "", fmt.Errorf("can not connect to router-info: %v", err)
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(stationTimeout))
+	conn.SetReadDeadline(time.Now().Add(stationTimeout))
+	if err := conn.WriteJSON(&basicstation.RouterInfoRequest{Router: basicstation.EUI(st.gw.id)}); err != nil {
+		return "", fmt.Errorf("can not send router-info request: %v", err)
+	}
+	var info basicstation.RouterInfo
+	if err := conn.ReadJSON(&info); err != nil {
+		return "", fmt.Errorf("can not read router-info: %v", err)
+	}
+	if info.Error != "" {
+		return "", fmt.Errorf("router-info: %s", info.Error)
+	}
+	if info.URI == "" {
+		return "", fmt.Errorf("router-info: no traffic endpoint")
+	}
+	return info.URI, nil
+}
+
+// connect connects to the traffic endpoint of the LNS and handles its messages until the connection fails.
+// It returns true if the LNS has sent a router_config.
+func (st *station) connect() (configured bool, err error) {
+	uri, err := st.discover()
+	if err != nil {
+		return false, err
+	}
+	log(LogLevelVerbose, "(<- %s) traffic endpoint: %s", st, uri)
+	conn, _, err := st.dialer.Dial(uri, st.header)
+	if err != nil {
+		return false, fmt.Errorf("can not connect to %s: %v", uri, err)
+	}
+	defer conn.Close()
+	log(LogLevelNormal, "(-> %s) connected", st)
+
+	send := make(chan interface{}, stationQueueLen)
+	done := make(chan struct{})
+	defer close(done)
+	go st.write(conn, send, done)
+
+	send <- &basicstation.Version{
+		MsgType:  basicstation.MsgVersion,
+		Station:  "single_chan_pkt_fwd",
+		Model:    "single_chan_pkt_fwd",
+		Protocol: basicstation.ProtocolVersion,
+	}
+
+	st.mu.Lock()
+	st.send = send
+	st.session = st.session%127 + 1
+	st.mu.Unlock()
+	defer func() {
+		st.mu.Lock()
+		st.send = nil
+		st.config = nil
+		st.mu.Unlock()
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return configured, fmt.Errorf("can not read: %v", err)
+		}
+		log(LogLevelDebug, "(<- %s) raw: %s", st, data)
+
+		msg, err := basicstation.Unmarshal(data)
+		if err != nil {
+			log(LogLevelWarning, "(<- %s) %v", st, err)
+			continue
+		}
+		switch msg := msg.(type) {
+		case *basicstation.RouterConfig:
+			log(LogLevelNormal, "(<- %s) router_config: region %s, %d data rates", st, msg.Region, len(msg.DRs))
+			configured = true
+			st.mu.Lock()
+			st.config = msg
+			st.mu.Unlock()
+		case *basicstation.DownlinkMessage:
+			log(LogLevelNormal, "(<- %s) dnmsg %d: class %c, %s", st, msg.DIID, 'A'+msg.DC, msg.PDU)
+			st.downlink(msg)
+		default:
+			log(LogLevelWarning, "(<- %s) unexpected message: %s", st, data)
+		}
+	}
+}
+
+// write sends the messages to the LNS until done is closed.
+// The connection is closed if a message can not be sent.
+func (st *station) write(conn *websocket.Conn, send <-chan interface{}, done <-chan struct{}) {
+	for {
+		select {
+		case msg := <-send:
+			conn.SetWriteDeadline(time.Now().Add(stationTimeout))
+			if err := conn.WriteJSON(msg); err != nil {
+				log(LogLevelError, "(-> %s) can not write: %v", st, err)
+				conn.Close()
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// queue queues the message for sending, it is dropped if the queue is full.
+func (st *station) queue(send chan<- interface{}, msg interface{}) {
+	select {
+	case send <- msg:
+	default:
+		log(LogLevelWarning, "(-> %s) send queue full, message dropped", st)
+	}
+}
+
+// uplink sends the received packets to the LNS.
+// As with LoRa Basics Station, packets with a CRC error are dropped.
+func (st *station) uplink(pkts []*lora.RxPacket) {
+	st.mu.Lock()
+	send, session, config := st.send, st.session, st.config
+	st.mu.Unlock()
+	if config == nil {
+		log(LogLevelVerbose, "(-> %s) not connected, %d packets dropped", st, len(pkts))
+		return
+	}
+
+	for _, rx := range pkts {
+		if rx.StatCRC == -1 {
+			continue
+		}
+		dr, err := config.DR(rx)
+		if err != nil {
+			log(LogLevelWarning, "(-> %s) packet dropped: %v", st, err)
+			continue
+		}
+		info := basicstation.UpInfo{
+			XTime: basicstation.XTime(session, st.gw.counter.At64(rx.TimeFin)),
+			RSSI:  rx.RSSI,
+			SNR:   rx.LoRaSNR,
+		}
+		if !rx.TimeGPS.IsZero() {
+			info.GPSTime = int64(rx.TimeGPS.Sub(lora.GPSEpoch) / time.Microsecond)
+		}
+		msg, err := basicstation.Uplink(rx, dr, info)
+		if err != nil {
+			log(LogLevelWarning, "(-> %s) packet dropped: %v", st, err)
+			continue
+		}
+		log(LogLevelNormal, "(-> %s) uplink: DR%d, %.2f MHz", st, dr, float64(rx.Freq)/1e6)
+		st.queue(send, msg)
+		st.mu.Lock()
+		st.upNb++
+		st.mu.Unlock()
+	}
+}
+
+// downlink queues a dnmsg for sending in RX1 (class A) or immediately (class C).
+func (st *station) downlink(msg *basicstation.DownlinkMessage) {
+	st.gw.stats.Lock()
+	st.gw.stats.DwNb++
+	st.gw.stats.Unlock()
+
+	st.mu.Lock()
+	session, config := st.session, st.config
+	st.mu.Unlock()
+	if config == nil {
+		log(LogLevelWarning, "(<- %s) downlink %d rejected: no router_config", st, msg.DIID)
+		return
+	}
+	if msg.DC == basicstation.ClassA && basicstation.XTimeSession(msg.XTime) != session {
+		log(LogLevelWarning, "(<- %s) downlink %d rejected: xtime of another session", st, msg.DIID)
+		return
+	}
+	st.schedule(config, stationDownlink{msg: msg})
+}
+
+// schedule passes the downlink to the downlink queue.
+func (st *station) schedule(config *basicstation.RouterConfig, dl stationDownlink) {
+	tx, err := config.TxPacket(dl.msg, dl.rx2)
+	if err != nil {
+		log(LogLevelWarning, "(<- %s) downlink %d rejected: %v", st, dl.msg.DIID, err)
+		return
+	}
+	pkt := &fwd.Packet{
+		Token:    fwd.RndToken(),
+		Ident:    fwd.PullResp,
+		TxPacket: tx,
+	}
+	st.mu.Lock()
+	st.pending[pkt] = dl
+	st.mu.Unlock()
+	st.gw.chanTx <- downlink{origin: st, pkt: pkt}
+}
+
+// txAck confirms a sent downlink with dntxed. Class A downlinks that could not be sent in RX1
+// are queued again for RX2, LoRa Basics Station does not report failed downlinks to the LNS.
+func (st *station) txAck(pkt *fwd.Packet, err error) {
+	st.mu.Lock()
+	dl, ok := st.pending[pkt]
+	delete(st.pending, pkt)
+	send, session, config := st.send, st.session, st.config
+	st.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if err != nil {
+		if dl.msg.DC == basicstation.ClassA && !dl.rx2 && dl.msg.RX2Freq != 0 && config != nil {
+			log(LogLevelVerbose, "(<- %s) downlink %d: %v in RX1, trying RX2", st, dl.msg.DIID, err)
+			dl.rx2 = true
+			// the run loop that called txAck is the receiver of the downlink queue
+			go st.schedule(config, dl)
+			return
+		}
+		log(LogLevelWarning, "(<- %s) downlink %d dropped: %v", st, dl.msg.DIID, err)
+		return
+	}
+
+	if send == nil {
+		log(LogLevelVerbose, "(-> %s) not connected, dntxed %d dropped", st, dl.msg.DIID)
+		return
+	}
+	t := time.Now()
+	if !pkt.TxPacket.Immediate {
+		t = st.gw.counter.Time(pkt.TxPacket.CountUs)
+	}
+	log(LogLevelNormal, "(-> %s) dntxed %d", st, dl.msg.DIID)
+	st.queue(send, &basicstation.DownlinkTransmitted{
+		MsgType: basicstation.MsgTransmitted,
+		DIID:    dl.msg.DIID,
+		DevEUI:  dl.msg.DevEUI,
+		RCtx:    dl.msg.RCtx,
+		XTime:   basicstation.XTime(session, st.gw.counter.At64(t)),
+	})
+}
+
+// stat returns if the station is connected and the number of uplinks sent since the last call.
+func (st *station) stat() (connected bool, upNb uint32) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	connected, upNb = st.config != nil, st.upNb
+	st.upNb = 0
+	return
+}
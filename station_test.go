@@ -0,0 +1,324 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/basicstation"
+	"github.com/Waziup/single_chan_pkt_fwd/basicstation/fakelns"
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+	"github.com/gorilla/websocket"
+)
+
+// connectStation connects a station to a new fakelns and waits for the router_config.
+// stop closes the LNS and waits until the station has disconnected.
+func connectStation(t *testing.T) (gw *gateway, st *station, lns *fakelns.Server, stop func()) {
+	lns, err := fakelns.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw = newGateway(0x0102030405060708)
+	if st, err = newStation(gw, lns.URI(), "", ""); err != nil {
+		lns.Close()
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		st.connect()
+		close(done)
+	}()
+	stop = func() {
+		lns.Close()
+		<-done
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st.mu.Lock()
+		config := st.config
+		st.mu.Unlock()
+		if config != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			stop()
+			t.Fatal("no router_config received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return gw, st, lns, stop
+}
+
+// currentSession returns the current xtime session of the station.
+func (st *station) currentSession() uint8 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.session
+}
+
+// nextDownlink returns the next downlink that is passed to the run loop, nil after the timeout.
+func nextDownlink(gw *gateway, timeout time.Duration) *downlink {
+	select {
+	case dl := <-gw.chanTx:
+		return &dl
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func TestStationConnect(t *testing.T) {
+	gw, st, lns, stop := connectStation(t)
+	defer stop()
+
+	router, version, ok := lns.WaitVersion(time.Second)
+	if !ok {
+		t.Fatal("no version received")
+	}
+	// the traffic endpoint of the router-info is the one of the gateway
+	if router != basicstation.EUI(gw.id) {
+		t.Errorf("connected as %s, expected %s", router, basicstation.EUI(gw.id))
+	}
+	if version.Station != "single_chan_pkt_fwd" || version.Protocol != basicstation.ProtocolVersion {
+		t.Errorf("version %+v, expected station single_chan_pkt_fwd, protocol %d", version, basicstation.ProtocolVersion)
+	}
+	st.mu.Lock()
+	config := st.config
+	st.mu.Unlock()
+	if config.Region != fakelns.EU868.Region || len(config.DRs) != len(fakelns.EU868.DRs) {
+		t.Errorf("router_config %+v, expected %+v", config, fakelns.EU868)
+	}
+	if connected, _ := st.stat(); !connected {
+		t.Errorf("station is not connected")
+	}
+}
+
+func TestStationDiscoverError(t *testing.T) {
+	var upgrader websocket.Upgrader
+	lns := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var req basicstation.RouterInfoRequest
+		conn.ReadJSON(&req)
+		conn.WriteJSON(&basicstation.RouterInfo{Error: "unknown router " + req.Router})
+	}))
+	defer lns.Close()
+
+	st, err := newStation(newGateway(1), "ws"+strings.TrimPrefix(lns.URL, "http"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = st.discover()
+	if err == nil || !strings.Contains(err.Error(), "unknown router 00-00-00-00-00-00-00-01") {
+		t.Errorf("discover: %v, expected the error of the router-info", err)
+	}
+
+	if _, err := newStation(newGateway(1), "http://lns.example.com", "", ""); err == nil {
+		t.Errorf("newStation accepted a http:// URI")
+	}
+}
+
+func TestStationUplink(t *testing.T) {
+	_, st, lns, stop := connectStation(t)
+	defer stop()
+	session := st.currentSession()
+
+	rx := func(data []byte, crc int8) *lora.RxPacket {
+		return &lora.RxPacket{
+			TimeFin:    time.Now(),
+			Freq:       868100000,
+			Modulation: "LORA",
+			Datarate:   7,
+			LoRaBW:     8,
+			LoRaCR:     5,
+			StatCRC:    crc,
+			RSSI:       -60,
+			LoRaSNR:    9,
+			Data:       data,
+		}
+	}
+	// unconfirmed data up of 49BE7DF1, ADR and ACK, FCnt 2, FPort 1
+	updf := []byte{0x40, 0xF1, 0x7D, 0xBE, 0x49, 0xA0, 0x02, 0x00, 0x01, 0x95, 0x43, 0x78, 0x76, 0x2B, 0x11, 0xFF, 0x0D}
+	jreq := []byte{0x00,
+		0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01, // JoinEUI
+		0x18, 0x17, 0x16, 0x15, 0x14, 0x13, 0x12, 0x11, // DevEUI
+		0x34, 0x12, // DevNonce
+		0x01, 0x02, 0x03, 0x04}
+	st.uplink([]*lora.RxPacket{rx(updf, -1), rx(updf, 1), rx(jreq, 1)})
+
+	msg := lns.WaitUplink(5 * time.Second)
+	up, ok := msg.(*basicstation.UplinkDataFrame)
+	if !ok {
+		t.Fatalf("received %T, expected updf", msg)
+	}
+	if up.DevAddr != 0x49BE7DF1 || up.FCtrl != 0xA0 || up.FCnt != 2 || up.FPort != 1 || up.FRMPayload != "95437876" || up.MHdr != 0x40 {
+		t.Errorf("updf %+v, expected DevAddr 49BE7DF1, FCtrl A0, FCnt 2, FPort 1, FRMPayload 95437876", up)
+	}
+	if up.DR != 5 || up.Freq != 868100000 || up.UpInfo.RSSI != -60 || up.UpInfo.SNR != 9 {
+		t.Errorf("updf %+v, expected DR5 at 868.1 MHz", up)
+	}
+	if s := basicstation.XTimeSession(up.UpInfo.XTime); s != session {
+		t.Errorf("updf of session %d, expected %d", s, session)
+	}
+
+	msg = lns.WaitUplink(5 * time.Second)
+	jr, ok := msg.(*basicstation.JoinRequest)
+	if !ok {
+		t.Fatalf("received %T, expected jreq", msg)
+	}
+	if jr.JoinEUI != "01-02-03-04-05-06-07-08" || jr.DevEUI != "11-12-13-14-15-16-17-18" || jr.DevNonce != 0x1234 || jr.DR != 5 {
+		t.Errorf("jreq %+v, expected JoinEUI 01-02-03-04-05-06-07-08, DevEUI 11-12-13-14-15-16-17-18, DevNonce 0x1234", jr)
+	}
+
+	// the packet with the CRC error has been dropped
+	if n := len(lns.Uplinks()); n != 2 {
+		t.Errorf("%d uplinks received, expected 2", n)
+	}
+	if _, upNb := st.stat(); upNb != 2 {
+		t.Errorf("%d uplinks counted, expected 2", upNb)
+	}
+}
+
+// classA returns a class A downlink for an uplink received now.
+func classA(gw *gateway, session uint8) *basicstation.DownlinkMessage {
+	return &basicstation.DownlinkMessage{
+		DevEUI:  "11-12-13-14-15-16-17-18",
+		DC:      basicstation.ClassA,
+		PDU:     "60f17dbe4900020001",
+		RxDelay: 1,
+		RX1DR:   5,
+		RX1Freq: 868100000,
+		RX2DR:   0,
+		RX2Freq: 869525000,
+		XTime:   basicstation.XTime(session, gw.counter.At64(time.Now())),
+		RCtx:    7,
+	}
+}
+
+func TestStationDownlink(t *testing.T) {
+	gw, st, lns, stop := connectStation(t)
+	defer stop()
+	session := st.currentSession()
+
+	dn := classA(gw, session)
+	diid, err := lns.Downlink(dn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl := nextDownlink(gw, 5*time.Second)
+	if dl == nil {
+		t.Fatal("dnmsg not queued")
+	}
+	tx := dl.pkt.TxPacket
+	if tx.Freq != 868100000 || tx.Datarate != 7 || tx.LoRaBW != 8 || tx.CountUs != uint32(dn.XTime+1000000) {
+		t.Errorf("queued %s, expected RX1 at %d", tx, uint32(dn.XTime+1000000))
+	}
+
+	dl.origin.txAck(dl.pkt, nil)
+	txed, ok := lns.WaitTransmitted(diid, 5*time.Second)
+	if !ok {
+		t.Fatal("no dntxed received")
+	}
+	if txed.DevEUI != dn.DevEUI || txed.RCtx != dn.RCtx {
+		t.Errorf("dntxed %+v, expected DevEui %s, rctx %d", txed, dn.DevEUI, dn.RCtx)
+	}
+	if basicstation.XTimeSession(txed.XTime) != session || uint32(txed.XTime) != tx.CountUs {
+		t.Errorf("dntxed xtime %X, expected the time of the downlink in session %d", txed.XTime, session)
+	}
+
+	gw.stats.Lock()
+	dwNb := gw.stats.DwNb
+	gw.stats.Unlock()
+	if dwNb != 1 {
+		t.Errorf("%d downlinks counted, expected 1", dwNb)
+	}
+}
+
+func TestStationRX2(t *testing.T) {
+	gw, st, lns, stop := connectStation(t)
+	defer stop()
+	session := st.currentSession()
+
+	dn := classA(gw, session)
+	diid, err := lns.Downlink(dn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl := nextDownlink(gw, 5*time.Second)
+	if dl == nil {
+		t.Fatal("dnmsg not queued")
+	}
+	dl.origin.txAck(dl.pkt, fwd.ErrTooLate)
+
+	// queued again for RX2, one second later
+	dl = nextDownlink(gw, 5*time.Second)
+	if dl == nil {
+		t.Fatal("downlink not queued again for RX2")
+	}
+	tx := dl.pkt.TxPacket
+	if tx.Freq != 869525000 || tx.Datarate != 12 || tx.CountUs != uint32(dn.XTime+2000000) {
+		t.Errorf("queued %s, expected RX2 at %d", tx, uint32(dn.XTime+2000000))
+	}
+	dl.origin.txAck(dl.pkt, nil)
+	if txed, ok := lns.WaitTransmitted(diid, 5*time.Second); !ok || uint32(txed.XTime) != tx.CountUs {
+		t.Errorf("dntxed %+v (%v), expected the time of RX2", txed, ok)
+	}
+
+	// a downlink that fails in RX2 too is dropped
+	diid, err = lns.Downlink(classA(gw, session))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, win := range []string{"RX1", "RX2"} {
+		dl = nextDownlink(gw, 5*time.Second)
+		if dl == nil {
+			t.Fatalf("downlink not queued for %s", win)
+		}
+		dl.origin.txAck(dl.pkt, fwd.ErrCollisionPacket)
+	}
+	if dl = nextDownlink(gw, 200*time.Millisecond); dl != nil {
+		t.Errorf("downlink queued again after RX2: %s", dl.pkt.TxPacket)
+	}
+	if _, ok := lns.WaitTransmitted(diid, 200*time.Millisecond); ok {
+		t.Errorf("dntxed received for a downlink that has not been sent")
+	}
+}
+
+func TestStationSessionMismatch(t *testing.T) {
+	gw, st, lns, stop := connectStation(t)
+	defer stop()
+	session := st.currentSession()
+
+	// xtime of the previous session, e.g. of an uplink from before a reconnection
+	if _, err := lns.Downlink(classA(gw, session-1)); err != nil {
+		t.Fatal(err)
+	}
+	if dl := nextDownlink(gw, 500*time.Millisecond); dl != nil {
+		t.Errorf("downlink of another session queued: %s", dl.pkt.TxPacket)
+	}
+
+	// class C downlinks have no xtime
+	dn := &basicstation.DownlinkMessage{
+		DevEUI:  "11-12-13-14-15-16-17-18",
+		DC:      basicstation.ClassC,
+		PDU:     "60f17dbe4900020001",
+		RX2DR:   0,
+		RX2Freq: 869525000,
+	}
+	if _, err := lns.Downlink(dn); err != nil {
+		t.Fatal(err)
+	}
+	dl := nextDownlink(gw, 5*time.Second)
+	if dl == nil {
+		t.Fatal("class C downlink not queued")
+	}
+	if tx := dl.pkt.TxPacket; !tx.Immediate || tx.Freq != 869525000 {
+		t.Errorf("queued %s, expected immediate in RX2", tx)
+	}
+}
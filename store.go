@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+)
+
+// storeRetry is the time after which a stored datagram that has not been acknowledged is sent again.
+var storeRetry = time.Second * 10
+
+// store is an on-disk queue of PUSH_DATA datagrams that a server has not acknowledged in time,
+// one file per datagram named "<sequence number>-<token>". It keeps the received packets while
+// the server is unreachable, also across restarts of the forwarder. The oldest datagrams are
+// dropped when the store is full or when they are older than maxAge.
+type store struct {
+	dir     string
+	maxAge  time.Duration
+	maxSize int64 // in bytes
+
+	mu      sync.Mutex
+	entries []storeEntry // oldest first
+	size    int64        // of all entries
+	seq     uint64       // sequence number of the newest entry
+}
+
+type storeEntry struct {
+	name  string
+	token fwd.Token
+	size  int64
+	time  time.Time
+}
+
+// openStore opens the store in dir, which is created if needed, with the datagrams of the last run.
+func openStore(dir string, maxAge time.Duration, maxSize int64) (*store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("can not create store: %v", err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("can not read store: %v", err)
+	}
+	st := &store{
+		dir:     dir,
+		maxAge:  maxAge,
+		maxSize: maxSize,
+	}
+	for _, file := range files {
+		parts := strings.Split(file.Name(), "-")
+		if len(parts) != 2 || file.IsDir() {
+			continue // e.g. a temporary file of an interrupted push
+		}
+		seq, err := strconv.ParseUint(parts[0], 16, 64)
+		if err != nil {
+			continue
+		}
+		var token fwd.Token
+		b, err := hex.DecodeString(parts[1])
+		if err != nil || len(b) != len(token) {
+			continue
+		}
+		copy(token[:], b)
+		st.entries = append(st.entries, storeEntry{
+			name:  file.Name(),
+			token: token,
+			size:  file.Size(),
+			time:  file.ModTime(),
+		})
+		st.size += file.Size()
+		if seq > st.seq {
+			st.seq = seq
+		}
+	}
+	// the sequence numbers have a fixed width, so the names sort like the numbers
+	sort.Slice(st.entries, func(i, j int) bool {
+		return st.entries[i].name < st.entries[j].name
+	})
+	st.mu.Lock()
+	st.expire()
+	st.mu.Unlock()
+	return st, nil
+}
+
+// len returns the number of stored datagrams.
+func (st *store) len() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.entries)
+}
+
+// push stores the datagram as newest entry.
+func (st *store) push(token fwd.Token, data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.seq++
+	name := fmt.Sprintf("%016x-%s", st.seq, hex.EncodeToString(token[:]))
+	// write and rename, so that only complete datagrams are found after a crash
+	tmp := filepath.Join(st.dir, "tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(st.dir, name)); err != nil {
+		return err
+	}
+	st.entries = append(st.entries, storeEntry{
+		name:  name,
+		token: token,
+		size:  int64(len(data)),
+		time:  time.Now(),
+	})
+	st.size += int64(len(data))
+	st.expire()
+	return nil
+}
+
+// head returns the oldest stored datagram.
+func (st *store) head() (entry storeEntry, data []byte, ok bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.expire()
+	for len(st.entries) != 0 {
+		entry = st.entries[0]
+		data, err := ioutil.ReadFile(filepath.Join(st.dir, entry.name))
+		if err == nil {
+			return entry, data, true
+		}
+		log(LogLevelError, "store %s: can not read %s, dropped: %v", st.dir, entry.name, err)
+		st.remove()
+	}
+	return entry, nil, false
+}
+
+// pop removes the oldest stored datagram if it is the named one, i.e. when it has been acknowledged.
+func (st *store) pop(name string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if len(st.entries) == 0 || st.entries[0].name != name {
+		return false
+	}
+	st.remove()
+	return true
+}
+
+// expire drops the datagrams that are too old, and the oldest datagrams while the store is too big.
+// st.mu must be held.
+func (st *store) expire() {
+	dropped := 0
+	for len(st.entries) != 0 {
+		entry := st.entries[0]
+		if (st.maxAge == 0 || time.Since(entry.time) <= st.maxAge) && (st.maxSize == 0 || st.size <= st.maxSize) {
+			break
+		}
+		st.remove()
+		dropped++
+	}
+	if dropped != 0 {
+		log(LogLevelWarning, "store %s: %d datagrams dropped (too old or store full)", st.dir, dropped)
+	}
+}
+
+// remove deletes the oldest datagram. st.mu must be held.
+func (st *store) remove() {
+	entry := st.entries[0]
+	if err := os.Remove(filepath.Join(st.dir, entry.name)); err != nil && !os.IsNotExist(err) {
+		log(LogLevelError, "store %s: can not remove %s: %v", st.dir, entry.name, err)
+	}
+	st.entries = st.entries[1:]
+	st.size -= entry.size
+}
+
+// storeName returns a directory name for the store of the server, like "127.0.0.1_1700".
+func storeName(s *server) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s.String())
+}
+
+// forward sends the stored datagrams of the server one after the other, in order: the next one
+// once the previous one has been acknowledged. A datagram that is not acknowledged is sent again
+// after storeRetry. It also stores the datagrams that have not been acknowledged in time.
+func (s *server) forward() {
+	timer := time.NewTimer(0)
+	for {
+		select {
+		case <-s.storeWake:
+		case <-timer.C:
+		}
+		s.persist()
+		s.sendStored()
+		resetTimer(timer, storeRetry)
+	}
+}
+
+// wake makes forward send the next stored datagram.
+func (s *server) wake() {
+	select {
+	case s.storeWake <- struct{}{}:
+	default:
+	}
+}
+
+// storePush stores the datagram, to be sent by forward.
+func (s *server) storePush(token fwd.Token, data []byte) {
+	if err := s.store.push(token, data); err != nil {
+		log(LogLevelError, "(-> %s) can not store PUSH_DATA %s: %v", s, token, err)
+		return
+	}
+	log(LogLevelVerbose, "(-> %s) PUSH_DATA %s stored", s, token)
+	s.wake()
+}
+
+// persist stores the PUSH_DATA that have been sent but not acknowledged within ackTimeout,
+// or all pending PUSH_DATA if the server is unreachable.
+func (s *server) persist() {
+	type unacked struct {
+		token fwd.Token
+		pendingDatagram
+	}
+	var list []unacked
+	now := time.Now()
+	s.mu.Lock()
+	for token, p := range s.pending {
+		if p.data != nil && (s.unreachable || now.Sub(p.sent) > ackTimeout) {
+			delete(s.pending, token)
+			list = append(list, unacked{token, p})
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].sent.Before(list[j].sent)
+	})
+	for _, u := range list {
+		if err := s.store.push(u.token, u.data); err != nil {
+			log(LogLevelError, "(-> %s) can not store PUSH_DATA %s: %v", s, u.token, err)
+		}
+	}
+	if len(list) != 0 {
+		log(LogLevelWarning, "(-> %s) %d PUSH_DATA not acknowledged, stored", s, len(list))
+	}
+}
+
+// sendStored sends the oldest stored datagram, unless it has been sent less than storeRetry ago.
+// It is sent with a new token that is not pending, so that its PUSH_ACK can not be mistaken for
+// the PUSH_ACK of another datagram with the same token.
+func (s *server) sendStored() {
+	entry, data, ok := s.store.head()
+	if !ok || len(data) < 4 {
+		return
+	}
+	s.mu.Lock()
+	recent := entry.name == s.storeName && time.Since(s.storeSent) < storeRetry
+	s.mu.Unlock()
+	conn := s.conn(fwd.PushData)
+	if recent || conn == nil {
+		return
+	}
+
+	s.mu.Lock()
+	var token fwd.Token
+	for {
+		token = fwd.RndToken()
+		if _, ok := s.pending[token]; !ok {
+			break
+		}
+	}
+	copy(data[1:3], token[:])
+	now := time.Now()
+	s.storeName, s.storeSent = entry.name, now
+	// not a new PUSH_DATA for the statistics, it has been counted when it was sent first
+	s.pending[token] = pendingDatagram{ident: fwd.PushData, sent: now, stored: true, name: entry.name}
+	s.mu.Unlock()
+	if _, err := conn.Write(data); err != nil {
+		log(LogLevelError, "(-> %s) can not write upstream: %v", conn.RemoteAddr(), err)
+		s.forget(token)
+		return
+	}
+	log(LogLevelNormal, "(-> %s) PUSH_DATA: Token: %s (stored, %d waiting)", conn.RemoteAddr(), token, s.store.len())
+}
+
+// storeAcked removes the acknowledged stored datagram from the store and sends the next one.
+func (s *server) storeAcked(name string) {
+	if s.store.pop(name) {
+		s.wake()
+	}
+}
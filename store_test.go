@@ -0,0 +1,209 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Waziup/single_chan_pkt_fwd/fwd"
+	"github.com/Waziup/single_chan_pkt_fwd/lora"
+)
+
+// readDatagram reads the next datagram that the server socket ns receives.
+func readDatagram(t *testing.T, ns *net.UDPConn, timeout time.Duration) (*fwd.Packet, *net.UDPAddr) {
+	var buf [2048]byte
+	ns.SetReadDeadline(time.Now().Add(timeout))
+	n, raddr, err := ns.ReadFromUDP(buf[:])
+	if err != nil {
+		return nil, nil
+	}
+	pkt := &fwd.Packet{}
+	if err := pkt.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatalf("can not unmarshal datagram: %v", err)
+	}
+	return pkt, raddr
+}
+
+func TestStoreLive(t *testing.T) {
+	defer func(d time.Duration) { ackTimeout = d }(ackTimeout)
+	ackTimeout = 100 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ns, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	port := ns.LocalAddr().(*net.UDPAddr).Port
+
+	gw := newGateway(1)
+	s := newServer(gw, "127.0.0.1", port, port, fwd.ProtocolVersion2)
+	gw.servers = []*server{s}
+	if s.store, err = openStore(dir, time.Hour, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.resolve(); err != nil {
+		t.Fatal(err)
+	}
+	defer closeServer(s)
+	if pkt, _ := readDatagram(t, ns, time.Second); pkt == nil || pkt.Ident != fwd.PullData {
+		t.Fatalf("received %v, expected PULL_DATA", pkt)
+	}
+
+	push := func() *fwd.Packet {
+		pkt := &fwd.Packet{
+			Token:     fwd.RndToken(),
+			Ident:     fwd.PushData,
+			RxPackets: []*lora.RxPacket{{Freq: 868100000, Modulation: "LORA", Datarate: 7, LoRaBW: 8, LoRaCR: 5, StatCRC: 1, Data: []byte{1, 2, 3}}},
+		}
+		gw.sendTo(gw.servers, pkt)
+		return pkt
+	}
+	ack := func(token fwd.Token, raddr *net.UDPAddr) {
+		data, _ := (&fwd.Packet{Version: fwd.ProtocolVersion2, Token: token, Ident: fwd.PushAck}).MarshalBinary()
+		if _, err := ns.WriteToUDP(data, raddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitStore := func(n int) {
+		deadline := time.Now().Add(time.Second)
+		for s.store.len() != n && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if l := s.store.len(); l != n {
+			t.Fatalf("%d datagrams stored, expected %d", l, n)
+		}
+	}
+
+	// sent right away and acknowledged in time: not stored
+	a := push()
+	pkt, raddr := readDatagram(t, ns, time.Second)
+	if pkt == nil || pkt.Token != a.Token {
+		t.Fatalf("received %v, expected the PUSH_DATA right away", pkt)
+	}
+	ack(a.Token, raddr)
+	time.Sleep(2 * ackTimeout)
+	s.persist()
+	waitStore(0)
+
+	// sent right away, but not acknowledged in time: stored and sent again
+	b := push()
+	if pkt, _ := readDatagram(t, ns, time.Second); pkt == nil || pkt.Token != b.Token {
+		t.Fatalf("received %v, expected the PUSH_DATA right away", pkt)
+	}
+	s.persist()
+	waitStore(0)
+	time.Sleep(2 * ackTimeout)
+	s.persist()
+	waitStore(1)
+	// sent again with new tokens
+	var tokens []fwd.Token
+	for i := 0; i < 2; i++ {
+		s.mu.Lock()
+		s.storeSent = time.Time{} // retry now
+		s.mu.Unlock()
+		s.sendStored()
+		pkt, _ := readDatagram(t, ns, time.Second)
+		if pkt == nil || pkt.Ident != fwd.PushData || len(pkt.RxPackets) != 1 {
+			t.Fatalf("received %v, expected the stored PUSH_DATA", pkt)
+		}
+		tokens = append(tokens, pkt.Token)
+	}
+	// the PUSH_ACK of the first try is late, but still acknowledges the datagram
+	ack(tokens[0], raddr)
+	waitStore(0)
+	ack(tokens[1], raddr)
+
+	// the retries are not counted as new PUSH_DATA
+	if stat := s.stat(); stat.pushNb != 2 || stat.pushAckNb != 1 {
+		t.Errorf("%d of %d PUSH_DATA acknowledged, expected 1 of 2", stat.pushAckNb, stat.pushNb)
+	}
+
+	// while the server is unreachable, the PUSH_DATA are stored right away
+	c := push()
+	for i := 0; i < maxMissedPullAcks+1; i++ {
+		gw.sendTo(gw.servers, &fwd.Packet{Token: fwd.RndToken(), Ident: fwd.PullData})
+	}
+	if !s.isUnreachable() {
+		t.Fatal("server is not unreachable")
+	}
+	s.persist()
+	waitStore(1)
+	push()
+	waitStore(2)
+	if entry, _, _ := s.store.head(); entry.token != c.Token {
+		t.Errorf("stored %s first, expected the pending PUSH_DATA %s", entry.token, c.Token)
+	}
+}
+
+func TestStoreTokenCollision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ns, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	up, err := net.DialUDP("udp", nil, ns.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+
+	s := newServer(newGateway(1), "127.0.0.1", 1700, 1700, fwd.ProtocolVersion2)
+	s.upConn = up
+	if s.store, err = openStore(dir, time.Hour, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	stored := fwd.Token{0x12, 0x34}
+	data, _ := (&fwd.Packet{Token: stored, Ident: fwd.PushData, Stat: &fwd.Stat{}}).MarshalBinary()
+	if err := s.store.push(stored, data); err != nil {
+		t.Fatal(err)
+	}
+
+	// a live PUSH_DATA with the token the datagram was stored with
+	s.sent(stored, fwd.PushData, nil)
+	if _, ok := s.acked(stored, fwd.PushAck); !ok {
+		t.Fatal("PUSH_ACK of the live PUSH_DATA not matched")
+	}
+	if n := s.store.len(); n != 1 {
+		t.Fatalf("%d datagrams stored after the PUSH_ACK of a live PUSH_DATA, expected 1", n)
+	}
+
+	// a live PUSH_DATA with the token the datagram has been sent again with
+	s.sendStored()
+	pkt, _ := readDatagram(t, ns, time.Second)
+	if pkt == nil || pkt.Ident != fwd.PushData {
+		t.Fatalf("received %v, expected the stored PUSH_DATA", pkt)
+	}
+	s.sent(pkt.Token, fwd.PushData, nil)
+	s.acked(pkt.Token, fwd.PushAck)
+	if n := s.store.len(); n != 1 {
+		t.Fatalf("%d datagrams stored after the PUSH_ACK of a live PUSH_DATA, expected 1", n)
+	}
+
+	// the tokens of the stored datagram are not pending, and it is removed with its own PUSH_ACK
+	s.mu.Lock()
+	s.storeSent = time.Time{} // retry now
+	s.mu.Unlock()
+	s.sent(fwd.Token{0x56, 0x78}, fwd.PushData, nil)
+	s.sendStored()
+	pkt, _ = readDatagram(t, ns, time.Second)
+	if pkt == nil || pkt.Token == (fwd.Token{0x56, 0x78}) {
+		t.Fatalf("received %v, expected the stored PUSH_DATA with a token that is not pending", pkt)
+	}
+	if _, ok := s.acked(pkt.Token, fwd.PushAck); !ok || s.store.len() != 0 {
+		t.Errorf("acked(stored PUSH_DATA) = %v, %d datagrams stored, expected removed", ok, s.store.len())
+	}
+}